@@ -30,6 +30,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/tsdb/labels"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
@@ -41,6 +42,7 @@ var (
 		verifier.IndexIssueID:                verifier.IndexIssue,
 		verifier.OverlappedBlocksIssueID:     verifier.OverlappedBlocksIssue,
 		verifier.DuplicatedCompactionIssueID: verifier.DuplicatedCompactionIssue,
+		verifier.FileIntegrityIssueID:        verifier.FileIntegrityIssue,
 	}
 	allIssues = func() (s []string) {
 		for id := range issuesMap {
@@ -61,6 +63,8 @@ func registerBucket(m map[string]setupFunc, app *kingpin.Application, name strin
 	registerBucketLs(m, cmd, name, objStoreConfig)
 	registerBucketInspect(m, cmd, name, objStoreConfig)
 	registerBucketWeb(m, cmd, name, objStoreConfig)
+	registerBucketMarkNoCompact(m, cmd, name, objStoreConfig)
+	registerBucketRelabel(m, cmd, name, objStoreConfig)
 }
 
 func registerBucketVerify(m map[string]setupFunc, root *kingpin.CmdClause, name string, objStoreConfig *pathOrContent) {
@@ -241,6 +245,134 @@ func registerBucketLs(m map[string]setupFunc, root *kingpin.CmdClause, name stri
 	}
 }
 
+func registerBucketMarkNoCompact(m map[string]setupFunc, root *kingpin.CmdClause, name string, objStoreConfig *pathOrContent) {
+	cmd := root.Command("mark-no-compact", "Mark blocks in the bucket for no compaction. The compactor leaves marked blocks out of compaction")
+	ids := cmd.Flag("id", "ID (ULID) of the block to mark. Repeated flag").Required().Strings()
+	details := cmd.Flag("details", "Human readable details on why the block is marked, stored in the mark").String()
+
+	m[name+" mark-no-compact"] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ bool) error {
+		var blockIDs []ulid.ULID
+		for _, id := range *ids {
+			u, err := ulid.Parse(id)
+			if err != nil {
+				return errors.Wrapf(err, "invalid ULID %s found in --id flag", id)
+			}
+			blockIDs = append(blockIDs, u)
+		}
+
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, name)
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		for _, id := range blockIDs {
+			if err := block.MarkForNoCompact(ctx, logger, bkt, id, metadata.ManualNoCompactReason, *details); err != nil {
+				return errors.Wrapf(err, "mark block %s for no compaction", id)
+			}
+			level.Info(logger).Log("msg", "marked block for no compaction", "block", id)
+		}
+		return nil
+	}
+}
+
+func registerBucketRelabel(m map[string]setupFunc, root *kingpin.CmdClause, name string, objStoreConfig *pathOrContent) {
+	cmd := root.Command("relabel", "Rewrite the external labels of blocks in the bucket. The previous meta.json of every changed block is kept as backup in the block directory")
+	relabelConfig := regRelabelConfigFlags(cmd, "", true)
+	ids := cmd.Flag("id", "ID (ULID) of a block to relabel. All blocks are relabeled if not given. Repeated flag").Strings()
+	dryRun := cmd.Flag("dry-run", "Only log the new labels of the blocks without rewriting them").Bool()
+
+	m[name+" relabel"] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, _ opentracing.Tracer, _ bool) error {
+		var blockIDs []ulid.ULID
+		for _, id := range *ids {
+			u, err := ulid.Parse(id)
+			if err != nil {
+				return errors.Wrapf(err, "invalid ULID %s found in --id flag", id)
+			}
+			blockIDs = append(blockIDs, u)
+		}
+
+		relabelContentYaml, err := relabelConfig.Content()
+		if err != nil {
+			return err
+		}
+		relabelConfigs, err := metadata.ParseRelabelConfig(relabelContentYaml)
+		if err != nil {
+			return errors.Wrap(err, "parse relabel configuration")
+		}
+
+		confContentYaml, err := objStoreConfig.Content()
+		if err != nil {
+			return err
+		}
+
+		bkt, err := client.NewBucket(logger, confContentYaml, reg, name)
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
+
+		// Dummy actor to immediately kill the group after the run function returns.
+		g.Add(func() error { return nil }, func(error) {})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		if *dryRun {
+			bkt = objstore.ReadOnlyBucket(bkt)
+		}
+		return relabelBucket(ctx, logger, bkt, relabelConfigs, blockIDs)
+	}
+}
+
+// relabelBucket rewrites the external labels of the blocks with the given IDs, or of all blocks if no ID is given.
+// In a read-only bucket the new labels are only logged.
+func relabelBucket(ctx context.Context, logger log.Logger, bkt objstore.Bucket, cfgs []*relabel.Config, ids []ulid.ULID) error {
+	if len(ids) == 0 {
+		if err := bkt.Iter(ctx, "", func(name string) error {
+			if id, ok := block.IsBlockDir(name); ok {
+				ids = append(ids, id)
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrap(err, "retrieve bucket block IDs")
+		}
+	}
+
+	for _, id := range ids {
+		m, err := block.DownloadMeta(ctx, logger, bkt, id)
+		if err != nil {
+			return err
+		}
+		newMeta, ok := metadata.Relabel(&m, cfgs)
+		if !ok {
+			continue
+		}
+		if err := block.RewriteMeta(ctx, logger, bkt, newMeta); err != nil {
+			if objstore.IsReadOnlyErr(err) {
+				level.Info(logger).Log("msg", "would rewrite labels of block", "block", id,
+					"labels", labels.FromMap(m.Thanos.Labels), "new_labels", labels.FromMap(newMeta.Thanos.Labels))
+				continue
+			}
+			return errors.Wrapf(err, "rewrite labels of block %s", id)
+		}
+		level.Info(logger).Log("msg", "rewrote labels of block", "block", id,
+			"labels", labels.FromMap(m.Thanos.Labels), "new_labels", labels.FromMap(newMeta.Thanos.Labels), "version", newMeta.LabelsVersion())
+	}
+	return nil
+}
+
 func registerBucketInspect(m map[string]setupFunc, root *kingpin.CmdClause, name string, objStoreConfig *pathOrContent) {
 	cmd := root.Command("inspect", "Inspect all blocks in the bucket in detailed, table-like way")
 	selector := cmd.Flag("selector", "Selects blocks based on label, e.g. '-l key1=\\\"value1\\\" -l key2=\\\"value2\\\"'. All key value pairs must match.").Short('l').
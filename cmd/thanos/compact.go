@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,14 +21,20 @@ import (
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact"
+	v1 "github.com/thanos-io/thanos/pkg/compact/api"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/ui"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -89,6 +98,9 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application, name stri
 	retentionRaw := modelDuration(cmd.Flag("retention.resolution-raw", "How long to retain raw samples in bucket. 0d - disables this retention").Default("0d"))
 	retention5m := modelDuration(cmd.Flag("retention.resolution-5m", "How long to retain samples of resolution 1 (5 minutes) in bucket. 0d - disables this retention").Default("0d"))
 	retention1h := modelDuration(cmd.Flag("retention.resolution-1h", "How long to retain samples of resolution 2 (1 hour) in bucket. 0d - disables this retention").Default("0d"))
+	retentionCustom := cmd.Flag("retention.resolution", "How long to retain samples of the given resolution in bucket, in the form <resolution>:<duration>, e.g. 15m:90d. "+
+		"Meant for custom downsampling levels and overrides the retention flags above for the same resolution. Repeated flag.").
+		PlaceHolder("<resolution>:<duration>").Strings()
 
 	wait := cmd.Flag("wait", "Do not exit after all compactions have been processed and wait for new work.").
 		Short('w').Bool()
@@ -110,8 +122,91 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application, name stri
 	compactionConcurrency := cmd.Flag("compact.concurrency", "Number of goroutines to use when compacting groups.").
 		Default("1").Int()
 
+	noCompactReasons := cmd.Flag("compact.no-compact-on", fmt.Sprintf("Mark blocks for no compaction instead of halting or failing when their compaction fails repeatedly for this reason. Marked blocks are left out of compaction. Possible values: %s, %s, %s. Repeated flag.",
+		metadata.IndexCriticalNoCompactReason, metadata.OutOfOrderChunksNoCompactReason, metadata.MalformedIndexNoCompactReason)).
+		Enums(string(metadata.IndexCriticalNoCompactReason), string(metadata.OutOfOrderChunksNoCompactReason), string(metadata.MalformedIndexNoCompactReason))
+
+	downsampleConcurrency := regDownsampleConcurrencyFlag(cmd)
+
+	downsampleLevels, downsampleAggrs := regDownsampleLevelFlags(cmd)
+
+	maxBlockIndexSize := cmd.Flag("compact.max-block-index-size", "Maximum index size of compacted blocks. Compactions are stopped early if the sum of the index sizes of the input blocks exceeds it. "+
+		"A block that cannot be compacted with its neighbours within this size is marked for no compaction. 0 disables the limit.").
+		Default("0").Bytes()
+
+	relabelConfig := regRelabelConfigFlags(cmd, "compact.", false)
+
+	dryRun := cmd.Flag("dry-run", "Do not change the bucket, but log which blocks would be compacted, marked for no compaction, downsampled "+
+		"and deleted by retention and garbage collection in a single pass. Compactions and downsamplings are only planned, "+
+		"so blocks are neither downloaded nor uploaded. Implies running a single pass without --wait.").
+		Default("false").Bool()
+
+	leaderElection := cmd.Flag("compact.leader-election", "Compete for a lease in the bucket and only compact while holding it. Enables running standby compactors "+
+		"against the same bucket, which take over automatically once the leader stops renewing its lease.").
+		Default("false").Bool()
+
+	leaderElectionID := cmd.Flag("compact.leader-election.id", "Identity of this compactor in the lease. Defaults to the hostname and process ID.").
+		Default("").String()
+
+	leaseDuration := modelDuration(cmd.Flag("compact.leader-election.lease-duration", "Time after which a lease which was not renewed is taken over by a standby compactor.").
+		Default("1m"))
+
+	leaseRenewInterval := modelDuration(cmd.Flag("compact.leader-election.renew-interval", "Interval in which the lease is renewed by the leader and checked by standby compactors. Must be less than the lease duration.").
+		Default("15s"))
+
+	noCompactAfterFailures := cmd.Flag("compact.no-compact-after-failures", "Number of failed compactions of a block for one of the --compact.no-compact-on reasons after which the block is marked for no compaction.").
+		Default("3").Int()
+
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ bool) error {
-		return runCompact(g, logger, reg,
+		var reasons []metadata.NoCompactReason
+		for _, r := range *noCompactReasons {
+			reasons = append(reasons, metadata.NoCompactReason(r))
+		}
+
+		retentionByResolution := map[compact.ResolutionLevel]time.Duration{
+			compact.ResolutionLevelRaw: time.Duration(*retentionRaw),
+			compact.ResolutionLevel5m:  time.Duration(*retention5m),
+			compact.ResolutionLevel1h:  time.Duration(*retention1h),
+		}
+		for _, rs := range *retentionCustom {
+			res, d, err := parseResolutionRetention(rs)
+			if err != nil {
+				return err
+			}
+			retentionByResolution[res] = d
+		}
+
+		dsLevels, dsAggrs, err := parseDownsampleLevelFlags(*downsampleLevels, *downsampleAggrs)
+		if err != nil {
+			return err
+		}
+
+		relabelContentYaml, err := relabelConfig.Content()
+		if err != nil {
+			return err
+		}
+		relabelConfigs, err := metadata.ParseRelabelConfig(relabelContentYaml)
+		if err != nil {
+			return errors.Wrap(err, "parse relabel configuration")
+		}
+
+		var election *leaderElectionConfig
+		if *leaderElection {
+			election = &leaderElectionConfig{
+				id:            *leaderElectionID,
+				leaseDuration: time.Duration(*leaseDuration),
+				renewInterval: time.Duration(*leaseRenewInterval),
+			}
+			if election.id == "" {
+				hostname, err := os.Hostname()
+				if err != nil {
+					return errors.Wrap(err, "get hostname for leader election identity")
+				}
+				election.id = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+			}
+		}
+
+		return runCompact(g, logger, reg, tracer,
 			*httpAddr,
 			*dataDir,
 			objStoreConfig,
@@ -120,24 +215,54 @@ func registerCompact(m map[string]setupFunc, app *kingpin.Application, name stri
 			*acceptMalformedIndex,
 			*wait,
 			*generateMissingIndexCacheFiles,
-			map[compact.ResolutionLevel]time.Duration{
-				compact.ResolutionLevelRaw: time.Duration(*retentionRaw),
-				compact.ResolutionLevel5m:  time.Duration(*retention5m),
-				compact.ResolutionLevel1h:  time.Duration(*retention1h),
-			},
+			retentionByResolution,
 			name,
 			*disableDownsampling,
 			*maxCompactionLevel,
 			*blockSyncConcurrency,
 			*compactionConcurrency,
+			reasons,
+			*noCompactAfterFailures,
+			int64(*maxBlockIndexSize),
+			*downsampleConcurrency,
+			dsLevels,
+			dsAggrs,
+			relabelConfigs,
+			*dryRun,
+			election,
 		)
 	}
 }
 
+// leaderElectionConfig configures the leader election among compactors of the same bucket.
+type leaderElectionConfig struct {
+	id            string
+	leaseDuration time.Duration
+	renewInterval time.Duration
+}
+
+// parseResolutionRetention parses a retention in the form <resolution>:<duration>.
+func parseResolutionRetention(s string) (compact.ResolutionLevel, time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid retention %q, expected <resolution>:<duration>", s)
+	}
+	res, err := compact.ParseResolutionLevel(parts[0])
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parse resolution of retention %q", s)
+	}
+	d, err := model.ParseDuration(parts[1])
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parse duration of retention %q", s)
+	}
+	return res, time.Duration(d), nil
+}
+
 func runCompact(
 	g *run.Group,
 	logger log.Logger,
 	reg *prometheus.Registry,
+	tracer opentracing.Tracer,
 	httpBindAddr string,
 	dataDir string,
 	objStoreConfig *pathOrContent,
@@ -152,6 +277,15 @@ func runCompact(
 	maxCompactionLevel int,
 	blockSyncConcurrency int,
 	concurrency int,
+	noCompactReasons []metadata.NoCompactReason,
+	noCompactAfterFailures int,
+	maxBlockIndexSize int64,
+	downsampleConcurrency int,
+	downsampleLevels downsample.Levels,
+	downsampleAggrs []downsample.AggrType,
+	relabelConfigs []*relabel.Config,
+	dryRun bool,
+	election *leaderElectionConfig,
 ) error {
 	halted := prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_compactor_halted",
@@ -185,8 +319,30 @@ func runCompact(
 		}
 	}()
 
+	var dryRunner *compact.DryRun
+	if dryRun {
+		level.Info(logger).Log("msg", "dry run enabled; the bucket is not changed")
+		bkt = objstore.ReadOnlyBucket(bkt)
+		dryRunner = compact.NewDryRun(logger)
+		wait = false
+		generateMissingIndexCacheFiles = false
+	}
+
+	var elector *compact.LeaderElector
+	if election != nil {
+		if dryRun {
+			level.Info(logger).Log("msg", "leader election is disabled in dry run mode")
+		} else {
+			elector, err = compact.NewLeaderElector(logger, reg, bkt, election.id, election.leaseDuration, election.renewInterval)
+			if err != nil {
+				return errors.Wrap(err, "create leader elector")
+			}
+			level.Info(logger).Log("msg", "leader election is enabled", "id", election.id)
+		}
+	}
+
 	sy, err := compact.NewSyncer(logger, reg, bkt, consistencyDelay,
-		blockSyncConcurrency, acceptMalformedIndex)
+		blockSyncConcurrency, acceptMalformedIndex, maxBlockIndexSize, relabelConfigs)
 	if err != nil {
 		return errors.Wrap(err, "create syncer")
 	}
@@ -214,30 +370,46 @@ func runCompact(
 		compactDir      = path.Join(dataDir, "compact")
 		downsamplingDir = path.Join(dataDir, "downsample")
 		indexCacheDir   = path.Join(dataDir, "index_cache")
+		progressDir     = path.Join(dataDir, "progress")
 	)
 
-	if err := os.RemoveAll(downsamplingDir); err != nil {
+	if downsampleConcurrency <= 0 {
 		cancel()
-		return errors.Wrap(err, "clean working downsample directory")
+		return errors.Errorf("invalid downsample concurrency %d, must be > 0", downsampleConcurrency)
 	}
 
-	compactor, err := compact.NewBucketCompactor(logger, sy, comp, compactDir, bkt, concurrency)
+	var marker *compact.NoCompactMarker
+	if len(noCompactReasons) > 0 {
+		if noCompactAfterFailures <= 0 {
+			cancel()
+			return errors.New("--compact.no-compact-after-failures must be greater than 0")
+		}
+		marker = compact.NewNoCompactMarker(logger, reg, bkt, noCompactReasons, noCompactAfterFailures)
+	}
+
+	compactor, err := compact.NewBucketCompactor(logger, sy, comp, compactDir, bkt, concurrency, marker, dryRunner)
 	if err != nil {
 		cancel()
 		return errors.Wrap(err, "create bucket compactor")
 	}
 
-	if retentionByResolution[compact.ResolutionLevelRaw].Seconds() != 0 {
-		level.Info(logger).Log("msg", "retention policy of raw samples is enabled", "duration", retentionByResolution[compact.ResolutionLevelRaw])
+	var retentionResolutions []compact.ResolutionLevel
+	for res := range retentionByResolution {
+		retentionResolutions = append(retentionResolutions, res)
 	}
-	if retentionByResolution[compact.ResolutionLevel5m].Seconds() != 0 {
-		level.Info(logger).Log("msg", "retention policy of 5 min aggregated samples is enabled", "duration", retentionByResolution[compact.ResolutionLevel5m])
+	sort.Slice(retentionResolutions, func(i, j int) bool {
+		return retentionResolutions[i] < retentionResolutions[j]
+	})
+	for _, res := range retentionResolutions {
+		if retentionByResolution[res].Seconds() != 0 {
+			level.Info(logger).Log("msg", "retention policy is enabled", "resolution", res, "duration", retentionByResolution[res])
+		}
 	}
-	if retentionByResolution[compact.ResolutionLevel1h].Seconds() != 0 {
-		level.Info(logger).Log("msg", "retention policy of 1 hour aggregated samples is enabled", "duration", retentionByResolution[compact.ResolutionLevel1h])
+	if !disableDownsampling {
+		level.Info(logger).Log("msg", "downsampling levels", "levels", fmt.Sprint(downsampleLevels))
 	}
 
-	f := func() error {
+	f := func(ctx context.Context) error {
 		if err := compactor.Compact(ctx); err != nil {
 			return errors.Wrap(err, "compaction failed")
 		}
@@ -246,47 +418,67 @@ func runCompact(
 		// TODO(bplotka): Remove "disableDownsampling" once https://github.com/thanos-io/thanos/issues/297 is fixed.
 		if !disableDownsampling {
 			// After all compactions are done, work down the downsampling backlog.
-			// We run two passes of this to ensure that the 1h downsampling is generated
-			// for 5m downsamplings created in the first run.
-			level.Info(logger).Log("msg", "start first pass of downsampling")
+			// Blocks created in this pass are downsampled to the next level right away, so a single pass is enough.
+			level.Info(logger).Log("msg", "start downsampling")
 
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, downsamplingDir); err != nil {
-				return errors.Wrap(err, "first pass of downsampling failed")
-			}
-
-			level.Info(logger).Log("msg", "start second pass of downsampling")
-
-			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, downsamplingDir); err != nil {
-				return errors.Wrap(err, "second pass of downsampling failed")
+			if err := downsampleBucket(ctx, logger, downsampleMetrics, bkt, downsamplingDir, downsampleConcurrency, downsampleLevels, downsampleAggrs, dryRunner); err != nil {
+				return errors.Wrap(err, "downsampling failed")
 			}
 			level.Info(logger).Log("msg", "downsampling iterations done")
 		} else {
 			level.Warn(logger).Log("msg", "downsampling was explicitly disabled")
 		}
 
-		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, retentionByResolution); err != nil {
+		if err := compact.ApplyRetentionPolicyByResolution(ctx, logger, bkt, retentionByResolution, dryRunner); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("retention failed"))
 		}
+
+		if dryRunner != nil {
+			r := dryRunner.Report()
+			level.Info(logger).Log("msg", "dry run done",
+				"compactions", len(r.Compactions),
+				"no_compact_marks", len(r.NoCompactMarks),
+				"downsamplings", len(r.Downsamplings),
+				"retention_deletions", len(r.RetentionDeletions),
+				"garbage_collections", len(r.GarbageCollections))
+		}
 		return nil
 	}
 
+	// lead runs f right away without leader election. Otherwise it waits until this compactor holds the lease
+	// and aborts f once the lease is lost, after which f is run again once the lease is held again.
+	lead := func(f func(context.Context) error) error {
+		if elector == nil {
+			return f(ctx)
+		}
+		for {
+			err := elector.Do(ctx, f)
+			if !compact.IsLeadershipLostErr(err) {
+				return err
+			}
+			level.Warn(logger).Log("msg", "lost leadership; aborted current pass and retrying it once leading again", "err", err)
+		}
+	}
+
 	g.Add(func() error {
 		defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
 
 		// Generate index file.
 		if generateMissingIndexCacheFiles {
-			if err := genMissingIndexCacheFiles(ctx, logger, bkt, indexCacheDir); err != nil {
+			if err := lead(func(ctx context.Context) error {
+				return genMissingIndexCacheFiles(ctx, logger, bkt, indexCacheDir)
+			}); err != nil {
 				return err
 			}
 		}
 
 		if !wait {
-			return f()
+			return lead(f)
 		}
 
 		// --wait=true is specified.
 		return runutil.Repeat(5*time.Minute, ctx.Done(), func() error {
-			err := f()
+			err := lead(f)
 			if err == nil {
 				return nil
 			}
@@ -318,8 +510,61 @@ func runCompact(
 		cancel()
 	})
 
-	if err := metricHTTPListenGroup(g, logger, reg, httpBindAddr); err != nil {
-		return err
+	if elector != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return elector.Run(ctx)
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	// Periodically calculate the pending work from the blocks known to the syncer.
+	var progressLevels downsample.Levels
+	if !disableDownsampling {
+		progressLevels = downsampleLevels
+	}
+	progress := compact.NewProgressCalculator(logger, reg, sy, comp, progressDir, retentionByResolution, progressLevels)
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return runutil.Repeat(time.Minute, ctx.Done(), func() error {
+				if err := progress.Update(); err != nil {
+					level.Warn(logger).Log("msg", "failed to calculate compaction progress", "err", err)
+				}
+				return nil
+			})
+		}, func(error) {
+			cancel()
+		})
+	}
+
+	// Start compact API + UI HTTP server.
+	{
+		router := route.New()
+		ins := extpromhttp.NewInstrumentationMiddleware(reg)
+
+		ui.NewCompactUI(logger, progress).Register(router, ins)
+
+		api := v1.NewAPI(logger, progress)
+		api.Register(router.WithPrefix("/api/v1"), tracer, logger, ins)
+
+		mux := http.NewServeMux()
+		registerMetrics(mux, reg)
+		registerProfile(mux)
+		mux.Handle("/", router)
+
+		l, err := net.Listen("tcp", httpBindAddr)
+		if err != nil {
+			return errors.Wrapf(err, "listen HTTP on address %s", httpBindAddr)
+		}
+
+		g.Add(func() error {
+			level.Info(logger).Log("msg", "Listening for compact API and metrics", "address", httpBindAddr)
+			return errors.Wrap(http.Serve(l, mux), "serve compact")
+		}, func(error) {
+			runutil.CloseWithLogOnErr(logger, l, "compact and metric listener")
+		})
 	}
 
 	level.Info(logger).Log("msg", "starting compact node")
@@ -7,17 +7,19 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/oklog/run"
-	"github.com/oklog/ulid"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/tsdb"
 	"github.com/prometheus/tsdb/chunkenc"
+	terrors "github.com/prometheus/tsdb/errors"
 	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact"
@@ -39,14 +41,58 @@ func registerDownsample(m map[string]setupFunc, app *kingpin.Application, name s
 
 	objStoreConfig := regCommonObjStoreFlags(cmd, "", true)
 
+	concurrency := regDownsampleConcurrencyFlag(cmd)
+
+	levels, aggrs := regDownsampleLevelFlags(cmd)
+
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ bool) error {
-		return runDownsample(g, logger, reg, *httpAddr, *dataDir, objStoreConfig)
+		dsLevels, dsAggrs, err := parseDownsampleLevelFlags(*levels, *aggrs)
+		if err != nil {
+			return err
+		}
+		return runDownsample(g, logger, reg, *httpAddr, *dataDir, objStoreConfig, *concurrency, dsLevels, dsAggrs)
 	}
 }
 
+func regDownsampleConcurrencyFlag(cmd *kingpin.CmdClause) *int {
+	return cmd.Flag("downsample.concurrency", "Number of blocks to download and downsample concurrently.").
+		Default("1").Int()
+}
+
+func regDownsampleLevelFlags(cmd *kingpin.CmdClause) (levels *[]string, aggrs *[]string) {
+	levels = cmd.Flag("downsample.level", "Downsampling level in the form <resolution>:<min block range>, e.g. 5m:40h. "+
+		"Blocks spanning at least the min block range are downsampled to the resolution of the level, starting from raw blocks "+
+		"and continuing with the blocks of the previous level. Repeat the flag for multiple levels. Defaults to 5m:40h and 1h:10d. "+
+		"All compactors and downsamplers of a bucket must use the same levels.").
+		PlaceHolder("<resolution>:<min-range>").Strings()
+	aggrs = cmd.Flag("downsample.aggregate", "Optional aggregate to compute in addition to count, sum, min, max and counter "+
+		"when downsampling raw blocks. Repeat the flag for multiple aggregates.").
+		PlaceHolder("<aggregate>").Enums(downsample.AggrLast.String())
+	return levels, aggrs
+}
+
+func parseDownsampleLevelFlags(levels, aggrs []string) (downsample.Levels, []downsample.AggrType, error) {
+	dsLevels, err := downsample.ParseLevels(levels)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parse downsampling levels")
+	}
+	var dsAggrs []downsample.AggrType
+	for _, a := range aggrs {
+		at, err := downsample.ParseAggrType(a)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "parse downsampling aggregates")
+		}
+		dsAggrs = append(dsAggrs, at)
+	}
+	return dsLevels, dsAggrs, nil
+}
+
 type DownsampleMetrics struct {
 	downsamples        *prometheus.CounterVec
 	downsampleFailures *prometheus.CounterVec
+	downsampleDuration *prometheus.HistogramVec
+	todoBlocks         prometheus.Gauge
+	inProgressBlocks   prometheus.Gauge
 }
 
 func newDownsampleMetrics(reg *prometheus.Registry) *DownsampleMetrics {
@@ -60,9 +106,27 @@ func newDownsampleMetrics(reg *prometheus.Registry) *DownsampleMetrics {
 		Name: "thanos_compact_downsample_failures_total",
 		Help: "Total number of failed downsampling attempts.",
 	}, []string{"group"})
+	m.downsampleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "thanos_compact_downsample_duration_seconds",
+		Help: "Time it took to download, downsample and upload a single block.",
+		Buckets: []float64{
+			1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200,
+		},
+	}, []string{"resolution"})
+	m.todoBlocks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_compact_downsample_todo_blocks",
+		Help: "Number of blocks left to downsample in the current downsampling pass.",
+	})
+	m.inProgressBlocks = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_compact_downsample_in_progress_blocks",
+		Help: "Number of blocks being downsampled.",
+	})
 
 	reg.MustRegister(m.downsamples)
 	reg.MustRegister(m.downsampleFailures)
+	reg.MustRegister(m.downsampleDuration)
+	reg.MustRegister(m.todoBlocks)
+	reg.MustRegister(m.inProgressBlocks)
 
 	return m
 }
@@ -74,7 +138,14 @@ func runDownsample(
 	httpBindAddr string,
 	dataDir string,
 	objStoreConfig *pathOrContent,
+	concurrency int,
+	levels downsample.Levels,
+	optionalAggrs []downsample.AggrType,
 ) error {
+	if concurrency <= 0 {
+		return errors.Errorf("invalid downsample concurrency %d, must be > 0", concurrency)
+	}
+
 	confContentYaml, err := objStoreConfig.Content()
 	if err != nil {
 		return err
@@ -101,15 +172,9 @@ func runDownsample(
 		g.Add(func() error {
 			defer runutil.CloseWithLogOnErr(logger, bkt, "bucket client")
 
-			level.Info(logger).Log("msg", "start first pass of downsampling")
+			level.Info(logger).Log("msg", "start downsampling")
 
-			if err := downsampleBucket(ctx, logger, metrics, bkt, dataDir); err != nil {
-				return errors.Wrap(err, "downsampling failed")
-			}
-
-			level.Info(logger).Log("msg", "start second pass of downsampling")
-
-			if err := downsampleBucket(ctx, logger, metrics, bkt, dataDir); err != nil {
+			if err := downsampleBucket(ctx, logger, metrics, bkt, dataDir, concurrency, levels, optionalAggrs, nil); err != nil {
 				return errors.Wrap(err, "downsampling failed")
 			}
 
@@ -127,19 +192,27 @@ func runDownsample(
 	return nil
 }
 
+// downsampleTask is a block to downsample to the given resolution.
+type downsampleTask struct {
+	meta       *metadata.Meta
+	resolution int64
+}
+
+// downsampleBucket downsamples all blocks of the bucket that have not been downsampled yet to the given levels, using
+// the given number of concurrent workers. Every block is processed in its own work directory within dir. Work directories
+// are kept on failures, so that blocks downloaded by a previous attempt do not need to be downloaded again.
+// If dryRun is not nil, the downsamplings are only recorded in it, considering the changes recorded before.
 func downsampleBucket(
 	ctx context.Context,
 	logger log.Logger,
 	metrics *DownsampleMetrics,
 	bkt objstore.Bucket,
 	dir string,
+	concurrency int,
+	levels downsample.Levels,
+	optionalAggrs []downsample.AggrType,
+	dryRun *compact.DryRun,
 ) error {
-	if err := os.RemoveAll(dir); err != nil {
-		return errors.Wrap(err, "clean working directory")
-	}
-	if err := os.MkdirAll(dir, 0777); err != nil {
-		return errors.Wrap(err, "create dir")
-	}
 	var metas []*metadata.Meta
 
 	err := bkt.Iter(ctx, "", func(name string) error {
@@ -172,93 +245,215 @@ func downsampleBucket(
 	if err != nil {
 		return errors.Wrap(err, "retrieve bucket block metas")
 	}
+	if dryRun != nil {
+		metas = dryRun.Apply(metas)
+	}
 
-	// mapping from a hash over all source IDs to blocks. We don't need to downsample a block
-	// if a downsampled version with the same hash already exists.
-	sources5m := map[ulid.ULID]struct{}{}
-	sources1h := map[ulid.ULID]struct{}{}
+	// Mapping from resolutions to the source IDs of their blocks. We don't need to downsample a block
+	// if all its sources are already part of blocks with the next resolution.
+	sources := downsample.Sources{}
+	for _, m := range metas {
+		sources.Add(m)
+	}
 
+	var tasks []downsampleTask
 	for _, m := range metas {
-		switch m.Thanos.Downsample.Resolution {
-		case 0:
+		// NOTE(fabxc): this must match with at which block size the compactor creates downsampled
+		// blocks. Otherwise we may never downsample some data.
+		l, ok := levels.Due(m, sources)
+		if !ok {
 			continue
-		case 5 * 60 * 1000:
-			for _, id := range m.Compaction.Sources {
-				sources5m[id] = struct{}{}
-			}
-		case 60 * 60 * 1000:
-			for _, id := range m.Compaction.Sources {
-				sources1h[id] = struct{}{}
-			}
-		default:
-			return errors.Errorf("unexpected downsampling resolution %d", m.Thanos.Downsample.Resolution)
 		}
+		tasks = append(tasks, downsampleTask{meta: m, resolution: l.Resolution})
 	}
 
-	for _, m := range metas {
-		switch m.Thanos.Downsample.Resolution {
-		case 0:
-			missing := false
-			for _, id := range m.Compaction.Sources {
-				if _, ok := sources5m[id]; !ok {
-					missing = true
+	if dryRun != nil {
+		// Record the downsamplings of all levels downsampleBlock would run for every task.
+		for _, t := range tasks {
+			m := dryRun.Downsampled(t.meta, t.resolution)
+			for {
+				l, ok := levels.Due(m, sources)
+				if !ok {
 					break
 				}
+				m = dryRun.Downsampled(m, l.Resolution)
 			}
-			if !missing {
-				continue
-			}
-			// Only downsample blocks once we are sure to get roughly 2 chunks out of it.
-			// NOTE(fabxc): this must match with at which block size the compactor creates downsampled
-			// blocks. Otherwise we may never downsample some data.
-			if m.MaxTime-m.MinTime < 40*60*60*1000 {
-				continue
-			}
-			if err := processDownsampling(ctx, logger, bkt, m, dir, 5*60*1000); err != nil {
-				metrics.downsampleFailures.WithLabelValues(compact.GroupKey(*m)).Inc()
-				return errors.Wrap(err, "downsampling to 5 min")
-			}
-			metrics.downsamples.WithLabelValues(compact.GroupKey(*m)).Inc()
+		}
+		return nil
+	}
 
-		case 5 * 60 * 1000:
-			missing := false
-			for _, id := range m.Compaction.Sources {
-				if _, ok := sources1h[id]; !ok {
-					missing = true
-					break
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
+	// Remove work directories of blocks that do not need to be downsampled anymore.
+	if err := cleanDownsampleWorkDirs(dir, tasks); err != nil {
+		return errors.Wrap(err, "clean working directory")
+	}
+
+	metrics.todoBlocks.Set(float64(len(tasks)))
+	defer metrics.todoBlocks.Set(0)
+
+	var (
+		wg       sync.WaitGroup
+		taskChan = make(chan downsampleTask)
+		errChan  = make(chan error, concurrency)
+	)
+	workCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for t := range taskChan {
+				metrics.inProgressBlocks.Inc()
+				err := downsampleBlock(workCtx, logger, metrics, bkt, t, filepath.Join(dir, t.meta.ULID.String()), levels, optionalAggrs, sources)
+				metrics.inProgressBlocks.Dec()
+				metrics.todoBlocks.Dec()
+
+				if err != nil {
+					metrics.downsampleFailures.WithLabelValues(compact.GroupKey(*t.meta)).Inc()
+					errChan <- errors.Wrapf(err, "downsampling block %s to resolution %d", t.meta.ULID, t.resolution)
+					return
 				}
+				metrics.downsamples.WithLabelValues(compact.GroupKey(*t.meta)).Inc()
 			}
-			if !missing {
-				continue
-			}
-			// Only downsample blocks once we are sure to get roughly 2 chunks out of it.
-			// NOTE(fabxc): this must match with at which block size the compactor creates downsampled
-			// blocks. Otherwise we may never downsample some data.
-			if m.MaxTime-m.MinTime < 10*24*60*60*1000 {
-				continue
-			}
-			if err := processDownsampling(ctx, logger, bkt, m, dir, 60*60*1000); err != nil {
-				metrics.downsampleFailures.WithLabelValues(compact.GroupKey(*m))
-				return errors.Wrap(err, "downsampling to 60 min")
-			}
-			metrics.downsamples.WithLabelValues(compact.GroupKey(*m))
+		}()
+	}
+
+taskLoop:
+	for _, t := range tasks {
+		select {
+		case err = <-errChan:
+			break taskLoop
+		case taskChan <- t:
+		}
+	}
+	close(taskChan)
+	wg.Wait()
+	close(errChan)
+
+	var errs terrors.MultiError
+	errs.Add(err)
+	// Collect any other errors reported by the workers.
+	for e := range errChan {
+		errs.Add(e)
+	}
+	return errs.Err()
+}
+
+// cleanDownsampleWorkDirs removes all work directories in dir that do not belong to any of the tasks.
+func cleanDownsampleWorkDirs(dir string, tasks []downsampleTask) error {
+	keep := map[string]struct{}{}
+	for _, t := range tasks {
+		keep[t.meta.ULID.String()] = struct{}{}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if _, ok := keep[f.Name()]; ok {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bucket, m *metadata.Meta, dir string, resolution int64) error {
+// downsampleBlock downsamples the block of the task within the given work directory and uploads the result.
+// If the result is long enough to be downsampled to the next level, it is downsampled right away while it is
+// still available locally. The work directory is removed once all results are uploaded.
+// The sources must not be modified while blocks are downsampled.
+func downsampleBlock(
+	ctx context.Context,
+	logger log.Logger,
+	metrics *DownsampleMetrics,
+	bkt objstore.Bucket,
+	t downsampleTask,
+	workDir string,
+	levels downsample.Levels,
+	optionalAggrs []downsample.AggrType,
+	sources downsample.Sources,
+) error {
 	begin := time.Now()
-	bdir := filepath.Join(dir, m.ULID.String())
 
-	err := block.Download(ctx, logger, bkt, m.ULID, bdir)
+	resMeta, err := processDownsampling(ctx, logger, bkt, t.meta, workDir, t.resolution, optionalAggrs...)
 	if err != nil {
-		return errors.Wrapf(err, "download block %s", m.ULID)
+		return err
+	}
+	metrics.downsampleDuration.WithLabelValues(strconv.FormatInt(t.resolution, 10)).Observe(time.Since(begin).Seconds())
+
+	for {
+		l, ok := levels.Due(resMeta, sources)
+		if !ok {
+			break
+		}
+		begin = time.Now()
+
+		m := resMeta
+		if resMeta, err = processDownsampling(ctx, logger, bkt, m, workDir, l.Resolution); err != nil {
+			return errors.Wrapf(err, "downsample block %s to resolution %d", m.ULID, l.Resolution)
+		}
+		metrics.downsampleDuration.WithLabelValues(strconv.FormatInt(l.Resolution, 10)).Observe(time.Since(begin).Seconds())
+	}
+
+	// It is not harmful if this fails.
+	if err := os.RemoveAll(workDir); err != nil {
+		level.Warn(logger).Log("msg", "failed to clean directory", "dir", workDir, "err", err)
+	}
+	return nil
+}
+
+// processDownsampling downsamples the block to the given resolution and uploads the result. The block is read from
+// the work directory if it is already there, e.g. from a previous attempt, and downloaded otherwise.
+// It returns the meta of the uploaded block.
+func processDownsampling(
+	ctx context.Context,
+	logger log.Logger,
+	bkt objstore.Bucket,
+	m *metadata.Meta,
+	dir string,
+	resolution int64,
+	optionalAggrs ...downsample.AggrType,
+) (*metadata.Meta, error) {
+	begin := time.Now()
+	bdir := filepath.Join(dir, m.ULID.String())
+
+	// Remove leftovers of previous attempts, but keep the completely downloaded input block.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "read dir %s", dir)
+	}
+	for _, f := range files {
+		if f.Name() == m.ULID.String() {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			return nil, errors.Wrapf(err, "clean %s", filepath.Join(dir, f.Name()))
+		}
+	}
+
+	if _, err := os.Stat(bdir); err == nil {
+		level.Info(logger).Log("msg", "reusing local block", "id", m.ULID)
+	} else {
+		// Download into a temporary directory first, so that only complete blocks are reused.
+		tmp := bdir + ".tmp"
+		if err := block.Download(ctx, logger, bkt, m.ULID, tmp); err != nil {
+			return nil, errors.Wrapf(err, "download block %s", m.ULID)
+		}
+		if err := os.Rename(tmp, bdir); err != nil {
+			return nil, errors.Wrapf(err, "rename downloaded block %s", m.ULID)
+		}
+		level.Info(logger).Log("msg", "downloaded block", "id", m.ULID, "duration", time.Since(begin))
 	}
-	level.Info(logger).Log("msg", "downloaded block", "id", m.ULID, "duration", time.Since(begin))
 
 	if err := block.VerifyIndex(logger, filepath.Join(bdir, block.IndexFilename), m.MinTime, m.MaxTime); err != nil {
-		return errors.Wrap(err, "input block index not valid")
+		return nil, errors.Wrap(err, "input block index not valid")
 	}
 
 	begin = time.Now()
@@ -272,13 +467,13 @@ func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bu
 
 	b, err := tsdb.OpenBlock(logger, bdir, pool)
 	if err != nil {
-		return errors.Wrapf(err, "open block %s", m.ULID)
+		return nil, errors.Wrapf(err, "open block %s", m.ULID)
 	}
 	defer runutil.CloseWithLogOnErr(log.With(logger, "outcome", "potential left mmap file handlers left"), b, "tsdb reader")
 
-	id, err := downsample.Downsample(logger, m, b, dir, resolution)
+	id, err := downsample.Downsample(logger, m, b, dir, resolution, optionalAggrs...)
 	if err != nil {
-		return errors.Wrapf(err, "downsample block %s to window %d", m.ULID, resolution)
+		return nil, errors.Wrapf(err, "downsample block %s to window %d", m.ULID, resolution)
 	}
 	resdir := filepath.Join(dir, id.String())
 
@@ -286,25 +481,21 @@ func processDownsampling(ctx context.Context, logger log.Logger, bkt objstore.Bu
 		"from", m.ULID, "to", id, "duration", time.Since(begin))
 
 	if err := block.VerifyIndex(logger, filepath.Join(resdir, block.IndexFilename), m.MinTime, m.MaxTime); err != nil {
-		return errors.Wrap(err, "output block index not valid")
+		return nil, errors.Wrap(err, "output block index not valid")
 	}
 
 	begin = time.Now()
 
 	err = block.Upload(ctx, logger, bkt, resdir)
 	if err != nil {
-		return errors.Wrapf(err, "upload downsampled block %s", id)
+		return nil, errors.Wrapf(err, "upload downsampled block %s", id)
 	}
 
 	level.Info(logger).Log("msg", "uploaded block", "id", id, "duration", time.Since(begin))
 
-	// It is not harmful if these fails.
-	if err := os.RemoveAll(bdir); err != nil {
-		level.Warn(logger).Log("msg", "failed to clean directory", "dir", bdir, "err", err)
-	}
-	if err := os.RemoveAll(resdir); err != nil {
-		level.Warn(logger).Log("msg", "failed to clean directory", "resdir", bdir, "err", err)
+	resMeta, err := metadata.Read(resdir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read meta of downsampled block %s", id)
 	}
-
-	return nil
+	return resMeta, nil
 }
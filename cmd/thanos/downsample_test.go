@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestDownsampleBucket(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "downsample-bucket")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := inmem.NewBucket()
+	logger := log.NewNopLogger()
+
+	// Two raw blocks, one long enough to be downsampled to 5m and one long enough for 5m and 1h.
+	series := []labels.Labels{labels.FromStrings("a", "1"), labels.FromStrings("a", "2")}
+	for _, maxt := range []int64{downsample.DownsampleRange0, downsample.DownsampleRange1} {
+		id, err := testutil.CreateBlock(ctx, dir, series, 100, 0, maxt, labels.FromStrings("ext", strconv.FormatInt(maxt, 10)), downsample.ResLevel0)
+		testutil.Ok(t, err)
+		testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+	}
+
+	workDir := filepath.Join(dir, "downsample")
+	// Leftovers of a previous run of a block that does not need downsampling anymore are removed.
+	testutil.Ok(t, os.MkdirAll(filepath.Join(workDir, "stale"), 0777))
+
+	metrics := newDownsampleMetrics(prometheus.NewRegistry())
+	testutil.Ok(t, downsampleBucket(ctx, logger, metrics, bkt, workDir, 2, downsample.DefaultLevels, nil, nil))
+
+	count := map[int64]int{}
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		id, ok := block.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		m, err := block.DownloadMeta(ctx, logger, bkt, id)
+		testutil.Ok(t, err)
+		count[m.Thanos.Downsample.Resolution]++
+		return nil
+	}))
+	testutil.Equals(t, map[int64]int{
+		downsample.ResLevel0: 2,
+		downsample.ResLevel1: 2,
+		downsample.ResLevel2: 1,
+	}, count)
+
+	files, err := ioutil.ReadDir(workDir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(files))
+
+	// Nothing is left to do in a second pass.
+	testutil.Ok(t, downsampleBucket(ctx, logger, metrics, bkt, workDir, 2, downsample.DefaultLevels, nil, nil))
+	n := 0
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		if _, ok := block.IsBlockDir(name); ok {
+			n++
+		}
+		return nil
+	}))
+	testutil.Equals(t, 5, n)
+}
+
+func TestProcessDownsampling_ReusesLocalBlock(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "downsample-reuse")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	logger := log.NewNopLogger()
+	series := []labels.Labels{labels.FromStrings("a", "1")}
+	id, err := testutil.CreateBlock(ctx, dir, series, 100, 0, downsample.DownsampleRange0, labels.FromStrings("ext", "1"), downsample.ResLevel0)
+	testutil.Ok(t, err)
+
+	m, err := metadata.Read(filepath.Join(dir, id.String()))
+	testutil.Ok(t, err)
+
+	// The block was downloaded by a previous attempt that failed afterwards and is not in the bucket anymore.
+	workDir := filepath.Join(dir, "work")
+	testutil.Ok(t, os.MkdirAll(workDir, 0777))
+	testutil.Ok(t, os.Rename(filepath.Join(dir, id.String()), filepath.Join(workDir, id.String())))
+	testutil.Ok(t, os.MkdirAll(filepath.Join(workDir, "partial-output"), 0777))
+
+	bkt := inmem.NewBucket()
+	resMeta, err := processDownsampling(ctx, logger, bkt, m, workDir, downsample.ResLevel1)
+	testutil.Ok(t, err)
+	testutil.Equals(t, downsample.ResLevel1, resMeta.Thanos.Downsample.Resolution)
+
+	_, err = os.Stat(filepath.Join(workDir, "partial-output"))
+	testutil.Assert(t, os.IsNotExist(err), "partial output of previous attempt not removed")
+
+	ok, err := bkt.Exists(ctx, path.Join(resMeta.ULID.String(), block.MetaFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "downsampled block not uploaded")
+}
+
+func TestDownsampleBucket_CustomLevels(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "downsample-bucket-levels")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := inmem.NewBucket()
+	logger := log.NewNopLogger()
+
+	levels, aggrs, err := parseDownsampleLevelFlags([]string{"6h:20h", "1m:2h", "15m:10h"}, []string{"last"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, []int64{0, 60 * 1000, 15 * 60 * 1000, 6 * 60 * 60 * 1000}, levels.Resolutions())
+
+	// A raw block long enough to be downsampled to 1m and 15m, but not to 6h.
+	series := []labels.Labels{labels.FromStrings("a", "1")}
+	id, err := testutil.CreateBlock(ctx, dir, series, 100, 0, 12*60*60*1000, labels.FromStrings("ext", "1"), downsample.ResLevel0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+
+	metrics := newDownsampleMetrics(prometheus.NewRegistry())
+	testutil.Ok(t, downsampleBucket(ctx, logger, metrics, bkt, filepath.Join(dir, "downsample"), 1, levels, aggrs, nil))
+
+	count := map[int64]int{}
+	testutil.Ok(t, bkt.Iter(ctx, "", func(name string) error {
+		id, ok := block.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+		m, err := block.DownloadMeta(ctx, logger, bkt, id)
+		testutil.Ok(t, err)
+		count[m.Thanos.Downsample.Resolution]++
+		return nil
+	}))
+	testutil.Equals(t, map[int64]int{
+		downsample.ResLevel0: 1,
+		60 * 1000:            1,
+		15 * 60 * 1000:       1,
+	}, count)
+}
+
+func TestDownsampleBucket_DryRun(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "downsample-bucket-dry-run")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := inmem.NewBucket()
+	logger := log.NewNopLogger()
+
+	// A raw block long enough to be downsampled to 5m and 1h.
+	series := []labels.Labels{labels.FromStrings("a", "1")}
+	id, err := testutil.CreateBlock(ctx, dir, series, 100, 0, downsample.DownsampleRange1, labels.FromStrings("ext", "1"), downsample.ResLevel0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, logger, bkt, filepath.Join(dir, id.String())))
+	objects := len(bkt.Objects())
+
+	d := compact.NewDryRun(logger)
+	workDir := filepath.Join(dir, "downsample")
+	metrics := newDownsampleMetrics(prometheus.NewRegistry())
+	testutil.Ok(t, downsampleBucket(ctx, logger, metrics, objstore.ReadOnlyBucket(bkt), workDir, 1, downsample.DefaultLevels, nil, d))
+
+	r := d.Report()
+	testutil.Equals(t, 2, len(r.Downsamplings))
+	testutil.Equals(t, id, r.Downsamplings[0].Block)
+	testutil.Equals(t, downsample.ResLevel1, r.Downsamplings[0].Resolution)
+	testutil.Equals(t, r.Downsamplings[0].Result, r.Downsamplings[1].Block)
+	testutil.Equals(t, downsample.ResLevel2, r.Downsamplings[1].Resolution)
+
+	// Nothing was downloaded or uploaded.
+	testutil.Equals(t, objects, len(bkt.Objects()))
+	_, err = os.Stat(workDir)
+	testutil.Assert(t, os.IsNotExist(err), "work directory created by dry run")
+}
@@ -114,6 +114,26 @@ func regCommonObjStoreFlags(cmd *kingpin.CmdClause, suffix string, required bool
 	}
 }
 
+func regRelabelConfigFlags(cmd *kingpin.CmdClause, prefix string, required bool) *pathOrContent {
+	fileFlagName := fmt.Sprintf("%srelabel-config-file", prefix)
+	contentFlagName := fmt.Sprintf("%srelabel-config", prefix)
+
+	help := "Path to YAML file that contains the relabel configuration applied to the external labels of blocks."
+	relabelConfFile := cmd.Flag(fileFlagName, help).PlaceHolder("<relabel.config-yaml-path>").String()
+
+	help = fmt.Sprintf("Alternative to '%s' flag. Relabel configuration applied to the external labels of blocks in YAML.", fileFlagName)
+	relabelConf := cmd.Flag(contentFlagName, help).PlaceHolder("<relabel.config-yaml>").String()
+
+	return &pathOrContent{
+		fileFlagName:    fileFlagName,
+		contentFlagName: contentFlagName,
+		required:        required,
+
+		path:    relabelConfFile,
+		content: relabelConf,
+	}
+}
+
 func regCommonTracingFlags(app *kingpin.Application) *pathOrContent {
 	fileFlagName := fmt.Sprintf("tracing.config-file")
 	contentFlagName := fmt.Sprintf("tracing.config")
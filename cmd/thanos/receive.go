@@ -19,6 +19,8 @@ import (
 	"github.com/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/component"
+	"github.com/thanos-io/thanos/pkg/discovery/dns"
+	"github.com/thanos-io/thanos/pkg/extprom"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
 	"github.com/thanos-io/thanos/pkg/receive"
 	"github.com/thanos-io/thanos/pkg/runutil"
@@ -38,6 +40,14 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application, name stri
 	remoteWriteAddress := cmd.Flag("remote-write.address", "Address to listen on for remote write requests.").
 		Default("0.0.0.0:19291").String()
 
+	rwClientCert := cmd.Flag("remote-write.client-tls-cert", "TLS Certificates to use to identify this receive node to the other receive nodes it forwards write requests to. Used if TLS is enabled for the gRPC server.").Default("").String()
+
+	rwClientKey := cmd.Flag("remote-write.client-tls-key", "TLS Key for the client's certificate.").Default("").String()
+
+	rwClientCA := cmd.Flag("remote-write.client-tls-ca", "TLS CA Certificates to use to verify the gRPC servers of other receive nodes.").Default("").String()
+
+	rwClientServerName := cmd.Flag("remote-write.client-server-name", "Server name to verify the hostname on the gRPC certificates returned by other receive nodes. See https://tools.ietf.org/html/rfc4366#section-3.1").Default("").String()
+
 	dataDir := cmd.Flag("tsdb.path", "Data directory of TSDB.").
 		Default("./data").String()
 
@@ -53,7 +63,22 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application, name stri
 	refreshInterval := modelDuration(cmd.Flag("receive.hashrings-file-refresh-interval", "Refresh interval to re-read the hashring configuration file. (used as a fallback)").
 		Default("5m"))
 
-	local := cmd.Flag("receive.local-endpoint", "Endpoint of local receive node. Used to identify the local node in the hashring configuration.").String()
+	hashringsURL := cmd.Flag("receive.hashrings-url", "URL returning the hashring configuration as JSON. Alternative to --receive.hashrings-file.").
+		PlaceHolder("<url>").String()
+
+	hashringsDNS := cmd.Flag("receive.hashrings-dns", "Addresses of receive nodes forming a single hashring, resolved via DNS, e.g. dnssrv+_grpc._tcp.thanos-receive. Alternative to --receive.hashrings-file.").
+		PlaceHolder("<address>").Strings()
+
+	hashringsDNSResolver := cmd.Flag("receive.hashrings-dns-resolver", fmt.Sprintf("Resolver to use. Possible options: [%s, %s]", dns.GolangResolverType, dns.MiekgdnsResolverType)).
+		Default(string(dns.GolangResolverType)).Hidden().String()
+
+	pollInterval := modelDuration(cmd.Flag("receive.hashrings-poll-interval", "Interval between fetches of the hashring configuration from --receive.hashrings-url or --receive.hashrings-dns.").
+		Default("30s"))
+
+	hashringsDebounce := modelDuration(cmd.Flag("receive.hashrings-debounce", "Time the hashring configuration must be unchanged before it is applied, to avoid churn while it settles.").
+		Default("5s"))
+
+	local := cmd.Flag("receive.local-endpoint", "Endpoint of local receive node. Used to identify the local node in the hashring configuration. This is the gRPC address other receive nodes forward write requests to.").String()
 
 	tenantHeader := cmd.Flag("receive.tenant-header", "HTTP header to determine tenant for write requests.").Default("THANOS-TENANT").String()
 
@@ -61,30 +86,86 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application, name stri
 
 	replicationFactor := cmd.Flag("receive.replication-factor", "How many times to replicate incoming write requests.").Default("1").Uint64()
 
+	relabelConfigFile := cmd.Flag("receive.relabel-config-file", "Path to YAML file that contains the relabel configuration applied to incoming time series per tenant. "+
+		"It is applied again by the receive nodes the time series are forwarded to, so it must be idempotent.").
+		PlaceHolder("<relabel.config-yaml-path>").String()
+
+	relabelConfig := cmd.Flag("receive.relabel-config", "Alternative to 'receive.relabel-config-file' flag. Relabel configuration applied to incoming time series per tenant in YAML.").
+		PlaceHolder("<relabel.config-yaml>").String()
+
+	tenantLabelName := cmd.Flag("receive.tenant-label-name", "Label name that is set to the tenant of the write request on all incoming time series, overriding any value sent by the client. Empty disables it.").
+		Default("").String()
+
+	maxBodySize := cmd.Flag("receive.max-body-size", "Maximum size of the decompressed body of text and line protocol write requests. 0 means no limit.").
+		Default("32MB").Bytes()
+
+	forwardQueueDir := cmd.Flag("receive.forward-queue.dir", "Directory in which write requests for unreachable peers are queued until they can be delivered. Empty disables queueing and fails such write requests.").
+		PlaceHolder("<path>").String()
+
+	forwardQueueMaxSize := cmd.Flag("receive.forward-queue.max-size", "Maximum size of write requests queued per peer. Write requests for a peer whose queue is full fail.").
+		Default("1GB").Bytes()
+
+	forwardQueueReplayInterval := modelDuration(cmd.Flag("receive.forward-queue.replay-interval", "Interval between attempts to deliver queued write requests to their peers.").
+		Default("30s"))
+
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, _ bool) error {
 		lset, err := parseFlagLabels(*labelStrs)
 		if err != nil {
 			return errors.Wrap(err, "parse labels")
 		}
 
-		var cw *receive.ConfigWatcher
-		if *hashringsFile != "" {
-			cw, err = receive.NewConfigWatcher(log.With(logger, "component", "config-watcher"), reg, *hashringsFile, *refreshInterval)
+		var sources int
+		for _, set := range []bool{*hashringsFile != "", *hashringsURL != "", len(*hashringsDNS) > 0} {
+			if set {
+				sources++
+			}
+		}
+		if sources > 1 {
+			return errors.New("only one of --receive.hashrings-file, --receive.hashrings-url and --receive.hashrings-dns can be specified")
+		}
+
+		var cs receive.ConfigSource
+		switch {
+		case *hashringsFile != "":
+			cs, err = receive.NewConfigWatcher(log.With(logger, "component", "config-watcher"), reg, *hashringsFile, *refreshInterval)
 			if err != nil {
 				return err
 			}
+		case *hashringsURL != "":
+			cs = receive.NewHTTPConfigPoller(log.With(logger, "component", "config-poller"), reg, nil, *hashringsURL, *pollInterval)
+		case len(*hashringsDNS) > 0:
+			dnsProvider := dns.NewProvider(
+				logger,
+				extprom.WrapRegistererWithPrefix("thanos_receive_hashrings_", reg),
+				dns.ResolverType(*hashringsDNSResolver),
+			)
+			cs = receive.NewDNSConfigPoller(log.With(logger, "component", "config-poller"), reg, dnsProvider, *hashringsDNS, *pollInterval)
 		}
 
 		// Local is empty, so try to generate a local endpoint
-		// based on the hostname and the listening port.
+		// based on the hostname and the listening gRPC port.
 		if *local == "" {
 			hostname, err := os.Hostname()
 			if hostname == "" || err != nil {
 				return errors.New("--receive.local-endpoint is empty and host could not be determined.")
 			}
-			parts := strings.Split(*remoteWriteAddress, ":")
+			parts := strings.Split(*grpcBindAddr, ":")
 			port := parts[len(parts)-1]
-			*local = fmt.Sprintf("http://%s:%s/api/v1/receive", hostname, port)
+			*local = fmt.Sprintf("%s:%s", hostname, port)
+		}
+
+		relabelContentYaml, err := (&pathOrContent{
+			fileFlagName:    "receive.relabel-config-file",
+			contentFlagName: "receive.relabel-config",
+			path:            relabelConfigFile,
+			content:         relabelConfig,
+		}).Content()
+		if err != nil {
+			return err
+		}
+		relabelConfigs, err := receive.ParseRelabelConfig(relabelContentYaml)
+		if err != nil {
+			return errors.Wrap(err, "parse relabel configuration")
 		}
 
 		return runReceive(
@@ -98,15 +179,26 @@ func registerReceive(m map[string]setupFunc, app *kingpin.Application, name stri
 			*clientCA,
 			*httpMetricsBindAddr,
 			*remoteWriteAddress,
+			*rwClientCert,
+			*rwClientKey,
+			*rwClientCA,
+			*rwClientServerName,
 			*dataDir,
 			objStoreConfig,
 			lset,
 			*retention,
-			cw,
+			cs,
+			time.Duration(*hashringsDebounce),
 			*local,
 			*tenantHeader,
 			*replicaHeader,
 			*replicationFactor,
+			relabelConfigs,
+			*tenantLabelName,
+			int64(*maxBodySize),
+			*forwardQueueDir,
+			int64(*forwardQueueMaxSize),
+			time.Duration(*forwardQueueReplayInterval),
 		)
 	}
 }
@@ -122,15 +214,26 @@ func runReceive(
 	clientCA string,
 	httpMetricsBindAddr string,
 	remoteWriteAddress string,
+	rwClientCert string,
+	rwClientKey string,
+	rwClientCA string,
+	rwClientServerName string,
 	dataDir string,
 	objStoreConfig *pathOrContent,
 	lset labels.Labels,
 	retention model.Duration,
-	cw *receive.ConfigWatcher,
+	cs receive.ConfigSource,
+	hashringsDebounce time.Duration,
 	endpoint string,
 	tenantHeader string,
 	replicaHeader string,
 	replicationFactor uint64,
+	relabelConfigs []receive.TenantRelabelConfig,
+	tenantLabelName string,
+	maxBodySize int64,
+	forwardQueueDir string,
+	forwardQueueMaxSize int64,
+	forwardQueueReplayInterval time.Duration,
 ) error {
 	logger = log.With(logger, "component", "receive")
 	level.Warn(logger).Log("msg", "setting up receive; the Thanos receive component is EXPERIMENTAL, it may break significantly without notice")
@@ -142,6 +245,20 @@ func runReceive(
 		MaxBlockDuration:  model.Duration(time.Hour * 2),
 	}
 
+	// Receive nodes forward write requests to each other over TLS if TLS is enabled for their gRPC servers.
+	dialOpts, err := storeClientGRPCOpts(logger, reg, tracer, cert != "", rwClientCert, rwClientKey, rwClientCA, rwClientServerName)
+	if err != nil {
+		return errors.Wrap(err, "setup gRPC client options")
+	}
+
+	var forwardQueue *receive.ForwardQueue
+	if forwardQueueDir != "" {
+		forwardQueue, err = receive.NewForwardQueue(log.With(logger, "component", "forward-queue"), reg, forwardQueueDir, forwardQueueMaxSize)
+		if err != nil {
+			return errors.Wrap(err, "create forward queue")
+		}
+	}
+
 	localStorage := &tsdb.ReadyStorage{}
 	receiver := receive.NewWriter(log.With(logger, "component", "receive-writer"), localStorage)
 	webHandler := receive.NewHandler(log.With(logger, "component", "receive-handler"), &receive.Options{
@@ -153,6 +270,12 @@ func runReceive(
 		TenantHeader:      tenantHeader,
 		ReplicaHeader:     replicaHeader,
 		ReplicationFactor: replicationFactor,
+		DialOpts:          dialOpts,
+		ForwardQueue:      forwardQueue,
+
+		TenantRelabelConfigs: relabelConfigs,
+		TenantLabelName:      tenantLabelName,
+		MaxBodySize:          maxBodySize,
 	})
 
 	// Start all components while we wait for TSDB to open but only load
@@ -197,10 +320,10 @@ func runReceive(
 	level.Debug(logger).Log("msg", "setting up hashring")
 	{
 		updates := make(chan receive.Hashring)
-		if cw != nil {
+		if cs != nil {
 			ctx, cancel := context.WithCancel(context.Background())
 			g.Add(func() error {
-				receive.HashringFromConfig(ctx, updates, cw)
+				receive.HashringFromConfig(ctx, updates, cs, hashringsDebounce)
 				return nil
 			}, func(error) {
 				cancel()
@@ -273,8 +396,9 @@ func runReceive(
 			}
 			s = grpc.NewServer(opts...)
 			storepb.RegisterStoreServer(s, tsdbStore)
+			storepb.RegisterWriteableStoreServer(s, webHandler)
 
-			level.Info(logger).Log("msg", "listening for StoreAPI gRPC", "address", grpcBindAddr)
+			level.Info(logger).Log("msg", "listening for StoreAPI and WriteableStoreAPI gRPC", "address", grpcBindAddr)
 			return errors.Wrap(s.Serve(l), "serve gRPC")
 		}, func(error) {
 			if s != nil {
@@ -339,6 +463,19 @@ func runReceive(
 		})
 	}
 
+	if forwardQueue != nil {
+		// Periodically deliver write requests queued for peers that were unreachable.
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return runutil.Repeat(forwardQueueReplayInterval, ctx.Done(), func() error {
+				webHandler.ReplayForwardQueue(ctx)
+				return nil
+			})
+		}, func(error) {
+			cancel()
+		})
+	}
+
 	level.Info(logger).Log("msg", "starting receiver")
 
 	return nil
@@ -11,6 +11,7 @@ import (
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/compact"
 	"github.com/thanos-io/thanos/pkg/objstore/client"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store"
@@ -32,6 +33,9 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 	indexCacheSize := cmd.Flag("index-cache-size", "Maximum size of items held in the index cache.").
 		Default("250MB").Bytes()
 
+	chunkCacheSize := cmd.Flag("chunk-cache-size", "Maximum size of chunk segment ranges held in the chunk cache. 0 disables the cache.").
+		Default("0").Bytes()
+
 	chunkPoolSize := cmd.Flag("chunk-pool-size", "Maximum size of concurrently allocatable bytes for chunks.").
 		Default("2GB").Bytes()
 
@@ -39,8 +43,24 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 		"Maximum amount of samples returned via a single Series call. 0 means no limit. NOTE: for efficiency we take 120 as the number of samples in chunk (it cannot be bigger than that), so the actual number of samples might be lower, even though the maximum could be hit.").
 		Default("0").Uint()
 
+	maxSeriesCount := cmd.Flag("store.grpc.touched-series-limit",
+		"Maximum amount of series touched via a single Series call. 0 means no limit. It is checked with the number of series matching the request in each block, before their data is fetched.").
+		Default("0").Uint()
+
+	maxChunkBytes := cmd.Flag("store.grpc.chunk-bytes-limit",
+		"Maximum amount of chunk bytes fetched from the bucket via a single Series call. 0 means no limit. It is checked with the size of the ranges to fetch, before fetching them.").
+		Default("0").Bytes()
+
 	maxConcurrent := cmd.Flag("store.grpc.series-max-concurrency", "Maximum number of concurrent Series calls.").Default("20").Int()
 
+	maxConcurrentPerTenant := cmd.Flag("store.grpc.series-max-concurrency-per-tenant", "Maximum number of concurrent Series calls of a single tenant. 0 means no limit other than --store.grpc.series-max-concurrency. "+
+		"The tenant is sent by queriers as gRPC metadata. Series calls waiting for their turn are served in round-robin order across tenants.").
+		Default("0").Int()
+
+	seriesBatchSize := cmd.Flag("store.grpc.series-batch-size", "Number of series of a block loaded with their chunks at once while streaming a Series call. "+
+		"Lower values bound the memory used by large queries, at the cost of more requests to the bucket.").
+		Default("10000").Int()
+
 	objStoreConfig := regCommonObjStoreFlags(cmd, "", true)
 
 	syncInterval := cmd.Flag("sync-block-duration", "Repeat interval for syncing the blocks between local and remote view.").
@@ -49,6 +69,29 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 	blockSyncConcurrency := cmd.Flag("block-sync-concurrency", "Number of goroutines to use when syncing blocks from object storage.").
 		Default("20").Int()
 
+	verifyIndex := cmd.Flag("store.verify-index", "Verify the index of each block against the size and hash recorded in its meta.json before loading the block. "+
+		"This reads the whole index from the bucket once more for every loaded block. Blocks that fail the verification are not served.").
+		Default("false").Bool()
+
+	lazyIndexHeader := cmd.Flag("store.index-header-lazy-loading", "Load the index-header of a block on its first query instead of when the block is synced. "+
+		"Together with --store.index-header-idle-timeout this bounds the memory used for rarely queried blocks.").
+		Default("false").Bool()
+
+	indexHeaderIdleTimeout := cmd.Flag("store.index-header-idle-timeout", "Release lazy loaded index-headers which were not queried for this long. 0 disables the release. Only used with --store.index-header-lazy-loading.").
+		Default("20m").Duration()
+
+	resolutions := cmd.Flag("store.resolution", "Resolution of the blocks to serve, either raw or a duration, e.g. 5m. Blocks of all resolutions are served if not given. "+
+		"The resolutions of the served blocks are advertised to queriers, which skip the store for queries with a lower max_source_resolution. Repeated flag.").
+		PlaceHolder("<resolution>").Strings()
+
+	minCompactionLevel := cmd.Flag("store.min-compaction-level", "Minimum compaction level of the blocks to serve. Allows skipping blocks that are soon replaced by the compactor, "+
+		"when another store serves them.").
+		Default("1").Int()
+
+	consistencyDelay := modelDuration(cmd.Flag("consistency-delay", "Minimum age of blocks not uploaded by a sidecar or receiver, e.g. compacted blocks, before they are loaded. "+
+		"The age is taken from the ULID of the block.").
+		Default("0s"))
+
 	m[name] = func(g *run.Group, logger log.Logger, reg *prometheus.Registry, tracer opentracing.Tracer, debugLogging bool) error {
 		return runStore(g,
 			logger,
@@ -62,13 +105,24 @@ func registerStore(m map[string]setupFunc, app *kingpin.Application, name string
 			*clientCA,
 			*httpBindAddr,
 			uint64(*indexCacheSize),
+			uint64(*chunkCacheSize),
 			uint64(*chunkPoolSize),
 			uint64(*maxSampleCount),
+			uint64(*maxSeriesCount),
+			uint64(*maxChunkBytes),
 			int(*maxConcurrent),
+			*maxConcurrentPerTenant,
+			*seriesBatchSize,
 			name,
 			debugLogging,
 			*syncInterval,
 			*blockSyncConcurrency,
+			*verifyIndex,
+			*lazyIndexHeader,
+			*indexHeaderIdleTimeout,
+			*resolutions,
+			*minCompactionLevel,
+			time.Duration(*consistencyDelay),
 		)
 	}
 }
@@ -87,13 +141,24 @@ func runStore(
 	clientCA string,
 	httpBindAddr string,
 	indexCacheSizeBytes uint64,
+	chunkCacheSizeBytes uint64,
 	chunkPoolSizeBytes uint64,
 	maxSampleCount uint64,
+	maxSeriesCount uint64,
+	maxChunkBytes uint64,
 	maxConcurrent int,
+	maxConcurrentPerTenant int,
+	seriesBatchSize int,
 	component string,
 	verbose bool,
 	syncInterval time.Duration,
 	blockSyncConcurrency int,
+	verifyIndex bool,
+	lazyIndexHeader bool,
+	indexHeaderIdleTimeout time.Duration,
+	resolutions []string,
+	minCompactionLevel int,
+	consistencyDelay time.Duration,
 ) error {
 	{
 		confContentYaml, err := objStoreConfig.Content()
@@ -124,18 +189,46 @@ func runStore(
 			return errors.Wrap(err, "create index cache")
 		}
 
-		bs, err := store.NewBucketStore(
-			logger,
-			reg,
-			bkt,
-			dataDir,
-			indexCache,
-			chunkPoolSizeBytes,
-			maxSampleCount,
-			maxConcurrent,
-			verbose,
-			blockSyncConcurrency,
-		)
+		var resolutionsMillis []int64
+		for _, r := range resolutions {
+			res, err := compact.ParseResolutionLevel(r)
+			if err != nil {
+				return errors.Wrapf(err, "parse resolution %q", r)
+			}
+			resolutionsMillis = append(resolutionsMillis, int64(res))
+		}
+
+		bsOpts := &store.BucketStoreOptions{
+			Dir:                    dataDir,
+			IndexCache:             indexCache,
+			MaxChunkPoolBytes:      chunkPoolSizeBytes,
+			MaxSampleCount:         maxSampleCount,
+			MaxSeriesCount:         maxSeriesCount,
+			MaxChunkBytes:          maxChunkBytes,
+			MaxConcurrent:          maxConcurrent,
+			MaxConcurrentPerTenant: maxConcurrentPerTenant,
+			SeriesBatchSize:        seriesBatchSize,
+			DebugLogging:           verbose,
+			BlockSyncConcurrency:   blockSyncConcurrency,
+			VerifyIndex:            verifyIndex,
+			LazyIndexHeader:        lazyIndexHeader,
+			IndexHeaderIdleTimeout: indexHeaderIdleTimeout,
+			Filter:                 store.NewResolutionLevelFilter(resolutionsMillis, minCompactionLevel),
+			ConsistencyDelay:       consistencyDelay,
+		}
+		// Chunks are not looked up and stored in a disabled chunk cache.
+		if chunkCacheSizeBytes > 0 {
+			chunksCache, err := storecache.NewChunksCache(logger, reg, storecache.Opts{
+				MaxSizeBytes:     chunkCacheSizeBytes,
+				MaxItemSizeBytes: chunkCacheSizeBytes / 2,
+			})
+			if err != nil {
+				return errors.Wrap(err, "create chunk cache")
+			}
+			bsOpts.ChunksCache = chunksCache
+		}
+
+		bs, err := store.NewBucketStore(logger, reg, bkt, bsOpts)
 		if err != nil {
 			return errors.Wrap(err, "create object storage store")
 		}
@@ -3,12 +3,14 @@
 package block
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 
@@ -45,13 +47,21 @@ func Download(ctx context.Context, logger log.Logger, bucket objstore.Bucket, id
 	_, err := os.Stat(chunksDir)
 	if os.IsNotExist(err) {
 		// This can happen if block is empty. We cannot easily upload empty directory, so create one here.
-		return os.Mkdir(chunksDir, os.ModePerm)
+		if err := os.Mkdir(chunksDir, os.ModePerm); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return errors.Wrapf(err, "stat %s", chunksDir)
 	}
 
+	// Verify the downloaded files against the sizes and hashes recorded on upload, if any.
+	meta, err := metadata.Read(dst)
 	if err != nil {
-		return errors.Wrapf(err, "stat %s", chunksDir)
+		return errors.Wrap(err, "read meta")
+	}
+	if err := VerifyFiles(logger, dst, meta.Thanos.Files); err != nil {
+		return errors.Wrapf(err, "verify block %s", id)
 	}
-
 	return nil
 }
 
@@ -84,6 +94,16 @@ func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir st
 		return errors.Errorf("empty external labels are not allowed for Thanos block.")
 	}
 
+	// Record the file sizes and hashes, so that the compactor can estimate the size of compacted blocks
+	// and the files can be verified after download.
+	meta.Thanos.Files, err = GatherFileStats(bdir, metadata.SHA256Func)
+	if err != nil {
+		return errors.Wrap(err, "gather file stats")
+	}
+	if err := metadata.Write(logger, bdir, meta); err != nil {
+		return errors.Wrap(err, "write meta file with file stats")
+	}
+
 	if err := objstore.UploadFile(ctx, logger, bkt, path.Join(bdir, MetaFilename), path.Join(DebugMetas, fmt.Sprintf("%s.json", id))); err != nil {
 		return errors.Wrap(err, "upload meta file to debug dir")
 	}
@@ -111,6 +131,52 @@ func Upload(ctx context.Context, logger log.Logger, bkt objstore.Bucket, bdir st
 	return nil
 }
 
+// GatherFileStats returns the index and chunk files of the block in the given directory with their sizes
+// and their hashes using the given hash function.
+func GatherFileStats(bdir string, hf metadata.HashFunc) (res []metadata.File, err error) {
+	chunks, err := ioutil.ReadDir(filepath.Join(bdir, ChunksDirname))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read dir %s", filepath.Join(bdir, ChunksDirname))
+	}
+	relPaths := make([]string, 0, len(chunks)+1)
+	for _, f := range chunks {
+		relPaths = append(relPaths, path.Join(ChunksDirname, f.Name()))
+	}
+	relPaths = append(relPaths, IndexFilename)
+
+	for _, p := range relPaths {
+		f, err := fileStats(filepath.Join(bdir, filepath.FromSlash(p)), hf)
+		if err != nil {
+			return nil, err
+		}
+		f.RelPath = p
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+func fileStats(fn string, hf metadata.HashFunc) (metadata.File, error) {
+	if hf == metadata.NoneFunc {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return metadata.File{}, errors.Wrapf(err, "stat %s", fn)
+		}
+		return metadata.File{SizeBytes: fi.Size()}, nil
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		return metadata.File{}, errors.Wrapf(err, "open %s", fn)
+	}
+	defer func() { _ = f.Close() }()
+
+	n, h, err := CalculateHash(f, hf)
+	if err != nil {
+		return metadata.File{}, errors.Wrapf(err, "hash %s", fn)
+	}
+	return metadata.File{SizeBytes: n, Hash: h}, nil
+}
+
 func cleanUp(bkt objstore.Bucket, id ulid.ULID, err error) error {
 	// Cleanup the dir with an uncancelable context.
 	cleanErr := Delete(context.Background(), bkt, id)
@@ -149,6 +215,107 @@ func DownloadMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, i
 	return m, nil
 }
 
+// RewriteMeta replaces the meta.json of the block in the bucket with the given meta, which must have the labels version
+// following the one of the current meta.json. The current meta.json is kept as backup in the block directory first,
+// so that the rewrite can be undone.
+func RewriteMeta(ctx context.Context, logger log.Logger, bkt objstore.Bucket, m *metadata.Meta) error {
+	metaPath := path.Join(m.ULID.String(), MetaFilename)
+
+	rc, err := bkt.Get(ctx, metaPath)
+	if err != nil {
+		return errors.Wrapf(err, "meta.json bkt get for %s", m.ULID)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "download meta bucket client")
+
+	obj, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return errors.Wrapf(err, "read meta.json for block %s", m.ULID)
+	}
+	var cur metadata.Meta
+	if err := json.Unmarshal(obj, &cur); err != nil {
+		return errors.Wrapf(err, "unmarshal meta.json for block %s", m.ULID)
+	}
+	if cur.LabelsVersion()+1 != m.LabelsVersion() {
+		return errors.Errorf("meta.json of block %s has labels version %d, cannot be rewritten to version %d", m.ULID, cur.LabelsVersion(), m.LabelsVersion())
+	}
+
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return errors.Wrapf(err, "marshal meta.json for block %s", m.ULID)
+	}
+	backupPath := path.Join(m.ULID.String(), metadata.BackupFilename(cur.LabelsVersion()))
+	if err := bkt.Upload(ctx, backupPath, bytes.NewReader(obj)); err != nil {
+		return errors.Wrapf(err, "upload meta.json backup for block %s", m.ULID)
+	}
+	if err := bkt.Upload(ctx, metaPath, bytes.NewReader(b)); err != nil {
+		return errors.Wrapf(err, "upload meta.json for block %s", m.ULID)
+	}
+	return nil
+}
+
+// MarkForNoCompact uploads a no-compact mark for the block with the given ID, which excludes the block from
+// any further compaction. It does nothing if the block is already marked.
+func MarkForNoCompact(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID, reason metadata.NoCompactReason, details string) error {
+	ok, err := bkt.Exists(ctx, path.Join(id.String(), MetaFilename))
+	if err != nil {
+		return errors.Wrapf(err, "check meta.json exists for block %s", id)
+	}
+	if !ok {
+		return errors.Errorf("block %s not found", id)
+	}
+
+	markPath := path.Join(id.String(), metadata.NoCompactMarkFilename)
+	ok, err = bkt.Exists(ctx, markPath)
+	if err != nil {
+		return errors.Wrapf(err, "check no-compact mark exists for block %s", id)
+	}
+	if ok {
+		return nil
+	}
+
+	b, err := json.Marshal(metadata.NoCompactMark{
+		ID:            id,
+		Version:       metadata.NoCompactMarkVersion1,
+		NoCompactTime: time.Now().Unix(),
+		Reason:        reason,
+		Details:       details,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal no-compact mark")
+	}
+	if err := bkt.Upload(ctx, markPath, bytes.NewReader(b)); err != nil {
+		return errors.Wrapf(err, "upload no-compact mark for block %s", id)
+	}
+	return nil
+}
+
+// ReadNoCompactMark downloads the no-compact mark of the block with the given ID.
+// It returns nil if the block is not marked.
+func ReadNoCompactMark(ctx context.Context, logger log.Logger, bkt objstore.Bucket, id ulid.ULID) (*metadata.NoCompactMark, error) {
+	rc, err := bkt.Get(ctx, path.Join(id.String(), metadata.NoCompactMarkFilename))
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "no-compact mark bkt get for %s", id)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "download no-compact mark bucket client")
+
+	obj, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read no-compact mark for block %s", id)
+	}
+
+	var m metadata.NoCompactMark
+	if err := json.Unmarshal(obj, &m); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal no-compact mark for block %s", id)
+	}
+	if m.Version != metadata.NoCompactMarkVersion1 {
+		return nil, errors.Errorf("unexpected no-compact mark version %d for block %s", m.Version, id)
+	}
+	return &m, nil
+}
+
 func IsBlockDir(path string) (id ulid.ULID, ok bool) {
 	id, err := ulid.Parse(filepath.Base(path))
 	return id, err == nil
@@ -1,9 +1,20 @@
 package block
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/oklog/ulid"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 )
 
 // NOTE(bplotka): For block packages we cannot use testutil, because they import block package. Consider moving simple
@@ -56,3 +67,175 @@ func TestIsBlockDir(t *testing.T) {
 		})
 	}
 }
+
+func TestMarkForNoCompact(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+	id := ulid.MustNew(1, nil)
+
+	if err := MarkForNoCompact(ctx, nil, bkt, id, metadata.ManualNoCompactReason, ""); err == nil {
+		t.Fatalf("expected error for missing block")
+	}
+	if err := bkt.Upload(ctx, path.Join(id.String(), MetaFilename), strings.NewReader("{}")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m, err := ReadNoCompactMark(ctx, nil, bkt, id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m != nil {
+		t.Fatalf("expected no mark, got %v", m)
+	}
+
+	if err := MarkForNoCompact(ctx, nil, bkt, id, metadata.IndexCriticalNoCompactReason, "broken index"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Marking again keeps the original mark.
+	if err := MarkForNoCompact(ctx, nil, bkt, id, metadata.ManualNoCompactReason, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m, err = ReadNoCompactMark(ctx, nil, bkt, id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m == nil || m.ID != id || m.Reason != metadata.IndexCriticalNoCompactReason || m.Details != "broken index" {
+		t.Errorf("unexpected mark %v", m)
+	}
+}
+
+func TestRewriteMeta(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+
+	var m metadata.Meta
+	m.Version = metadata.MetaVersion1
+	m.ULID = ulid.MustNew(1, nil)
+	m.Thanos.Labels = map[string]string{"cluster": "eu1", "replica": "a"}
+	b, err := json.Marshal(&m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bkt.Upload(ctx, path.Join(m.ULID.String(), MetaFilename), bytes.NewReader(b)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfgs, err := metadata.ParseRelabelConfig([]byte(`
+- source_labels: [cluster]
+  regex: (.+)
+  target_label: cluster_name
+- regex: cluster
+  action: labeldrop
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	newMeta, ok := metadata.Relabel(&m, cfgs)
+	if !ok {
+		t.Fatalf("expected labels to change")
+	}
+	if exp := map[string]string{"cluster_name": "eu1", "replica": "a"}; !reflect.DeepEqual(exp, newMeta.Thanos.Labels) {
+		t.Fatalf("expected labels %v, got %v", exp, newMeta.Thanos.Labels)
+	}
+	if newMeta.LabelsVersion() != 1 || !reflect.DeepEqual(m.Thanos.Labels, newMeta.Thanos.LabelRewrites[0].Labels) {
+		t.Fatalf("unexpected label rewrites %v", newMeta.Thanos.LabelRewrites)
+	}
+	// The relabel configuration is idempotent, so labels are only rewritten once.
+	if _, ok := metadata.Relabel(newMeta, cfgs); ok {
+		t.Fatalf("expected relabeled labels not to change again")
+	}
+
+	if err := RewriteMeta(ctx, nil, bkt, newMeta); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The rewrite cannot be applied twice to the same version.
+	if err := RewriteMeta(ctx, nil, bkt, newMeta); err == nil {
+		t.Fatalf("expected error for outdated labels version")
+	}
+
+	got, err := DownloadMeta(ctx, nil, bkt, m.ULID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(newMeta.Thanos, got.Thanos) {
+		t.Errorf("expected meta %v, got %v", newMeta.Thanos, got.Thanos)
+	}
+	if backup := bkt.Objects()[path.Join(m.ULID.String(), metadata.BackupFilename(0))]; !bytes.Equal(b, backup) {
+		t.Errorf("expected backup %s, got %s", b, backup)
+	}
+}
+
+func TestUploadDownload_FileIntegrity(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+
+	dir, err := ioutil.TempDir("", "block-integrity")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	// A fake block is enough, as neither upload nor download parse the index or chunks.
+	var m metadata.Meta
+	m.Version = metadata.MetaVersion1
+	m.ULID = ulid.MustNew(1, nil)
+	m.Thanos.Labels = map[string]string{"cluster": "eu1"}
+
+	bdir := filepath.Join(dir, m.ULID.String())
+	if err := os.MkdirAll(filepath.Join(bdir, ChunksDirname), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bdir, ChunksDirname, "000001"), []byte("chunks"), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(bdir, IndexFilename), []byte("index"), os.ModePerm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := metadata.Write(nil, bdir, &m); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := Upload(ctx, nil, bkt, bdir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := DownloadMeta(ctx, nil, bkt, m.ULID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	exp := []metadata.File{
+		{RelPath: "chunks/000001", SizeBytes: 6, Hash: &metadata.ObjectHash{Func: metadata.SHA256Func, Value: "903998a13c26111438bcdf5ccf829e38beea39f5c240f35fb2f398d206dedd10"}},
+		{RelPath: "index", SizeBytes: 5, Hash: &metadata.ObjectHash{Func: metadata.SHA256Func, Value: "1bc04b5291c26a46d918139138b992d2de976d6851d0893b0476b85bfbdfc6e6"}},
+	}
+	if !reflect.DeepEqual(exp, got.Thanos.Files) {
+		t.Fatalf("expected files %v, got %v", exp, got.Thanos.Files)
+	}
+	for _, f := range got.Thanos.Files {
+		if err := VerifyObject(ctx, nil, bkt, m.ULID, f); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := Download(ctx, nil, bkt, m.ULID, filepath.Join(dir, "download")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Corrupt the content of the chunk file without changing its size.
+	if err := bkt.Upload(ctx, path.Join(m.ULID.String(), ChunksDirname, "000001"), strings.NewReader("chunkz")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := VerifyObject(ctx, nil, bkt, m.ULID, got.Thanos.Files[0]); !IsIntegrityErr(err) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+	if err := Download(ctx, nil, bkt, m.ULID, filepath.Join(dir, "download-corrupted")); !IsIntegrityErr(err) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+
+	// Truncate the index.
+	if err := bkt.Upload(ctx, path.Join(m.ULID.String(), IndexFilename), strings.NewReader("ind")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := VerifyObject(ctx, nil, bkt, m.ULID, got.Thanos.Files[1]); !IsIntegrityErr(err) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package block
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// ErrIntegrity is the cause of errors returned if a block file does not match its size or hash recorded in meta.json.
+var ErrIntegrity = errors.New("block file integrity check failed")
+
+// IsIntegrityErr returns true if the error was caused by a block file not matching its recorded size or hash.
+func IsIntegrityErr(err error) bool {
+	return errors.Cause(err) == ErrIntegrity
+}
+
+// CalculateHash reads r until EOF and returns the number of read bytes and their hash using the given hash function.
+// The hash is nil for NoneFunc.
+func CalculateHash(r io.Reader, hf metadata.HashFunc) (int64, *metadata.ObjectHash, error) {
+	switch hf {
+	case metadata.NoneFunc:
+		n, err := io.Copy(ioutil.Discard, r)
+		return n, nil, err
+	case metadata.SHA256Func:
+		h := sha256.New()
+		n, err := io.Copy(h, r)
+		if err != nil {
+			return n, nil, err
+		}
+		return n, &metadata.ObjectHash{Func: hf, Value: hex.EncodeToString(h.Sum(nil))}, nil
+	default:
+		return 0, nil, errors.Errorf("unsupported hash function %q", hf)
+	}
+}
+
+// verify reads r and checks its size and, if recorded, its hash against the given file.
+func verify(r io.Reader, f metadata.File) error {
+	hf := metadata.NoneFunc
+	if f.Hash != nil {
+		hf = f.Hash.Func
+	}
+	n, h, err := CalculateHash(r, hf)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", f.RelPath)
+	}
+	if n != f.SizeBytes {
+		return errors.Wrapf(ErrIntegrity, "%s: expected size %d, got %d", f.RelPath, f.SizeBytes, n)
+	}
+	if h != nil && h.Value != f.Hash.Value {
+		return errors.Wrapf(ErrIntegrity, "%s: expected %s hash %s, got %s", f.RelPath, hf, f.Hash.Value, h.Value)
+	}
+	return nil
+}
+
+// VerifyFiles checks the given files of the block in bdir against their sizes and hashes recorded in meta.json.
+func VerifyFiles(logger log.Logger, bdir string, files []metadata.File) error {
+	for _, f := range files {
+		r, err := os.Open(filepath.Join(bdir, filepath.FromSlash(f.RelPath)))
+		if err != nil {
+			return errors.Wrapf(err, "open %s", f.RelPath)
+		}
+		err = verify(r, f)
+		runutil.CloseWithLogOnErr(logger, r, "verified block file")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyObject checks the given file of the block in the bucket against its size and hash recorded in meta.json
+// without downloading it to disk.
+func VerifyObject(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, id ulid.ULID, f metadata.File) error {
+	rc, err := bkt.Get(ctx, path.Join(id.String(), f.RelPath))
+	if err != nil {
+		return errors.Wrapf(err, "get %s", f.RelPath)
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "verified block object")
+
+	return verify(rc, f)
+}
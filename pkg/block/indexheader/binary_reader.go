@@ -0,0 +1,596 @@
+package indexheader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/encoding"
+	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/index"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// BinaryFilename is the name of the binary index-header file in the local block directory.
+	BinaryFilename = "index-header"
+
+	// BinaryFormatV1 is the first version of the binary index-header format.
+	BinaryFormatV1 = 1
+
+	// MagicIndexHeader are the 4 bytes at the head of an index-header file.
+	MagicIndexHeader = 0xBAAAD792
+
+	// headerLen is the length of the index-header file header: magic number, format version, index version
+	// and the end of the postings section in the index.
+	headerLen = 4 + 1 + 1 + 8
+
+	// binaryTOCLen is the length of the index-header table of contents: offsets of the symbols in the index-header
+	// and in the index, offset of the postings offset table in the index-header and a CRC32 checksum.
+	binaryTOCLen = 3*8 + 4
+
+	// indexTOCLen is the length of the table of contents at the end of a TSDB index.
+	indexTOCLen = 6*8 + 4
+
+	// symbolFactor is the sampling rate of symbol offsets kept in memory.
+	symbolFactor = 32
+	// postingOffsetsFactor is the sampling rate of postings offset table entries kept in memory.
+	postingOffsetsFactor = 32
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The binary index-header format is:
+//
+// ┌────────────────────────────┬──────────────────┬────────────────────┬────────────────────────────────┐
+// │ magic(0xBAAAD792) <4b>     │ version(1) <1b>  │ index version <1b> │ index postings end <8b>        │
+// ├────────────────────────────┴──────────────────┴────────────────────┴────────────────────────────────┤
+// │                          symbol table, copied verbatim from the index                               │
+// ├─────────────────────────────────────────────────────────────────────────────────────────────────────┤
+// │                      postings offset table, copied verbatim from the index                          │
+// ├─────────────────────────────────────────────────────────────────────────────────────────────────────┤
+// │ TOC: symbols offset <8b> │ index symbols offset <8b> │ postings offset table offset <8b> │ CRC32 <4b>   │
+// └─────────────────────────────────────────────────────────────────────────────────────────────────────┘
+//
+// Offsets in the postings offset table and symbol references of version 1 indexes point into the index,
+// so the index offsets needed to translate them are kept in the header.
+
+// rangeReader reads byte ranges of an index.
+type rangeReader interface {
+	read(ctx context.Context, off, length int64) (io.ReadCloser, error)
+}
+
+type bucketRangeReader struct {
+	bkt  objstore.BucketReader
+	name string
+}
+
+func (r bucketRangeReader) read(ctx context.Context, off, length int64) (io.ReadCloser, error) {
+	return r.bkt.GetRange(ctx, r.name, off, length)
+}
+
+type byteSliceRangeReader []byte
+
+func (r byteSliceRangeReader) read(_ context.Context, off, length int64) (io.ReadCloser, error) {
+	if off < 0 || off+length > int64(len(r)) {
+		return nil, errors.Errorf("range %d+%d out of bounds of %d bytes", off, length, len(r))
+	}
+	return ioutil.NopCloser(bytes.NewReader(r[off : off+length])), nil
+}
+
+func readRange(ctx context.Context, logger log.Logger, r rangeReader, off, length int64) ([]byte, error) {
+	rc, err := r.read(ctx, off, length)
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithLogOnErr(logger, rc, "index range reader")
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) != length {
+		return nil, errors.Wrapf(encoding.ErrInvalidSize, "read %d bytes at %d, expected %d", len(b), off, length)
+	}
+	return b, nil
+}
+
+// WriteBinary builds the binary index-header of the given block and writes it to fn. If the size of the index is known,
+// only the needed sections of the index are read from the bucket with ranged reads. Otherwise the index is downloaded.
+func WriteBinary(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, id ulid.ULID, indexSize int64, fn string) error {
+	if indexSize > 0 {
+		return writeBinary(ctx, logger, bucketRangeReader{bkt: bkt, name: path.Join(id.String(), block.IndexFilename)}, indexSize, fn)
+	}
+
+	indexfn := fn + ".index.tmp"
+	if err := objstore.DownloadFile(ctx, logger, bkt, path.Join(id.String(), block.IndexFilename), indexfn); err != nil {
+		return errors.Wrap(err, "download index file")
+	}
+	defer func() {
+		if err := os.Remove(indexfn); err != nil {
+			level.Error(logger).Log("msg", "failed to remove temp index file", "path", indexfn, "err", err)
+		}
+	}()
+
+	f, err := fileutil.OpenMmapFile(indexfn)
+	if err != nil {
+		return errors.Wrapf(err, "open mmap index file %s", indexfn)
+	}
+	defer runutil.CloseWithLogOnErr(logger, f, "index mmap file")
+
+	return writeBinary(ctx, logger, byteSliceRangeReader(f.Bytes()), int64(len(f.Bytes())), fn)
+}
+
+func writeBinary(ctx context.Context, logger log.Logger, r rangeReader, indexSize int64, fn string) (err error) {
+	if indexSize < index.HeaderLen+indexTOCLen {
+		return errors.Wrapf(encoding.ErrInvalidSize, "index of %d bytes", indexSize)
+	}
+
+	h, err := readRange(ctx, logger, r, 0, index.HeaderLen)
+	if err != nil {
+		return errors.Wrap(err, "read index header")
+	}
+	if m := binary.BigEndian.Uint32(h[0:4]); m != index.MagicIndex {
+		return errors.Errorf("invalid index magic number %x", m)
+	}
+	indexVersion := int(h[4])
+	if indexVersion != index.FormatV1 && indexVersion != index.FormatV2 {
+		return errors.Errorf("unknown index version %d", indexVersion)
+	}
+
+	tocBytes, err := readRange(ctx, logger, r, indexSize-indexTOCLen, indexTOCLen)
+	if err != nil {
+		return errors.Wrap(err, "read index TOC")
+	}
+	toc, err := index.NewTOCFromByteSlice(realByteSlice(tocBytes))
+	if err != nil {
+		return errors.Wrap(err, "parse index TOC")
+	}
+
+	tmp := fn + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrap(err, "create index-header file")
+	}
+	defer func() {
+		if err != nil {
+			runutil.CloseWithLogOnErr(logger, f, "index-header file")
+			if rerr := os.Remove(tmp); rerr != nil {
+				level.Warn(logger).Log("msg", "failed to remove temp index-header file", "path", tmp, "err", rerr)
+			}
+		}
+	}()
+	w := bufio.NewWriter(f)
+
+	buf := encoding.Encbuf{}
+	buf.PutBE32(MagicIndexHeader)
+	buf.PutByte(BinaryFormatV1)
+	buf.PutByte(byte(indexVersion))
+	// The postings section ends where the label offset table starts.
+	buf.PutBE64(toc.LabelIndicesTable)
+	if _, err := w.Write(buf.Get()); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+	pos := int64(headerLen)
+
+	// copySection copies the section at the given index offset, which is prefixed with its length and followed by a CRC32.
+	copySection := func(off uint64) error {
+		l, err := readRange(ctx, logger, r, int64(off), 4)
+		if err != nil {
+			return err
+		}
+		length := 4 + int64(binary.BigEndian.Uint32(l)) + 4
+
+		rc, err := r.read(ctx, int64(off), length)
+		if err != nil {
+			return err
+		}
+		defer runutil.CloseWithLogOnErr(logger, rc, "index range reader")
+
+		n, err := io.Copy(w, rc)
+		if err != nil {
+			return err
+		}
+		if n != length {
+			return errors.Wrapf(encoding.ErrInvalidSize, "copied %d bytes at %d, expected %d", n, off, length)
+		}
+		pos += n
+		return nil
+	}
+
+	symbolsOff := pos
+	if err := copySection(toc.Symbols); err != nil {
+		return errors.Wrap(err, "copy symbols")
+	}
+	postingsOffsetTableOff := pos
+	if err := copySection(toc.PostingsTable); err != nil {
+		return errors.Wrap(err, "copy postings offset table")
+	}
+
+	buf.Reset()
+	buf.PutBE64(uint64(symbolsOff))
+	buf.PutBE64(toc.Symbols)
+	buf.PutBE64(uint64(postingsOffsetTableOff))
+	buf.PutBE32(crc32.Checksum(buf.Get(), castagnoliTable))
+	if _, err := w.Write(buf.Get()); err != nil {
+		return errors.Wrap(err, "write TOC")
+	}
+
+	if err := w.Flush(); err != nil {
+		return errors.Wrap(err, "flush index-header file")
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "sync index-header file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "close index-header file")
+	}
+	return errors.Wrap(os.Rename(tmp, fn), "rename index-header file")
+}
+
+type realByteSlice []byte
+
+func (b realByteSlice) Len() int {
+	return len(b)
+}
+
+func (b realByteSlice) Range(start, end int) []byte {
+	return b[start:end]
+}
+
+// postingOffset is a sampled entry of the postings offset table.
+type postingOffset struct {
+	value string
+	// tableOff is the offset of the entry in the index-header.
+	tableOff int
+}
+
+// postingValueOffsets holds the sampled postings offset table entries of a single label name.
+type postingValueOffsets struct {
+	// offsets are every postingOffsetsFactor-th entry of the label name plus its last entry.
+	offsets []postingOffset
+	// end is the offset in the index-header after the last entry of the label name.
+	end int
+}
+
+// BinaryReader is a Reader backed by a memory mapped binary index-header file. Only samples of the symbols
+// and of the postings offset table are held in memory, everything else is read from the file on lookup.
+type BinaryReader struct {
+	b realByteSlice
+	c io.Closer
+
+	indexVersion int
+	// indexLastPostingEnd is the end of the postings section in the index.
+	indexLastPostingEnd int64
+
+	// indexSymbolsOff and symbolsOff translate symbol references of version 1 indexes into index-header offsets.
+	indexSymbolsOff int
+	symbolsOff      int
+	symbolsEnd      int
+	// symbolOffsets are the index-header offsets of every symbolFactor-th symbol of version 2 indexes.
+	symbolOffsets []int
+	symbolsCount  int
+
+	postings  map[string]*postingValueOffsets
+	tableEnd  int
+	nameCache []string
+}
+
+// NewBinaryReader opens the binary index-header of the given block in dir. If it does not exist yet,
+// it is built from the index in the bucket first.
+func NewBinaryReader(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, dir string, id ulid.ULID, indexSize int64) (*BinaryReader, error) {
+	fn := filepath.Join(dir, BinaryFilename)
+	br, err := newFileBinaryReader(fn)
+	if err == nil {
+		return br, nil
+	}
+	if !os.IsNotExist(errors.Cause(err)) {
+		level.Warn(logger).Log("msg", "failed to read index-header from disk; recreating", "path", fn, "err", err)
+	}
+
+	if err := WriteBinary(ctx, logger, bkt, id, indexSize, fn); err != nil {
+		return nil, errors.Wrap(err, "write index-header")
+	}
+	return newFileBinaryReader(fn)
+}
+
+func newFileBinaryReader(fn string) (br *BinaryReader, err error) {
+	f, err := fileutil.OpenMmapFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+		}
+	}()
+
+	r := &BinaryReader{
+		b:        realByteSlice(f.Bytes()),
+		c:        f,
+		postings: map[string]*postingValueOffsets{},
+	}
+	if len(r.b) < headerLen+binaryTOCLen {
+		return nil, errors.Wrapf(encoding.ErrInvalidSize, "index-header of %d bytes", len(r.b))
+	}
+	if m := binary.BigEndian.Uint32(r.b[0:4]); m != MagicIndexHeader {
+		return nil, errors.Errorf("invalid index-header magic number %x", m)
+	}
+	if v := int(r.b[4]); v != BinaryFormatV1 {
+		return nil, errors.Errorf("unknown index-header version %d", v)
+	}
+	r.indexVersion = int(r.b[5])
+	if r.indexVersion != index.FormatV1 && r.indexVersion != index.FormatV2 {
+		return nil, errors.Errorf("unknown index version %d", r.indexVersion)
+	}
+	r.indexLastPostingEnd = int64(binary.BigEndian.Uint64(r.b[6:headerLen]))
+
+	toc := r.b[len(r.b)-binaryTOCLen:]
+	if exp := binary.BigEndian.Uint32(toc[binaryTOCLen-4:]); crc32.Checksum(toc[:binaryTOCLen-4], castagnoliTable) != exp {
+		return nil, errors.Wrap(encoding.ErrInvalidChecksum, "read index-header TOC")
+	}
+	r.symbolsOff = int(binary.BigEndian.Uint64(toc[0:8]))
+	r.indexSymbolsOff = int(binary.BigEndian.Uint64(toc[8:16]))
+	postingsOffsetTableOff := int(binary.BigEndian.Uint64(toc[16:24]))
+
+	if err := r.readSymbols(); err != nil {
+		return nil, errors.Wrap(err, "read symbols")
+	}
+	if err := r.readPostingsOffsetTable(postingsOffsetTableOff); err != nil {
+		return nil, errors.Wrap(err, "read postings offset table")
+	}
+	return r, nil
+}
+
+// readSymbols verifies the symbol table and samples the offsets of version 2 symbols.
+func (r *BinaryReader) readSymbols() error {
+	d := encoding.NewDecbufAt(r.b, r.symbolsOff, castagnoliTable)
+	if d.Err() != nil {
+		return d.Err()
+	}
+	// The contents start after the 4 bytes length.
+	base := r.symbolsOff + 4 + d.Len()
+	r.symbolsEnd = base
+
+	cnt := d.Be32int()
+	for i := 0; d.Err() == nil && i < cnt; i++ {
+		if r.indexVersion == index.FormatV2 && i%symbolFactor == 0 {
+			r.symbolOffsets = append(r.symbolOffsets, base-d.Len())
+		}
+		skipUvarintBytes(&d)
+	}
+	r.symbolsCount = cnt
+	return d.Err()
+}
+
+// readPostingsOffsetTable verifies the postings offset table and samples its entries for every label name.
+func (r *BinaryReader) readPostingsOffsetTable(off int) error {
+	d := encoding.NewDecbufAt(r.b, off, castagnoliTable)
+	if d.Err() != nil {
+		return d.Err()
+	}
+	base := off + 4 + d.Len()
+	r.tableEnd = base
+
+	var (
+		cnt          = d.Be32int()
+		lastName     []byte
+		lastValue    []byte
+		lastEntryOff int
+		lastOff      uint64
+		cur          *postingValueOffsets
+		i            int
+	)
+	// finish samples the last entry of the current label name, if not sampled already, so that lookups of values
+	// beyond the last one are answered without scanning.
+	finish := func(end int) {
+		if cur == nil {
+			return
+		}
+		if (i-1)%postingOffsetsFactor != 0 {
+			cur.offsets = append(cur.offsets, postingOffset{value: string(lastValue), tableOff: lastEntryOff})
+		}
+		cur.end = end
+	}
+
+	for ; d.Err() == nil && cnt > 0; cnt-- {
+		entryOff := base - d.Len()
+		if keys := d.Uvarint(); keys != 2 {
+			return errors.Errorf("unexpected key length for posting table %d", keys)
+		}
+		name := uvarintBytes(&d)
+		value := uvarintBytes(&d)
+		o := d.Uvarint64()
+		if d.Err() != nil {
+			break
+		}
+		if o < lastOff {
+			return errors.Errorf("postings offset table is not sorted by offset at %d", entryOff)
+		}
+		lastOff = o
+
+		if cur == nil || !bytes.Equal(name, lastName) {
+			finish(entryOff)
+			if _, ok := r.postings[string(name)]; ok {
+				return errors.Errorf("postings of label name %q are not contiguous", name)
+			}
+			cur = &postingValueOffsets{}
+			r.postings[string(name)] = cur
+			lastName, i = name, 0
+		} else if bytes.Compare(lastValue, value) >= 0 {
+			return errors.Errorf("postings of label name %q are not sorted by value", name)
+		}
+
+		if i%postingOffsetsFactor == 0 {
+			cur.offsets = append(cur.offsets, postingOffset{value: string(value), tableOff: entryOff})
+		}
+		lastValue, lastEntryOff = value, entryOff
+		i++
+	}
+	if d.Err() != nil {
+		return d.Err()
+	}
+	finish(base - d.Len())
+
+	for n := range r.postings {
+		if n == "" {
+			continue
+		}
+		r.nameCache = append(r.nameCache, n)
+	}
+	sort.Strings(r.nameCache)
+	return nil
+}
+
+// uvarintBytes returns the next uvarint prefixed bytes of the buffer without copying them.
+func uvarintBytes(d *encoding.Decbuf) []byte {
+	l := d.Uvarint64()
+	if d.Err() != nil {
+		return nil
+	}
+	if uint64(len(d.B)) < l {
+		d.E = encoding.ErrInvalidSize
+		return nil
+	}
+	b := d.B[:l]
+	d.B = d.B[l:]
+	return b
+}
+
+func skipUvarintBytes(d *encoding.Decbuf) {
+	_ = uvarintBytes(d)
+}
+
+// postingsEntry decodes the postings offset table entry at the given index-header offset and returns its value,
+// its offset in the index and the index-header offset of the next entry.
+func (r *BinaryReader) postingsEntry(off int) ([]byte, uint64, int, error) {
+	if off < 0 || off >= r.tableEnd {
+		return nil, 0, 0, errors.Errorf("postings offset table entry %d out of bounds", off)
+	}
+	d := encoding.Decbuf{B: r.b[off:r.tableEnd]}
+	d.Uvarint()
+	skipUvarintBytes(&d)
+	value := uvarintBytes(&d)
+	o := d.Uvarint64()
+	if d.Err() != nil {
+		return nil, 0, 0, errors.Wrapf(d.Err(), "decode postings offset table entry at %d", off)
+	}
+	return value, o, r.tableEnd - d.Len(), nil
+}
+
+// IndexVersion returns the version of the TSDB index.
+func (r *BinaryReader) IndexVersion() (int, error) {
+	return r.indexVersion, nil
+}
+
+// PostingsOffset returns the byte range of the postings list of the given label in the index.
+func (r *BinaryReader) PostingsOffset(name, value string) (index.Range, error) {
+	e, ok := r.postings[name]
+	if !ok {
+		return index.Range{}, NotFoundRangeErr
+	}
+
+	// Find the last sampled entry not greater than the value and scan from there.
+	i := sort.Search(len(e.offsets), func(i int) bool { return e.offsets[i].value > value })
+	if i == 0 {
+		return index.Range{}, NotFoundRangeErr
+	}
+
+	for off := e.offsets[i-1].tableOff; off < e.end; {
+		v, start, next, err := r.postingsEntry(off)
+		if err != nil {
+			return index.Range{}, err
+		}
+		switch c := bytes.Compare(v, []byte(value)); {
+		case c < 0:
+			off = next
+			continue
+		case c > 0:
+			return index.Range{}, NotFoundRangeErr
+		}
+
+		// The postings list ends right before the CRC32, followed by the next postings list or the label offset table.
+		end := r.indexLastPostingEnd
+		if next < r.tableEnd {
+			_, nextStart, _, err := r.postingsEntry(next)
+			if err != nil {
+				return index.Range{}, err
+			}
+			end = int64(nextStart)
+		}
+		return index.Range{Start: int64(start) + 4, End: end - crc32.Size}, nil
+	}
+	return index.Range{}, NotFoundRangeErr
+}
+
+// LookupSymbol returns the symbol referenced by the given offset or sequence number.
+func (r *BinaryReader) LookupSymbol(o uint32) (string, error) {
+	var off int
+	if r.indexVersion == index.FormatV1 {
+		// Version 1 references are offsets of the symbols in the index.
+		off = int(o) - r.indexSymbolsOff + r.symbolsOff
+		if int(o) < r.indexSymbolsOff || off >= r.symbolsEnd {
+			return "", errors.Errorf("indexheader: unknown symbol offset %d", o)
+		}
+	} else {
+		if int(o) >= r.symbolsCount {
+			return "", errors.Errorf("indexheader: unknown symbol reference %d", o)
+		}
+		off = r.symbolOffsets[int(o)/symbolFactor]
+	}
+
+	d := encoding.Decbuf{B: r.b[off:r.symbolsEnd]}
+	if r.indexVersion == index.FormatV2 {
+		for i := int(o) % symbolFactor; i > 0; i-- {
+			skipUvarintBytes(&d)
+		}
+	}
+	s := d.UvarintStr()
+	if d.Err() != nil {
+		return "", errors.Wrapf(d.Err(), "indexheader: read symbol %d", o)
+	}
+	return s, nil
+}
+
+// LabelValues returns all values of the given label name in sorted order.
+func (r *BinaryReader) LabelValues(name string) ([]string, error) {
+	e, ok := r.postings[name]
+	if !ok {
+		return nil, nil
+	}
+	res := make([]string, 0, len(e.offsets)*postingOffsetsFactor)
+	for off := e.offsets[0].tableOff; off < e.end; {
+		v, _, next, err := r.postingsEntry(off)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, string(v))
+		off = next
+	}
+	return res, nil
+}
+
+// LabelNames returns all label names in sorted order.
+func (r *BinaryReader) LabelNames() ([]string, error) {
+	res := make([]string, 0, len(r.nameCache))
+	return append(res, r.nameCache...), nil
+}
+
+// Close unmaps the index-header file.
+func (r *BinaryReader) Close() error {
+	return r.c.Close()
+}
@@ -0,0 +1,34 @@
+// Package indexheader implements readers of the small portion of a TSDB block index which is needed
+// to lookup symbols and postings, without loading the whole index into memory.
+package indexheader
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/index"
+)
+
+// NotFoundRangeErr is returned by PostingsOffset if the index has no postings for the given label.
+var NotFoundRangeErr = errors.New("range not found")
+
+// Reader reads the symbols and the postings offsets of a block index from its header.
+type Reader interface {
+	io.Closer
+
+	// IndexVersion returns the version of the TSDB index the header was built from.
+	IndexVersion() (int, error)
+
+	// PostingsOffset returns the byte range of the postings list of the given label in the index.
+	// NotFoundRangeErr is returned if the index has no postings for the label.
+	PostingsOffset(name string, value string) (index.Range, error)
+
+	// LookupSymbol returns the symbol referenced by the given offset or sequence number, depending on the index version.
+	LookupSymbol(o uint32) (string, error)
+
+	// LabelValues returns all values of the given label name in sorted order.
+	LabelValues(name string) ([]string, error)
+
+	// LabelNames returns all label names in sorted order.
+	LabelNames() ([]string, error)
+}
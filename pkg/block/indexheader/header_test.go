@@ -0,0 +1,195 @@
+package indexheader
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/tsdb/fileutil"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestReaders(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-indexheader")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := inmem.NewBucket()
+
+	// More values than the sampling factors to cover lookups between and after the samples.
+	var series []labels.Labels
+	for i := 0; i < 100; i++ {
+		series = append(series, labels.Labels{{Name: "a", Value: fmt.Sprintf("%03d", i)}})
+	}
+	for i := 0; i < 33; i++ {
+		series = append(series, labels.Labels{{Name: "b", Value: fmt.Sprintf("%d", i)}, {Name: "c", Value: "1"}})
+	}
+	id, err := testutil.CreateBlock(ctx, tmpDir, series, 10, 0, 1000, labels.Labels{{Name: "ext1", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(tmpDir, id.String())))
+
+	meta, err := metadata.Read(filepath.Join(tmpDir, id.String()))
+	testutil.Ok(t, err)
+	testutil.Assert(t, meta.IndexSize() > 0, "index size not recorded in meta.json")
+
+	for _, tcase := range []struct {
+		name      string
+		newReader func(dir string) (Reader, error)
+	}{
+		{
+			name: "binary with ranged reads",
+			newReader: func(dir string) (Reader, error) {
+				return NewBinaryReader(ctx, log.NewNopLogger(), bkt, dir, id, meta.IndexSize())
+			},
+		},
+		{
+			name: "binary with unknown index size",
+			newReader: func(dir string) (Reader, error) {
+				return NewBinaryReader(ctx, log.NewNopLogger(), bkt, dir, id, 0)
+			},
+		},
+		{
+			name: "json",
+			newReader: func(dir string) (Reader, error) {
+				return NewJSONReader(ctx, log.NewNopLogger(), bkt, dir, id)
+			},
+		},
+	} {
+		if ok := t.Run(tcase.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir(tmpDir, "reader")
+			testutil.Ok(t, err)
+
+			r, err := tcase.newReader(dir)
+			testutil.Ok(t, err)
+			compareIndexToHeader(t, filepath.Join(tmpDir, id.String(), block.IndexFilename), r)
+			testutil.Ok(t, r.Close())
+
+			// Second time the header is read from disk.
+			r, err = tcase.newReader(dir)
+			testutil.Ok(t, err)
+			compareIndexToHeader(t, filepath.Join(tmpDir, id.String(), block.IndexFilename), r)
+			testutil.Ok(t, r.Close())
+		}); !ok {
+			return
+		}
+	}
+}
+
+func TestBinaryReader_Corrupted(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-indexheader-corrupted")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := inmem.NewBucket()
+	id, err := testutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 10, 0, 1000, labels.Labels{{Name: "ext1", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(tmpDir, id.String())))
+
+	dir := filepath.Join(tmpDir, "reader")
+	testutil.Ok(t, os.MkdirAll(dir, os.ModePerm))
+	fn := filepath.Join(dir, BinaryFilename)
+
+	r, err := NewBinaryReader(ctx, log.NewNopLogger(), bkt, dir, id, 0)
+	testutil.Ok(t, err)
+	testutil.Ok(t, r.Close())
+
+	// Flip a byte in the symbols section to break its checksum.
+	b, err := ioutil.ReadFile(fn)
+	testutil.Ok(t, err)
+	b[headerLen+8] ^= 0xff
+	testutil.Ok(t, ioutil.WriteFile(fn, b, os.ModePerm))
+
+	_, err = newFileBinaryReader(fn)
+	testutil.NotOk(t, err)
+
+	// The corrupted header is recreated from the bucket.
+	r, err = NewBinaryReader(ctx, log.NewNopLogger(), bkt, dir, id, 0)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, r.Close()) }()
+
+	rng, err := r.PostingsOffset("a", "2")
+	testutil.Ok(t, err)
+	testutil.Assert(t, rng.End > rng.Start, "empty postings range %v", rng)
+}
+
+func compareIndexToHeader(t *testing.T, indexFn string, r Reader) {
+	f, err := fileutil.OpenMmapFile(indexFn)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, f.Close()) }()
+
+	ir, err := index.NewReader(realByteSlice(f.Bytes()))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, ir.Close()) }()
+
+	version, err := r.IndexVersion()
+	testutil.Ok(t, err)
+	testutil.Equals(t, ir.Version(), version)
+
+	toc, err := index.NewTOCFromByteSlice(realByteSlice(f.Bytes()))
+	testutil.Ok(t, err)
+	symbols, _, err := index.ReadSymbols(realByteSlice(f.Bytes()), ir.Version(), int(toc.Symbols))
+	testutil.Ok(t, err)
+	for i, s := range symbols {
+		v, err := r.LookupSymbol(uint32(i))
+		testutil.Ok(t, err)
+		testutil.Equals(t, s, v)
+	}
+	_, err = r.LookupSymbol(uint32(len(symbols)))
+	testutil.NotOk(t, err)
+
+	pranges, err := ir.PostingsRanges()
+	testutil.Ok(t, err)
+
+	lvals := map[string][]string{}
+	for l, rng := range pranges {
+		got, err := r.PostingsOffset(l.Name, l.Value)
+		testutil.Ok(t, err)
+		testutil.Equals(t, rng, got)
+
+		if l.Name != "" {
+			lvals[l.Name] = append(lvals[l.Name], l.Value)
+		}
+	}
+
+	var names []string
+	for n, vals := range lvals {
+		names = append(names, n)
+		sort.Strings(vals)
+
+		got, err := r.LabelValues(n)
+		testutil.Ok(t, err)
+		testutil.Equals(t, vals, got)
+	}
+	sort.Strings(names)
+	gotNames, err := r.LabelNames()
+	testutil.Ok(t, err)
+	testutil.Equals(t, names, gotNames)
+
+	for _, l := range []labels.Label{
+		{Name: "a", Value: ""},
+		{Name: "a", Value: "0005"},
+		{Name: "a", Value: "100"},
+		{Name: "b", Value: "40"},
+		{Name: "not-existing", Value: "1"},
+	} {
+		_, err := r.PostingsOffset(l.Name, l.Value)
+		testutil.Equals(t, NotFoundRangeErr, err)
+	}
+}
@@ -0,0 +1,123 @@
+package indexheader
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// JSONReader is a Reader backed by the JSON index cache file, which is fully loaded into memory.
+// NOTE: Kept for reading blocks during the migration to the binary index-header. Prefer BinaryReader.
+type JSONReader struct {
+	indexVersion int
+	symbols      map[uint32]string
+	lvals        map[string][]string
+	postings     map[labels.Label]index.Range
+}
+
+// NewJSONReader loads the JSON index cache of the given block from dir. If it does not exist yet, it is downloaded
+// from the bucket or, if the bucket has none, built from the downloaded index.
+func NewJSONReader(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, dir string, id ulid.ULID) (*JSONReader, error) {
+	cachefn := filepath.Join(dir, block.IndexCacheFilename)
+	jr, err := newFileJSONReader(logger, cachefn)
+	if err == nil {
+		return jr, nil
+	}
+	if !os.IsNotExist(errors.Cause(err)) {
+		return nil, errors.Wrap(err, "read index cache")
+	}
+
+	// Try to download index cache file from object store.
+	if err = objstore.DownloadFile(ctx, logger, bkt, path.Join(id.String(), block.IndexCacheFilename), cachefn); err == nil {
+		return newFileJSONReader(logger, cachefn)
+	}
+
+	if !bkt.IsObjNotFoundErr(errors.Cause(err)) {
+		return nil, errors.Wrap(err, "download index cache file")
+	}
+
+	// No cache exists on disk yet, build it from the downloaded index and retry.
+	fn := filepath.Join(dir, block.IndexFilename)
+
+	if err := objstore.DownloadFile(ctx, logger, bkt, path.Join(id.String(), block.IndexFilename), fn); err != nil {
+		return nil, errors.Wrap(err, "download index file")
+	}
+
+	defer func() {
+		if rerr := os.Remove(fn); rerr != nil {
+			level.Error(logger).Log("msg", "failed to remove temp index file", "path", fn, "err", rerr)
+		}
+	}()
+
+	if err := block.WriteIndexCache(logger, fn, cachefn); err != nil {
+		return nil, errors.Wrap(err, "write index cache")
+	}
+
+	jr, err = newFileJSONReader(logger, cachefn)
+	return jr, errors.Wrap(err, "read index cache")
+}
+
+func newFileJSONReader(logger log.Logger, fn string) (*JSONReader, error) {
+	var (
+		r   JSONReader
+		err error
+	)
+	r.indexVersion, r.symbols, r.lvals, r.postings, err = block.ReadIndexCache(logger, fn)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// IndexVersion returns the version of the TSDB index.
+func (r *JSONReader) IndexVersion() (int, error) {
+	return r.indexVersion, nil
+}
+
+// PostingsOffset returns the byte range of the postings list of the given label in the index.
+func (r *JSONReader) PostingsOffset(name, value string) (index.Range, error) {
+	rng, ok := r.postings[labels.Label{Name: name, Value: value}]
+	if !ok {
+		return index.Range{}, NotFoundRangeErr
+	}
+	return rng, nil
+}
+
+// LookupSymbol returns the symbol referenced by the given offset or sequence number.
+func (r *JSONReader) LookupSymbol(o uint32) (string, error) {
+	s, ok := r.symbols[o]
+	if !ok {
+		return "", errors.Errorf("indexheader: unknown symbol offset %d", o)
+	}
+	return s, nil
+}
+
+// LabelValues returns all values of the given label name.
+func (r *JSONReader) LabelValues(name string) ([]string, error) {
+	res := make([]string, 0, len(r.lvals[name]))
+	return append(res, r.lvals[name]...), nil
+}
+
+// LabelNames returns all label names in sorted order.
+func (r *JSONReader) LabelNames() ([]string, error) {
+	res := make([]string, 0, len(r.lvals))
+	for ln := range r.lvals {
+		res = append(res, ln)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Close does nothing, as the JSON index cache is fully held in memory.
+func (r *JSONReader) Close() error { return nil }
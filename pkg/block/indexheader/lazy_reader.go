@@ -0,0 +1,320 @@
+package indexheader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb/index"
+)
+
+var errNotIdle = errors.New("the reader is not idle")
+
+// LazyReaderMetrics holds the metrics of lazy loaded index-header readers.
+type LazyReaderMetrics struct {
+	loadCount         prometheus.Counter
+	loadFailedCount   prometheus.Counter
+	unloadCount       prometheus.Counter
+	unloadFailedCount prometheus.Counter
+	loadDuration      prometheus.Histogram
+}
+
+// NewLazyReaderMetrics creates the metrics of lazy loaded index-header readers and registers them if reg is not nil.
+func NewLazyReaderMetrics(reg prometheus.Registerer) *LazyReaderMetrics {
+	var m LazyReaderMetrics
+
+	m.loadCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_indexheader_lazy_load_total",
+		Help: "Total number of index-header lazy load operations.",
+	})
+	m.loadFailedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_indexheader_lazy_load_failed_total",
+		Help: "Total number of failed index-header lazy load operations.",
+	})
+	m.unloadCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_indexheader_lazy_unload_total",
+		Help: "Total number of index-header lazy unload operations.",
+	})
+	m.unloadFailedCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_indexheader_lazy_unload_failed_total",
+		Help: "Total number of failed index-header lazy unload operations.",
+	})
+	m.loadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "thanos_bucket_store_indexheader_lazy_load_duration_seconds",
+		Help:    "Duration of the index-header lazy loading in seconds.",
+		Buckets: []float64{0.01, 0.02, 0.05, 0.1, 0.2, 0.5, 1, 2, 5, 15, 30, 60, 120, 300},
+	})
+
+	if reg != nil {
+		reg.MustRegister(
+			m.loadCount,
+			m.loadFailedCount,
+			m.unloadCount,
+			m.unloadFailedCount,
+			m.loadDuration,
+		)
+	}
+	return &m
+}
+
+// LazyReader is a Reader which loads the underlying reader on first use and can release it again while idle.
+// Failed loads are retried on next use.
+type LazyReader struct {
+	// usedAt is the unix nanoseconds timestamp of the last use. Accessed atomically, so kept first for alignment.
+	usedAt int64
+
+	logger  log.Logger
+	load    func() (Reader, error)
+	metrics *LazyReaderMetrics
+	// onClosed is called when the reader is closed.
+	onClosed func(*LazyReader)
+
+	readerMtx sync.RWMutex
+	reader    Reader
+}
+
+// NewLazyReader returns a LazyReader loading the underlying reader with the given function on first use.
+func NewLazyReader(logger log.Logger, metrics *LazyReaderMetrics, load func() (Reader, error), onClosed func(*LazyReader)) *LazyReader {
+	return &LazyReader{
+		usedAt:   time.Now().UnixNano(),
+		logger:   logger,
+		load:     load,
+		metrics:  metrics,
+		onClosed: onClosed,
+	}
+}
+
+// acquire returns the underlying reader, loading it if needed. The read lock is held on success and must be released
+// with release once done with the reader, so that it is not unloaded in use.
+func (r *LazyReader) acquire() (Reader, error) {
+	for {
+		r.readerMtx.RLock()
+		if r.reader != nil {
+			atomic.StoreInt64(&r.usedAt, time.Now().UnixNano())
+			return r.reader, nil
+		}
+		r.readerMtx.RUnlock()
+
+		if err := r.loadOnce(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// loadOnce loads the underlying reader unless someone else did in the meantime.
+func (r *LazyReader) loadOnce() error {
+	r.readerMtx.Lock()
+	defer r.readerMtx.Unlock()
+
+	if r.reader != nil {
+		return nil
+	}
+
+	r.metrics.loadCount.Inc()
+	start := time.Now()
+
+	reader, err := r.load()
+	if err != nil {
+		r.metrics.loadFailedCount.Inc()
+		return errors.Wrap(err, "lazy load index-header")
+	}
+	r.reader = reader
+	// Count the load as use, so that it is not unloaded before the caller got it.
+	atomic.StoreInt64(&r.usedAt, time.Now().UnixNano())
+
+	r.metrics.loadDuration.Observe(time.Since(start).Seconds())
+	level.Debug(r.logger).Log("msg", "lazy loaded index-header", "elapsed", time.Since(start))
+	return nil
+}
+
+func (r *LazyReader) release() {
+	r.readerMtx.RUnlock()
+}
+
+// IndexVersion returns the version of the TSDB index.
+func (r *LazyReader) IndexVersion() (int, error) {
+	reader, err := r.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer r.release()
+	return reader.IndexVersion()
+}
+
+// PostingsOffset returns the byte range of the postings list of the given label in the index.
+func (r *LazyReader) PostingsOffset(name, value string) (index.Range, error) {
+	reader, err := r.acquire()
+	if err != nil {
+		return index.Range{}, err
+	}
+	defer r.release()
+	return reader.PostingsOffset(name, value)
+}
+
+// LookupSymbol returns the symbol referenced by the given offset or sequence number.
+func (r *LazyReader) LookupSymbol(o uint32) (string, error) {
+	reader, err := r.acquire()
+	if err != nil {
+		return "", err
+	}
+	defer r.release()
+	return reader.LookupSymbol(o)
+}
+
+// LabelValues returns all values of the given label name in sorted order.
+func (r *LazyReader) LabelValues(name string) ([]string, error) {
+	reader, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+	return reader.LabelValues(name)
+}
+
+// LabelNames returns all label names in sorted order.
+func (r *LazyReader) LabelNames() ([]string, error) {
+	reader, err := r.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer r.release()
+	return reader.LabelNames()
+}
+
+// Close releases the underlying reader, if loaded.
+func (r *LazyReader) Close() error {
+	if r.onClosed != nil {
+		r.onClosed(r)
+	}
+	return r.unloadIfIdleSince(0)
+}
+
+// unloadIfIdleSince releases the underlying reader if it was not used since the given unix nanoseconds timestamp.
+// A zero timestamp releases it unconditionally. errNotIdle is returned if it was used in the meantime.
+func (r *LazyReader) unloadIfIdleSince(ts int64) error {
+	r.readerMtx.Lock()
+	defer r.readerMtx.Unlock()
+
+	if r.reader == nil {
+		return nil
+	}
+	if ts > 0 && atomic.LoadInt64(&r.usedAt) > ts {
+		return errNotIdle
+	}
+
+	r.metrics.unloadCount.Inc()
+	if err := r.reader.Close(); err != nil {
+		r.metrics.unloadFailedCount.Inc()
+		return err
+	}
+	r.reader = nil
+	return nil
+}
+
+// loaded returns true if the underlying reader is currently loaded.
+func (r *LazyReader) loaded() bool {
+	r.readerMtx.RLock()
+	defer r.readerMtx.RUnlock()
+	return r.reader != nil
+}
+
+// ReaderPool creates index-header readers, lazy loaded ones if enabled, and unloads lazy readers after being idle
+// for the configured timeout.
+type ReaderPool struct {
+	logger      log.Logger
+	lazy        bool
+	idleTimeout time.Duration
+	metrics     *LazyReaderMetrics
+	close       chan struct{}
+	closeOnce   sync.Once
+
+	mtx     sync.Mutex
+	readers map[*LazyReader]struct{}
+}
+
+// NewReaderPool creates a new ReaderPool. If lazy is false, readers are loaded right away. An idle timeout of zero
+// disables unloading of lazy readers.
+func NewReaderPool(logger log.Logger, reg prometheus.Registerer, lazy bool, idleTimeout time.Duration) *ReaderPool {
+	p := &ReaderPool{
+		logger:      logger,
+		lazy:        lazy,
+		idleTimeout: idleTimeout,
+		metrics:     NewLazyReaderMetrics(reg),
+		close:       make(chan struct{}),
+		readers:     map[*LazyReader]struct{}{},
+	}
+
+	if lazy && idleTimeout > 0 {
+		go func() {
+			// Check a few times per timeout, so readers are not kept for much longer than it.
+			t := time.NewTicker(idleTimeout / 10)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-p.close:
+					return
+				case <-t.C:
+					p.closeIdleReaders()
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// NewReader returns the reader built by the given function, or a LazyReader deferring it to first use if lazy
+// loading is enabled. Lazy readers are loaded long after the given context is done, so they get a background context.
+func (p *ReaderPool) NewReader(ctx context.Context, logger log.Logger, load func(context.Context) (Reader, error)) (Reader, error) {
+	if !p.lazy {
+		return load(ctx)
+	}
+
+	r := NewLazyReader(logger, p.metrics, func() (Reader, error) { return load(context.Background()) }, p.onLazyReaderClosed)
+
+	p.mtx.Lock()
+	p.readers[r] = struct{}{}
+	p.mtx.Unlock()
+
+	return r, nil
+}
+
+// Close stops the unloading of idle readers. It does not close the readers.
+func (p *ReaderPool) Close() {
+	p.closeOnce.Do(func() { close(p.close) })
+}
+
+func (p *ReaderPool) closeIdleReaders() {
+	idleSince := time.Now().Add(-p.idleTimeout).UnixNano()
+
+	for _, r := range p.loadedReaders() {
+		if err := r.unloadIfIdleSince(idleSince); err != nil && err != errNotIdle {
+			level.Warn(p.logger).Log("msg", "failed to unload idle index-header", "err", err)
+		}
+	}
+}
+
+func (p *ReaderPool) loadedReaders() []*LazyReader {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	res := make([]*LazyReader, 0, len(p.readers))
+	for r := range p.readers {
+		if r.loaded() {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func (p *ReaderPool) onLazyReaderClosed(r *LazyReader) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	delete(p.readers, r)
+}
@@ -0,0 +1,130 @@
+package indexheader
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestLazyReader(t *testing.T) {
+	ctx := context.Background()
+
+	tmpDir, err := ioutil.TempDir("", "test-indexheader-lazy")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(tmpDir)) }()
+
+	bkt := inmem.NewBucket()
+	id, err := testutil.CreateBlock(ctx, tmpDir, []labels.Labels{
+		{{Name: "a", Value: "1"}},
+		{{Name: "a", Value: "2"}},
+	}, 10, 0, 1000, labels.Labels{{Name: "ext1", Value: "1"}}, 124)
+	testutil.Ok(t, err)
+	testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(tmpDir, id.String())))
+
+	dir := filepath.Join(tmpDir, "reader")
+	testutil.Ok(t, os.MkdirAll(dir, os.ModePerm))
+
+	failLoad := true
+	m := NewLazyReaderMetrics(nil)
+	r := NewLazyReader(log.NewNopLogger(), m, func() (Reader, error) {
+		if failLoad {
+			return nil, errors.New("failed")
+		}
+		return NewBinaryReader(ctx, log.NewNopLogger(), bkt, dir, id, 0)
+	}, nil)
+
+	// Nothing is loaded until first use.
+	testutil.Assert(t, !r.loaded(), "reader loaded before first use")
+	testutil.Equals(t, float64(0), promtest.ToFloat64(m.loadCount))
+
+	// Failed loads are retried on next use.
+	_, err = r.LabelNames()
+	testutil.NotOk(t, err)
+	testutil.Assert(t, !r.loaded(), "reader loaded after failure")
+	testutil.Equals(t, float64(1), promtest.ToFloat64(m.loadFailedCount))
+
+	failLoad = false
+	names, err := r.LabelNames()
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"a"}, names)
+	testutil.Assert(t, r.loaded(), "reader not loaded after use")
+	testutil.Equals(t, float64(2), promtest.ToFloat64(m.loadCount))
+
+	// A used reader is kept.
+	testutil.Equals(t, errNotIdle, r.unloadIfIdleSince(time.Now().Add(-time.Minute).UnixNano()))
+	testutil.Assert(t, r.loaded(), "reader unloaded while in use")
+
+	testutil.Ok(t, r.unloadIfIdleSince(time.Now().UnixNano()))
+	testutil.Assert(t, !r.loaded(), "idle reader not unloaded")
+	testutil.Equals(t, float64(1), promtest.ToFloat64(m.unloadCount))
+
+	// It is loaded again on next use.
+	vals, err := r.LabelValues("a")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"1", "2"}, vals)
+	testutil.Equals(t, float64(3), promtest.ToFloat64(m.loadCount))
+
+	testutil.Ok(t, r.Close())
+	testutil.Assert(t, !r.loaded(), "reader loaded after close")
+	testutil.Equals(t, float64(2), promtest.ToFloat64(m.unloadCount))
+}
+
+func TestReaderPool_UnloadsIdleReaders(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p := NewReaderPool(log.NewNopLogger(), nil, true, 100*time.Millisecond)
+	defer p.Close()
+
+	loads := 0
+	r, err := p.NewReader(ctx, log.NewNopLogger(), func(context.Context) (Reader, error) {
+		loads++
+		return &JSONReader{indexVersion: 2}, nil
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, loads)
+
+	lr, ok := r.(*LazyReader)
+	testutil.Assert(t, ok, "expected lazy reader, got %T", r)
+
+	v, err := r.IndexVersion()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, v)
+	testutil.Equals(t, 1, loads)
+
+	testutil.Ok(t, runutil.Retry(10*time.Millisecond, ctx.Done(), func() error {
+		if lr.loaded() {
+			return errors.New("reader still loaded")
+		}
+		return nil
+	}))
+
+	testutil.Ok(t, r.Close())
+	testutil.Equals(t, 0, len(p.loadedReaders()))
+	testutil.Equals(t, 0, len(p.readers))
+}
+
+func TestReaderPool_NotLazy(t *testing.T) {
+	p := NewReaderPool(log.NewNopLogger(), nil, false, time.Minute)
+	defer p.Close()
+
+	r, err := p.NewReader(context.Background(), log.NewNopLogger(), func(context.Context) (Reader, error) {
+		return &JSONReader{indexVersion: 2}, nil
+	})
+	testutil.Ok(t, err)
+
+	_, ok := r.(*JSONReader)
+	testutil.Assert(t, ok, "expected loaded reader, got %T", r)
+}
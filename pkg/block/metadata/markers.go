@@ -0,0 +1,44 @@
+package metadata
+
+import (
+	"github.com/oklog/ulid"
+)
+
+const (
+	// NoCompactMarkFilename is the known JSON filename of the marker that excludes a block from compaction.
+	NoCompactMarkFilename = "no-compact-mark.json"
+
+	// NoCompactMarkVersion1 is the version of no-compact marks supported by Thanos.
+	NoCompactMarkVersion1 = 1
+)
+
+// NoCompactReason is the reason a block was marked for no compaction.
+type NoCompactReason string
+
+const (
+	// ManualNoCompactReason is used for blocks marked by an operator.
+	ManualNoCompactReason NoCompactReason = "manual"
+	// IndexCriticalNoCompactReason is used for blocks with critical index issues.
+	IndexCriticalNoCompactReason NoCompactReason = "index-critical"
+	// OutOfOrderChunksNoCompactReason is used for blocks with out of order chunks that could not be repaired.
+	OutOfOrderChunksNoCompactReason NoCompactReason = "out-of-order-chunks"
+	// MalformedIndexNoCompactReason is used for blocks with out of order label names in the index.
+	MalformedIndexNoCompactReason NoCompactReason = "malformed-index"
+	// IndexSizeExceedingNoCompactReason is used for blocks that would make a compacted block exceed the max index size.
+	IndexSizeExceedingNoCompactReason NoCompactReason = "index-size-exceeding"
+)
+
+// NoCompactMark is the content of the no-compact mark of a block. Blocks with
+// such a mark are never planned for compaction, but are still downsampled and
+// subject to retention.
+type NoCompactMark struct {
+	// ID of the marked block.
+	ID ulid.ULID `json:"id"`
+	// Version of the mark file.
+	Version int `json:"version"`
+	// NoCompactTime is the unix timestamp in seconds when the block was marked.
+	NoCompactTime int64           `json:"no_compact_time"`
+	Reason        NoCompactReason `json:"reason"`
+	// Details is a human readable description of why the block was marked.
+	Details string `json:"details"`
+}
@@ -34,6 +34,8 @@ const (
 const (
 	// MetaFilename is the known JSON filename for meta information.
 	MetaFilename = "meta.json"
+	// IndexFilename is the known index file for block index.
+	IndexFilename = "index"
 )
 
 const (
@@ -56,6 +58,48 @@ type Thanos struct {
 
 	// Source is a real upload source of the block.
 	Source SourceType `json:"source"`
+
+	// Files are the index and chunk files of the block with their sizes and hashes, gathered on upload.
+	Files []File `json:"files,omitempty"`
+
+	// LabelRewrites records the rewrites of the external labels, oldest first.
+	LabelRewrites []LabelRewrite `json:"label_rewrites,omitempty"`
+}
+
+// File describes a single file of a block.
+type File struct {
+	// RelPath is the path of the file relative to the block directory.
+	RelPath   string `json:"rel_path"`
+	SizeBytes int64  `json:"size_bytes"`
+
+	// Hash is the hash of the file content. Nil for blocks uploaded before hashes were recorded.
+	Hash *ObjectHash `json:"hash,omitempty"`
+}
+
+// HashFunc is the hash function used for the hashes of block files.
+type HashFunc string
+
+const (
+	// NoneFunc disables hashing of block files.
+	NoneFunc HashFunc = ""
+	// SHA256Func hashes block files with SHA256.
+	SHA256Func HashFunc = "SHA256"
+)
+
+// ObjectHash is the hash of a block file.
+type ObjectHash struct {
+	Func  HashFunc `json:"hashFunc"`
+	Value string   `json:"value"`
+}
+
+// IndexSize returns the size of the index file recorded in the meta, or 0 if it is unknown.
+func (m *Meta) IndexSize() int64 {
+	for _, f := range m.Thanos.Files {
+		if f.RelPath == IndexFilename {
+			return f.SizeBytes
+		}
+	}
+	return 0
 }
 
 type ThanosDownsample struct {
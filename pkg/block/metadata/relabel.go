@@ -0,0 +1,65 @@
+package metadata
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LabelRewrite records a rewrite of the external labels of a block.
+type LabelRewrite struct {
+	// Version is the labels version of the meta file after the rewrite.
+	Version int `json:"version"`
+	// RewriteTime is the unix timestamp in seconds when the labels were rewritten.
+	RewriteTime int64 `json:"rewrite_time"`
+	// Labels are the external labels before the rewrite.
+	Labels map[string]string `json:"labels"`
+}
+
+// LabelsVersion returns the number of times the external labels of the block were rewritten.
+// The meta file of a block as uploaded has version 0.
+func (m *Meta) LabelsVersion() int {
+	return len(m.Thanos.LabelRewrites)
+}
+
+// BackupFilename returns the name of the backup of the meta file with the given labels version,
+// which is kept in the block directory once the labels are rewritten.
+func BackupFilename(version int) string {
+	return fmt.Sprintf("%s.%d.bak", MetaFilename, version)
+}
+
+// ParseRelabelConfig parses the YAML relabel configuration of external labels.
+func ParseRelabelConfig(content []byte) ([]*relabel.Config, error) {
+	var cfgs []*relabel.Config
+	if err := yaml.UnmarshalStrict(content, &cfgs); err != nil {
+		return nil, errors.Wrap(err, "parsing YAML content")
+	}
+	return cfgs, nil
+}
+
+// Relabel applies the relabel configs to the external labels of the block. If they change, a copy of the meta with the
+// new labels and a record of the rewrite is returned. The meta is returned unchanged together with false if the labels
+// do not change or if the relabeling drops the block or all of its labels.
+func Relabel(m *Meta, cfgs []*relabel.Config) (*Meta, bool) {
+	if len(cfgs) == 0 {
+		return m, false
+	}
+	lset := labels.FromMap(m.Thanos.Labels)
+	res := relabel.Process(lset.Copy(), cfgs...)
+	if len(res) == 0 || labels.Equal(lset, res) {
+		return m, false
+	}
+
+	n := *m
+	n.Thanos.Labels = res.Map()
+	n.Thanos.LabelRewrites = append(append([]LabelRewrite{}, m.Thanos.LabelRewrites...), LabelRewrite{
+		Version:     m.LabelsVersion() + 1,
+		RewriteTime: time.Now().Unix(),
+		Labels:      m.Thanos.Labels,
+	})
+	return &n, true
+}
@@ -16,6 +16,8 @@ import (
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/relabel"
 	"github.com/prometheus/tsdb"
 	terrors "github.com/prometheus/tsdb/errors"
 	"github.com/prometheus/tsdb/labels"
@@ -25,6 +27,8 @@ import (
 	"github.com/thanos-io/thanos/pkg/objstore"
 )
 
+// ResolutionLevel is the resolution of the samples of a block in milliseconds.
+// Besides the standard levels, any resolution of a custom downsampling level is valid.
 type ResolutionLevel int64
 
 const (
@@ -35,6 +39,25 @@ const (
 	MinimumAgeForRemoval = time.Duration(30 * time.Minute)
 )
 
+// ParseResolutionLevel parses a resolution given as duration, e.g. 15m, or "raw".
+func ParseResolutionLevel(s string) (ResolutionLevel, error) {
+	if s == "raw" {
+		return ResolutionLevelRaw, nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return ResolutionLevel(time.Duration(d) / time.Millisecond), nil
+}
+
+func (r ResolutionLevel) String() string {
+	if r == ResolutionLevelRaw {
+		return "raw"
+	}
+	return model.Duration(time.Duration(r) * time.Millisecond).String()
+}
+
 var blockTooFreshSentinelError = errors.New("Block too fresh")
 
 // Syncer syncronizes block metas from a bucket into a local directory.
@@ -46,10 +69,13 @@ type Syncer struct {
 	consistencyDelay     time.Duration
 	mtx                  sync.Mutex
 	blocks               map[ulid.ULID]*metadata.Meta
+	noCompactMarks       map[ulid.ULID]struct{}
 	blocksMtx            sync.Mutex
 	blockSyncConcurrency int
 	metrics              *syncerMetrics
 	acceptMalformedIndex bool
+	maxBlockIndexSize    int64
+	relabelConfigs       []*relabel.Config
 }
 
 type syncerMetrics struct {
@@ -57,6 +83,7 @@ type syncerMetrics struct {
 	syncMetaFailures          prometheus.Counter
 	syncMetaDuration          prometheus.Histogram
 	garbageCollectedBlocks    prometheus.Counter
+	relabeledBlocks           prometheus.Counter
 	garbageCollections        prometheus.Counter
 	garbageCollectionFailures prometheus.Counter
 	garbageCollectionDuration prometheus.Histogram
@@ -88,6 +115,11 @@ func newSyncerMetrics(reg prometheus.Registerer) *syncerMetrics {
 		Help: "Total number of deleted blocks by compactor.",
 	})
 
+	m.relabeledBlocks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_compact_relabeled_blocks_total",
+		Help: "Total number of blocks whose external labels were rewritten by the compactor.",
+	})
+
 	m.garbageCollections = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "thanos_compact_garbage_collection_total",
 		Help: "Total number of garbage collection operations.",
@@ -119,6 +151,7 @@ func newSyncerMetrics(reg prometheus.Registerer) *syncerMetrics {
 			m.syncMetaFailures,
 			m.syncMetaDuration,
 			m.garbageCollectedBlocks,
+			m.relabeledBlocks,
 			m.garbageCollections,
 			m.garbageCollectionFailures,
 			m.garbageCollectionDuration,
@@ -131,7 +164,10 @@ func newSyncerMetrics(reg prometheus.Registerer) *syncerMetrics {
 
 // NewSyncer returns a new Syncer for the given Bucket and directory.
 // Blocks must be at least as old as the sync delay for being considered.
-func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, consistencyDelay time.Duration, blockSyncConcurrency int, acceptMalformedIndex bool) (*Syncer, error) {
+// Compactions of its groups are limited to blocks with an index size of at most maxBlockIndexSize bytes, if not zero.
+// The external labels of synced blocks are rewritten with the relabel configs, if any, so that blocks can join
+// the group of blocks with the new labels.
+func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket, consistencyDelay time.Duration, blockSyncConcurrency int, acceptMalformedIndex bool, maxBlockIndexSize int64, relabelConfigs []*relabel.Config) (*Syncer, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
@@ -140,10 +176,13 @@ func NewSyncer(logger log.Logger, reg prometheus.Registerer, bkt objstore.Bucket
 		reg:                  reg,
 		consistencyDelay:     consistencyDelay,
 		blocks:               map[ulid.ULID]*metadata.Meta{},
+		noCompactMarks:       map[ulid.ULID]struct{}{},
 		bkt:                  bkt,
 		metrics:              newSyncerMetrics(reg),
 		blockSyncConcurrency: blockSyncConcurrency,
 		acceptMalformedIndex: acceptMalformedIndex,
+		maxBlockIndexSize:    maxBlockIndexSize,
+		relabelConfigs:       relabelConfigs,
 	}, nil
 }
 
@@ -185,10 +224,10 @@ func (c *Syncer) syncMetas(ctx context.Context) error {
 				c.blocksMtx.Lock()
 				_, seen := c.blocks[id]
 				c.blocksMtx.Unlock()
+
 				if seen {
 					continue
 				}
-
 				meta, err := c.downloadMeta(workCtx, id)
 				if err == blockTooFreshSentinelError {
 					continue
@@ -200,9 +239,23 @@ func (c *Syncer) syncMetas(ctx context.Context) error {
 					errChan <- err
 					return
 				}
+				if meta, err = c.relabel(workCtx, meta); err != nil {
+					errChan <- err
+					return
+				}
+				// The no-compact mark is read along with the meta. Blocks marked later are
+				// noticed by the group right before compacting them.
+				mark, err := block.ReadNoCompactMark(workCtx, c.logger, c.bkt, id)
+				if err != nil {
+					errChan <- err
+					return
+				}
 
 				c.blocksMtx.Lock()
 				c.blocks[id] = meta
+				if mark != nil {
+					c.noCompactMarks[id] = struct{}{}
+				}
 				c.blocksMtx.Unlock()
 			}
 		}()
@@ -242,6 +295,7 @@ func (c *Syncer) syncMetas(ctx context.Context) error {
 	for id := range c.blocks {
 		if _, ok := remote[id]; !ok {
 			delete(c.blocks, id)
+			delete(c.noCompactMarks, id)
 		}
 	}
 
@@ -278,6 +332,27 @@ func (c *Syncer) downloadMeta(ctx context.Context, id ulid.ULID) (*metadata.Meta
 	return &meta, nil
 }
 
+// relabel rewrites the external labels of the block in the bucket if the relabel configs change them and returns
+// the meta with the new labels. In a read-only bucket only the returned meta has the new labels.
+func (c *Syncer) relabel(ctx context.Context, meta *metadata.Meta) (*metadata.Meta, error) {
+	newMeta, ok := metadata.Relabel(meta, c.relabelConfigs)
+	if !ok {
+		return meta, nil
+	}
+	if err := block.RewriteMeta(ctx, c.logger, c.bkt, newMeta); err != nil {
+		if !objstore.IsReadOnlyErr(err) {
+			return nil, errors.Wrapf(err, "rewrite labels of block %s", meta.ULID)
+		}
+		level.Info(c.logger).Log("msg", "would rewrite labels of block, but bucket is read-only", "block", meta.ULID,
+			"labels", labels.FromMap(meta.Thanos.Labels), "new_labels", labels.FromMap(newMeta.Thanos.Labels))
+		return newMeta, nil
+	}
+	level.Info(c.logger).Log("msg", "rewrote labels of block", "block", meta.ULID,
+		"labels", labels.FromMap(meta.Thanos.Labels), "new_labels", labels.FromMap(newMeta.Thanos.Labels), "version", newMeta.LabelsVersion())
+	c.metrics.relabeledBlocks.Inc()
+	return newMeta, nil
+}
+
 // removeIfMalformed removes a block from the bucket if that block does not have a meta file.  It ignores blocks that
 // are younger than MinimumAgeForRemoval.
 func (c *Syncer) removeIfMetaMalformed(ctx context.Context, id ulid.ULID) (removedOrIgnored bool) {
@@ -297,6 +372,10 @@ func (c *Syncer) removeIfMetaMalformed(ctx context.Context, id ulid.ULID) (remov
 	}
 
 	if err := block.Delete(ctx, c.bkt, id); err != nil {
+		if objstore.IsReadOnlyErr(err) {
+			level.Info(c.logger).Log("msg", "would delete malformed block, but bucket is read-only", "block", id)
+			return true
+		}
 		level.Warn(c.logger).Log("msg", "failed to delete malformed block", "block", id, "err", err)
 		return false
 	}
@@ -331,6 +410,7 @@ func (c *Syncer) Groups() (res []*Group, err error) {
 				labels.FromMap(m.Thanos.Labels),
 				m.Thanos.Downsample.Resolution,
 				c.acceptMalformedIndex,
+				c.maxBlockIndexSize,
 				c.metrics.compactions.WithLabelValues(GroupKey(*m)),
 				c.metrics.compactionFailures.WithLabelValues(GroupKey(*m)),
 				c.metrics.garbageCollectedBlocks,
@@ -344,6 +424,9 @@ func (c *Syncer) Groups() (res []*Group, err error) {
 		if err := g.Add(m); err != nil {
 			return nil, errors.Wrap(err, "add compaction group")
 		}
+		if _, ok := c.noCompactMarks[m.ULID]; ok {
+			g.noCompact[m.ULID] = struct{}{}
+		}
 	}
 	sort.Slice(res, func(i, j int) bool {
 		return res[i].Key() < res[j].Key()
@@ -351,6 +434,16 @@ func (c *Syncer) Groups() (res []*Group, err error) {
 	return res, nil
 }
 
+// addNoCompactMarks records the no-compact marks the group found or added during compaction.
+func (c *Syncer) addNoCompactMarks(g *Group) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, id := range g.NoCompactIDs() {
+		c.noCompactMarks[id] = struct{}{}
+	}
+}
+
 // GarbageCollect deletes blocks from the bucket if their data is available as part of a
 // block with a higher compaction level.
 func (c *Syncer) GarbageCollect(ctx context.Context) error {
@@ -359,10 +452,8 @@ func (c *Syncer) GarbageCollect(ctx context.Context) error {
 
 	begin := time.Now()
 
-	// Run a separate round of garbage collections for each valid resolution.
-	for _, res := range []int64{
-		downsample.ResLevel0, downsample.ResLevel1, downsample.ResLevel2,
-	} {
+	// Run a separate round of garbage collections for each resolution of the known blocks.
+	for _, res := range c.resolutions() {
 		err := c.garbageCollect(ctx, res)
 		if err != nil {
 			c.metrics.garbageCollectionFailures.Inc()
@@ -377,6 +468,23 @@ func (c *Syncer) GarbageCollect(ctx context.Context) error {
 	return nil
 }
 
+// resolutions returns the sorted resolutions of the known blocks. The lock of c must be held.
+func (c *Syncer) resolutions() (res []int64) {
+	seen := map[int64]struct{}{}
+	for _, m := range c.blocks {
+		r := m.Thanos.Downsample.Resolution
+		if _, ok := seen[r]; ok {
+			continue
+		}
+		seen[r] = struct{}{}
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
 func (c *Syncer) GarbageBlocks(resolution int64) (ids []ulid.ULID, err error) {
 	// Map each block to its highest priority parent. Initial blocks have themselves
 	// in their source section, i.e. are their own parent.
@@ -476,7 +584,9 @@ type Group struct {
 	resolution                  int64
 	mtx                         sync.Mutex
 	blocks                      map[ulid.ULID]*metadata.Meta
+	noCompact                   map[ulid.ULID]struct{}
 	acceptMalformedIndex        bool
+	maxBlockIndexSize           int64
 	compactions                 prometheus.Counter
 	compactionFailures          prometheus.Counter
 	groupGarbageCollectedBlocks prometheus.Counter
@@ -489,6 +599,7 @@ func newGroup(
 	lset labels.Labels,
 	resolution int64,
 	acceptMalformedIndex bool,
+	maxBlockIndexSize int64,
 	compactions prometheus.Counter,
 	compactionFailures prometheus.Counter,
 	groupGarbageCollectedBlocks prometheus.Counter,
@@ -502,7 +613,9 @@ func newGroup(
 		labels:                      lset,
 		resolution:                  resolution,
 		blocks:                      map[ulid.ULID]*metadata.Meta{},
+		noCompact:                   map[ulid.ULID]struct{}{},
 		acceptMalformedIndex:        acceptMalformedIndex,
+		maxBlockIndexSize:           maxBlockIndexSize,
 		compactions:                 compactions,
 		compactionFailures:          compactionFailures,
 		groupGarbageCollectedBlocks: groupGarbageCollectedBlocks,
@@ -544,6 +657,20 @@ func (cg *Group) IDs() (ids []ulid.ULID) {
 	return ids
 }
 
+// NoCompactIDs returns all sorted IDs of blocks in the group that are marked for no compaction.
+func (cg *Group) NoCompactIDs() (ids []ulid.ULID) {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+
+	for id := range cg.noCompact {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].Compare(ids[j]) < 0
+	})
+	return ids
+}
+
 // Labels returns the labels that all blocks in the group share.
 func (cg *Group) Labels() labels.Labels {
 	return cg.labels
@@ -595,6 +722,39 @@ func IsIssue347Error(err error) bool {
 	return ok
 }
 
+// UnhealthyBlockError is a type wrapper for errors caused by a single block that cannot be compacted.
+// Depending on the configuration such a block can be marked for no compaction.
+type UnhealthyBlockError struct {
+	err error
+
+	id     ulid.ULID
+	reason metadata.NoCompactReason
+}
+
+func unhealthyBlock(err error, id ulid.ULID, reason metadata.NoCompactReason) UnhealthyBlockError {
+	return UnhealthyBlockError{err: err, id: id, reason: reason}
+}
+
+func (e UnhealthyBlockError) Error() string {
+	return e.err.Error()
+}
+
+// blockError returns the block responsible for the error and the reason the block
+// cannot be compacted, if the error is caused by a single block. Halt errors are looked through.
+func blockError(err error) (id ulid.ULID, reason metadata.NoCompactReason, ok bool) {
+	cause := errors.Cause(err)
+	if h, isHalt := cause.(HaltError); isHalt {
+		cause = errors.Cause(h.err)
+	}
+	switch e := cause.(type) {
+	case UnhealthyBlockError:
+		return e.id, e.reason, true
+	case Issue347Error:
+		return e.id, metadata.OutOfOrderChunksNoCompactReason, true
+	}
+	return ulid.ULID{}, "", false
+}
+
 // HaltError is a type wrapper for errors that should halt any further progress on compactions.
 type HaltError struct {
 	err error
@@ -611,7 +771,7 @@ func (e HaltError) Error() string {
 // IsHaltError returns true if the base error is a HaltError.
 // If a multierror is passed, any halt error will return true.
 func IsHaltError(err error) bool {
-	if multiErr, ok := err.(terrors.MultiError); ok {
+	if multiErr, ok := errors.Cause(err).(terrors.MultiError); ok {
 		for _, err := range multiErr {
 			if _, ok := errors.Cause(err).(HaltError); ok {
 				return true
@@ -644,7 +804,7 @@ func (e RetryError) Error() string {
 // IsRetryError returns true if the base error is a RetryError.
 // If a multierror is passed, all errors must be retriable.
 func IsRetryError(err error) bool {
-	if multiErr, ok := err.(terrors.MultiError); ok {
+	if multiErr, ok := errors.Cause(err).(terrors.MultiError); ok {
 		for _, err := range multiErr {
 			if _, ok := errors.Cause(err).(RetryError); !ok {
 				return false
@@ -750,37 +910,235 @@ func RepairIssue347(ctx context.Context, logger log.Logger, bkt objstore.Bucket,
 	return nil
 }
 
-func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (shouldRerun bool, compID ulid.ULID, err error) {
+// Plan returns the IDs of the blocks the next compaction of the group would compact,
+// without compacting them. The directory is used as scratch space for planning.
+func (cg *Group) Plan(dir string, comp tsdb.Compactor) ([]ulid.ULID, error) {
 	cg.mtx.Lock()
 	defer cg.mtx.Unlock()
 
-	// Check for overlapped blocks.
-	if err := cg.areBlocksOverlapping(nil); err != nil {
-		return false, ulid.ULID{}, halt(errors.Wrap(err, "pre compaction overlap check"))
+	subDir := filepath.Join(dir, cg.Key())
+	if err := os.RemoveAll(subDir); err != nil {
+		return nil, errors.Wrap(err, "clean planning group dir")
+	}
+	defer func() {
+		if err := os.RemoveAll(subDir); err != nil {
+			level.Warn(cg.logger).Log("msg", "failed to remove planning group dir", "dir", subDir, "err", err)
+		}
+	}()
+
+	plan, err := cg.plan(subDir, comp)
+	if err != nil {
+		return nil, err
+	}
+	plan, exceeding, err := cg.limitPlan(plan)
+	if err != nil {
+		return nil, err
+	}
+	if exceeding != nil {
+		// The next compaction marks the exceeding block for no compaction instead of compacting.
+		return nil, nil
+	}
+
+	ids := make([]ulid.ULID, 0, len(plan))
+	for _, pdir := range plan {
+		id, err := ulid.Parse(filepath.Base(pdir))
+		if err != nil {
+			return nil, errors.Wrapf(err, "plan dir %s", pdir)
+		}
+		ids = append(ids, id)
 	}
+	return ids, nil
+}
+
+// plan returns the directories of the blocks to compact next. The lock of cg must be held.
+func (cg *Group) plan(dir string, comp tsdb.Compactor) ([]string, error) {
+	runs := cg.compactableRuns()
+	for i, metas := range runs {
+		runDir := dir
+		if len(runs) > 1 {
+			runDir = filepath.Join(dir, fmt.Sprintf("run-%d", i))
+		}
+
+		// Planning a compaction works purely based on the meta.json files in our future group's dir.
+		// So we first dump all our memory block metas into the directory.
+		for _, meta := range metas {
+			bdir := filepath.Join(runDir, meta.ULID.String())
+			if err := os.MkdirAll(bdir, 0777); err != nil {
+				return nil, errors.Wrap(err, "create planning block dir")
+			}
+			if err := metadata.Write(cg.logger, bdir, meta); err != nil {
+				return nil, errors.Wrap(err, "write planning meta file")
+			}
+		}
+
+		// Plan against the written meta.json files.
+		plan, err := comp.Plan(runDir)
+		if err != nil {
+			return nil, errors.Wrap(err, "plan compaction")
+		}
+		if len(plan) == 0 {
+			continue
+		}
+		for _, pdir := range plan {
+			id, err := ulid.Parse(filepath.Base(pdir))
+			if err != nil {
+				return nil, errors.Wrapf(err, "plan dir %s", pdir)
+			}
+			if _, ok := cg.noCompact[id]; ok {
+				return nil, errors.Errorf("block %s marked for no compaction was planned for compaction", id)
+			}
+		}
+		return plan, nil
+	}
+	return nil, nil
+}
+
+// limitPlan returns the longest prefix of the time sorted plan whose compacted block is estimated to have an
+// index of at most the max block index size. The estimate is the sum of the index sizes of the planned blocks,
+// which is an upper bound as series present in multiple blocks are indexed only once. Blocks without a recorded
+// index size are not accounted for. If less than two blocks fit, the largest block of the first two is returned
+// instead, so that it can be marked for no compaction. The lock of cg must be held.
+func (cg *Group) limitPlan(plan []string) ([]string, *metadata.Meta, error) {
+	if cg.maxBlockIndexSize <= 0 || len(plan) == 0 {
+		return plan, nil, nil
+	}
+
+	var (
+		metas = make([]*metadata.Meta, 0, len(plan))
+		dirs  = make(map[ulid.ULID]string, len(plan))
+	)
+	for _, pdir := range plan {
+		id, err := ulid.Parse(filepath.Base(pdir))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "plan dir %s", pdir)
+		}
+		m, ok := cg.blocks[id]
+		if !ok {
+			return nil, nil, errors.Errorf("planned block %s not found in group", id)
+		}
+		metas = append(metas, m)
+		dirs[id] = pdir
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].MinTime < metas[j].MinTime
+	})
 
-	// Planning a compaction works purely based on the meta.json files in our future group's dir.
-	// So we first dump all our memory block metas into the directory.
-	for _, meta := range cg.blocks {
-		bdir := filepath.Join(dir, meta.ULID.String())
-		if err := os.MkdirAll(bdir, 0777); err != nil {
-			return false, ulid.ULID{}, errors.Wrap(err, "create planning block dir")
+	var size int64
+	for i, m := range metas {
+		size += m.IndexSize()
+		if size <= cg.maxBlockIndexSize {
+			continue
+		}
+		if i < 2 {
+			largest := metas[0]
+			if metas[i].IndexSize() > largest.IndexSize() {
+				largest = metas[i]
+			}
+			return nil, largest, nil
+		}
+		limited := make([]string, 0, i)
+		for _, m := range metas[:i] {
+			limited = append(limited, dirs[m.ULID])
 		}
-		if err := metadata.Write(cg.logger, bdir, meta); err != nil {
-			return false, ulid.ULID{}, errors.Wrap(err, "write planning meta file")
+		return limited, nil, nil
+	}
+	return plan, nil, nil
+}
+
+// compactableRuns returns the blocks of the group sorted by time and split into runs at every block
+// marked for no compaction. Runs are planned separately, so that no compacted block spans the time
+// range of a marked block. A run ends with the marked block following it, if any, as the planner
+// never selects the most recent block but considers it for deciding whether a time range is complete.
+// The lock of cg must be held.
+func (cg *Group) compactableRuns() (runs [][]*metadata.Meta) {
+	metas := make([]*metadata.Meta, 0, len(cg.blocks))
+	for _, m := range cg.blocks {
+		metas = append(metas, m)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].MinTime < metas[j].MinTime
+	})
+
+	var run []*metadata.Meta
+	for _, m := range metas {
+		if _, ok := cg.noCompact[m.ULID]; ok {
+			if len(run) > 0 {
+				runs = append(runs, append(run, m))
+			}
+			run = nil
+			continue
 		}
+		run = append(run, m)
+	}
+	if len(run) > 0 {
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (shouldRerun bool, compID ulid.ULID, err error) {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+
+	// Check for overlapped blocks.
+	if err := cg.areBlocksOverlapping(nil); err != nil {
+		return false, ulid.ULID{}, halt(errors.Wrap(err, "pre compaction overlap check"))
 	}
 
-	// Plan against the written meta.json files.
-	plan, err := comp.Plan(dir)
+	plan, err := cg.plan(dir, comp)
 	if err != nil {
-		return false, ulid.ULID{}, errors.Wrap(err, "plan compaction")
+		return false, ulid.ULID{}, err
 	}
 	if len(plan) == 0 {
 		// Nothing to do.
 		return false, ulid.ULID{}, nil
 	}
 
+	limited, exceeding, err := cg.limitPlan(plan)
+	if err != nil {
+		return false, ulid.ULID{}, err
+	}
+	if exceeding != nil {
+		// The block cannot be compacted with its neighbours without exceeding the max index size. We mark it
+		// for no compaction, which splits the time range at the block and unblocks the compaction of later ranges.
+		details := fmt.Sprintf("compacting the block would exceed the max block index size of %d bytes", cg.maxBlockIndexSize)
+		if err := block.MarkForNoCompact(ctx, cg.logger, cg.bkt, exceeding.ULID, metadata.IndexSizeExceedingNoCompactReason, details); err != nil {
+			return false, ulid.ULID{}, retry(errors.Wrapf(err, "mark block %s for no compaction", exceeding.ULID))
+		}
+		cg.noCompact[exceeding.ULID] = struct{}{}
+
+		level.Info(cg.logger).Log("msg", "marked block for no compaction as compacting it would exceed the max block index size",
+			"block", exceeding.ULID, "max_size", cg.maxBlockIndexSize)
+		return true, ulid.ULID{}, nil
+	}
+	if len(limited) < len(plan) {
+		level.Info(cg.logger).Log("msg", "limited compaction to stay within the max block index size",
+			"planned", fmt.Sprintf("%v", plan), "limited", fmt.Sprintf("%v", limited), "max_size", cg.maxBlockIndexSize)
+		plan = limited
+	}
+
+	// The syncer reads the no-compact marks of blocks only once, so we check the planned
+	// blocks for marks added since, e.g. manually, before compacting them.
+	var marked bool
+	for _, pdir := range plan {
+		id, err := ulid.Parse(filepath.Base(pdir))
+		if err != nil {
+			return false, ulid.ULID{}, errors.Wrapf(err, "plan dir %s", pdir)
+		}
+		mark, err := block.ReadNoCompactMark(ctx, cg.logger, cg.bkt, id)
+		if err != nil {
+			return false, ulid.ULID{}, retry(err)
+		}
+		if mark != nil {
+			cg.noCompact[id] = struct{}{}
+			marked = true
+		}
+	}
+	if marked {
+		level.Info(cg.logger).Log("msg", "planned blocks were marked for no compaction; replanning", "plan", fmt.Sprintf("%v", plan))
+		return true, ulid.ULID{}, nil
+	}
+
 	// Due to #183 we verify that none of the blocks in the plan have overlapping sources.
 	// This is one potential source of how we could end up with duplicated chunks.
 	uniqueSources := map[ulid.ULID]struct{}{}
@@ -825,7 +1183,7 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 		}
 
 		if err := stats.CriticalErr(); err != nil {
-			return false, ulid.ULID{}, halt(errors.Wrapf(err, "block with not healthy index found %s; Compaction level %v; Labels: %v", pdir, meta.Compaction.Level, meta.Thanos.Labels))
+			return false, ulid.ULID{}, halt(unhealthyBlock(errors.Wrapf(err, "block with not healthy index found %s; Compaction level %v; Labels: %v", pdir, meta.Compaction.Level, meta.Thanos.Labels), meta.ULID, metadata.IndexCriticalNoCompactReason))
 		}
 
 		if err := stats.Issue347OutsideChunksErr(); err != nil {
@@ -833,8 +1191,8 @@ func (cg *Group) compact(ctx context.Context, dir string, comp tsdb.Compactor) (
 		}
 
 		if err := stats.PrometheusIssue5372Err(); !cg.acceptMalformedIndex && err != nil {
-			return false, ulid.ULID{}, errors.Wrapf(err,
-				"block id %s, try running with --debug.accept-malformed-index", id)
+			return false, ulid.ULID{}, unhealthyBlock(errors.Wrapf(err,
+				"block id %s, try running with --debug.accept-malformed-index", id), id, metadata.MalformedIndexNoCompactReason)
 		}
 	}
 	level.Debug(cg.logger).Log("msg", "downloaded and verified blocks",
@@ -946,9 +1304,13 @@ type BucketCompactor struct {
 	compactDir  string
 	bkt         objstore.Bucket
 	concurrency int
+	marker      *NoCompactMarker
+	dryRun      *DryRun
 }
 
-// NewBucketCompactor creates a new bucket compactor.
+// NewBucketCompactor creates a new bucket compactor. If marker is not nil, it is used to
+// mark unhealthy blocks for no compaction instead of failing the compaction. If dryRun is not nil,
+// garbage collections and compactions are only recorded in it instead of being run.
 func NewBucketCompactor(
 	logger log.Logger,
 	sy *Syncer,
@@ -956,6 +1318,8 @@ func NewBucketCompactor(
 	compactDir string,
 	bkt objstore.Bucket,
 	concurrency int,
+	marker *NoCompactMarker,
+	dryRun *DryRun,
 ) (*BucketCompactor, error) {
 	if concurrency <= 0 {
 		return nil, errors.New("invalid concurrency level (%d), concurrency level must be > 0")
@@ -967,11 +1331,17 @@ func NewBucketCompactor(
 		compactDir:  compactDir,
 		bkt:         bkt,
 		concurrency: concurrency,
+		marker:      marker,
+		dryRun:      dryRun,
 	}, nil
 }
 
 // Compact runs compaction over bucket.
 func (c *BucketCompactor) Compact(ctx context.Context) error {
+	if c.dryRun != nil {
+		return c.dryRunCompact(ctx)
+	}
+
 	// Loop over bucket and compact until there's no work left.
 	for {
 		var (
@@ -992,6 +1362,7 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 				defer wg.Done()
 				for g := range groupChan {
 					shouldRerunGroup, _, err := g.Compact(workCtx, c.compactDir, c.comp)
+					c.sy.addNoCompactMarks(g)
 					if err == nil {
 						if shouldRerunGroup {
 							mtx.Lock()
@@ -1009,6 +1380,15 @@ func (c *BucketCompactor) Compact(ctx context.Context) error {
 							continue
 						}
 					}
+					if c.marker != nil {
+						var marked bool
+						if marked, err = c.marker.observe(workCtx, err); marked {
+							mtx.Lock()
+							finishedAllGroups = false
+							mtx.Unlock()
+							continue
+						}
+					}
 					errChan <- errors.Wrap(err, fmt.Sprintf("compaction failed for group %s", g.Key()))
 					return
 				}
@@ -3,6 +3,7 @@ package compact
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"path"
 	"testing"
 	"time"
@@ -10,6 +11,9 @@ import (
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	terrors "github.com/prometheus/tsdb/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -37,6 +41,7 @@ func TestHaltMultiError(t *testing.T) {
 
 	errs.Add(haltErr)
 	testutil.Assert(t, IsHaltError(errs), "if any halt errors are present this should return true")
+	testutil.Assert(t, IsHaltError(errors.Wrap(errs, "something")), "wrapped multierror with halt errors should return true")
 }
 
 func TestRetryMultiError(t *testing.T) {
@@ -48,6 +53,7 @@ func TestRetryMultiError(t *testing.T) {
 
 	errs = terrors.MultiError{retryErr}
 	testutil.Assert(t, IsRetryError(errs), "if all errors are retriable this should return true")
+	testutil.Assert(t, IsRetryError(errors.Wrap(errs, "something")), "wrapped multierror with only retriable errors should return true")
 
 	errs = terrors.MultiError{nonRetryErr, retryErr}
 	testutil.Assert(t, !IsRetryError(errs), "mixed errors should return false")
@@ -75,7 +81,7 @@ func TestSyncer_SyncMetas_HandlesMalformedBlocks(t *testing.T) {
 	defer cancel()
 
 	bkt := inmem.NewBucket()
-	sy, err := NewSyncer(nil, nil, bkt, 10*time.Second, 1, false)
+	sy, err := NewSyncer(nil, nil, bkt, 10*time.Second, 1, false, 0, nil)
 	testutil.Ok(t, err)
 
 	// Generate 1 block which is older than MinimumAgeForRemoval which has chunk data but no meta.  Compactor should delete it.
@@ -103,3 +109,75 @@ func TestSyncer_SyncMetas_HandlesMalformedBlocks(t *testing.T) {
 	testutil.Ok(t, err)
 	testutil.Equals(t, true, exists)
 }
+
+func TestSyncer_SyncMetas_Relabel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	bkt := inmem.NewBucket()
+	hour := int64(time.Hour / time.Millisecond)
+
+	// The cluster label was renamed after the first block was uploaded.
+	var ids []ulid.ULID
+	for i, cluster := range []string{"eu1-old", "eu1"} {
+		var m metadata.Meta
+		m.Version = metadata.MetaVersion1
+		m.ULID = ulid.MustNew(uint64(i+1), nil)
+		m.MinTime = int64(i) * 2 * hour
+		m.MaxTime = int64(i+1) * 2 * hour
+		m.Compaction.Level = 1
+		m.Compaction.Sources = []ulid.ULID{m.ULID}
+		m.Thanos.Labels = map[string]string{"cluster": cluster}
+
+		b, err := json.Marshal(&m)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), block.MetaFilename), bytes.NewReader(b)))
+		ids = append(ids, m.ULID)
+	}
+
+	cfgs, err := metadata.ParseRelabelConfig([]byte(`
+- source_labels: [cluster]
+  regex: eu1-old
+  target_label: cluster
+  replacement: eu1
+`))
+	testutil.Ok(t, err)
+
+	// A read-only bucket is left unchanged, but the blocks are grouped by their new labels nonetheless.
+	sy, err := NewSyncer(nil, nil, objstore.ReadOnlyBucket(bkt), 0, 1, false, 0, cfgs)
+	testutil.Ok(t, err)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+
+	groups, err := sy.Groups()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, ids, groups[0].IDs())
+
+	m, err := block.DownloadMeta(ctx, nil, bkt, ids[0])
+	testutil.Ok(t, err)
+	testutil.Equals(t, "eu1-old", m.Thanos.Labels["cluster"])
+
+	sy, err = NewSyncer(nil, nil, bkt, 0, 1, false, 0, cfgs)
+	testutil.Ok(t, err)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+
+	groups, err = sy.Groups()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, ids, groups[0].IDs())
+
+	m, err = block.DownloadMeta(ctx, nil, bkt, ids[0])
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"cluster": "eu1"}, m.Thanos.Labels)
+	testutil.Equals(t, 1, m.LabelsVersion())
+	testutil.Equals(t, map[string]string{"cluster": "eu1-old"}, m.Thanos.LabelRewrites[0].Labels)
+
+	exists, err := bkt.Exists(ctx, path.Join(ids[0].String(), metadata.BackupFilename(0)))
+	testutil.Ok(t, err)
+	testutil.Assert(t, exists, "meta.json backup missing")
+
+	// The second block already had the new labels.
+	m, err = block.DownloadMeta(ctx, nil, bkt, ids[1])
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, m.LabelsVersion())
+}
@@ -17,11 +17,17 @@ type AggrChunk []byte
 
 // EncodeAggrChunk encodes a new aggregate chunk from the array of chunks for each aggregate.
 // Each array entry corresponds to the respective AggrType number.
-func EncodeAggrChunk(chks [5]chunkenc.Chunk) *AggrChunk {
+// Trailing unset aggregates are omitted, so chunks without optional aggregates
+// remain readable by older versions.
+func EncodeAggrChunk(chks [numAggrTypes]chunkenc.Chunk) *AggrChunk {
 	var b []byte
 	buf := [8]byte{}
 
-	for _, c := range chks {
+	n := len(chks)
+	for n > 0 && chks[n-1] == nil {
+		n--
+	}
+	for _, c := range chks[:n] {
 		// Unset aggregates are marked with a zero length entry.
 		if c == nil {
 			n := binary.PutUvarint(buf[:], 0)
@@ -71,8 +77,12 @@ func (c AggrChunk) Get(t AggrType) (chunkenc.Chunk, error) {
 	var x []byte
 
 	for i := AggrType(0); i <= t; i++ {
+		// Omitted trailing aggregates are unset.
+		if len(b) == 0 {
+			return nil, ErrAggrNotExist
+		}
 		l, n := binary.Uvarint(b)
-		if n < 1 || len(b[n:]) < int(l)+1 {
+		if n < 1 {
 			return nil, errors.New("invalid size")
 		}
 		b = b[n:]
@@ -83,6 +93,9 @@ func (c AggrChunk) Get(t AggrType) (chunkenc.Chunk, error) {
 			}
 			continue
 		}
+		if len(b) < int(l)+1 {
+			return nil, errors.New("invalid size")
+		}
 		x = b[:int(l)+1]
 		b = b[int(l)+1:]
 	}
@@ -99,6 +112,11 @@ const (
 	AggrMin
 	AggrMax
 	AggrCounter
+	// AggrLast is the last sample value of each window. It is optional and
+	// only present if enabled when downsampling.
+	AggrLast
+
+	numAggrTypes = int(AggrLast) + 1
 )
 
 func (t AggrType) String() string {
@@ -113,6 +131,18 @@ func (t AggrType) String() string {
 		return "max"
 	case AggrCounter:
 		return "counter"
+	case AggrLast:
+		return "last"
 	}
 	return "<unknown>"
 }
+
+// ParseAggrType returns the aggregation type with the given name.
+func ParseAggrType(s string) (AggrType, error) {
+	for t := AggrType(0); int(t) < numAggrTypes; t++ {
+		if t.String() == s {
+			return t, nil
+		}
+	}
+	return 0, errors.Errorf("unknown aggregate %q", s)
+}
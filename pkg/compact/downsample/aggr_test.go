@@ -12,15 +12,22 @@ import (
 func TestAggrChunk(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
-	var input [5][]sample
+	var input [numAggrTypes][]sample
 
 	input[AggrCount] = []sample{{100, 30}, {200, 50}, {300, 60}, {400, 67}}
 	input[AggrSum] = []sample{{100, 130}, {200, 1000}, {300, 2000}, {400, 5555}}
 	input[AggrMin] = []sample{{100, 0}, {200, -10}, {300, 1000}, {400, -9.5}}
-	// Maximum is absent.
+	// Maximum and last are absent.
 	input[AggrCounter] = []sample{{100, 5}, {200, 10}, {300, 10.1}, {400, 15}, {400, 3}}
 
-	var chks [5]chunkenc.Chunk
+	testutil.Equals(t, input, encodeDecodeAggrChunk(t, input))
+
+	input[AggrLast] = []sample{{100, 2}, {200, 8}, {300, 1}, {400, 3}}
+	testutil.Equals(t, input, encodeDecodeAggrChunk(t, input))
+}
+
+func encodeDecodeAggrChunk(t *testing.T, input [numAggrTypes][]sample) (res [numAggrTypes][]sample) {
+	var chks [numAggrTypes]chunkenc.Chunk
 
 	for i, smpls := range input {
 		if len(smpls) == 0 {
@@ -35,14 +42,13 @@ func TestAggrChunk(t *testing.T) {
 		}
 	}
 
-	var res [5][]sample
 	ac := EncodeAggrChunk(chks)
 
-	for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+	for at := AggrType(0); int(at) < numAggrTypes; at++ {
 		if c, err := ac.Get(at); err != ErrAggrNotExist {
 			testutil.Ok(t, err)
 			testutil.Ok(t, expandChunkIterator(c.Iterator(), &res[at]))
 		}
 	}
-	testutil.Equals(t, input, res)
+	return res
 }
@@ -5,6 +5,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -28,17 +29,34 @@ const (
 	ResLevel2 = int64(60 * 60 * 1000) // 1 hour in milliseconds
 )
 
+// Downsampling ranges i.e. minimum block size after which we start to downsample blocks (in milliseconds).
+// Blocks are only downsampled once we are sure to get roughly 2 chunks out of them.
+const (
+	DownsampleRange0 = 40 * 60 * 60 * 1000      // 40 hours
+	DownsampleRange1 = 10 * 24 * 60 * 60 * 1000 // 10 days
+)
+
 // Downsample downsamples the given block. It writes a new block into dir and returns its ID.
+// Besides the standard aggregates, the given optional aggregates are computed for raw data.
+// Optional aggregates of already downsampled data are kept if all its chunks contain them.
 func Downsample(
 	logger log.Logger,
 	origMeta *metadata.Meta,
 	b tsdb.BlockReader,
 	dir string,
 	resolution int64,
+	optionalAggrs ...AggrType,
 ) (id ulid.ULID, err error) {
 	if origMeta.Thanos.Downsample.Resolution >= resolution {
 		return id, errors.New("target resolution not lower than existing one")
 	}
+	var last bool
+	for _, at := range optionalAggrs {
+		if at != AggrLast {
+			return id, errors.Errorf("aggregate %s is not optional", at)
+		}
+		last = true
+	}
 
 	indexr, err := b.Index()
 	if err != nil {
@@ -84,6 +102,14 @@ func Downsample(
 	}
 	defer runutil.CloseWithErrCapture(&err, streamedBlockWriter, "close stream block writer")
 
+	// Buckets of histograms are downsampled together to keep them consistent.
+	var families map[uint64]*histogramFamily
+	if origMeta.Thanos.Downsample.Resolution == 0 {
+		if families, err = histogramFamilies(indexr); err != nil {
+			return id, errors.Wrap(err, "find histograms")
+		}
+	}
+
 	postings, err := indexr.Postings(index.AllPostingsKey())
 	if err != nil {
 		return id, errors.Wrap(err, "get all postings list")
@@ -123,7 +149,18 @@ func Downsample(
 					return id, errors.Wrapf(err, "expand chunk %d, series %d", c.Ref, postings.At())
 				}
 			}
-			if err := streamedBlockWriter.WriteSeries(lset, downsampleRaw(all, resolution)); err != nil {
+			var downsampledChunks []chunks.Meta
+			if f, ok := families[postings.At()]; ok {
+				if !f.prepared {
+					if err := f.prepare(indexr, chunkr, resolution); err != nil {
+						return id, errors.Wrapf(err, "prepare histogram of series %d", postings.At())
+					}
+				}
+				downsampledChunks = downsampleRawBatches(all, resolution, last, f.batchEnds, f.resets)
+			} else {
+				downsampledChunks = downsampleRaw(all, resolution, last)
+			}
+			if err := streamedBlockWriter.WriteSeries(lset, downsampledChunks); err != nil {
 				return id, errors.Wrapf(err, "downsample raw data, series: %d", postings.At())
 			}
 		} else {
@@ -210,9 +247,11 @@ func (a *aggregator) reset() {
 	a.max = -math.MaxFloat64
 }
 
-func (a *aggregator) add(v float64) {
+// add adds the value to the current window. It follows a counter reset if reset is true
+// or if it is lower than the last value.
+func (a *aggregator) add(v float64, reset bool) {
 	if a.total > 0 {
-		if v < a.last {
+		if v < a.last || reset {
 			// Counter reset, correct the value.
 			a.counter += v
 			a.resets++
@@ -243,11 +282,11 @@ type aggrChunkBuilder struct {
 	mint, maxt int64
 	added      int
 
-	chunks [5]chunkenc.Chunk
-	apps   [5]chunkenc.Appender
+	chunks [numAggrTypes]chunkenc.Chunk
+	apps   [numAggrTypes]chunkenc.Appender
 }
 
-func newAggrChunkBuilder() *aggrChunkBuilder {
+func newAggrChunkBuilder(last bool) *aggrChunkBuilder {
 	b := &aggrChunkBuilder{
 		mint: math.MaxInt64,
 		maxt: math.MinInt64,
@@ -257,6 +296,9 @@ func newAggrChunkBuilder() *aggrChunkBuilder {
 	b.chunks[AggrMin] = chunkenc.NewXORChunk()
 	b.chunks[AggrMax] = chunkenc.NewXORChunk()
 	b.chunks[AggrCounter] = chunkenc.NewXORChunk()
+	if last {
+		b.chunks[AggrLast] = chunkenc.NewXORChunk()
+	}
 
 	for i, c := range b.chunks {
 		if c != nil {
@@ -278,6 +320,9 @@ func (b *aggrChunkBuilder) add(t int64, aggr *aggregator) {
 	b.apps[AggrMax].Append(t, aggr.max)
 	b.apps[AggrCount].Append(t, float64(aggr.count))
 	b.apps[AggrCounter].Append(t, aggr.counter)
+	if b.apps[AggrLast] != nil {
+		b.apps[AggrLast].Append(t, aggr.last)
+	}
 
 	b.added++
 }
@@ -295,36 +340,37 @@ func (b *aggrChunkBuilder) encode() chunks.Meta {
 }
 
 // downsampleRaw create a series of aggregation chunks for the given sample data.
-func downsampleRaw(data []sample, resolution int64) []chunks.Meta {
+// The last value of each window is only kept if last is true.
+func downsampleRaw(data []sample, resolution int64, last bool) []chunks.Meta {
+	return downsampleRawBatches(data, resolution, last, rawBatchEnds(data, resolution, nil), nil)
+}
+
+// downsampleRawBatches creates an aggregation chunk for the samples up to each of the given batch ends.
+// Samples after the last batch end are part of the last chunk. Samples right after any of the given resets
+// are treated as counter resets, even if their value did not decrease.
+func downsampleRawBatches(data []sample, resolution int64, last bool, batchEnds []int64, resets []int64) []chunks.Meta {
 	if len(data) == 0 {
 		return nil
 	}
-	var (
-		mint, maxt = data[0].t, data[len(data)-1].t
-		// We assume a raw resolution of 1 minute. In practice it will often be lower
-		// but this is sufficient for our heuristic to produce well-sized chunks.
-		numChunks = targetChunkCount(mint, maxt, 1*60*1000, resolution, len(data))
-		chks      = make([]chunks.Meta, 0, numChunks)
-		batchSize = (len(data) / numChunks) + 1
-	)
+	chks := make([]chunks.Meta, 0, len(batchEnds))
 
-	for len(data) > 0 {
-		j := batchSize
-		if j > len(data) {
-			j = len(data)
+	for i, end := range batchEnds {
+		if len(data) == 0 {
+			break
 		}
-		curW := currentWindow(data[j-1].t, resolution)
-
-		// The batch we took might end in the middle of a downsampling window. We additionally grab
-		// all further samples in the window to keep our samples regular.
-		for ; j < len(data) && data[j].t <= curW; j++ {
+		j := len(data)
+		if i < len(batchEnds)-1 {
+			j = sort.Search(len(data), func(k int) bool { return data[k].t > end })
+		}
+		if j == 0 {
+			continue
 		}
 
-		ab := newAggrChunkBuilder()
+		ab := newAggrChunkBuilder(last)
 		batch := data[:j]
 		data = data[j:]
 
-		lastT := downsampleBatch(batch, resolution, ab.add)
+		lastT := downsampleBatch(batch, resolution, resets, ab.add)
 
 		// InjectThanosMeta the chunk's counter aggregate with the last true sample.
 		ab.finalizeChunk(lastT, batch[len(batch)-1].v)
@@ -336,12 +382,13 @@ func downsampleRaw(data []sample, resolution int64) []chunks.Meta {
 }
 
 // downsampleBatch aggregates the data over the given resolution and calls add each time
-// the end of a resolution was reached.
-func downsampleBatch(data []sample, resolution int64, add func(int64, *aggregator)) int64 {
+// the end of a resolution was reached. Samples right after any of the given resets are treated as counter resets.
+func downsampleBatch(data []sample, resolution int64, resets []int64, add func(int64, *aggregator)) int64 {
 	var (
 		aggr  aggregator
 		nextT = int64(-1)
 		lastT = data[len(data)-1].t
+		prevT int64
 	)
 	// Fill up one aggregate chunk with up to m samples.
 	for _, s := range data {
@@ -362,7 +409,8 @@ func downsampleBatch(data []sample, resolution int64, add func(int64, *aggregato
 				nextT = lastT
 			}
 		}
-		aggr.add(s.v)
+		aggr.add(s.v, len(resets) > 0 && aggr.total > 0 && resetBetween(resets, prevT, s.t))
+		prevT = s.t
 	}
 	// Add the last sample.
 	add(nextT, &aggr)
@@ -448,7 +496,7 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 		ab.chunks[at] = chunkenc.NewXORChunk()
 		ab.apps[at], _ = ab.chunks[at].Appender()
 
-		downsampleBatch(*buf, resolution, func(t int64, a *aggregator) {
+		downsampleBatch(*buf, resolution, nil, func(t int64, a *aggregator) {
 			if t < mint {
 				mint = t
 			} else if t > maxt {
@@ -478,6 +526,24 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 	}); err != nil {
 		return chk, err
 	}
+	// The last value is optional. Keep it only if all chunks have it, as it would be wrong for windows
+	// covered by chunks without it otherwise.
+	hasLast := true
+	for _, achk := range chks {
+		if _, err := achk.Get(AggrLast); err == ErrAggrNotExist {
+			hasLast = false
+			break
+		} else if err != nil {
+			return chk, err
+		}
+	}
+	if hasLast {
+		if err := do(AggrLast, func(a *aggregator) float64 {
+			return a.last
+		}); err != nil {
+			return chk, err
+		}
+	}
 
 	// Handle counters by reading them properly.
 	acs := make([]chunkenc.Iterator, 0, len(chks))
@@ -504,7 +570,7 @@ func downsampleAggrBatch(chks []*AggrChunk, buf *[]sample, resolution int64) (ch
 	ab.chunks[AggrCounter] = chunkenc.NewXORChunk()
 	ab.apps[AggrCounter], _ = ab.chunks[AggrCounter].Appender()
 
-	lastT := downsampleBatch(*buf, resolution, func(t int64, a *aggregator) {
+	lastT := downsampleBatch(*buf, resolution, nil, func(t int64, a *aggregator) {
 		if t < mint {
 			mint = t
 		} else if t > maxt {
@@ -104,8 +104,61 @@ func TestDownsampleAggr(t *testing.T) {
 	testDownsample(t, input, &meta, 500)
 }
 
+func TestDownsampleRaw_Last(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	input := []*downsampleTestSet{
+		{
+			lset:  labels.FromStrings("__name__", "a"),
+			inRaw: []sample{{20, 1}, {40, 2}, {60, 3}, {80, 1}, {100, 2}, {120, 5}, {180, 10}, {250, 1}},
+			output: map[AggrType][]sample{
+				AggrCount:   {{99, 4}, {199, 3}, {250, 1}},
+				AggrSum:     {{99, 7}, {199, 17}, {250, 1}},
+				AggrMin:     {{99, 1}, {199, 2}, {250, 1}},
+				AggrMax:     {{99, 3}, {199, 10}, {250, 1}},
+				AggrCounter: {{99, 4}, {199, 13}, {250, 14}, {250, 1}},
+				AggrLast:    {{99, 1}, {199, 10}, {250, 1}},
+			},
+		},
+	}
+	testDownsample(t, input, &metadata.Meta{BlockMeta: tsdb.BlockMeta{MinTime: 0, MaxTime: 250}}, 100, AggrLast)
+}
+
+func TestDownsampleAggr_Last(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	input := []*downsampleTestSet{
+		{
+			lset: labels.FromStrings("__name__", "a"),
+			inAggr: map[AggrType][]sample{
+				AggrCount:   {{199, 5}, {299, 1}, {499, 10}, {999, 100}},
+				AggrSum:     {{199, 5}, {299, 1}, {499, 10}, {999, 100}},
+				AggrMin:     {{199, 5}, {299, 1}, {499, 10}, {999, 100}},
+				AggrMax:     {{199, 5}, {299, 1}, {499, 10}, {999, 100}},
+				AggrCounter: {{199, 5}, {299, 6}, {499, 16}, {999, 116}, {999, 116}},
+				AggrLast:    {{199, 3}, {299, 7}, {499, 2}, {999, 42}},
+			},
+			output: map[AggrType][]sample{
+				AggrCount:   {{499, 16}, {999, 100}},
+				AggrSum:     {{499, 16}, {999, 100}},
+				AggrMin:     {{499, 1}, {999, 100}},
+				AggrMax:     {{499, 10}, {999, 100}},
+				AggrCounter: {{499, 16}, {999, 116}, {999, 116}},
+				AggrLast:    {{499, 2}, {999, 42}},
+			},
+		},
+	}
+	var meta metadata.Meta
+	meta.Thanos.Downsample.Resolution = 10
+	meta.BlockMeta = tsdb.BlockMeta{MinTime: 99, MaxTime: 1000}
+
+	// The last value of downsampled data is kept without being requested.
+	testDownsample(t, input, &meta, 500)
+}
+
 func encodeTestAggrSeries(v map[AggrType][]sample) chunks.Meta {
-	b := newAggrChunkBuilder()
+	_, last := v[AggrLast]
+	b := newAggrChunkBuilder(last)
 
 	for at, d := range v {
 		for _, s := range d {
@@ -125,7 +178,7 @@ type downsampleTestSet struct {
 
 // testDownsample inserts the input into a block and invokes the downsampler with the given resolution.
 // The chunk ranges within the input block are aligned at 500 time units.
-func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta, resolution int64) {
+func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta, resolution int64, optionalAggrs ...AggrType) {
 	t.Helper()
 
 	dir, err := ioutil.TempDir("", "downsample-raw")
@@ -160,7 +213,7 @@ func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta
 		mb.addSeries(ser)
 	}
 
-	id, err := Downsample(log.NewNopLogger(), meta, mb, dir, resolution)
+	id, err := Downsample(log.NewNopLogger(), meta, mb, dir, resolution, optionalAggrs...)
 	testutil.Ok(t, err)
 
 	_, err = metadata.Read(filepath.Join(dir, id.String()))
@@ -197,7 +250,7 @@ func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta
 			chk, err := chunkr.Chunk(c.Ref)
 			testutil.Ok(t, err)
 
-			for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+			for at := AggrType(0); int(at) < numAggrTypes; at++ {
 				c, err := chk.(*AggrChunk).Get(at)
 				if err == ErrAggrNotExist {
 					continue
@@ -214,7 +267,7 @@ func testDownsample(t *testing.T, data []*downsampleTestSet, meta *metadata.Meta
 	testutil.Equals(t, len(exp), len(got))
 
 	for h, ser := range exp {
-		for _, at := range []AggrType{AggrCount, AggrSum, AggrMin, AggrMax, AggrCounter} {
+		for at := AggrType(0); int(at) < numAggrTypes; at++ {
 			t.Logf("series %d, type %s", h, at)
 			testutil.Equals(t, ser[at], got[h][at])
 		}
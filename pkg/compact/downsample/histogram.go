@@ -0,0 +1,182 @@
+package downsample
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+)
+
+const (
+	metricNameLabel = "__name__"
+	bucketLabel     = "le"
+	bucketSuffix    = "_bucket"
+)
+
+// histogramFamily is the set of bucket series of a classic histogram. Its buckets are downsampled with the
+// same chunk boundaries and counter resets, so that the downsampled buckets stay consistent with each other.
+// Otherwise a bucket whose value happened to increase across a restart would miss the reset all other buckets
+// had, which breaks histogram_quantile over downsampled data.
+type histogramFamily struct {
+	refs []uint64
+
+	// Timestamps of samples at which any of the buckets was reset.
+	resets []int64
+	// End timestamps of the chunks all buckets are cut into.
+	batchEnds []int64
+	prepared  bool
+}
+
+// histogramFamilyKey returns the key of the histogram family the series belongs to. Series that are not
+// histogram buckets do not belong to any family.
+func histogramFamilyKey(lset labels.Labels) (string, bool) {
+	if !strings.HasSuffix(lset.Get(metricNameLabel), bucketSuffix) || lset.Get(bucketLabel) == "" {
+		return "", false
+	}
+	key := make(labels.Labels, 0, len(lset)-1)
+	for _, l := range lset {
+		if l.Name != bucketLabel {
+			key = append(key, l)
+		}
+	}
+	return key.String(), true
+}
+
+// histogramFamilies returns the histogram families of the index with at least two buckets by series reference.
+func histogramFamilies(indexr tsdb.IndexReader) (map[uint64]*histogramFamily, error) {
+	postings, err := indexr.Postings(index.AllPostingsKey())
+	if err != nil {
+		return nil, errors.Wrap(err, "get all postings list")
+	}
+
+	var (
+		lset     labels.Labels
+		chks     []chunks.Meta
+		families = map[string]*histogramFamily{}
+	)
+	for postings.Next() {
+		if err := indexr.Series(postings.At(), &lset, &chks); err != nil {
+			return nil, errors.Wrapf(err, "get series %d", postings.At())
+		}
+		key, ok := histogramFamilyKey(lset)
+		if !ok {
+			continue
+		}
+		f, ok := families[key]
+		if !ok {
+			f = &histogramFamily{}
+			families[key] = f
+		}
+		f.refs = append(f.refs, postings.At())
+	}
+	if postings.Err() != nil {
+		return nil, errors.Wrap(postings.Err(), "iterate series set")
+	}
+
+	res := map[uint64]*histogramFamily{}
+	for _, f := range families {
+		if len(f.refs) < 2 {
+			continue
+		}
+		for _, ref := range f.refs {
+			res[ref] = f
+		}
+	}
+	return res, nil
+}
+
+// prepare computes the counter resets and chunk boundaries of the family from the samples of all its buckets.
+func (f *histogramFamily) prepare(indexr tsdb.IndexReader, chunkr tsdb.ChunkReader, resolution int64) error {
+	var (
+		lset  labels.Labels
+		chks  []chunks.Meta
+		all   []sample
+		ref   []sample
+		seen  = map[int64]struct{}{}
+		reset = func(t int64) {
+			if _, ok := seen[t]; !ok {
+				seen[t] = struct{}{}
+				f.resets = append(f.resets, t)
+			}
+		}
+	)
+	for _, id := range f.refs {
+		if err := indexr.Series(id, &lset, &chks); err != nil {
+			return errors.Wrapf(err, "get series %d", id)
+		}
+		all = all[:0]
+		for _, c := range chks {
+			chk, err := chunkr.Chunk(c.Ref)
+			if err != nil {
+				return errors.Wrapf(err, "get chunk %d, series %d", c.Ref, id)
+			}
+			if err := expandChunkIterator(chk.Iterator(), &all); err != nil {
+				return errors.Wrapf(err, "expand chunk %d, series %d", c.Ref, id)
+			}
+		}
+		for i := 1; i < len(all); i++ {
+			if all[i].v < all[i-1].v {
+				reset(all[i].t)
+			}
+		}
+		// The bucket with most samples determines the chunk boundaries of all buckets.
+		if len(all) > len(ref) {
+			ref = append(ref[:0], all...)
+		}
+	}
+	sort.Slice(f.resets, func(i, j int) bool {
+		return f.resets[i] < f.resets[j]
+	})
+	f.batchEnds = rawBatchEnds(ref, resolution, f.resets)
+	f.prepared = true
+	return nil
+}
+
+// rawBatchEnds returns the end timestamps of the chunks raw data is downsampled into. Chunks are aligned with
+// windows of the given resolution. A chunk is never cut right before one of the given resets, as a reset would
+// get lost between the last value of one chunk and the first counter value of the next one.
+func rawBatchEnds(data []sample, resolution int64, resets []int64) []int64 {
+	if len(data) == 0 {
+		return nil
+	}
+	var (
+		mint, maxt = data[0].t, data[len(data)-1].t
+		// We assume a raw resolution of 1 minute. In practice it will often be lower
+		// but this is sufficient for our heuristic to produce well-sized chunks.
+		numChunks = targetChunkCount(mint, maxt, 1*60*1000, resolution, len(data))
+		ends      = make([]int64, 0, numChunks)
+		batchSize = (len(data) / numChunks) + 1
+	)
+
+	for len(data) > 0 {
+		j := batchSize
+		if j > len(data) {
+			j = len(data)
+		}
+		curW := currentWindow(data[j-1].t, resolution)
+
+		for {
+			// The batch we took might end in the middle of a downsampling window. We additionally grab
+			// all further samples in the window to keep our samples regular.
+			for ; j < len(data) && data[j].t <= curW; j++ {
+			}
+			if j == len(data) || !resetBetween(resets, data[j-1].t, data[j].t) {
+				break
+			}
+			curW = currentWindow(data[j].t, resolution)
+		}
+		ends = append(ends, curW)
+		data = data[j:]
+	}
+	return ends
+}
+
+// resetBetween returns true if any of the sorted resets is within (mint, maxt].
+func resetBetween(resets []int64, mint, maxt int64) bool {
+	i := sort.Search(len(resets), func(i int) bool { return resets[i] > mint })
+	return i < len(resets) && resets[i] <= maxt
+}
@@ -0,0 +1,261 @@
+package downsample
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
+	"github.com/prometheus/tsdb/chunks"
+	"github.com/prometheus/tsdb/index"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestHistogramFamilyKey(t *testing.T) {
+	k1, ok := histogramFamilyKey(labels.FromStrings("__name__", "x_bucket", "le", "1", "a", "b"))
+	testutil.Assert(t, ok, "bucket not detected")
+	k2, ok := histogramFamilyKey(labels.FromStrings("__name__", "x_bucket", "le", "+Inf", "a", "b"))
+	testutil.Assert(t, ok, "bucket not detected")
+	testutil.Equals(t, k1, k2)
+
+	k3, ok := histogramFamilyKey(labels.FromStrings("__name__", "x_bucket", "le", "1", "a", "c"))
+	testutil.Assert(t, ok, "bucket not detected")
+	testutil.Assert(t, k1 != k3, "different histograms in the same family")
+
+	_, ok = histogramFamilyKey(labels.FromStrings("__name__", "x_count", "le", "1"))
+	testutil.Assert(t, !ok, "non-bucket series detected as bucket")
+	_, ok = histogramFamilyKey(labels.FromStrings("__name__", "x_bucket"))
+	testutil.Assert(t, !ok, "bucket without le label detected as bucket")
+}
+
+func TestRawBatchEnds(t *testing.T) {
+	var data []sample
+	for i := int64(0); i < 1000; i++ {
+		data = append(data, sample{i * 10, float64(i)})
+	}
+	testutil.Equals(t, []int64{2519, 5039, 7559, 9999}, rawBatchEnds(data, 20, nil))
+
+	// Chunks are not cut right before a reset, but extended to the end of the window with the reset.
+	testutil.Equals(t, []int64{2539, 5079, 7599, 9999}, rawBatchEnds(data, 20, []int64{2520, 5060}))
+}
+
+func TestDownsampleHistogram(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	const (
+		scrapeInterval = int64(15 * 1000)
+		numScrapes     = 6 * 240
+		restartAt      = 3 * 240
+		hour           = int64(60 * 60 * 1000)
+	)
+	bounds := []float64{1, 5, math.Inf(+1)}
+
+	// Observations per scrape within each bucket's range. The process restarts at the scrape restartAt.
+	// The first bucket's value before the restart is lower than right after it, so its reset can only be
+	// detected through the other buckets.
+	obs := make([][]float64, numScrapes)
+	for i := range obs {
+		obs[i] = []float64{0, 2, 1}
+		switch {
+		case i == 0:
+			obs[i][0] = 3
+		case i == restartAt:
+			obs[i][0] = 10
+		case i > restartAt && i%4 == 0:
+			obs[i][0] = 1
+		}
+	}
+
+	// The raw bucket values as exposed by the process, which are reset by the restart, and the
+	// true number of observations since the beginning.
+	var (
+		raw   = make([][]sample, len(bounds))
+		truth = make([][]sample, len(bounds))
+		cur   = make([]float64, len(bounds))
+		total = make([]float64, len(bounds))
+	)
+	for i, o := range obs {
+		if i == restartAt {
+			cur = make([]float64, len(bounds))
+		}
+		ts := int64(i) * scrapeInterval
+
+		var cum float64
+		for b := range bounds {
+			cum += o[b]
+			cur[b] += cum
+			total[b] += cum
+			raw[b] = append(raw[b], sample{ts, cur[b]})
+			truth[b] = append(truth[b], sample{ts, total[b]})
+		}
+	}
+
+	mb := newMemBlock()
+	var lsets []labels.Labels
+	for _, method := range []string{"get", "post"} {
+		for _, le := range bounds {
+			lsets = append(lsets, labels.FromStrings("__name__", "req_bucket", "le", strconv.FormatFloat(le, 'f', -1, 64), "method", method))
+		}
+	}
+	sort.Slice(lsets, func(i, j int) bool { return labels.Compare(lsets[i], lsets[j]) < 0 })
+
+	for _, lset := range lsets {
+		b := 0
+		for b < len(bounds) && strconv.FormatFloat(bounds[b], 'f', -1, 64) != lset.Get("le") {
+			b++
+		}
+		chk := chunkenc.NewXORChunk()
+		app, err := chk.Appender()
+		testutil.Ok(t, err)
+		for _, s := range raw[b] {
+			app.Append(s.t, s.v)
+		}
+		mb.addSeries(&series{lset: lset, chunks: []chunks.Meta{{MinTime: raw[b][0].t, MaxTime: raw[b][len(raw[b])-1].t, Chunk: chk}}})
+	}
+
+	dir, err := ioutil.TempDir("", "downsample-histogram")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	meta := &metadata.Meta{BlockMeta: tsdb.BlockMeta{MinTime: 0, MaxTime: numScrapes * scrapeInterval}}
+	id, err := Downsample(log.NewNopLogger(), meta, mb, dir, ResLevel1)
+	testutil.Ok(t, err)
+
+	downsampled := readCounters(t, filepath.Join(dir, id.String()))
+	testutil.Equals(t, len(lsets), len(downsampled))
+
+	// Every downsampled counter value matches the true number of observations.
+	for _, lset := range lsets {
+		got := downsampled[lset.String()]
+		b := 0
+		for b < len(bounds) && strconv.FormatFloat(bounds[b], 'f', -1, 64) != lset.Get("le") {
+			b++
+		}
+		testutil.Assert(t, len(got) > 0, "no samples for %s", lset)
+		for _, s := range got {
+			testutil.Equals(t, valueAt(truth[b], s.t), s.v)
+		}
+	}
+
+	// Quantiles over hourly increases of downsampled data match the raw ones, including the hour of the restart.
+	// Downsampling buckets independently loses the reset of the first bucket and gets the quantile wrong.
+	var independent [][]sample
+	for b := range bounds {
+		var chks []*AggrChunk
+		for _, c := range downsampleRaw(raw[b], ResLevel1, false) {
+			chks = append(chks, c.Chunk.(*AggrChunk))
+		}
+		independent = append(independent, expandCounter(t, chks))
+	}
+	for h := int64(1); h < 6; h++ {
+		mint, maxt := (h-1)*hour-1, h*hour-1
+
+		var exp, got, indep []float64
+		for b, le := range bounds {
+			lset := labels.FromStrings("__name__", "req_bucket", "le", strconv.FormatFloat(le, 'f', -1, 64), "method", "get")
+
+			exp = append(exp, valueAt(truth[b], maxt)-valueAt(truth[b], mint))
+			got = append(got, valueAt(downsampled[lset.String()], maxt)-valueAt(downsampled[lset.String()], mint))
+			indep = append(indep, valueAt(independent[b], maxt)-valueAt(independent[b], mint))
+		}
+		for _, q := range []float64{0.1, 0.5, 0.9} {
+			testutil.Equals(t, bucketQuantile(q, bounds, exp), bucketQuantile(q, bounds, got))
+		}
+		if h == restartAt*scrapeInterval/hour+1 {
+			testutil.Assert(t, bucketQuantile(0.1, bounds, exp) != bucketQuantile(0.1, bounds, indep),
+				"expected independently downsampled buckets to be inconsistent")
+		}
+	}
+}
+
+// readCounters reads the counter aggregates of all series of the downsampled block.
+func readCounters(t *testing.T, dir string) map[string][]sample {
+	indexr, err := index.NewFileReader(filepath.Join(dir, block.IndexFilename))
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, indexr.Close()) }()
+
+	chunkr, err := chunks.NewDirReader(filepath.Join(dir, block.ChunksDirname), NewPool())
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, chunkr.Close()) }()
+
+	pall, err := indexr.Postings(index.AllPostingsKey())
+	testutil.Ok(t, err)
+
+	res := map[string][]sample{}
+	for pall.Next() {
+		var (
+			lset labels.Labels
+			chks []chunks.Meta
+			achs []*AggrChunk
+		)
+		testutil.Ok(t, indexr.Series(pall.At(), &lset, &chks))
+
+		for _, c := range chks {
+			chk, err := chunkr.Chunk(c.Ref)
+			testutil.Ok(t, err)
+			achs = append(achs, chk.(*AggrChunk))
+		}
+		res[lset.String()] = expandCounter(t, achs)
+	}
+	testutil.Ok(t, pall.Err())
+	return res
+}
+
+func expandCounter(t *testing.T, chks []*AggrChunk) []sample {
+	var its []chunkenc.Iterator
+	for _, c := range chks {
+		x, err := c.Get(AggrCounter)
+		testutil.Ok(t, err)
+		its = append(its, x.Iterator())
+	}
+	var res []sample
+	testutil.Ok(t, expandChunkIterator(NewCounterSeriesIterator(its...), &res))
+	return res
+}
+
+// valueAt returns the value of the last sample at or before t.
+func valueAt(samples []sample, t int64) float64 {
+	var v float64
+	for _, s := range samples {
+		if s.t > t {
+			break
+		}
+		v = s.v
+	}
+	return v
+}
+
+// bucketQuantile calculates the quantile of cumulative bucket counts the way histogram_quantile does.
+func bucketQuantile(q float64, bounds []float64, counts []float64) float64 {
+	observations := counts[len(counts)-1]
+	if observations == 0 {
+		return math.NaN()
+	}
+	rank := q * observations
+	b := sort.SearchFloat64s(counts, rank)
+	if b == len(bounds)-1 {
+		return bounds[len(bounds)-2]
+	}
+	var (
+		bucketStart float64
+		bucketEnd   = bounds[b]
+		count       = counts[b]
+	)
+	if b > 0 {
+		bucketStart = bounds[b-1]
+		count -= counts[b-1]
+		rank -= counts[b-1]
+	}
+	return bucketStart + (bucketEnd-bucketStart)*(rank/count)
+}
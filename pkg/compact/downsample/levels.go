@@ -0,0 +1,152 @@
+package downsample
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/common/model"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// Level is a downsampling resolution level.
+type Level struct {
+	// Resolution of the downsampled data in milliseconds.
+	Resolution int64
+	// MinBlockRange is the minimum time range in milliseconds a block of the previous level
+	// must span before it is downsampled to this level.
+	MinBlockRange int64
+}
+
+func (l Level) String() string {
+	return model.Duration(time.Duration(l.Resolution)*time.Millisecond).String() + ":" +
+		model.Duration(time.Duration(l.MinBlockRange)*time.Millisecond).String()
+}
+
+// ParseLevel parses a level in the form <resolution>:<min block range>, e.g. 5m:40h.
+func ParseLevel(s string) (Level, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return Level{}, errors.Errorf("invalid downsampling level %q, expected <resolution>:<min block range>", s)
+	}
+	res, err := model.ParseDuration(parts[0])
+	if err != nil {
+		return Level{}, errors.Wrapf(err, "parse resolution of downsampling level %q", s)
+	}
+	minRange, err := model.ParseDuration(parts[1])
+	if err != nil {
+		return Level{}, errors.Wrapf(err, "parse min block range of downsampling level %q", s)
+	}
+	return Level{
+		Resolution:    int64(time.Duration(res) / time.Millisecond),
+		MinBlockRange: int64(time.Duration(minRange) / time.Millisecond),
+	}, nil
+}
+
+// Levels is a set of downsampling levels ordered by increasing resolution.
+// Raw data is not part of it.
+type Levels []Level
+
+// DefaultLevels are the standard downsampling levels in Thanos.
+var DefaultLevels = Levels{
+	{Resolution: ResLevel1, MinBlockRange: DownsampleRange0},
+	{Resolution: ResLevel2, MinBlockRange: DownsampleRange1},
+}
+
+// ParseLevels parses the given levels in the form accepted by ParseLevel and validates them.
+// DefaultLevels are returned if no level is given.
+func ParseLevels(ss []string) (Levels, error) {
+	if len(ss) == 0 {
+		return DefaultLevels, nil
+	}
+	ls := make(Levels, 0, len(ss))
+	for _, s := range ss {
+		l, err := ParseLevel(s)
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].Resolution < ls[j].Resolution
+	})
+	for i, l := range ls {
+		if l.Resolution <= 0 {
+			return nil, errors.Errorf("resolution of downsampling level %s must be positive", l)
+		}
+		if i > 0 && ls[i-1].Resolution == l.Resolution {
+			return nil, errors.Errorf("duplicate downsampling resolution %s", l)
+		}
+		// Blocks need to span a few windows of the new resolution to yield any reasonable chunks.
+		if l.MinBlockRange <= l.Resolution {
+			return nil, errors.Errorf("min block range of downsampling level %s must be greater than its resolution", l)
+		}
+	}
+	return ls, nil
+}
+
+// Resolutions returns the raw resolution followed by the resolutions of all levels.
+func (ls Levels) Resolutions() []int64 {
+	res := []int64{ResLevel0}
+	for _, l := range ls {
+		res = append(res, l.Resolution)
+	}
+	return res
+}
+
+// Next returns the level blocks with the given resolution are downsampled to next.
+// Only raw blocks and blocks of one of the levels are downsampled any further.
+func (ls Levels) Next(resolution int64) (Level, bool) {
+	if resolution == ResLevel0 && len(ls) > 0 {
+		return ls[0], true
+	}
+	for i, l := range ls {
+		if l.Resolution == resolution && i+1 < len(ls) {
+			return ls[i+1], true
+		}
+	}
+	return Level{}, false
+}
+
+// Sources maps resolutions to the IDs of the source blocks that are covered by blocks with that resolution.
+type Sources map[int64]map[ulid.ULID]struct{}
+
+// Add adds the sources of the given block.
+func (s Sources) Add(m *metadata.Meta) {
+	res := m.Thanos.Downsample.Resolution
+	if res == ResLevel0 {
+		return
+	}
+	if s[res] == nil {
+		s[res] = map[ulid.ULID]struct{}{}
+	}
+	for _, id := range m.Compaction.Sources {
+		s[res][id] = struct{}{}
+	}
+}
+
+// Missing returns true if any source of the given block is not yet covered by a block with the given resolution.
+func (s Sources) Missing(m *metadata.Meta, resolution int64) bool {
+	for _, id := range m.Compaction.Sources {
+		if _, ok := s[resolution][id]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Due returns the level the given block must be downsampled to, if any. A block is only downsampled
+// once we are sure to get roughly 2 chunks out of it and if not all of its sources are already covered
+// by blocks of the next level.
+func (ls Levels) Due(m *metadata.Meta, sources Sources) (Level, bool) {
+	l, ok := ls.Next(m.Thanos.Downsample.Resolution)
+	if !ok {
+		return Level{}, false
+	}
+	if m.MaxTime-m.MinTime < l.MinBlockRange || !sources.Missing(m, l.Resolution) {
+		return Level{}, false
+	}
+	return l, true
+}
@@ -0,0 +1,67 @@
+package downsample
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestParseLevels(t *testing.T) {
+	ls, err := ParseLevels(nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, DefaultLevels, ls)
+
+	ls, err = ParseLevels([]string{"1h:10d", "5m:40h"})
+	testutil.Ok(t, err)
+	testutil.Equals(t, DefaultLevels, ls)
+	testutil.Equals(t, "[5m:40h 1h:10d]", fmt.Sprint(ls))
+
+	for _, s := range []string{"5m", "5m:40h:1d", "x:40h", "5m:x", "0s:1h", "1h:1h", "5m:40h,5m:50h"} {
+		_, err := ParseLevels(strings.Split(s, ","))
+		testutil.NotOk(t, err)
+	}
+}
+
+func TestLevels_Due(t *testing.T) {
+	ls, err := ParseLevels([]string{"1m:2h", "15m:10h"})
+	testutil.Ok(t, err)
+
+	newMeta := func(id uint64, res, maxt int64, sources ...uint64) *metadata.Meta {
+		m := &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: ulid.MustNew(id, nil), MaxTime: maxt}}
+		m.Thanos.Downsample.Resolution = res
+		for _, s := range sources {
+			m.Compaction.Sources = append(m.Compaction.Sources, ulid.MustNew(s, nil))
+		}
+		return m
+	}
+	hour := int64(60 * 60 * 1000)
+	sources := Sources{}
+
+	// Raw blocks are downsampled to the first level once they are long enough.
+	_, ok := ls.Due(newMeta(1, ResLevel0, hour, 1), sources)
+	testutil.Assert(t, !ok, "short raw block due")
+	l, ok := ls.Due(newMeta(1, ResLevel0, 2*hour, 1), sources)
+	testutil.Assert(t, ok, "raw block not due")
+	testutil.Equals(t, ls[0], l)
+
+	// Once all sources are covered by the next level, the block is done.
+	sources.Add(newMeta(2, ls[0].Resolution, 2*hour, 1))
+	_, ok = ls.Due(newMeta(1, ResLevel0, 2*hour, 1), sources)
+	testutil.Assert(t, !ok, "downsampled raw block due")
+	_, ok = ls.Due(newMeta(3, ResLevel0, 2*hour, 1, 3), sources)
+	testutil.Assert(t, ok, "raw block with new sources not due")
+
+	// Blocks of the last level and of unknown resolutions are not downsampled any further.
+	l, ok = ls.Due(newMeta(4, ls[0].Resolution, 10*hour, 1), sources)
+	testutil.Assert(t, ok, "first level block not due")
+	testutil.Equals(t, ls[1], l)
+	_, ok = ls.Due(newMeta(5, ls[1].Resolution, 100*hour, 1), sources)
+	testutil.Assert(t, !ok, "last level block due")
+	_, ok = ls.Due(newMeta(6, ResLevel1, 100*hour, 1), sources)
+	testutil.Assert(t, !ok, "block of unknown resolution due")
+}
@@ -0,0 +1,348 @@
+package compact
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+)
+
+// DryRun records the changes the compactor would make to a bucket instead of making them.
+// Compactions and downsamplings are simulated on the metas of the blocks only, so that later
+// steps of a dry run see the blocks earlier steps would have created and deleted.
+type DryRun struct {
+	logger log.Logger
+
+	mtx     sync.Mutex
+	entropy *rand.Rand
+	created map[ulid.ULID]*metadata.Meta
+	deleted map[ulid.ULID]struct{}
+	report  DryRunReport
+}
+
+// DryRunReport lists the changes of a dry run in the order they would have been made.
+type DryRunReport struct {
+	Compactions        []PlannedCompaction   `json:"compactions"`
+	NoCompactMarks     []ulid.ULID           `json:"noCompactMarks"`
+	Downsamplings      []PlannedDownsampling `json:"downsamplings"`
+	RetentionDeletions []ulid.ULID           `json:"retentionDeletions"`
+	GarbageCollections []ulid.ULID           `json:"garbageCollections"`
+}
+
+// PlannedCompaction is a compaction of blocks of a group into a single block.
+type PlannedCompaction struct {
+	Group  string      `json:"group"`
+	Blocks []ulid.ULID `json:"blocks"`
+	// Result is the made up ID of the compacted block.
+	Result  ulid.ULID `json:"result"`
+	MinTime int64     `json:"minTime"`
+	MaxTime int64     `json:"maxTime"`
+	Level   int       `json:"level"`
+}
+
+// PlannedDownsampling is a downsampling of a block to a resolution.
+type PlannedDownsampling struct {
+	Block ulid.ULID `json:"block"`
+	// Result is the made up ID of the downsampled block.
+	Result     ulid.ULID `json:"result"`
+	MinTime    int64     `json:"minTime"`
+	MaxTime    int64     `json:"maxTime"`
+	Resolution int64     `json:"resolution"`
+}
+
+// NewDryRun returns a new DryRun that logs every recorded change.
+func NewDryRun(logger log.Logger) *DryRun {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &DryRun{
+		logger:  logger,
+		entropy: rand.New(rand.NewSource(time.Now().UnixNano())),
+		created: map[ulid.ULID]*metadata.Meta{},
+		deleted: map[ulid.ULID]struct{}{},
+	}
+}
+
+// Report returns the changes recorded so far.
+func (d *DryRun) Report() DryRunReport {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	return d.report
+}
+
+// Apply returns the given metas of the blocks in the bucket as they would be after the recorded changes,
+// sorted by ID.
+func (d *DryRun) Apply(metas []*metadata.Meta) []*metadata.Meta {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	res := make([]*metadata.Meta, 0, len(metas)+len(d.created))
+	for _, m := range metas {
+		if _, ok := d.deleted[m.ULID]; ok {
+			continue
+		}
+		if _, ok := d.created[m.ULID]; ok {
+			continue
+		}
+		res = append(res, m)
+	}
+	for _, m := range d.created {
+		res = append(res, m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ULID.Compare(res[j].ULID) < 0
+	})
+	return res
+}
+
+// Compacted records the compaction of the given blocks of a group and returns the meta of the compacted block.
+func (d *DryRun) Compacted(group string, metas []*metadata.Meta) *metadata.Meta {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	res := *metas[0]
+	res.ULID = d.newULID()
+	res.Thanos.Source = metadata.CompactorSource
+	res.Compaction.Sources = nil
+	res.Compaction.Parents = nil
+	res.Stats = tsdb.BlockStats{}
+
+	var (
+		ids       = make([]ulid.ULID, 0, len(metas))
+		indexSize int64
+	)
+	for _, m := range metas {
+		if m.MinTime < res.MinTime {
+			res.MinTime = m.MinTime
+		}
+		if m.MaxTime > res.MaxTime {
+			res.MaxTime = m.MaxTime
+		}
+		if m.Compaction.Level > res.Compaction.Level {
+			res.Compaction.Level = m.Compaction.Level
+		}
+		res.Compaction.Sources = append(res.Compaction.Sources, m.Compaction.Sources...)
+		res.Compaction.Parents = append(res.Compaction.Parents, tsdb.BlockDesc{ULID: m.ULID, MinTime: m.MinTime, MaxTime: m.MaxTime})
+		// Series present in multiple blocks are counted multiple times, which makes the stats an upper bound.
+		res.Stats.NumSeries += m.Stats.NumSeries
+		res.Stats.NumSamples += m.Stats.NumSamples
+		res.Stats.NumChunks += m.Stats.NumChunks
+		indexSize += m.IndexSize()
+		ids = append(ids, m.ULID)
+
+		d.delete(m.ULID)
+	}
+	res.Compaction.Level++
+	sort.Slice(res.Compaction.Sources, func(i, j int) bool {
+		return res.Compaction.Sources[i].Compare(res.Compaction.Sources[j]) < 0
+	})
+	res.Thanos.Files = nil
+	if indexSize > 0 {
+		res.Thanos.Files = []metadata.File{{RelPath: metadata.IndexFilename, SizeBytes: indexSize}}
+	}
+	d.created[res.ULID] = &res
+
+	d.report.Compactions = append(d.report.Compactions, PlannedCompaction{
+		Group:   group,
+		Blocks:  ids,
+		Result:  res.ULID,
+		MinTime: res.MinTime,
+		MaxTime: res.MaxTime,
+		Level:   res.Compaction.Level,
+	})
+	level.Info(d.logger).Log("msg", "dry run: would compact blocks", "group", group, "blocks", fmt.Sprintf("%v", ids),
+		"mint", timestamp(res.MinTime), "maxt", timestamp(res.MaxTime), "level", res.Compaction.Level)
+	return &res
+}
+
+// MarkedForNoCompact records that the block would be marked for no compaction.
+func (d *DryRun) MarkedForNoCompact(id ulid.ULID, reason metadata.NoCompactReason) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.report.NoCompactMarks = append(d.report.NoCompactMarks, id)
+	level.Info(d.logger).Log("msg", "dry run: would mark block for no compaction", "block", id, "reason", reason)
+}
+
+// Downsampled records the downsampling of the block to the given resolution and returns the meta of the downsampled block.
+func (d *DryRun) Downsampled(m *metadata.Meta, resolution int64) *metadata.Meta {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	res := *m
+	res.ULID = d.newULID()
+	res.Thanos.Downsample.Resolution = resolution
+	res.Thanos.Files = nil
+	d.created[res.ULID] = &res
+
+	d.report.Downsamplings = append(d.report.Downsamplings, PlannedDownsampling{
+		Block:      m.ULID,
+		Result:     res.ULID,
+		MinTime:    res.MinTime,
+		MaxTime:    res.MaxTime,
+		Resolution: resolution,
+	})
+	level.Info(d.logger).Log("msg", "dry run: would downsample block", "block", m.ULID, "resolution", ResolutionLevel(resolution),
+		"mint", timestamp(res.MinTime), "maxt", timestamp(res.MaxTime))
+	return &res
+}
+
+// DeletedByRetention records the deletion of the block by the retention policy.
+func (d *DryRun) DeletedByRetention(m *metadata.Meta) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.delete(m.ULID)
+	d.report.RetentionDeletions = append(d.report.RetentionDeletions, m.ULID)
+	level.Info(d.logger).Log("msg", "dry run: would delete block due to retention", "block", m.ULID,
+		"resolution", ResolutionLevel(m.Thanos.Downsample.Resolution), "maxt", timestamp(m.MaxTime))
+}
+
+// GarbageCollected records the deletion of the block by the garbage collection.
+func (d *DryRun) GarbageCollected(id ulid.ULID) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.delete(id)
+	d.report.GarbageCollections = append(d.report.GarbageCollections, id)
+	level.Info(d.logger).Log("msg", "dry run: would delete outdated block", "block", id)
+}
+
+// delete records the deletion of the block. The lock of d must be held.
+func (d *DryRun) delete(id ulid.ULID) {
+	if _, ok := d.created[id]; ok {
+		delete(d.created, id)
+		return
+	}
+	d.deleted[id] = struct{}{}
+}
+
+// newULID returns a new block ID. The lock of d must be held.
+func (d *DryRun) newULID() ulid.ULID {
+	return ulid.MustNew(ulid.Now(), d.entropy)
+}
+
+func timestamp(t int64) string {
+	return time.Unix(t/1000, (t%1000)*int64(time.Millisecond)).UTC().Format(time.RFC3339)
+}
+
+// dryRunGarbageCollect records the blocks GarbageCollect would delete and forgets them,
+// just like GarbageCollect does after deleting them.
+func (c *Syncer) dryRunGarbageCollect(d *DryRun) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, res := range c.resolutions() {
+		ids, err := c.GarbageBlocks(res)
+		if err != nil {
+			return errors.Wrapf(err, "garbage collect resolution %d", res)
+		}
+		for _, id := range ids {
+			d.GarbageCollected(id)
+			delete(c.blocks, id)
+		}
+	}
+	return nil
+}
+
+// dryRunCompact records all compactions of the group, until there is nothing left to compact. Instead of
+// compacting the planned blocks, they are replaced by the meta of the would-be compacted block, which is
+// then considered by the next plan.
+func (cg *Group) dryRunCompact(dir string, comp tsdb.Compactor, d *DryRun) error {
+	cg.mtx.Lock()
+	defer cg.mtx.Unlock()
+
+	if err := cg.areBlocksOverlapping(nil); err != nil {
+		return halt(errors.Wrap(err, "pre compaction overlap check"))
+	}
+
+	subDir := filepath.Join(dir, cg.Key())
+	defer func() {
+		if err := os.RemoveAll(subDir); err != nil {
+			level.Warn(cg.logger).Log("msg", "failed to remove planning group dir", "dir", subDir, "err", err)
+		}
+	}()
+
+	for {
+		if err := os.RemoveAll(subDir); err != nil {
+			return errors.Wrap(err, "clean planning group dir")
+		}
+		plan, err := cg.plan(subDir, comp)
+		if err != nil {
+			return err
+		}
+		if len(plan) == 0 {
+			return nil
+		}
+		plan, exceeding, err := cg.limitPlan(plan)
+		if err != nil {
+			return err
+		}
+		if exceeding != nil {
+			d.MarkedForNoCompact(exceeding.ULID, metadata.IndexSizeExceedingNoCompactReason)
+			cg.noCompact[exceeding.ULID] = struct{}{}
+			continue
+		}
+
+		metas := make([]*metadata.Meta, 0, len(plan))
+		for _, pdir := range plan {
+			id, err := ulid.Parse(filepath.Base(pdir))
+			if err != nil {
+				return errors.Wrapf(err, "plan dir %s", pdir)
+			}
+			metas = append(metas, cg.blocks[id])
+		}
+		sort.Slice(metas, func(i, j int) bool {
+			return metas[i].MinTime < metas[j].MinTime
+		})
+
+		res := d.Compacted(cg.Key(), metas)
+		for _, m := range metas {
+			delete(cg.blocks, m.ULID)
+		}
+		cg.blocks[res.ULID] = res
+	}
+}
+
+// dryRunCompact records the garbage collection and all compactions of a single pass of Compact.
+func (c *BucketCompactor) dryRunCompact(ctx context.Context) error {
+	level.Info(c.logger).Log("msg", "start sync of metas")
+
+	if err := c.sy.SyncMetas(ctx); err != nil {
+		return errors.Wrap(err, "sync")
+	}
+
+	level.Info(c.logger).Log("msg", "start of GC")
+
+	if err := c.sy.dryRunGarbageCollect(c.dryRun); err != nil {
+		return errors.Wrap(err, "garbage")
+	}
+
+	level.Info(c.logger).Log("msg", "start of compaction")
+
+	groups, err := c.sy.Groups()
+	if err != nil {
+		return errors.Wrap(err, "build compaction groups")
+	}
+	for _, g := range groups {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := g.dryRunCompact(c.compactDir, c.comp, c.dryRun); err != nil {
+			return errors.Wrapf(err, "compaction failed for group %s", g.Key())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBucketCompactor_DryRun(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "compact-dry-run")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	hour := int64(time.Hour / time.Millisecond)
+	bkt := inmem.NewBucket()
+
+	upload := func(id uint64, lbls map[string]string, minTime, maxTime int64, lvl int, res int64, sources ...ulid.ULID) *metadata.Meta {
+		var m metadata.Meta
+		m.Version = 1
+		m.ULID = ulid.MustNew(id, nil)
+		m.MinTime = minTime
+		m.MaxTime = maxTime
+		m.Compaction.Level = lvl
+		m.Compaction.Sources = append([]ulid.ULID{m.ULID}, sources...)
+		m.Thanos.Labels = lbls
+		m.Thanos.Downsample.Resolution = res
+		m.Thanos.Source = metadata.TestSource
+
+		b, err := json.Marshal(&m)
+		testutil.Ok(t, err)
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), block.MetaFilename), bytes.NewReader(b)))
+		return &m
+	}
+
+	// Nine consecutive 2h blocks; the first eight fill two whole 8h ranges.
+	var raw []*metadata.Meta
+	for i := int64(0); i < 9; i++ {
+		raw = append(raw, upload(uint64(i+1), map[string]string{"a": "1"}, i*2*hour, (i+1)*2*hour, 1, 0))
+	}
+	// A block whose sources are part of a block with a higher compaction level.
+	garbage := upload(10, map[string]string{"a": "2"}, 0, 2*hour, 1, 0)
+	upload(11, map[string]string{"a": "2"}, 0, 4*hour, 2, 0, garbage.ULID)
+	// A downsampled block that is due for deletion by the retention policy.
+	old := upload(12, map[string]string{"a": "3"}, 0, 2*hour, 1, int64(ResolutionLevel5m))
+
+	objects := len(bkt.Objects())
+
+	ro := objstore.ReadOnlyBucket(bkt)
+	sy, err := NewSyncer(nil, nil, ro, 0, 1, false, 0, nil)
+	testutil.Ok(t, err)
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, nil, []int64{2 * hour, 8 * hour}, nil)
+	testutil.Ok(t, err)
+
+	d := NewDryRun(nil)
+	bc, err := NewBucketCompactor(log.NewNopLogger(), sy, comp, dir, ro, 1, nil, d)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bc.Compact(ctx))
+	testutil.Ok(t, ApplyRetentionPolicyByResolution(ctx, log.NewNopLogger(), ro, map[ResolutionLevel]time.Duration{
+		ResolutionLevel5m: time.Hour,
+	}, d))
+
+	r := d.Report()
+	testutil.Equals(t, 2, len(r.Compactions))
+	for i, c := range r.Compactions {
+		testutil.Equals(t, "0@{a=\"1\"}", c.Group)
+		testutil.Equals(t, []ulid.ULID{raw[4*i].ULID, raw[4*i+1].ULID, raw[4*i+2].ULID, raw[4*i+3].ULID}, c.Blocks)
+		testutil.Equals(t, int64(i)*8*hour, c.MinTime)
+		testutil.Equals(t, int64(i+1)*8*hour, c.MaxTime)
+		testutil.Equals(t, 2, c.Level)
+	}
+	testutil.Equals(t, []ulid.ULID{garbage.ULID}, r.GarbageCollections)
+	testutil.Equals(t, []ulid.ULID{old.ULID}, r.RetentionDeletions)
+	testutil.Equals(t, 0, len(r.Downsamplings))
+	testutil.Equals(t, 0, len(r.NoCompactMarks))
+
+	// The compacted blocks replace their inputs in the state after the dry run.
+	after := d.Apply(append(append([]*metadata.Meta{}, raw...), garbage, old))
+	testutil.Equals(t, 3, len(after))
+	testutil.Equals(t, raw[8].ULID, after[0].ULID)
+	testutil.Equals(t, r.Compactions[0].Result, after[1].ULID)
+	testutil.Equals(t, r.Compactions[1].Result, after[2].ULID)
+	testutil.Equals(t, raw[0].ULID, after[1].Compaction.Sources[0])
+	testutil.Equals(t, 4, len(after[1].Compaction.Sources))
+
+	// Nothing was changed in the bucket.
+	testutil.Equals(t, objects, len(bkt.Objects()))
+}
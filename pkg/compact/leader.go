@@ -0,0 +1,414 @@
+package compact
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+const (
+	// LeaseFilename is the name of the object in the root of the bucket holding the lease of the leading compactor.
+	LeaseFilename = "thanos-compact-lease.json"
+
+	// LeaseVersion1 is an enumeration of lease versions supported by Thanos.
+	LeaseVersion1 = 1
+
+	// DefaultLeaseSettleDelay is the time a compactor waits after writing the lease before reading it back
+	// to check whether it won the lease, if the bucket does not support conditional uploads.
+	DefaultLeaseSettleDelay = 5 * time.Second
+)
+
+// ErrLeadershipLost is the cause of errors returned by LeaderElector.Do if the lease was lost while running.
+var ErrLeadershipLost = errors.New("leadership lost")
+
+// IsLeadershipLostErr returns true if the error was caused by losing the lease.
+func IsLeadershipLostErr(err error) bool {
+	return errors.Cause(err) == ErrLeadershipLost
+}
+
+// Lease is the content of the lease object. Timestamps are in milliseconds since epoch.
+type Lease struct {
+	Version int `json:"version"`
+	// Holder is the identity of the compactor holding the lease. Empty if the lease was released.
+	Holder        string `json:"holder"`
+	AcquireTime   int64  `json:"acquire_time"`
+	RenewTime     int64  `json:"renew_time"`
+	LeaseDuration int64  `json:"lease_duration_ms"`
+}
+
+// LeaderElector makes sure that only a single compactor works on a bucket at a time, by holding a lease
+// object in the bucket which has to be renewed periodically.
+//
+// A lease is considered expired if its content did not change for its duration since it was first observed.
+// Expiry is based on the local clock of the observer only, so clocks of compactors do not have to be in sync.
+//
+// If the bucket supports conditional uploads, the lease is only written if it did not change since it was read,
+// so two compactors can never hold the lease at the same time. Otherwise a best-effort protocol is used: a compactor
+// writes the lease, waits for a settle delay and reads the lease back to check that it was not overwritten by
+// another compactor. In rare races two compactors may both believe to be the leader, until the next renewal,
+// where the one whose lease was overwritten steps down.
+type LeaderElector struct {
+	logger        log.Logger
+	bkt           objstore.Bucket
+	cbkt          objstore.ConditionalBucket
+	holder        string
+	leaseDuration time.Duration
+	renewInterval time.Duration
+	settleDelay   time.Duration
+
+	mtx          sync.Mutex
+	observedRaw  []byte
+	observedTime time.Time
+	lastRenew    time.Time
+	leading      bool
+	acquired     chan struct{}
+	term         context.Context
+	termCancel   context.CancelFunc
+
+	leader      prometheus.Gauge
+	leaderInfo  *prometheus.GaugeVec
+	transitions prometheus.Counter
+}
+
+// NewLeaderElector returns a new LeaderElector competing for the lease in the given bucket under the given holder identity.
+// The lease is renewed every renewInterval and expires if it was not renewed for leaseDuration.
+func NewLeaderElector(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	bkt objstore.Bucket,
+	holder string,
+	leaseDuration time.Duration,
+	renewInterval time.Duration,
+) (*LeaderElector, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if holder == "" {
+		return nil, errors.New("empty lease holder identity")
+	}
+	if renewInterval <= 0 || renewInterval >= leaseDuration {
+		return nil, errors.Errorf("lease renew interval %s must be greater than 0 and less than the lease duration %s", renewInterval, leaseDuration)
+	}
+	e := &LeaderElector{
+		logger:        logger,
+		bkt:           bkt,
+		holder:        holder,
+		leaseDuration: leaseDuration,
+		renewInterval: renewInterval,
+		settleDelay:   DefaultLeaseSettleDelay,
+		acquired:      make(chan struct{}),
+		leader: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_leader",
+			Help: "Set to 1 if this compactor holds the lease of the bucket.",
+		}),
+		leaderInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "thanos_compact_leader_info",
+			Help: "Set to 1 for the compactor currently holding the lease of the bucket, as observed by this compactor.",
+		}, []string{"holder"}),
+		transitions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "thanos_compact_leader_transitions_total",
+			Help: "Total number of times this compactor acquired the lease of the bucket.",
+		}),
+	}
+	if cbkt, ok := objstore.AsConditionalBucket(bkt); ok {
+		e.cbkt = cbkt
+	} else {
+		level.Info(logger).Log("msg", "bucket does not support conditional uploads; using best-effort leader election")
+	}
+
+	if reg != nil {
+		reg.MustRegister(e.leader, e.leaderInfo, e.transitions)
+	}
+	return e, nil
+}
+
+// Leading returns true if this compactor currently holds the lease.
+func (e *LeaderElector) Leading() bool {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	return e.leading
+}
+
+// Run competes for the lease and renews it while holding it, until the context is canceled.
+// A held lease is released on return, so that a standby compactor can take over right away.
+func (e *LeaderElector) Run(ctx context.Context) error {
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), e.renewInterval)
+		defer cancel()
+
+		if err := e.release(ctx); err != nil {
+			level.Warn(e.logger).Log("msg", "failed to release lease", "err", err)
+		}
+	}()
+
+	return runutil.Repeat(e.renewInterval, ctx.Done(), func() error {
+		if err := e.tryAcquireOrRenew(ctx); err != nil {
+			level.Warn(e.logger).Log("msg", "failed to acquire or renew lease", "err", err)
+
+			e.mtx.Lock()
+			if e.leading && time.Since(e.lastRenew) > e.leaseDuration-e.renewInterval {
+				level.Warn(e.logger).Log("msg", "lease could not be renewed in time; stepping down")
+				e.stepDown()
+			}
+			e.mtx.Unlock()
+		}
+		return nil
+	})
+}
+
+// Do waits until this compactor holds the lease and runs f. The context passed to f is canceled once the lease is lost,
+// in which case an error caused by ErrLeadershipLost is returned.
+func (e *LeaderElector) Do(ctx context.Context, f func(context.Context) error) error {
+	var term context.Context
+	for {
+		e.mtx.Lock()
+		acquired := e.acquired
+		e.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-acquired:
+		}
+
+		e.mtx.Lock()
+		term = e.term
+		e.mtx.Unlock()
+
+		// Leadership might have been lost right away again.
+		if term.Err() == nil {
+			break
+		}
+	}
+
+	fctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-term.Done():
+			cancel()
+		case <-fctx.Done():
+		}
+	}()
+
+	err := f(fctx)
+	if term.Err() != nil && ctx.Err() == nil {
+		return errors.Wrapf(ErrLeadershipLost, "holder %s", e.holder)
+	}
+	return err
+}
+
+// readLease returns the raw and parsed lease together with its version. The raw lease is nil if no lease exists.
+func (e *LeaderElector) readLease(ctx context.Context) ([]byte, *Lease, string, error) {
+	var (
+		raw     []byte
+		version string
+		err     error
+	)
+	if e.cbkt != nil {
+		raw, version, err = e.cbkt.GetWithVersion(ctx, LeaseFilename)
+	} else {
+		var rc io.ReadCloser
+		rc, err = e.bkt.Get(ctx, LeaseFilename)
+		if err == nil {
+			raw, err = ioutil.ReadAll(rc)
+			runutil.CloseWithLogOnErr(e.logger, rc, "lease reader")
+		}
+	}
+	if e.bkt.IsObjNotFoundErr(err) {
+		return nil, &Lease{}, "", nil
+	}
+	if err != nil {
+		return nil, nil, "", errors.Wrap(err, "get lease")
+	}
+
+	var l Lease
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return nil, nil, "", errors.Wrap(err, "unmarshal lease")
+	}
+	if l.Version != LeaseVersion1 {
+		return nil, nil, "", errors.Errorf("unexpected lease version %d", l.Version)
+	}
+	return raw, &l, version, nil
+}
+
+// writeLease writes the lease if it was not changed since the given version was read. Without conditional uploads
+// the lease is written unconditionally. It returns false if the lease was changed in the meantime.
+func (e *LeaderElector) writeLease(ctx context.Context, l *Lease, version string) ([]byte, bool, error) {
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "marshal lease")
+	}
+	if e.cbkt == nil {
+		return raw, true, errors.Wrap(e.bkt.Upload(ctx, LeaseFilename, bytes.NewReader(raw)), "upload lease")
+	}
+	if err := e.cbkt.UploadIfVersion(ctx, LeaseFilename, bytes.NewReader(raw), version); err != nil {
+		if objstore.IsVersionMismatchErr(err) {
+			return nil, false, nil
+		}
+		return nil, false, errors.Wrap(err, "upload lease")
+	}
+	return raw, true, nil
+}
+
+// tryAcquireOrRenew acquires the lease if it is free or expired and renews it if it is held already.
+func (e *LeaderElector) tryAcquireOrRenew(ctx context.Context) error {
+	raw, l, version, err := e.readLease(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+
+	e.mtx.Lock()
+	e.observe(l.Holder)
+	if !bytes.Equal(raw, e.observedRaw) {
+		e.observedRaw = raw
+		e.observedTime = now
+	}
+	expired := now.After(e.observedTime.Add(time.Duration(l.LeaseDuration) * time.Millisecond))
+	leading := e.leading
+	e.mtx.Unlock()
+
+	if l.Holder != "" && l.Holder != e.holder && !expired {
+		if leading {
+			level.Warn(e.logger).Log("msg", "lease was taken over by another compactor; stepping down", "holder", l.Holder)
+			e.mtx.Lock()
+			e.stepDown()
+			e.mtx.Unlock()
+		}
+		return nil
+	}
+
+	nl := &Lease{
+		Version:       LeaseVersion1,
+		Holder:        e.holder,
+		AcquireTime:   unixMillis(now),
+		RenewTime:     unixMillis(now),
+		LeaseDuration: int64(e.leaseDuration / time.Millisecond),
+	}
+	if l.Holder == e.holder {
+		nl.AcquireTime = l.AcquireTime
+	}
+
+	written, ok, err := e.writeLease(ctx, nl, version)
+	if err == nil && ok && e.cbkt == nil && !leading {
+		written, ok, err = e.settle(ctx, written)
+	}
+	if err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if !ok {
+		level.Debug(e.logger).Log("msg", "lost race for the lease")
+		if e.leading {
+			e.stepDown()
+		}
+		return nil
+	}
+
+	e.observedRaw = written
+	e.observedTime = now
+	e.lastRenew = now
+	e.observe(e.holder)
+
+	if !e.leading {
+		level.Info(e.logger).Log("msg", "acquired lease; this compactor is the leader now", "holder", e.holder)
+		e.leading = true
+		e.term, e.termCancel = context.WithCancel(context.Background())
+		close(e.acquired)
+		e.leader.Set(1)
+		e.transitions.Inc()
+	}
+	return nil
+}
+
+// settle waits for the settle delay and reads back the lease written without conditional upload to check
+// whether it was overwritten by a competing compactor in the meantime.
+func (e *LeaderElector) settle(ctx context.Context, written []byte) ([]byte, bool, error) {
+	select {
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case <-time.After(e.settleDelay):
+	}
+
+	raw, l, _, err := e.readLease(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if l.Holder != e.holder {
+		return nil, false, nil
+	}
+	return raw, true, nil
+}
+
+// release gives up a held lease by clearing its holder.
+func (e *LeaderElector) release(ctx context.Context) error {
+	e.mtx.Lock()
+	leading := e.leading
+	if leading {
+		e.stepDown()
+	}
+	e.mtx.Unlock()
+
+	if !leading {
+		return nil
+	}
+
+	_, l, version, err := e.readLease(ctx)
+	if err != nil {
+		return err
+	}
+	if l.Holder != e.holder {
+		return nil
+	}
+	l.Holder = ""
+	l.RenewTime = unixMillis(time.Now())
+
+	_, ok, err := e.writeLease(ctx, l, version)
+	if err != nil {
+		return err
+	}
+	if ok {
+		level.Info(e.logger).Log("msg", "released lease", "holder", e.holder)
+		e.mtx.Lock()
+		e.observe("")
+		e.mtx.Unlock()
+	}
+	return nil
+}
+
+// stepDown gives up leadership locally. Must be called with the lock held.
+func (e *LeaderElector) stepDown() {
+	e.leading = false
+	e.termCancel()
+	e.acquired = make(chan struct{})
+	e.leader.Set(0)
+}
+
+// observe records the holder of the lease as observed by this compactor. Must be called with the lock held.
+func (e *LeaderElector) observe(holder string) {
+	e.leaderInfo.Reset()
+	if holder != "" {
+		e.leaderInfo.WithLabelValues(holder).Set(1)
+	}
+}
+
+func unixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
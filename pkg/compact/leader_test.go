@@ -0,0 +1,118 @@
+package compact
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+// unconditionalBucket hides the conditional uploads of the wrapped bucket.
+type unconditionalBucket struct {
+	objstore.Bucket
+}
+
+func TestLeaderElector(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		bkt  func() objstore.Bucket
+	}{
+		{name: "conditional", bkt: func() objstore.Bucket { return inmem.NewBucket() }},
+		{name: "best-effort", bkt: func() objstore.Bucket { return unconditionalBucket{inmem.NewBucket()} }},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			ctx := context.Background()
+			bkt := tcase.bkt()
+
+			newElector := func(holder string) *LeaderElector {
+				e, err := NewLeaderElector(nil, nil, bkt, holder, 200*time.Millisecond, 50*time.Millisecond)
+				testutil.Ok(t, err)
+				e.settleDelay = 0
+				return e
+			}
+			e1 := newElector("a")
+			e2 := newElector("b")
+
+			// First compactor takes the free lease, the second one has to wait.
+			testutil.Ok(t, e1.tryAcquireOrRenew(ctx))
+			testutil.Assert(t, e1.Leading(), "first compactor should lead")
+			testutil.Ok(t, e2.tryAcquireOrRenew(ctx))
+			testutil.Assert(t, !e2.Leading(), "second compactor should not lead")
+
+			// Renewals keep the lease.
+			for i := 0; i < 3; i++ {
+				time.Sleep(100 * time.Millisecond)
+				testutil.Ok(t, e1.tryAcquireOrRenew(ctx))
+				testutil.Ok(t, e2.tryAcquireOrRenew(ctx))
+				testutil.Assert(t, e1.Leading(), "first compactor should still lead")
+				testutil.Assert(t, !e2.Leading(), "second compactor should still not lead")
+			}
+
+			// Once not renewed anymore, the lease expires and the standby takes over.
+			time.Sleep(300 * time.Millisecond)
+			testutil.Ok(t, e2.tryAcquireOrRenew(ctx))
+			testutil.Assert(t, e2.Leading(), "second compactor should lead after expiry")
+
+			// The former leader notices that it lost the lease.
+			testutil.Ok(t, e1.tryAcquireOrRenew(ctx))
+			testutil.Assert(t, !e1.Leading(), "first compactor should step down")
+
+			// A released lease can be taken right away.
+			testutil.Ok(t, e2.release(ctx))
+			testutil.Assert(t, !e2.Leading(), "second compactor should not lead after release")
+			testutil.Ok(t, e1.tryAcquireOrRenew(ctx))
+			testutil.Assert(t, e1.Leading(), "first compactor should lead after release")
+		})
+	}
+}
+
+func TestLeaderElector_ConditionalRace(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+
+	e1, err := NewLeaderElector(nil, nil, bkt, "a", time.Minute, time.Second)
+	testutil.Ok(t, err)
+	e2, err := NewLeaderElector(nil, nil, bkt, "b", time.Minute, time.Second)
+	testutil.Ok(t, err)
+
+	// Both compactors see no lease, but only the first write wins.
+	_, _, version, err := e1.readLease(ctx)
+	testutil.Ok(t, err)
+	_, ok, err := e2.writeLease(ctx, &Lease{Version: LeaseVersion1, Holder: "b"}, version)
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "first write should succeed")
+	_, ok, err = e1.writeLease(ctx, &Lease{Version: LeaseVersion1, Holder: "a"}, version)
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "second write should fail")
+}
+
+func TestLeaderElector_Do(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bkt := inmem.NewBucket()
+	e1, err := NewLeaderElector(nil, nil, bkt, "a", time.Minute, 20*time.Millisecond)
+	testutil.Ok(t, err)
+
+	done := make(chan error)
+	go func() { done <- e1.Run(ctx) }()
+
+	// Run f once leading and lose the lease to another holder while it is running.
+	err = e1.Do(ctx, func(fctx context.Context) error {
+		_, _, version, err := e1.readLease(ctx)
+		testutil.Ok(t, err)
+		_, ok, err := e1.writeLease(ctx, &Lease{Version: LeaseVersion1, Holder: "b", LeaseDuration: int64(time.Minute / time.Millisecond)}, version)
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok, "overwriting lease should succeed")
+
+		<-fctx.Done()
+		return fctx.Err()
+	})
+	testutil.Assert(t, IsLeadershipLostErr(err), "expected leadership lost error, got %v", err)
+
+	cancel()
+	testutil.Ok(t, <-done)
+}
@@ -0,0 +1,99 @@
+package compact
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+// NoCompactMarker marks blocks for no compaction once their compaction failed repeatedly
+// for one of the configured reasons. This way a single unhealthy block only stops the
+// compaction of its time range instead of halting the whole compactor.
+type NoCompactMarker struct {
+	logger      log.Logger
+	bkt         objstore.Bucket
+	reasons     map[metadata.NoCompactReason]struct{}
+	maxFailures int
+
+	mtx      sync.Mutex
+	failures map[ulid.ULID]int
+
+	marked *prometheus.CounterVec
+}
+
+// NewNoCompactMarker returns a new NoCompactMarker that marks blocks after maxFailures failed
+// compactions caused by any of the given reasons.
+func NewNoCompactMarker(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	bkt objstore.Bucket,
+	reasons []metadata.NoCompactReason,
+	maxFailures int,
+) *NoCompactMarker {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	m := &NoCompactMarker{
+		logger:      logger,
+		bkt:         bkt,
+		reasons:     map[metadata.NoCompactReason]struct{}{},
+		maxFailures: maxFailures,
+		failures:    map[ulid.ULID]int{},
+		marked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "thanos_compact_blocks_marked_for_no_compact_total",
+			Help: "Total number of blocks marked for no compaction by the compactor.",
+		}, []string{"reason"}),
+	}
+	for _, r := range reasons {
+		m.reasons[r] = struct{}{}
+	}
+
+	if reg != nil {
+		reg.MustRegister(m.marked)
+	}
+	return m
+}
+
+// observe records a failed compaction. If the failure was caused by a single block for one of the
+// configured reasons, the error is turned into a retriable one until the block failed often enough,
+// after which the block is marked for no compaction and true is returned.
+// Any other error is returned unchanged.
+func (m *NoCompactMarker) observe(ctx context.Context, err error) (bool, error) {
+	id, reason, ok := blockError(err)
+	if !ok {
+		return false, err
+	}
+	if _, ok := m.reasons[reason]; !ok {
+		return false, err
+	}
+
+	m.mtx.Lock()
+	m.failures[id]++
+	failures := m.failures[id]
+	m.mtx.Unlock()
+
+	if failures < m.maxFailures {
+		level.Warn(m.logger).Log("msg", "compaction of unhealthy block failed", "block", id, "reason", reason, "failures", failures, "err", err)
+		// Drop a possible halt to retry the compaction, which is how we notice repeated failures.
+		return false, RetryError{err: errors.Wrapf(err, "compaction of block %s failed %d times", id, failures)}
+	}
+
+	if err := block.MarkForNoCompact(ctx, m.logger, m.bkt, id, reason, err.Error()); err != nil {
+		return false, retry(errors.Wrapf(err, "mark block %s for no compaction", id))
+	}
+	level.Warn(m.logger).Log("msg", "marked block for no compaction", "block", id, "reason", reason, "err", err)
+	m.marked.WithLabelValues(string(reason)).Inc()
+
+	m.mtx.Lock()
+	delete(m.failures, id)
+	m.mtx.Unlock()
+	return true, nil
+}
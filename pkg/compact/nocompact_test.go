@@ -0,0 +1,269 @@
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGroup_Plan_NoCompactMarks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact-plan-no-compact")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	hour := int64(time.Hour / time.Millisecond)
+
+	comp, err := tsdb.NewLeveledCompactor(context.Background(), nil, nil, []int64{2 * hour, 8 * hour}, nil)
+	testutil.Ok(t, err)
+
+	// Six consecutive 2h blocks.
+	var ids []ulid.ULID
+	newGroupWithBlocks := func() *Group {
+		g, err := newGroup(nil, inmem.NewBucket(), labels.FromStrings("a", "1"), 0, false, 0,
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+		)
+		testutil.Ok(t, err)
+
+		ids = ids[:0]
+		for i := int64(0); i < 6; i++ {
+			var m metadata.Meta
+			m.Version = 1
+			m.ULID = ulid.MustNew(uint64(i+1), nil)
+			m.MinTime = i * 2 * hour
+			m.MaxTime = (i + 1) * 2 * hour
+			m.Compaction.Level = 1
+			m.Compaction.Sources = []ulid.ULID{m.ULID}
+			m.Thanos.Labels = map[string]string{"a": "1"}
+			testutil.Ok(t, g.Add(&m))
+			ids = append(ids, m.ULID)
+		}
+		return g
+	}
+
+	g := newGroupWithBlocks()
+	plan, err := g.Plan(dir, comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ids[:4], plan)
+
+	// A marked block right after a complete range does not prevent compacting it.
+	g = newGroupWithBlocks()
+	g.noCompact[ids[4]] = struct{}{}
+	plan, err = g.Plan(dir, comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ids[:4], plan)
+
+	// A marked block within a range splits it, only the blocks after it are compacted.
+	g = newGroupWithBlocks()
+	g.noCompact[ids[1]] = struct{}{}
+	plan, err = g.Plan(dir, comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ids[2:4], plan)
+	testutil.Equals(t, []ulid.ULID{ids[1]}, g.NoCompactIDs())
+}
+
+func TestNoCompactMarker(t *testing.T) {
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+	id := ulid.MustNew(1, nil)
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), block.MetaFilename), strings.NewReader(`{"ulid":"`+id.String()+`","version":1}`)))
+
+	// The syncer reads the marks of new blocks only.
+	sy, serr := NewSyncer(nil, nil, bkt, 0, 1, false, 0, nil)
+	testutil.Ok(t, serr)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+
+	m := NewNoCompactMarker(nil, nil, bkt, []metadata.NoCompactReason{metadata.IndexCriticalNoCompactReason}, 2)
+
+	// Errors not caused by a single block or with other reasons are returned unchanged.
+	err := errors.New("test")
+	marked, merr := m.observe(ctx, err)
+	testutil.Assert(t, !marked, "unexpected mark")
+	testutil.Equals(t, err, merr)
+
+	err = unhealthyBlock(errors.New("test"), id, metadata.MalformedIndexNoCompactReason)
+	marked, merr = m.observe(ctx, err)
+	testutil.Assert(t, !marked, "unexpected mark")
+	testutil.Equals(t, err, merr)
+
+	// Failures with configured reasons are retried until the block failed often enough.
+	err = errors.Wrap(halt(unhealthyBlock(errors.New("test"), id, metadata.IndexCriticalNoCompactReason)), "compact")
+	marked, merr = m.observe(ctx, err)
+	testutil.Assert(t, !marked, "unexpected mark")
+	testutil.Assert(t, IsRetryError(merr), "not a retry error")
+	testutil.Assert(t, !IsHaltError(merr), "unexpected halt error")
+
+	mark, rerr := block.ReadNoCompactMark(ctx, nil, bkt, id)
+	testutil.Ok(t, rerr)
+	testutil.Assert(t, mark == nil, "unexpected no-compact mark")
+
+	marked, merr = m.observe(ctx, err)
+	testutil.Assert(t, marked, "block not marked")
+	testutil.Ok(t, merr)
+
+	mark, rerr = block.ReadNoCompactMark(ctx, nil, bkt, id)
+	testutil.Ok(t, rerr)
+	testutil.Equals(t, metadata.IndexCriticalNoCompactReason, mark.Reason)
+	testutil.Equals(t, id, mark.ID)
+
+	testutil.Ok(t, sy.SyncMetas(ctx))
+	groups, gerr := sy.Groups()
+	testutil.Ok(t, gerr)
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, 0, len(groups[0].NoCompactIDs()))
+
+	// A new syncer picks up the mark and excludes the block from planning.
+	sy, serr = NewSyncer(nil, nil, bkt, 0, 1, false, 0, nil)
+	testutil.Ok(t, serr)
+	testutil.Ok(t, sy.SyncMetas(ctx))
+
+	groups, gerr = sy.Groups()
+	testutil.Ok(t, gerr)
+	testutil.Equals(t, 1, len(groups))
+	testutil.Equals(t, []ulid.ULID{id}, groups[0].NoCompactIDs())
+}
+
+func TestGroup_Compact_NoCompactMarkAdded(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "compact-no-compact-added")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	hour := int64(time.Hour / time.Millisecond)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, nil, []int64{2 * hour, 8 * hour}, nil)
+	testutil.Ok(t, err)
+
+	bkt := inmem.NewBucket()
+	sy, err := NewSyncer(nil, nil, bkt, 0, 1, false, 0, nil)
+	testutil.Ok(t, err)
+
+	// Five consecutive 2h blocks, the first four fill a whole 8h range.
+	var ids []ulid.ULID
+	for i := int64(0); i < 5; i++ {
+		var m metadata.Meta
+		m.Version = 1
+		m.ULID = ulid.MustNew(uint64(i+1), nil)
+		m.MinTime = i * 2 * hour
+		m.MaxTime = (i + 1) * 2 * hour
+		m.Compaction.Level = 1
+		m.Compaction.Sources = []ulid.ULID{m.ULID}
+		m.Thanos.Labels = map[string]string{"a": "1"}
+		sy.blocks[m.ULID] = &m
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), block.MetaFilename), strings.NewReader("{}")))
+		ids = append(ids, m.ULID)
+	}
+
+	groups, err := sy.Groups()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(groups))
+
+	// A planned block marked after the syncer read its meta is left out before the compaction starts.
+	testutil.Ok(t, block.MarkForNoCompact(ctx, nil, bkt, ids[1], metadata.ManualNoCompactReason, ""))
+
+	shouldRerun, _, err := groups[0].Compact(ctx, dir, comp)
+	testutil.Ok(t, err)
+	testutil.Assert(t, shouldRerun, "expected rerun after finding the mark")
+	testutil.Equals(t, []ulid.ULID{ids[1]}, groups[0].NoCompactIDs())
+
+	// The syncer keeps the mark for the following compaction passes.
+	sy.addNoCompactMarks(groups[0])
+	groups, err = sy.Groups()
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ulid.ULID{ids[1]}, groups[0].NoCompactIDs())
+}
+
+func TestGroup_Compact_MaxBlockIndexSize(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "compact-max-index-size")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	hour := int64(time.Hour / time.Millisecond)
+
+	comp, err := tsdb.NewLeveledCompactor(ctx, nil, nil, []int64{2 * hour, 8 * hour}, nil)
+	testutil.Ok(t, err)
+
+	// Five consecutive 2h blocks with the given index sizes, the first four fill a whole 8h range.
+	newGroupWithBlocks := func(indexSizes ...int64) (*Group, []ulid.ULID) {
+		bkt := inmem.NewBucket()
+		g, err := newGroup(nil, bkt, labels.FromStrings("a", "1"), 0, false, 64,
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+			prometheus.NewCounter(prometheus.CounterOpts{}),
+		)
+		testutil.Ok(t, err)
+
+		var ids []ulid.ULID
+		for i, size := range indexSizes {
+			var m metadata.Meta
+			m.Version = 1
+			m.ULID = ulid.MustNew(uint64(i+1), nil)
+			m.MinTime = int64(i) * 2 * hour
+			m.MaxTime = int64(i+1) * 2 * hour
+			m.Compaction.Level = 1
+			m.Compaction.Sources = []ulid.ULID{m.ULID}
+			m.Thanos.Labels = map[string]string{"a": "1"}
+			m.Thanos.Files = []metadata.File{{RelPath: block.IndexFilename, SizeBytes: size}}
+			testutil.Ok(t, g.Add(&m))
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(m.ULID.String(), block.MetaFilename), strings.NewReader("{}")))
+			ids = append(ids, m.ULID)
+		}
+		return g, ids
+	}
+
+	// The compaction stops before the block that exceeds the max index size.
+	g, ids := newGroupWithBlocks(10, 10, 50, 10, 10)
+	plan, err := g.Plan(dir, comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ids[:2], plan)
+
+	// The first two blocks cannot be compacted together, so the larger one gets marked for no compaction.
+	for _, tcase := range []struct {
+		indexSizes []int64
+		marked     int
+	}{
+		{indexSizes: []int64{40, 30, 10, 10, 10}, marked: 0},
+		{indexSizes: []int64{30, 40, 10, 10, 10}, marked: 1},
+		{indexSizes: []int64{70, 10, 10, 10, 10}, marked: 0},
+	} {
+		g, ids = newGroupWithBlocks(tcase.indexSizes...)
+		plan, err = g.Plan(dir, comp)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(plan))
+
+		shouldRerun, _, err := g.Compact(ctx, dir, comp)
+		testutil.Ok(t, err)
+		testutil.Assert(t, shouldRerun, "expected rerun after marking the block")
+		testutil.Equals(t, []ulid.ULID{ids[tcase.marked]}, g.NoCompactIDs())
+
+		mark, err := block.ReadNoCompactMark(ctx, nil, g.bkt, ids[tcase.marked])
+		testutil.Ok(t, err)
+		testutil.Equals(t, metadata.IndexSizeExceedingNoCompactReason, mark.Reason)
+	}
+
+	// Once the second block is marked, the blocks after it fill no whole range and the block before it has no neighbours.
+	g, _ = newGroupWithBlocks(30, 40, 10, 10, 10)
+	_, _, err = g.Compact(ctx, dir, comp)
+	testutil.Ok(t, err)
+	plan, err = g.Plan(dir, comp)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(plan))
+}
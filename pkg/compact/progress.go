@@ -0,0 +1,203 @@
+package compact
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+)
+
+// Progress is a snapshot of the work the compactor still has to do.
+type Progress struct {
+	UpdatedAt time.Time       `json:"updatedAt"`
+	Groups    []GroupProgress `json:"groups"`
+}
+
+// GroupProgress describes the blocks of a compaction group and the work planned for them.
+type GroupProgress struct {
+	Key        string            `json:"key"`
+	Labels     map[string]string `json:"labels"`
+	Resolution int64             `json:"resolution"`
+	Blocks     []BlockInfo       `json:"blocks"`
+	// PlannedCompaction are the blocks the next compaction of the group would compact.
+	PlannedCompaction []ulid.ULID `json:"plannedCompaction"`
+	// DownsampleCandidates are the blocks that are due for downsampling to the next resolution.
+	DownsampleCandidates []ulid.ULID `json:"downsampleCandidates"`
+	// RetentionCandidates are the blocks that are due for deletion by the retention policy.
+	RetentionCandidates []ulid.ULID `json:"retentionCandidates"`
+	// NoCompact are the blocks marked for no compaction.
+	NoCompact []ulid.ULID `json:"noCompact"`
+}
+
+// BlockInfo describes a single block of a compaction group.
+type BlockInfo struct {
+	ULID            ulid.ULID `json:"ulid"`
+	MinTime         int64     `json:"minTime"`
+	MaxTime         int64     `json:"maxTime"`
+	CompactionLevel int       `json:"compactionLevel"`
+	NumSeries       uint64    `json:"numSeries"`
+	NumSamples      uint64    `json:"numSamples"`
+}
+
+// ProgressCalculator computes the pending compactions, downsamplings and retention
+// deletions from the blocks known to a Syncer.
+type ProgressCalculator struct {
+	logger                log.Logger
+	sy                    *Syncer
+	comp                  tsdb.Compactor
+	dir                   string
+	retentionByResolution map[ResolutionLevel]time.Duration
+	downsampleLevels      downsample.Levels
+
+	mtx  sync.RWMutex
+	last *Progress
+
+	todoCompactions      prometheus.Gauge
+	todoCompactionBlocks prometheus.Gauge
+	todoDownsampleBlocks prometheus.Gauge
+	todoDeletionBlocks   prometheus.Gauge
+}
+
+// NewProgressCalculator returns a new ProgressCalculator. The directory is used as scratch
+// space for planning compactions. Downsampling candidates are reported for the given downsampling levels,
+// no levels mean downsampling is disabled.
+func NewProgressCalculator(
+	logger log.Logger,
+	reg prometheus.Registerer,
+	sy *Syncer,
+	comp tsdb.Compactor,
+	dir string,
+	retentionByResolution map[ResolutionLevel]time.Duration,
+	downsampleLevels downsample.Levels,
+) *ProgressCalculator {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	p := &ProgressCalculator{
+		logger:                logger,
+		sy:                    sy,
+		comp:                  comp,
+		dir:                   dir,
+		retentionByResolution: retentionByResolution,
+		downsampleLevels:      downsampleLevels,
+		last:                  &Progress{},
+		todoCompactions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_todo_compactions",
+			Help: "Number of compaction groups with a planned compaction.",
+		}),
+		todoCompactionBlocks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_todo_compaction_blocks",
+			Help: "Number of blocks planned to be compacted by the next compaction of every group.",
+		}),
+		todoDownsampleBlocks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_todo_downsample_blocks",
+			Help: "Number of blocks due for downsampling.",
+		}),
+		todoDeletionBlocks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "thanos_compact_todo_deletion_blocks",
+			Help: "Number of blocks due for deletion by the retention policy.",
+		}),
+	}
+
+	if reg != nil {
+		reg.MustRegister(
+			p.todoCompactions,
+			p.todoCompactionBlocks,
+			p.todoDownsampleBlocks,
+			p.todoDeletionBlocks,
+		)
+	}
+	return p
+}
+
+// Update recalculates the progress from the current state of the Syncer.
+func (p *ProgressCalculator) Update() error {
+	groups, err := p.sy.Groups()
+	if err != nil {
+		return errors.Wrap(err, "build compaction groups")
+	}
+
+	// A block does not need downsampling if all its sources are
+	// already part of a block with the next resolution.
+	sources := downsample.Sources{}
+	for _, g := range groups {
+		for _, m := range g.blocks {
+			sources.Add(m)
+		}
+	}
+
+	var (
+		progress = &Progress{UpdatedAt: time.Now()}
+
+		compactions, compactionBlocks, downsampleBlocks, deletionBlocks int
+	)
+	for _, g := range groups {
+		gp := GroupProgress{
+			Key:        g.Key(),
+			Labels:     g.Labels().Map(),
+			Resolution: g.Resolution(),
+			NoCompact:  g.NoCompactIDs(),
+		}
+
+		plan, err := g.Plan(p.dir, p.comp)
+		if err != nil {
+			return errors.Wrapf(err, "plan compaction for group %s", g.Key())
+		}
+		gp.PlannedCompaction = plan
+		if len(plan) > 0 {
+			compactions++
+			compactionBlocks += len(plan)
+		}
+
+		retention := p.retentionByResolution[ResolutionLevel(g.Resolution())]
+		for _, id := range g.IDs() {
+			m := g.blocks[id]
+			gp.Blocks = append(gp.Blocks, BlockInfo{
+				ULID:            id,
+				MinTime:         m.MinTime,
+				MaxTime:         m.MaxTime,
+				CompactionLevel: m.Compaction.Level,
+				NumSeries:       m.Stats.NumSeries,
+				NumSamples:      m.Stats.NumSamples,
+			})
+
+			// This must match the criteria the downsampler uses to pick blocks.
+			if _, ok := p.downsampleLevels.Due(m, sources); ok {
+				gp.DownsampleCandidates = append(gp.DownsampleCandidates, id)
+				downsampleBlocks++
+			}
+			if retention.Seconds() != 0 && time.Now().After(time.Unix(m.MaxTime/1000, 0).Add(retention)) {
+				gp.RetentionCandidates = append(gp.RetentionCandidates, id)
+				deletionBlocks++
+			}
+		}
+		progress.Groups = append(progress.Groups, gp)
+	}
+	sort.Slice(progress.Groups, func(i, j int) bool {
+		return progress.Groups[i].Key < progress.Groups[j].Key
+	})
+
+	p.todoCompactions.Set(float64(compactions))
+	p.todoCompactionBlocks.Set(float64(compactionBlocks))
+	p.todoDownsampleBlocks.Set(float64(downsampleBlocks))
+	p.todoDeletionBlocks.Set(float64(deletionBlocks))
+
+	p.mtx.Lock()
+	p.last = progress
+	p.mtx.Unlock()
+	return nil
+}
+
+// Progress returns the last calculated progress.
+func (p *ProgressCalculator) Progress() *Progress {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.last
+}
@@ -0,0 +1,87 @@
+package compact
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/tsdb"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
+	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestProgressCalculator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact-progress")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	sy, err := NewSyncer(nil, nil, inmem.NewBucket(), 0, 1, false, 0, nil)
+	testutil.Ok(t, err)
+
+	hour := int64(time.Hour / time.Millisecond)
+
+	newMeta := func(id uint64, lbls map[string]string, minTime, maxTime int64, lvl int) *metadata.Meta {
+		var m metadata.Meta
+		m.Version = 1
+		m.ULID = ulid.MustNew(id, nil)
+		m.MinTime = minTime
+		m.MaxTime = maxTime
+		m.Compaction.Level = lvl
+		m.Compaction.Sources = []ulid.ULID{m.ULID}
+		m.Thanos.Labels = lbls
+		return &m
+	}
+
+	// Five consecutive 2h blocks; the first four fill a whole 8h range and can be compacted.
+	var planned []ulid.ULID
+	for i := int64(0); i < 5; i++ {
+		m := newMeta(uint64(i+1), map[string]string{"a": "1"}, i*2*hour, (i+1)*2*hour, 1)
+		sy.blocks[m.ULID] = m
+		if i < 4 {
+			planned = append(planned, m.ULID)
+		}
+	}
+	// A large block of another group that is due for downsampling.
+	large := newMeta(10, map[string]string{"a": "2"}, 0, downsample.DownsampleRange0, 3)
+	sy.blocks[large.ULID] = large
+
+	comp, err := tsdb.NewLeveledCompactor(context.Background(), nil, nil, []int64{2 * hour, 8 * hour}, nil)
+	testutil.Ok(t, err)
+
+	p := NewProgressCalculator(nil, nil, sy, comp, dir, map[ResolutionLevel]time.Duration{
+		ResolutionLevelRaw: time.Hour,
+	}, downsample.DefaultLevels)
+	testutil.Ok(t, p.Update())
+
+	progress := p.Progress()
+	testutil.Equals(t, 2, len(progress.Groups))
+
+	g := progress.Groups[0]
+	testutil.Equals(t, "0@{a=\"1\"}", g.Key)
+	testutil.Equals(t, 5, len(g.Blocks))
+	testutil.Equals(t, planned, g.PlannedCompaction)
+	testutil.Equals(t, 0, len(g.DownsampleCandidates))
+	testutil.Equals(t, 5, len(g.RetentionCandidates))
+
+	g = progress.Groups[1]
+	testutil.Equals(t, "0@{a=\"2\"}", g.Key)
+	testutil.Equals(t, 0, len(g.PlannedCompaction))
+	testutil.Equals(t, []ulid.ULID{large.ULID}, g.DownsampleCandidates)
+	testutil.Equals(t, []ulid.ULID{large.ULID}, g.RetentionCandidates)
+
+	// Once a downsampled block contains the sources, the block needs no downsampling anymore.
+	downsampled := newMeta(11, map[string]string{"a": "2"}, 0, downsample.DownsampleRange0, 3)
+	downsampled.Compaction.Sources = large.Compaction.Sources
+	downsampled.Thanos.Downsample.Resolution = downsample.ResLevel1
+	sy.blocks[downsampled.ULID] = downsampled
+
+	testutil.Ok(t, p.Update())
+	for _, g := range p.Progress().Groups {
+		testutil.Equals(t, 0, len(g.DownsampleCandidates))
+	}
+}
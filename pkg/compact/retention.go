@@ -8,13 +8,17 @@ import (
 	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
 )
 
 // Apply removes blocks depending on the specified retentionByResolution based on blocks MaxTime.
 // A value of 0 disables the retention for its resolution.
-func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bkt objstore.Bucket, retentionByResolution map[ResolutionLevel]time.Duration) error {
+// If dryRun is not nil, the deletions are only recorded in it, considering the changes recorded before.
+func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bkt objstore.Bucket, retentionByResolution map[ResolutionLevel]time.Duration, dryRun *DryRun) error {
 	level.Info(logger).Log("msg", "start optional retention")
+
+	var metas []*metadata.Meta
 	if err := bkt.Iter(ctx, "", func(name string) error {
 		id, ok := block.IsBlockDir(name)
 		if !ok {
@@ -24,23 +28,33 @@ func ApplyRetentionPolicyByResolution(ctx context.Context, logger log.Logger, bk
 		if err != nil {
 			return errors.Wrap(err, "download metadata")
 		}
+		metas = append(metas, &m)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "retention")
+	}
+	if dryRun != nil {
+		metas = dryRun.Apply(metas)
+	}
 
+	for _, m := range metas {
 		retentionDuration := retentionByResolution[ResolutionLevel(m.Thanos.Downsample.Resolution)]
 		if retentionDuration.Seconds() == 0 {
-			return nil
+			continue
 		}
 
 		maxTime := time.Unix(m.MaxTime/1000, 0)
-		if time.Now().After(maxTime.Add(retentionDuration)) {
-			level.Info(logger).Log("msg", "deleting block", "id", id, "maxTime", maxTime.String())
-			if err := block.Delete(ctx, bkt, id); err != nil {
-				return errors.Wrap(err, "delete block")
-			}
+		if !time.Now().After(maxTime.Add(retentionDuration)) {
+			continue
+		}
+		if dryRun != nil {
+			dryRun.DeletedByRetention(m)
+			continue
+		}
+		level.Info(logger).Log("msg", "deleting block", "id", m.ULID, "maxTime", maxTime.String())
+		if err := block.Delete(ctx, bkt, m.ULID); err != nil {
+			return errors.Wrap(err, "retention: delete block")
 		}
-
-		return nil
-	}); err != nil {
-		return errors.Wrap(err, "retention")
 	}
 
 	level.Info(logger).Log("msg", "optional retention apply done")
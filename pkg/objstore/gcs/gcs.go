@@ -5,8 +5,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -16,7 +19,9 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/version"
 	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/runutil"
 	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
 	yaml "gopkg.in/yaml.v2"
@@ -150,6 +155,46 @@ func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	return w.Close()
 }
 
+// GetWithVersion returns the content of the given object together with its generation.
+func (b *Bucket) GetWithVersion(ctx context.Context, name string) ([]byte, string, error) {
+	r, err := b.bkt.Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	defer runutil.CloseWithLogOnErr(b.logger, r, "gcs reader")
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	return content, strconv.FormatInt(r.Attrs.Generation, 10), nil
+}
+
+// UploadIfVersion uploads the content of the reader only if the current generation of the object is the given one.
+// An empty version means that the object must not exist.
+func (b *Bucket) UploadIfVersion(ctx context.Context, name string, r io.Reader, version string) error {
+	cond := storage.Conditions{DoesNotExist: true}
+	if version != "" {
+		gen, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parse generation %q", version)
+		}
+		cond = storage.Conditions{GenerationMatch: gen}
+	}
+	w := b.bkt.Object(name).If(cond).NewWriter(ctx)
+
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusPreconditionFailed {
+			return errors.Wrapf(objstore.ErrVersionMismatch, "upload %s: generation %q", name, version)
+		}
+		return err
+	}
+	return nil
+}
+
 // Delete removes the object with the given name.
 func (b *Bucket) Delete(ctx context.Context, name string) error {
 	return b.bkt.Object(name).Delete(ctx)
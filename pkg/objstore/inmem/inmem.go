@@ -7,7 +7,9 @@ import (
 
 	"bytes"
 	"io/ioutil"
+	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/thanos-io/thanos/pkg/objstore"
@@ -17,13 +19,16 @@ var errNotFound = errors.New("inmem: object not found")
 
 // Bucket implements the store.Bucket and shipper.Bucket interfaces against local memory.
 type Bucket struct {
-	objects map[string][]byte
+	mtx      sync.RWMutex
+	objects  map[string][]byte
+	versions map[string]int64
+	version  int64
 }
 
 // NewBucket returns a new in memory Bucket.
 // NOTE: Returned bucket is just a naive in memory bucket implementation. For test use cases only.
 func NewBucket() *Bucket {
-	return &Bucket{objects: map[string][]byte{}}
+	return &Bucket{objects: map[string][]byte{}, versions: map[string]int64{}}
 }
 
 // Objects returns internally stored objects.
@@ -35,6 +40,7 @@ func (b *Bucket) Objects() map[string][]byte {
 // Iter calls f for each entry in the given directory. The argument to f is the full
 // object name including the prefix of the inspected directory.
 func (b *Bucket) Iter(_ context.Context, dir string, f func(string) error) error {
+	b.mtx.RLock()
 	unique := map[string]struct{}{}
 
 	var dirPartsCount int
@@ -53,6 +59,7 @@ func (b *Bucket) Iter(_ context.Context, dir string, f func(string) error) error
 		parts := strings.SplitAfter(filename, objstore.DirDelim)
 		unique[strings.Join(parts[:dirPartsCount+1], "")] = struct{}{}
 	}
+	b.mtx.RUnlock()
 
 	var keys []string
 	for n := range unique {
@@ -86,7 +93,9 @@ func (b *Bucket) Get(_ context.Context, name string) (io.ReadCloser, error) {
 		return nil, errors.New("inmem: object name is empty")
 	}
 
+	b.mtx.RLock()
 	file, ok := b.objects[name]
+	b.mtx.RUnlock()
 	if !ok {
 		return nil, errNotFound
 	}
@@ -100,7 +109,9 @@ func (b *Bucket) GetRange(_ context.Context, name string, off, length int64) (io
 		return nil, errors.New("inmem: object name is empty")
 	}
 
+	b.mtx.RLock()
 	file, ok := b.objects[name]
+	b.mtx.RUnlock()
 	if !ok {
 		return nil, errNotFound
 	}
@@ -119,6 +130,9 @@ func (b *Bucket) GetRange(_ context.Context, name string, off, length int64) (io
 
 // Exists checks if the given directory exists in memory.
 func (b *Bucket) Exists(_ context.Context, name string) (bool, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
 	_, ok := b.objects[name]
 	return ok, nil
 }
@@ -129,13 +143,61 @@ func (b *Bucket) Upload(_ context.Context, name string, r io.Reader) error {
 	if err != nil {
 		return err
 	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.put(name, body)
+	return nil
+}
+
+func (b *Bucket) put(name string, body []byte) {
+	b.version++
 	b.objects[name] = body
+	b.versions[name] = b.version
+}
+
+// GetWithVersion returns the content of the given object together with its version.
+func (b *Bucket) GetWithVersion(_ context.Context, name string) ([]byte, string, error) {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+
+	file, ok := b.objects[name]
+	if !ok {
+		return nil, "", errNotFound
+	}
+	return file, strconv.FormatInt(b.versions[name], 10), nil
+}
+
+// UploadIfVersion writes the content of the reader into the memory if the current version of the object
+// is the given one. An empty version means that the object must not exist.
+func (b *Bucket) UploadIfVersion(_ context.Context, name string, r io.Reader, version string) error {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	current := ""
+	if _, ok := b.objects[name]; ok {
+		current = strconv.FormatInt(b.versions[name], 10)
+	}
+	if current != version {
+		return errors.Wrapf(objstore.ErrVersionMismatch, "upload %s: expected version %q, got %q", name, version, current)
+	}
+	b.put(name, body)
 	return nil
 }
 
 // Delete removes all data prefixed with the dir.
 func (b *Bucket) Delete(_ context.Context, name string) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
 	delete(b.objects, name)
+	delete(b.versions, name)
 	return nil
 }
 
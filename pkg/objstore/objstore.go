@@ -338,6 +338,95 @@ func (b *metricBucket) Name() string {
 	return b.bkt.Name()
 }
 
+// ErrReadOnly is the cause of errors returned by write operations against a read-only bucket.
+var ErrReadOnly = errors.New("bucket is read-only")
+
+// IsReadOnlyErr returns true if the error was caused by a write to a read-only bucket.
+func IsReadOnlyErr(err error) bool {
+	return errors.Cause(err) == ErrReadOnly
+}
+
+// ReadOnlyBucket wraps the given bucket, so that all reads are passed through and
+// all uploads and deletions are rejected without touching the bucket.
+func ReadOnlyBucket(b Bucket) Bucket {
+	return &readOnlyBucket{bkt: b}
+}
+
+type readOnlyBucket struct {
+	bkt Bucket
+}
+
+func (b *readOnlyBucket) Iter(ctx context.Context, dir string, f func(name string) error) error {
+	return b.bkt.Iter(ctx, dir, f)
+}
+
+func (b *readOnlyBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.bkt.Get(ctx, name)
+}
+
+func (b *readOnlyBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	return b.bkt.GetRange(ctx, name, off, length)
+}
+
+func (b *readOnlyBucket) Exists(ctx context.Context, name string) (bool, error) {
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *readOnlyBucket) Upload(_ context.Context, name string, _ io.Reader) error {
+	return errors.Wrapf(ErrReadOnly, "upload %s", name)
+}
+
+func (b *readOnlyBucket) Delete(_ context.Context, name string) error {
+	return errors.Wrapf(ErrReadOnly, "delete %s", name)
+}
+
+func (b *readOnlyBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *readOnlyBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *readOnlyBucket) Name() string {
+	return b.bkt.Name()
+}
+
+// ErrVersionMismatch is the cause of errors returned by conditional uploads if the object
+// was changed since the given version was read.
+var ErrVersionMismatch = errors.New("object version mismatch")
+
+// IsVersionMismatchErr returns true if the error was caused by a failed conditional upload.
+func IsVersionMismatchErr(err error) bool {
+	return errors.Cause(err) == ErrVersionMismatch
+}
+
+// ConditionalBucket is implemented by buckets which are able to upload an object only if it was
+// not changed in the meantime, e.g. using generations or ETags of the provider.
+type ConditionalBucket interface {
+	// GetWithVersion returns the content of the object with the given name together with its current version.
+	// Versions are opaque, provider specific strings.
+	GetWithVersion(ctx context.Context, name string) ([]byte, string, error)
+
+	// UploadIfVersion uploads the contents of the reader as an object into the bucket only if the current version
+	// of the object is the given one. An empty version requires the object to not exist yet.
+	// If the condition is not met, an error caused by ErrVersionMismatch is returned.
+	UploadIfVersion(ctx context.Context, name string, r io.Reader, version string) error
+}
+
+// AsConditionalBucket returns the given bucket as ConditionalBucket if it supports conditional uploads.
+// Buckets wrapped by BucketWithMetrics are unwrapped, read-only buckets never support them.
+func AsConditionalBucket(b Bucket) (ConditionalBucket, bool) {
+	if mb, ok := b.(*metricBucket); ok {
+		return AsConditionalBucket(mb.bkt)
+	}
+	if _, ok := b.(*readOnlyBucket); ok {
+		return nil, false
+	}
+	cb, ok := b.(ConditionalBucket)
+	return cb, ok
+}
+
 type timingReadCloser struct {
 	io.ReadCloser
 
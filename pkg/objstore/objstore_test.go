@@ -0,0 +1,31 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestReadOnlyBucket(t *testing.T) {
+	ctx := context.Background()
+
+	bkt := inmem.NewBucket()
+	testutil.Ok(t, bkt.Upload(ctx, "a", bytes.NewReader([]byte("a"))))
+
+	ro := objstore.ReadOnlyBucket(bkt)
+	ok, err := ro.Exists(ctx, "a")
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "object not readable")
+
+	err = ro.Upload(ctx, "b", bytes.NewReader([]byte("b")))
+	testutil.Assert(t, objstore.IsReadOnlyErr(err), "upload not rejected: %v", err)
+	err = ro.Delete(ctx, "a")
+	testutil.Assert(t, objstore.IsReadOnlyErr(err), "delete not rejected: %v", err)
+	testutil.Equals(t, 1, len(bkt.Objects()))
+	testutil.Assert(t, !objstore.IsReadOnlyErr(errors.New("other")), "unrelated error detected as read-only error")
+}
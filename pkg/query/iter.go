@@ -141,10 +141,12 @@ func (s *chunkSeries) Iterator() storage.SeriesIterator {
 			its = append(its, getFirstIterator(c.Counter, c.Raw))
 		}
 		sit = downsample.NewCounterSeriesIterator(its...)
-	case resAggrAvg:
+	case resAggrAvg, resAggrLast:
 		for _, c := range s.chunks {
 			if c.Raw != nil {
 				its = append(its, getFirstIterator(c.Raw))
+			} else if s.aggr == resAggrLast && c.Last != nil {
+				its = append(its, getFirstIterator(c.Last))
 			} else {
 				sum, cnt := getFirstIterator(c.Sum), getFirstIterator(c.Count)
 				its = append(its, downsample.NewAverageChunkIterator(cnt, sum))
@@ -143,6 +143,7 @@ const (
 	resAggrMin
 	resAggrMax
 	resAggrCounter
+	resAggrLast
 )
 
 // aggrsFromFunc infers aggregates of the underlying data based on the wrapping
@@ -164,6 +165,11 @@ func aggrsFromFunc(f string) ([]storepb.Aggr, resAggr) {
 	if f == "increase" || f == "rate" {
 		return []storepb.Aggr{storepb.Aggr_COUNTER}, resAggrCounter
 	}
+	// Plain series selections look up the latest sample, so use the last value of each window
+	// if it was stored. Count and sum are retrieved as well to fall back to an average.
+	if f == "" {
+		return []storepb.Aggr{storepb.Aggr_LAST, storepb.Aggr_COUNT, storepb.Aggr_SUM}, resAggrLast
+	}
 	// In the default case, we retrieve count and sum to compute an average.
 	return []storepb.Aggr{storepb.Aggr_COUNT, storepb.Aggr_SUM}, resAggrAvg
 }
@@ -213,6 +213,45 @@ func TestQuerier_Series(t *testing.T) {
 	testutil.Equals(t, len(expected), i)
 }
 
+func TestAggrsFromFunc_Last(t *testing.T) {
+	aggrs, aggr := aggrsFromFunc("")
+	testutil.Equals(t, []storepb.Aggr{storepb.Aggr_LAST, storepb.Aggr_COUNT, storepb.Aggr_SUM}, aggrs)
+	testutil.Equals(t, resAggrLast, aggr)
+
+	xorChunk := func(smpls []sample) *storepb.Chunk {
+		c := chunkenc.NewXORChunk()
+		a, err := c.Appender()
+		testutil.Ok(t, err)
+		for _, smpl := range smpls {
+			a.Append(smpl.t, smpl.v)
+		}
+		return &storepb.Chunk{Type: storepb.Chunk_XOR, Data: c.Bytes()}
+	}
+
+	s := newChunkSeries(nil, []storepb.AggrChunk{
+		// Downsampled with the last aggregate.
+		{
+			MinTime: 0, MaxTime: 199,
+			Count: xorChunk([]sample{{99, 2}, {199, 4}}),
+			Sum:   xorChunk([]sample{{99, 10}, {199, 20}}),
+			Last:  xorChunk([]sample{{99, 7}, {199, 9}}),
+		},
+		// Downsampled without the last aggregate falls back to the average.
+		{
+			MinTime: 200, MaxTime: 399,
+			Count: xorChunk([]sample{{299, 2}, {399, 4}}),
+			Sum:   xorChunk([]sample{{299, 10}, {399, 20}}),
+		},
+		// Raw data is used as is.
+		{
+			MinTime: 400, MaxTime: 499,
+			Raw: xorChunk([]sample{{450, 3}, {499, 1}}),
+		},
+	}, 0, 500, aggr)
+
+	testutil.Equals(t, []sample{{99, 7}, {199, 9}, {299, 5}, {399, 5}, {450, 3}, {499, 1}}, expandSeries(t, s.Iterator()))
+}
+
 func TestSortReplicaLabel(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
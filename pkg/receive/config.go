@@ -3,9 +3,12 @@ package receive
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"reflect"
+	"sort"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -13,6 +16,8 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/thanos-io/thanos/pkg/discovery/dns"
+	"github.com/thanos-io/thanos/pkg/runutil"
 	"gopkg.in/fsnotify.v1"
 )
 
@@ -24,6 +29,58 @@ type HashringConfig struct {
 	Endpoints []string `json:"endpoints"`
 }
 
+// ConfigSource provides updates of the hashring configuration.
+type ConfigSource interface {
+	// Run starts the ConfigSource until the given context is cancelled.
+	// The channel returned by C must be closed once Run returns.
+	Run(ctx context.Context)
+	// C returns a chan that gets hashring configuration updates.
+	C() <-chan []HashringConfig
+}
+
+// validateHashringConfig checks that a hashring configuration can be used to build hashrings.
+func validateHashringConfig(cfg []HashringConfig) error {
+	if len(cfg) == 0 {
+		return errors.New("no hashrings configured")
+	}
+	var defaults int
+	tenants := map[string]string{}
+	for i, h := range cfg {
+		name := h.Hashring
+		if name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		if len(h.Endpoints) == 0 {
+			return errors.Errorf("hashring %s has no endpoints", name)
+		}
+		endpoints := map[string]struct{}{}
+		for _, e := range h.Endpoints {
+			if e == "" {
+				return errors.Errorf("hashring %s has an empty endpoint", name)
+			}
+			if _, ok := endpoints[e]; ok {
+				return errors.Errorf("hashring %s has duplicate endpoint %s", name, e)
+			}
+			endpoints[e] = struct{}{}
+		}
+		// Hashrings are matched in order, so anything after the first default hashring,
+		// or tenants listed in more than one hashring, could never be used.
+		if len(h.Tenants) == 0 {
+			defaults++
+			if defaults > 1 {
+				return errors.Errorf("hashring %s is a second default hashring without tenants", name)
+			}
+		}
+		for _, t := range h.Tenants {
+			if other, ok := tenants[t]; ok {
+				return errors.Errorf("tenant %s is in both hashring %s and %s", t, other, name)
+			}
+			tenants[t] = name
+		}
+	}
+	return nil
+}
+
 // ConfigWatcher is able to watch a file containing a hashring configuration
 // for updates.
 type ConfigWatcher struct {
@@ -150,8 +207,10 @@ func (cw *ConfigWatcher) readFile() ([]HashringConfig, error) {
 	}
 
 	var config []HashringConfig
-	err = json.Unmarshal(content, &config)
-	return config, err
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, err
+	}
+	return config, validateHashringConfig(config)
 }
 
 // refresh reads the configured file and sends the hashring configuration on the channel.
@@ -211,3 +270,165 @@ func (cw *ConfigWatcher) stop() {
 func (cw *ConfigWatcher) C() <-chan []HashringConfig {
 	return cw.ch
 }
+
+// ConfigPoller periodically fetches a hashring configuration from a dynamic
+// source, e.g. DNS or HTTP, and sends it on a channel whenever it changes.
+type ConfigPoller struct {
+	ch       chan []HashringConfig
+	source   string
+	interval time.Duration
+	logger   log.Logger
+	fetch    func(context.Context) ([]HashringConfig, error)
+
+	changesCounter prometheus.Counter
+	errorCounter   prometheus.Counter
+	refreshCounter prometheus.Counter
+
+	// last is the last known configuration.
+	last []HashringConfig
+}
+
+func newConfigPoller(logger log.Logger, r prometheus.Registerer, source string, interval model.Duration, fetch func(context.Context) ([]HashringConfig, error)) *ConfigPoller {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	c := &ConfigPoller{
+		ch:       make(chan []HashringConfig),
+		source:   source,
+		interval: time.Duration(interval),
+		logger:   logger,
+		fetch:    fetch,
+		changesCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("thanos_receive_hashrings_%s_changes_total", source),
+				Help: fmt.Sprintf("The number of times the hashrings configuration from %s has changed.", source),
+			}),
+		errorCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("thanos_receive_hashrings_%s_errors_total", source),
+				Help: fmt.Sprintf("The number of errors fetching the hashrings configuration from %s.", source),
+			}),
+		refreshCounter: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: fmt.Sprintf("thanos_receive_hashrings_%s_refreshes_total", source),
+				Help: fmt.Sprintf("The number of refreshes of the hashrings configuration from %s.", source),
+			}),
+	}
+
+	if r != nil {
+		r.MustRegister(
+			c.changesCounter,
+			c.errorCounter,
+			c.refreshCounter,
+		)
+	}
+
+	return c
+}
+
+// NewHTTPConfigPoller creates a ConfigPoller that fetches the hashring configuration
+// as JSON from the given URL.
+func NewHTTPConfigPoller(logger log.Logger, r prometheus.Registerer, client *http.Client, url string, interval model.Duration) *ConfigPoller {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return newConfigPoller(logger, r, "http", interval, func(ctx context.Context) ([]HashringConfig, error) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "create request")
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errors.Wrapf(err, "get %s", url)
+		}
+		defer runutil.CloseWithLogOnErr(logger, resp.Body, "hashrings response body")
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("get %s: unexpected status %s", url, resp.Status)
+		}
+
+		var config []HashringConfig
+		if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+			return nil, errors.Wrap(err, "decode hashrings configuration")
+		}
+		return config, nil
+	})
+}
+
+// NewDNSConfigPoller creates a ConfigPoller that builds a single default hashring
+// from the given addresses. Addresses prefixed with `dns+` or `dnssrv+` are resolved
+// with the given provider.
+func NewDNSConfigPoller(logger log.Logger, r prometheus.Registerer, provider *dns.Provider, addrs []string, interval model.Duration) *ConfigPoller {
+	return newConfigPoller(logger, r, "dns", interval, func(ctx context.Context) ([]HashringConfig, error) {
+		provider.Resolve(ctx, addrs)
+
+		// The order of endpoints determines which node owns a series,
+		// so it must not depend on the order of DNS answers.
+		seen := map[string]struct{}{}
+		var endpoints []string
+		for _, e := range provider.Addresses() {
+			if _, ok := seen[e]; ok {
+				continue
+			}
+			seen[e] = struct{}{}
+			endpoints = append(endpoints, e)
+		}
+		sort.Strings(endpoints)
+
+		return []HashringConfig{{Endpoints: endpoints}}, nil
+	})
+}
+
+// Run starts the ConfigPoller until the given context is cancelled.
+func (cp *ConfigPoller) Run(ctx context.Context) {
+	defer close(cp.ch)
+
+	cp.refresh(ctx)
+
+	ticker := time.NewTicker(cp.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cp.refresh(ctx)
+		}
+	}
+}
+
+// refresh fetches the hashring configuration and sends it on the channel if it changed.
+func (cp *ConfigPoller) refresh(ctx context.Context) {
+	cp.refreshCounter.Inc()
+	config, err := cp.fetch(ctx)
+	if err == nil {
+		err = validateHashringConfig(config)
+	}
+	if err != nil {
+		cp.errorCounter.Inc()
+		level.Error(cp.logger).Log("msg", "failed to fetch hashrings configuration", "err", err, "source", cp.source)
+		return
+	}
+
+	// If there was no change to the configuration, return early.
+	if reflect.DeepEqual(cp.last, config) {
+		return
+	}
+	cp.changesCounter.Inc()
+	// Save the last known configuration.
+	cp.last = config
+
+	select {
+	case <-ctx.Done():
+		return
+	case cp.ch <- config:
+		return
+	}
+}
+
+// C returns a chan that gets hashring configuration updates.
+func (cp *ConfigPoller) C() <-chan []HashringConfig {
+	return cp.ch
+}
@@ -0,0 +1,144 @@
+package receive
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestValidateHashringConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   []HashringConfig
+		valid bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:  "single default",
+			cfg:   []HashringConfig{{Endpoints: []string{"node1:10901", "node2:10901"}}},
+			valid: true,
+		},
+		{
+			name: "tenants and default",
+			cfg: []HashringConfig{
+				{Hashring: "a", Tenants: []string{"t1", "t2"}, Endpoints: []string{"node1:10901"}},
+				{Hashring: "b", Endpoints: []string{"node2:10901"}},
+			},
+			valid: true,
+		},
+		{
+			name: "no endpoints",
+			cfg:  []HashringConfig{{Hashring: "a"}},
+		},
+		{
+			name: "duplicate endpoint",
+			cfg:  []HashringConfig{{Endpoints: []string{"node1:10901", "node1:10901"}}},
+		},
+		{
+			name: "two defaults",
+			cfg: []HashringConfig{
+				{Endpoints: []string{"node1:10901"}},
+				{Endpoints: []string{"node2:10901"}},
+			},
+		},
+		{
+			name: "tenant in two hashrings",
+			cfg: []HashringConfig{
+				{Tenants: []string{"t1"}, Endpoints: []string{"node1:10901"}},
+				{Tenants: []string{"t1"}, Endpoints: []string{"node2:10901"}},
+			},
+		},
+	} {
+		err := validateHashringConfig(tc.cfg)
+		if tc.valid && err != nil {
+			t.Errorf("case %q: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("case %q: expected error", tc.name)
+		}
+	}
+}
+
+func TestHTTPConfigPoller(t *testing.T) {
+	cfg := []HashringConfig{{Endpoints: []string{"node1:10901"}}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewEncoder(w).Encode(cfg); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cp := NewHTTPConfigPoller(nil, nil, nil, srv.URL, model.Duration(time.Hour))
+	go cp.Run(ctx)
+
+	select {
+	case got := <-cp.C():
+		if !reflect.DeepEqual(got, cfg) {
+			t.Errorf("expected %v, got %v", cfg, got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for hashring configuration")
+	}
+}
+
+// staticConfigSource sends the given configurations and then waits to be stopped.
+type staticConfigSource struct {
+	ch      chan []HashringConfig
+	configs [][]HashringConfig
+}
+
+func (s *staticConfigSource) Run(ctx context.Context) {
+	defer close(s.ch)
+	for _, c := range s.configs {
+		s.ch <- c
+	}
+	<-ctx.Done()
+}
+
+func (s *staticConfigSource) C() <-chan []HashringConfig {
+	return s.ch
+}
+
+func TestHashringFromConfigDebounce(t *testing.T) {
+	last := []HashringConfig{{Endpoints: []string{"node1:10901", "node2:10901", "node3:10901"}}}
+	cs := &staticConfigSource{
+		ch: make(chan []HashringConfig),
+		configs: [][]HashringConfig{
+			{{Endpoints: []string{"node1:10901"}}},
+			{{Endpoints: []string{"node1:10901", "node2:10901"}}},
+			last,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updates := make(chan Hashring, 3)
+	go HashringFromConfig(ctx, updates, cs, 100*time.Millisecond)
+
+	// Only the settled configuration is applied.
+	select {
+	case h := <-updates:
+		if got := h.(configuredHashring).Config(); !reflect.DeepEqual(got, last) {
+			t.Errorf("expected %v, got %v", last, got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for hashring")
+	}
+	select {
+	case h := <-updates:
+		t.Errorf("unexpected hashring update %v", h)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
@@ -0,0 +1,225 @@
+package receive
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/textparse"
+	"github.com/prometheus/prometheus/util/strutil"
+	"github.com/thanos-io/thanos/pkg/store/prompb"
+)
+
+// parseText converts metrics in the Prometheus text exposition format, or the OpenMetrics
+// format depending on the content type, into a write request.
+// Samples without a timestamp get the given default timestamp in milliseconds.
+func parseText(b []byte, contentType string, defaultTimestamp int64) (*prompb.WriteRequest, error) {
+	var (
+		wreq = &prompb.WriteRequest{}
+		p    = textparse.New(b, contentType)
+	)
+	for {
+		e, err := p.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e != textparse.EntrySeries {
+			continue
+		}
+
+		_, ts, v := p.Series()
+		t := defaultTimestamp
+		if ts != nil {
+			t = *ts
+		}
+
+		var lset labels.Labels
+		p.Metric(&lset)
+
+		series := prompb.TimeSeries{
+			Labels:  make([]prompb.Label, 0, len(lset)),
+			Samples: []prompb.Sample{{Value: v, Timestamp: t}},
+		}
+		for _, l := range lset {
+			series.Labels = append(series.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		wreq.Timeseries = append(wreq.Timeseries, series)
+	}
+	return wreq, nil
+}
+
+// influxPrecisionToMillis returns a function converting timestamps of
+// the given InfluxDB precision to milliseconds.
+func influxPrecisionToMillis(precision string) (func(int64) int64, error) {
+	switch precision {
+	case "", "n", "ns":
+		return func(t int64) int64 { return t / 1e6 }, nil
+	case "u", "us":
+		return func(t int64) int64 { return t / 1e3 }, nil
+	case "ms":
+		return func(t int64) int64 { return t }, nil
+	case "s":
+		return func(t int64) int64 { return t * 1e3 }, nil
+	}
+	return nil, errors.Errorf("unsupported precision %q", precision)
+}
+
+// parseInflux converts metrics in the InfluxDB line protocol into a write request.
+// Every numeric or boolean field becomes a series named `<measurement>_<field>`,
+// with the tags of the line as labels. String fields are ignored.
+// Lines without a timestamp get the given default timestamp in milliseconds.
+func parseInflux(b []byte, precision string, defaultTimestamp int64) (*prompb.WriteRequest, error) {
+	toMillis, err := influxPrecisionToMillis(precision)
+	if err != nil {
+		return nil, err
+	}
+
+	wreq := &prompb.WriteRequest{}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		series, err := parseInfluxLine(line, toMillis, defaultTimestamp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", i+1)
+		}
+		wreq.Timeseries = append(wreq.Timeseries, series...)
+	}
+	return wreq, nil
+}
+
+// parseInfluxLine converts a single line of the InfluxDB line protocol into time series.
+func parseInfluxLine(line string, toMillis func(int64) int64, defaultTimestamp int64) ([]prompb.TimeSeries, error) {
+	parts := splitUnescaped(line, ' ', true)
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, errors.New("expected measurement, fields and optional timestamp")
+	}
+
+	t := defaultTimestamp
+	if len(parts) == 3 {
+		ts, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parse timestamp")
+		}
+		t = toMillis(ts)
+	}
+
+	key := splitUnescaped(parts[0], ',', false)
+	measurement := unescapeInflux(key[0])
+	if measurement == "" {
+		return nil, errors.New("empty measurement")
+	}
+	tags := make([]prompb.Label, 0, len(key))
+	for _, kv := range key[1:] {
+		tag := splitUnescaped(kv, '=', false)
+		if len(tag) != 2 {
+			return nil, errors.Errorf("invalid tag %q", kv)
+		}
+		tags = append(tags, prompb.Label{
+			Name:  strutil.SanitizeLabelName(unescapeInflux(tag[0])),
+			Value: unescapeInflux(tag[1]),
+		})
+	}
+
+	var series []prompb.TimeSeries
+	for _, kv := range splitUnescaped(parts[1], ',', true) {
+		field := splitUnescaped(kv, '=', true)
+		if len(field) != 2 {
+			return nil, errors.Errorf("invalid field %q", kv)
+		}
+		v, ok, err := parseInfluxValue(field[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse field %q", kv)
+		}
+		if !ok {
+			continue
+		}
+
+		lset := make([]prompb.Label, 0, len(tags)+1)
+		lset = append(lset, prompb.Label{
+			Name:  labels.MetricName,
+			Value: strutil.SanitizeLabelName(measurement + "_" + unescapeInflux(field[0])),
+		})
+		lset = append(lset, tags...)
+		sort.Slice(lset, func(i, j int) bool { return lset[i].Name < lset[j].Name })
+
+		series = append(series, prompb.TimeSeries{
+			Labels:  lset,
+			Samples: []prompb.Sample{{Value: v, Timestamp: t}},
+		})
+	}
+	return series, nil
+}
+
+// parseInfluxValue parses a field value of the InfluxDB line protocol.
+// It returns false if the value is a string, which cannot be represented as a sample.
+func parseInfluxValue(s string) (float64, bool, error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if s == "" {
+		return 0, false, errors.New("empty value")
+	}
+	switch s[len(s)-1] {
+	case '"':
+		return 0, false, nil
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), err == nil, err
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, err == nil, err
+}
+
+// splitUnescaped splits s at every sep that is not escaped by a backslash and,
+// if quoted is true, not within a double-quoted string.
+func splitUnescaped(s string, sep byte, quoted bool) []string {
+	var (
+		parts    []string
+		start    int
+		inQuotes bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quoted && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux removes the escaping of measurements, tag keys, tag values and field keys.
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case ',', ' ', '=', '"', '\\':
+				i++
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package receive
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/store/prompb"
+)
+
+func TestParseText(t *testing.T) {
+	in := `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"} 3
+`
+	wreq, err := parseText([]byte(in), "text/plain; version=0.0.4", 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	exp := []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "200"},
+				{Name: "method", Value: "post"},
+			},
+			Samples: []prompb.Sample{{Value: 1027, Timestamp: 1395066363000}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "http_requests_total"},
+				{Name: "code", Value: "400"},
+				{Name: "method", Value: "post"},
+			},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: 1000}},
+		},
+	}
+	if !reflect.DeepEqual(wreq.Timeseries, exp) {
+		t.Errorf("expected %v, got %v", exp, wreq.Timeseries)
+	}
+
+	om := `# TYPE queue_length gauge
+queue_length{queue="a"} 42 1520879607.5
+# EOF
+`
+	wreq, err = parseText([]byte(om), "application/openmetrics-text; version=0.0.1", 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(wreq.Timeseries) != 1 || wreq.Timeseries[0].Samples[0].Timestamp != 1520879607500 {
+		t.Errorf("unexpected OpenMetrics series %v", wreq.Timeseries)
+	}
+
+	if _, err := parseText([]byte("http_requests_total{method=\"post\"} abc\n"), "text/plain", 0); err == nil {
+		t.Errorf("expected error for invalid value")
+	}
+}
+
+func TestParseInflux(t *testing.T) {
+	in := `# comment
+cpu,host=server\ 1,region=us-west usage_idle=92.5,usage_user=3i,enabled=t,name="x" 1556813561098000000
+weather temp=21.5
+`
+	wreq, err := parseInflux([]byte(in), "", 1000)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cpu := func(name string, v float64) prompb.TimeSeries {
+		return prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: name},
+				{Name: "host", Value: "server 1"},
+				{Name: "region", Value: "us-west"},
+			},
+			Samples: []prompb.Sample{{Value: v, Timestamp: 1556813561098}},
+		}
+	}
+	exp := []prompb.TimeSeries{
+		cpu("cpu_usage_idle", 92.5),
+		cpu("cpu_usage_user", 3),
+		cpu("cpu_enabled", 1),
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "weather_temp"}},
+			Samples: []prompb.Sample{{Value: 21.5, Timestamp: 1000}},
+		},
+	}
+	if !reflect.DeepEqual(wreq.Timeseries, exp) {
+		t.Errorf("expected %v, got %v", exp, wreq.Timeseries)
+	}
+
+	wreq, err = parseInflux([]byte("mem used=1u 1556813561"), "s", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts := wreq.Timeseries[0].Samples[0].Timestamp; ts != 1556813561000 {
+		t.Errorf("expected timestamp %d, got %d", 1556813561000, ts)
+	}
+
+	for _, in := range []string{
+		"cpu",
+		"cpu usage=abc",
+		"cpu,host usage=1",
+		"cpu usage=1 notatimestamp",
+	} {
+		if _, err := parseInflux([]byte(in), "", 0); err == nil {
+			t.Errorf("expected error for %q", in)
+		}
+	}
+	if _, err := parseInflux([]byte("cpu usage=1"), "h", 0); err == nil {
+		t.Errorf("expected error for unsupported precision")
+	}
+}
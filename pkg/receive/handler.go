@@ -1,15 +1,19 @@
 package receive
 
 import (
-	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	stdlog "log"
 	"net"
 	"net/http"
 	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -22,10 +26,16 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/route"
+	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/prometheus/promql"
 	promtsdb "github.com/prometheus/prometheus/storage/tsdb"
 	terrors "github.com/prometheus/tsdb/errors"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store/prompb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Options for the web Handler.
@@ -38,6 +48,16 @@ type Options struct {
 	TenantHeader      string
 	ReplicaHeader     string
 	ReplicationFactor uint64
+	DialOpts          []grpc.DialOption
+	ForwardQueue      *ForwardQueue
+	// TenantRelabelConfigs are applied to incoming write requests before they are routed.
+	TenantRelabelConfigs []TenantRelabelConfig
+	// TenantLabelName is the label that is set to the tenant on all incoming time series
+	// if not empty, so that the tenant cannot be spoofed by the sender.
+	TenantLabelName string
+	// MaxBodySize is the maximum size in bytes of the decoded body of text and line protocol write requests.
+	// 0 means no limit.
+	MaxBodySize int64
 }
 
 // Handler serves a Prometheus remote write receiving HTTP endpoint.
@@ -49,12 +69,15 @@ type Handler struct {
 	hashring     Hashring
 	options      *Options
 	listener     net.Listener
+	peers        *peerGroup
+	relabeler    *relabeler
 
 	// Metrics
 	requestDuration      *prometheus.HistogramVec
 	requestsTotal        *prometheus.CounterVec
 	responseSize         *prometheus.HistogramVec
 	forwardRequestsTotal *prometheus.CounterVec
+	relabelDroppedSeries prometheus.Counter
 
 	// These fields are uint32 rather than boolean to be able to use atomic functions.
 	storageReady  uint32
@@ -71,6 +94,8 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 		readyStorage: o.ReadyStorage,
 		receiver:     o.Receiver,
 		options:      o,
+		peers:        newPeerGroup(o.DialOpts...),
+		relabeler:    newRelabeler(o.TenantRelabelConfigs, o.TenantLabelName),
 		requestDuration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Name:    "thanos_http_request_duration_seconds",
@@ -99,6 +124,12 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 				Help: "The number of forward requests.",
 			}, []string{"result"},
 		),
+		relabelDroppedSeries: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_relabel_dropped_series_total",
+				Help: "The number of incoming time series dropped by relabeling.",
+			},
+		),
 	}
 
 	router := route.New().WithInstrumentation(h.instrumentHandler)
@@ -106,6 +137,9 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 
 	readyf := h.testReady
 	router.Post("/api/v1/receive", readyf(h.receive))
+	router.Post("/api/v1/receive/text", readyf(h.receiveText))
+	router.Post("/api/v1/receive/influx", readyf(h.receiveInflux))
+	router.Get("/api/v1/hashring", h.hashringInfo)
 
 	if o.Registry != nil {
 		o.Registry.MustRegister(
@@ -113,6 +147,7 @@ func NewHandler(logger log.Logger, o *Options) *Handler {
 			h.requestsTotal,
 			h.responseSize,
 			h.forwardRequestsTotal,
+			h.relabelDroppedSeries,
 		)
 	}
 
@@ -177,6 +212,9 @@ func (h *Handler) Close() {
 	if h.listener != nil {
 		runutil.CloseWithLogOnErr(h.logger, h.listener, "receive HTTP listener")
 	}
+	if err := h.peers.close(); err != nil {
+		level.Warn(h.logger).Log("msg", "failed to close peer connections", "err", err)
+	}
 }
 
 // Run serves the HTTP endpoints.
@@ -237,7 +275,94 @@ func (h *Handler) receive(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var rep replica
+	h.write(w, r, &wreq)
+}
+
+// receiveText accepts metrics in the Prometheus text exposition format,
+// or the OpenMetrics format if sent with its content type.
+func (h *Handler) receiveText(w http.ResponseWriter, r *http.Request) {
+	b, err := readBody(r, h.options.MaxBodySize)
+	if err != nil {
+		readBodyError(w, err)
+		return
+	}
+
+	wreq, err := parseText(b, r.Header.Get("Content-Type"), timestamp.FromTime(time.Now()))
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "parse text format").Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.write(w, r, wreq)
+}
+
+// receiveInflux accepts metrics in the InfluxDB line protocol. The precision
+// of timestamps is given by the `precision` URL parameter and defaults to nanoseconds.
+func (h *Handler) receiveInflux(w http.ResponseWriter, r *http.Request) {
+	b, err := readBody(r, h.options.MaxBodySize)
+	if err != nil {
+		readBodyError(w, err)
+		return
+	}
+
+	wreq, err := parseInflux(b, r.URL.Query().Get("precision"), timestamp.FromTime(time.Now()))
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "parse line protocol").Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.write(w, r, wreq)
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// readBody reads the body of the request, decompressing it if it is gzip encoded.
+// It fails with errBodyTooLarge if the decoded body exceeds maxSize bytes, unless maxSize is 0.
+func readBody(r *http.Request, maxSize int64) ([]byte, error) {
+	b, err := readDecodedBody(r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if maxSize > 0 && int64(len(b)) > maxSize {
+		return nil, errBodyTooLarge
+	}
+	return b, nil
+}
+
+// readDecodedBody reads at most maxSize+1 bytes of the decoded body, or all of it if maxSize is 0.
+func readDecodedBody(r *http.Request, maxSize int64) (_ []byte, err error) {
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "gzip decode")
+		}
+		defer runutil.CloseWithErrCapture(&err, gz, "close gzip reader")
+		body = gz
+	}
+	if maxSize > 0 {
+		body = io.LimitReader(body, maxSize+1)
+	}
+	return ioutil.ReadAll(body)
+}
+
+// readBodyError writes the error of readBody to the response.
+func readBodyError(w http.ResponseWriter, err error) {
+	if err == errBodyTooLarge {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// write forwards the write request of the given HTTP request for the tenant and
+// replica given in its headers.
+func (h *Handler) write(w http.ResponseWriter, r *http.Request, wreq *prompb.WriteRequest) {
+	var (
+		rep replica
+		err error
+	)
 	replicaRaw := r.Header.Get(h.options.ReplicaHeader)
 	// If the header is emtpy, we assume the request is not yet replicated.
 	if replicaRaw != "" {
@@ -255,15 +380,70 @@ func (h *Handler) receive(w http.ResponseWriter, r *http.Request) {
 
 	tenant := r.Header.Get(h.options.TenantHeader)
 
+	// Senders must not be able to skip relabeling or spoof the tenant label with the replica header.
+	h.relabelDroppedSeries.Add(float64(h.relabeler.relabel(tenant, wreq)))
+
 	// Forward any time series as necessary. All time series
 	// destined for the local node will be written to the receiver.
 	// Time series will be replicated as necessary.
-	if err := h.forward(r.Context(), tenant, rep, &wreq); err != nil {
+	if err := h.forward(r.Context(), tenant, rep, wreq); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 }
 
+// hashringResponse is the response of the hashring debug endpoint.
+type hashringResponse struct {
+	Hashrings []HashringConfig `json:"hashrings"`
+	Tenant    string           `json:"tenant,omitempty"`
+	Series    string           `json:"series,omitempty"`
+	// Owners are the nodes handling the series, ordered by replica number.
+	Owners []string `json:"owners,omitempty"`
+}
+
+// hashringInfo shows the current hashring configuration. If a series is given,
+// e.g. `series={foo="bar"}&tenant=foo`, the nodes handling it are shown as well.
+func (h *Handler) hashringInfo(w http.ResponseWriter, r *http.Request) {
+	hashring := h.hashring
+	if hashring == nil {
+		http.Error(w, "no hashring configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var resp hashringResponse
+	if c, ok := hashring.(configuredHashring); ok {
+		resp.Hashrings = c.Config()
+	}
+
+	if series := r.FormValue("series"); series != "" {
+		lset, err := promql.ParseMetric(series)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "parse series").Error(), http.StatusBadRequest)
+			return
+		}
+		ts := &prompb.TimeSeries{}
+		for _, l := range lset {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+		}
+
+		resp.Tenant = r.FormValue("tenant")
+		resp.Series = series
+		for n := uint64(0); n < h.options.ReplicationFactor; n++ {
+			endpoint, err := hashring.GetN(resp.Tenant, ts, n)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp.Owners = append(resp.Owners, endpoint)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		level.Error(h.logger).Log("msg", "failed to write hashring response", "err", err)
+	}
+}
+
 // forward accepts a write request, batches its time series by
 // corresponding endpoint, and forwards them in parallel to the
 // correct endpoint. Requests destined for the local node are written
@@ -335,20 +515,7 @@ func (h *Handler) parallelizeRequests(ctx context.Context, tenant string, replic
 		}
 		// Make a request to the specified endpoint.
 		go func(endpoint string) {
-			buf, err := proto.Marshal(wreqs[endpoint])
-			if err != nil {
-				level.Error(h.logger).Log("msg", "proto marshal error", "err", err, "endpoint", endpoint)
-				ec <- err
-				return
-			}
-			req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(snappy.Encode(nil, buf)))
-			if err != nil {
-				level.Error(h.logger).Log("msg", "create request error", "err", err, "endpoint", endpoint)
-				ec <- err
-				return
-			}
-			req.Header.Add(h.options.TenantHeader, tenant)
-			req.Header.Add(h.options.ReplicaHeader, strconv.FormatUint(replicas[endpoint].n, 10))
+			var err error
 
 			// Increment the counters as necessary now that
 			// the requests will go out.
@@ -362,15 +529,37 @@ func (h *Handler) parallelizeRequests(ctx context.Context, tenant string, replic
 
 			// Actually make the request against the endpoint
 			// we determined should handle these time series.
-			var res *http.Response
-			res, err = http.DefaultClient.Do(req.WithContext(ctx))
-			if err != nil {
-				level.Error(h.logger).Log("msg", "forward request error", "err", err, "endpoint", endpoint)
-				ec <- err
+			wr := &storepb.WriteRequest{
+				Timeseries: wreqs[endpoint].Timeseries,
+				Tenant:     tenant,
+				Replica:    int64(replicas[endpoint].n),
+			}
+			// Older write requests are still queued for the peer, so queue this one
+			// behind them to deliver the requests in order.
+			if h.options.ForwardQueue != nil && h.options.ForwardQueue.Pending(endpoint) {
+				if err = h.options.ForwardQueue.Enqueue(endpoint, wr); err != nil {
+					level.Error(h.logger).Log("msg", "failed to queue write request", "err", err, "endpoint", endpoint)
+					ec <- err
+					return
+				}
+				ec <- nil
 				return
 			}
-			if res.StatusCode != http.StatusOK {
-				ec <- errors.New(res.Status)
+			if err = h.sendToPeer(ctx, endpoint, wr); err != nil {
+				// If the peer is unreachable, persist its share of the write request
+				// and deliver it later instead of failing the whole request.
+				if h.options.ForwardQueue != nil && isUnreachable(err) {
+					qerr := h.options.ForwardQueue.Enqueue(endpoint, wr)
+					if qerr == nil {
+						level.Warn(h.logger).Log("msg", "peer unreachable; queued write request", "err", err, "endpoint", endpoint)
+						err = nil
+						ec <- nil
+						return
+					}
+					level.Error(h.logger).Log("msg", "failed to queue write request", "err", qerr, "endpoint", endpoint)
+				}
+				level.Error(h.logger).Log("msg", "forward request error", "err", err, "endpoint", endpoint)
+				ec <- err
 				return
 			}
 			ec <- nil
@@ -414,6 +603,116 @@ func (h *Handler) replicate(ctx context.Context, tenant string, wreq *prompb.Wri
 		if uint64(len(errs)) >= (h.options.ReplicationFactor+1)/2 {
 			return errors.New("did not meet replication threshhold")
 		}
+		// The write request was written by a quorum of the nodes.
+		return nil
 	}
 	return errors.Wrap(err, "could not replicate write request")
 }
+
+// RemoteWrite implements the gRPC remote write handler for storepb.WriteableStore.
+// It is used by other receive nodes to forward and replicate write requests.
+func (h *Handler) RemoteWrite(ctx context.Context, r *storepb.WriteRequest) (*storepb.WriteResponse, error) {
+	if !h.isReady() {
+		return nil, status.Error(codes.Unavailable, "receive node is not ready")
+	}
+
+	// Requests coming over gRPC are sent by another receive node, thus the replica number is explicit and the
+	// request is considered replicated.
+	rep := replica{n: uint64(r.Replica), replicated: true}
+	// The replica value is zero-indexed, thus we need >=.
+	if rep.n >= h.options.ReplicationFactor {
+		return nil, status.Error(codes.InvalidArgument, "replica count exceeds replication factor")
+	}
+
+	// The gRPC API is served on the same port as the StoreAPI, so requests are relabeled again, so that other
+	// clients cannot skip relabeling or spoof the tenant label either. Setting the tenant label is idempotent.
+	wreq := &prompb.WriteRequest{Timeseries: r.Timeseries}
+	h.relabelDroppedSeries.Add(float64(h.relabeler.relabel(r.Tenant, wreq)))
+
+	if err := h.forward(ctx, r.Tenant, rep, wreq); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &storepb.WriteResponse{}, nil
+}
+
+// sendToPeer sends the write request to the receive node at the given endpoint.
+func (h *Handler) sendToPeer(ctx context.Context, endpoint string, wreq *storepb.WriteRequest) error {
+	cl, err := h.peers.get(endpoint)
+	if err != nil {
+		return err
+	}
+	_, err = cl.RemoteWrite(ctx, wreq)
+	return err
+}
+
+// ReplayForwardQueue delivers the write requests that were queued while their peers were unreachable.
+// It is a no-op if no forward queue is configured.
+func (h *Handler) ReplayForwardQueue(ctx context.Context) {
+	if h.options.ForwardQueue == nil {
+		return
+	}
+	h.options.ForwardQueue.Replay(ctx, h.sendToPeer)
+}
+
+// isUnreachable returns true if the error is caused by the peer not being reachable,
+// as opposed to the peer rejecting the write request.
+func isUnreachable(err error) bool {
+	switch status.Code(errors.Cause(err)) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// peerGroup is a pool of gRPC connections to other receive nodes.
+// Connections are established lazily and reused for all subsequent requests.
+type peerGroup struct {
+	dialOpts []grpc.DialOption
+
+	mtx     sync.Mutex
+	conns   map[string]*grpc.ClientConn
+	clients map[string]storepb.WriteableStoreClient
+}
+
+func newPeerGroup(dialOpts ...grpc.DialOption) *peerGroup {
+	return &peerGroup{
+		dialOpts: dialOpts,
+		conns:    map[string]*grpc.ClientConn{},
+		clients:  map[string]storepb.WriteableStoreClient{},
+	}
+}
+
+// get returns a client for the given address, dialing a new connection if none exists yet.
+func (p *peerGroup) get(addr string) (storepb.WriteableStoreClient, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if c, ok := p.clients[addr]; ok {
+		return c, nil
+	}
+
+	conn, err := grpc.Dial(addr, p.dialOpts...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dialing peer %s", addr)
+	}
+	c := storepb.NewWriteableStoreClient(conn)
+	p.conns[addr] = conn
+	p.clients[addr] = c
+	return c, nil
+}
+
+// close closes all connections of the group.
+func (p *peerGroup) close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	var errs terrors.MultiError
+	for addr, conn := range p.conns {
+		if err := conn.Close(); err != nil {
+			errs.Add(errors.Wrapf(err, "closing connection to %s", addr))
+		}
+		delete(p.conns, addr)
+		delete(p.clients, addr)
+	}
+	return errs.Err()
+}
@@ -0,0 +1,471 @@
+package receive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/thanos-io/thanos/pkg/store/prompb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeAppendable counts the samples appended per series and fails all appends if err is set.
+type fakeAppendable struct {
+	mtx     sync.Mutex
+	samples map[string]int
+	err     error
+}
+
+func newFakeAppendable() *fakeAppendable {
+	return &fakeAppendable{samples: map[string]int{}}
+}
+
+func (f *fakeAppendable) Appender() (storage.Appender, error) {
+	return &fakeAppender{f: f}, nil
+}
+
+func (f *fakeAppendable) count(lset string) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.samples[lset]
+}
+
+func (f *fakeAppendable) total() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	n := 0
+	for _, c := range f.samples {
+		n += c
+	}
+	return n
+}
+
+type fakeAppender struct {
+	f *fakeAppendable
+}
+
+func (a *fakeAppender) Add(l labels.Labels, t int64, v float64) (uint64, error) {
+	a.f.mtx.Lock()
+	defer a.f.mtx.Unlock()
+
+	if a.f.err != nil {
+		return 0, a.f.err
+	}
+	a.f.samples[l.String()]++
+	return 0, nil
+}
+
+func (a *fakeAppender) AddFast(l labels.Labels, ref uint64, t int64, v float64) error {
+	_, err := a.Add(l, t, v)
+	return err
+}
+
+func (a *fakeAppender) Commit() error   { return nil }
+func (a *fakeAppender) Rollback() error { return nil }
+
+// testReceivers starts n receive handlers serving the gRPC WriteableStore API on local ports,
+// sharing a hashring of all of them.
+func testReceivers(t *testing.T, n int, replicationFactor uint64) ([]*Handler, []*fakeAppendable, []*grpc.Server, func()) {
+	var (
+		handlers    []*Handler
+		appendables []*fakeAppendable
+		servers     []*grpc.Server
+		addrs       []string
+	)
+	for i := 0; i < n; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		app := newFakeAppendable()
+		h := NewHandler(nil, &Options{
+			Receiver:          NewWriter(nil, app),
+			Endpoint:          lis.Addr().String(),
+			ReplicationFactor: replicationFactor,
+			DialOpts:          []grpc.DialOption{grpc.WithInsecure()},
+		})
+		h.StorageReady()
+
+		srv := grpc.NewServer()
+		storepb.RegisterWriteableStoreServer(srv, h)
+		go func() { _ = srv.Serve(lis) }()
+
+		handlers = append(handlers, h)
+		appendables = append(appendables, app)
+		servers = append(servers, srv)
+		addrs = append(addrs, lis.Addr().String())
+	}
+	for _, h := range handlers {
+		h.Hashring(simpleHashring(addrs))
+	}
+	return handlers, appendables, servers, func() {
+		for i := range handlers {
+			servers[i].Stop()
+			handlers[i].Close()
+		}
+	}
+}
+
+func testWriteRequest(series int) *prompb.WriteRequest {
+	wreq := &prompb.WriteRequest{}
+	for i := 0; i < series; i++ {
+		wreq.Timeseries = append(wreq.Timeseries, prompb.TimeSeries{
+			Labels:  []prompb.Label{{Name: "series", Value: fmt.Sprintf("%d", i)}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+		})
+	}
+	return wreq
+}
+
+// owner returns the index of the node handling the nth replica of the time series.
+func owner(t *testing.T, h *Handler, tenant string, ts *prompb.TimeSeries, n uint64) int {
+	endpoint, err := h.hashring.GetN(tenant, ts, n)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i, addr := range h.hashring.(simpleHashring) {
+		if addr == endpoint {
+			return i
+		}
+	}
+	t.Fatalf("endpoint %s not in hashring", endpoint)
+	return -1
+}
+
+func seriesString(ts prompb.TimeSeries) string {
+	lset := make(labels.Labels, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+	}
+	return lset.String()
+}
+
+func TestHandler_Forward(t *testing.T) {
+	handlers, appendables, _, cleanup := testReceivers(t, 3, 1)
+	defer cleanup()
+
+	wreq := testWriteRequest(30)
+	if err := handlers[0].forward(context.Background(), "tenant", replica{}, wreq); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every series is written once, by the node owning it in the hashring.
+	var total int
+	for i, ts := range wreq.Timeseries {
+		o := owner(t, handlers[0], "tenant", &wreq.Timeseries[i], 0)
+		if c := appendables[o].count(seriesString(ts)); c != 1 {
+			t.Errorf("expected series %s to be written once to node %d, got %d", seriesString(ts), o, c)
+		}
+	}
+	for _, app := range appendables {
+		total += app.total()
+	}
+	if total != len(wreq.Timeseries) {
+		t.Errorf("expected %d samples to be written, got %d", len(wreq.Timeseries), total)
+	}
+}
+
+func TestHandler_ForwardPeerError(t *testing.T) {
+	for _, tcase := range []struct {
+		name string
+		fail func(app *fakeAppendable, srv *grpc.Server)
+	}{
+		{
+			name: "peer rejects write",
+			fail: func(app *fakeAppendable, _ *grpc.Server) { app.err = errors.New("append failed") },
+		},
+		{
+			name: "peer unreachable",
+			fail: func(_ *fakeAppendable, srv *grpc.Server) { srv.Stop() },
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			handlers, appendables, servers, cleanup := testReceivers(t, 3, 1)
+			defer cleanup()
+
+			wreq := testWriteRequest(30)
+			// Fail a peer owning some of the series, not the node receiving the request.
+			failing := 0
+			for i := range wreq.Timeseries {
+				if failing = owner(t, handlers[0], "tenant", &wreq.Timeseries[i], 0); failing != 0 {
+					break
+				}
+			}
+			tcase.fail(appendables[failing], servers[failing])
+
+			if err := handlers[0].forward(context.Background(), "tenant", replica{}, wreq); err == nil {
+				t.Fatalf("expected error forwarding to failing peer")
+			}
+			if appendables[failing].total() != 0 {
+				t.Errorf("expected no samples to be written to the failing node")
+			}
+		})
+	}
+}
+
+func TestHandler_ForwardQueued(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward-queue")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	handlers, appendables, _, cleanup := testReceivers(t, 3, 1)
+	defer cleanup()
+
+	q, err := NewForwardQueue(nil, nil, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	handlers[0].options.ForwardQueue = q
+
+	wreq := testWriteRequest(30)
+	peer := 0
+	for i := range wreq.Timeseries {
+		if peer = owner(t, handlers[0], "tenant", &wreq.Timeseries[i], 0); peer != 0 {
+			break
+		}
+	}
+	// An older write request is still queued for the peer.
+	if err := q.Enqueue(handlers[peer].options.Endpoint, &storepb.WriteRequest{
+		Tenant:     "tenant",
+		Timeseries: []prompb.TimeSeries{{Labels: []prompb.Label{{Name: "series", Value: "queued"}}, Samples: []prompb.Sample{{Value: 1, Timestamp: 0}}}},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := handlers[0].forward(context.Background(), "tenant", replica{}, wreq); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The new write request must be queued behind the older one rather than sent directly.
+	if total := appendables[peer].total(); total != 0 {
+		t.Fatalf("expected no samples to be written to node %d before the queue is replayed, got %d", peer, total)
+	}
+
+	handlers[0].ReplayForwardQueue(context.Background())
+	if q.Pending(handlers[peer].options.Endpoint) {
+		t.Errorf("expected the queue to be replayed")
+	}
+	var queued, total int
+	for _, app := range appendables {
+		queued += app.count(`{series="queued"}`)
+		total += app.total()
+	}
+	if queued != 1 {
+		t.Errorf("expected the queued series to be written once, got %d", queued)
+	}
+	if total != len(wreq.Timeseries)+1 {
+		t.Errorf("expected %d samples to be written, got %d", len(wreq.Timeseries)+1, total)
+	}
+}
+
+func TestHandler_ReplicationQuorum(t *testing.T) {
+	for _, tcase := range []struct {
+		failing     int
+		expectedErr bool
+	}{
+		{failing: 0},
+		{failing: 1},
+		{failing: 2, expectedErr: true},
+	} {
+		t.Run(fmt.Sprintf("%d failing nodes", tcase.failing), func(t *testing.T) {
+			handlers, appendables, _, cleanup := testReceivers(t, 3, 3)
+			defer cleanup()
+
+			// Fail the last nodes, so that the node receiving the request is a peer of the failing ones.
+			for i := 0; i < tcase.failing; i++ {
+				appendables[len(appendables)-1-i].err = errors.New("append failed")
+			}
+
+			wreq := testWriteRequest(10)
+			err := handlers[0].forward(context.Background(), "tenant", replica{}, wreq)
+			if tcase.expectedErr {
+				if err == nil {
+					t.Fatalf("expected error as the replication quorum was not met")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// Every series is replicated to all healthy nodes.
+			for i := 0; i < len(appendables)-tcase.failing; i++ {
+				if total := appendables[i].total(); total != len(wreq.Timeseries) {
+					t.Errorf("expected %d samples to be written to node %d, got %d", len(wreq.Timeseries), i, total)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_RemoteWrite(t *testing.T) {
+	handlers, appendables, _, cleanup := testReceivers(t, 2, 1)
+	defer cleanup()
+
+	wreq := testWriteRequest(1)
+	ts := wreq.Timeseries[0]
+	o := owner(t, handlers[0], "tenant", &ts, 0)
+
+	// A forwarded request is written by the node owning it, even if received by another node.
+	other := (o + 1) % len(handlers)
+	if _, err := handlers[other].RemoteWrite(context.Background(), &storepb.WriteRequest{Timeseries: wreq.Timeseries, Tenant: "tenant"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c := appendables[o].count(seriesString(ts)); c != 1 {
+		t.Errorf("expected series to be written once to node %d, got %d", o, c)
+	}
+
+	_, err := handlers[0].RemoteWrite(context.Background(), &storepb.WriteRequest{Timeseries: wreq.Timeseries, Tenant: "tenant", Replica: 1})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument error for replica exceeding replication factor, got %v", err)
+	}
+
+	handlers[0].Hashring(nil)
+	_, err = handlers[0].RemoteWrite(context.Background(), &storepb.WriteRequest{Timeseries: wreq.Timeseries, Tenant: "tenant"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable error for node that is not ready, got %v", err)
+	}
+}
+
+func TestHandler_EnforceTenantLabel(t *testing.T) {
+	app := newFakeAppendable()
+	h := NewHandler(nil, &Options{
+		Receiver:          NewWriter(nil, app),
+		Endpoint:          "localhost:10901",
+		TenantHeader:      "THANOS-TENANT",
+		ReplicaHeader:     "THANOS-REPLICA",
+		ReplicationFactor: 1,
+		TenantLabelName:   "tenant_id",
+	})
+	defer h.Close()
+	h.StorageReady()
+	h.Hashring(SingleNodeHashring("localhost:10901"))
+
+	// The replica header must not allow senders to skip relabeling.
+	req := httptest.NewRequest("POST", "/api/v1/receive/text", strings.NewReader("foo{tenant_id=\"spoofed\"} 1\n"))
+	req.Header.Set("THANOS-TENANT", "tenant-a")
+	req.Header.Set("THANOS-REPLICA", "0")
+	rec := httptest.NewRecorder()
+	h.router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code %d: %s", rec.Code, rec.Body.String())
+	}
+	if c := app.count(`{__name__="foo", tenant_id="tenant-a"}`); c != 1 {
+		t.Errorf("expected series with the tenant label of the request to be written once, got %d", c)
+	}
+	if app.total() != 1 {
+		t.Errorf("expected 1 sample to be written, got %d", app.total())
+	}
+}
+
+func TestHandler_EnforceTenantLabelGRPC(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	app := newFakeAppendable()
+	h := NewHandler(nil, &Options{
+		Receiver:          NewWriter(nil, app),
+		Endpoint:          lis.Addr().String(),
+		ReplicationFactor: 1,
+		TenantLabelName:   "tenant_id",
+	})
+	defer h.Close()
+	h.StorageReady()
+	h.Hashring(SingleNodeHashring(lis.Addr().String()))
+
+	srv := grpc.NewServer()
+	storepb.RegisterWriteableStoreServer(srv, h)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer conn.Close()
+
+	// Any client of the gRPC API, not only other receive nodes, must not be able to spoof the tenant label.
+	_, err = storepb.NewWriteableStoreClient(conn).RemoteWrite(context.Background(), &storepb.WriteRequest{
+		Tenant: "tenant-a",
+		Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "foo"}, {Name: "tenant_id", Value: "spoofed"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c := app.count(`{__name__="foo", tenant_id="tenant-a"}`); c != 1 {
+		t.Errorf("expected series with the tenant label of the request to be written once, got %d", c)
+	}
+	if app.total() != 1 {
+		t.Errorf("expected 1 sample to be written, got %d", app.total())
+	}
+}
+
+func TestReadBody(t *testing.T) {
+	gzipped := func(s string) io.Reader {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write([]byte(s)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return &buf
+	}
+	for _, tcase := range []struct {
+		name        string
+		body        io.Reader
+		gzip        bool
+		maxSize     int64
+		expected    string
+		expectedErr error
+	}{
+		{name: "plain", body: strings.NewReader("foo 1\n"), maxSize: 6, expected: "foo 1\n"},
+		{name: "plain too large", body: strings.NewReader("foo 1\n"), maxSize: 5, expectedErr: errBodyTooLarge},
+		{name: "gzip", body: gzipped("foo 1\n"), gzip: true, maxSize: 6, expected: "foo 1\n"},
+		{name: "gzip decoded too large", body: gzipped(strings.Repeat("foo 1\n", 1000)), gzip: true, maxSize: 100, expectedErr: errBodyTooLarge},
+		{name: "no limit", body: gzipped(strings.Repeat("foo 1\n", 1000)), gzip: true, expected: strings.Repeat("foo 1\n", 1000)},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/receive/text", tcase.body)
+			if tcase.gzip {
+				r.Header.Set("Content-Encoding", "gzip")
+			}
+			b, err := readBody(r, tcase.maxSize)
+			if err != tcase.expectedErr {
+				t.Fatalf("expected error %v, got %v", tcase.expectedErr, err)
+			}
+			if string(b) != tcase.expected {
+				t.Errorf("expected body %q, got %q", tcase.expected, string(b))
+			}
+		})
+	}
+
+	r := httptest.NewRequest("POST", "/api/v1/receive/text", strings.NewReader("not gzip"))
+	r.Header.Set("Content-Encoding", "gzip")
+	if _, err := readBody(r, 0); err == nil {
+		t.Errorf("expected error for invalid gzip body")
+	}
+}
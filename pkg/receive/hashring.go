@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/thanos-io/thanos/pkg/store/prompb"
 
@@ -36,6 +37,12 @@ type Hashring interface {
 	GetN(tenant string, timeSeries *prompb.TimeSeries, n uint64) (string, error)
 }
 
+// configuredHashring is implemented by hashrings that can report
+// the configuration they were built from.
+type configuredHashring interface {
+	Config() []HashringConfig
+}
+
 // hash returns a hash for the given tenant and time series.
 func hash(tenant string, ts *prompb.TimeSeries) uint64 {
 	// Sort labelset to ensure a stable hash.
@@ -69,6 +76,11 @@ func (s SingleNodeHashring) GetN(_ string, _ *prompb.TimeSeries, n uint64) (stri
 	return string(s), nil
 }
 
+// Config returns the configuration of the hashring.
+func (s SingleNodeHashring) Config() []HashringConfig {
+	return []HashringConfig{{Endpoints: []string{string(s)}}}
+}
+
 // simpleHashring represents a group of nodes handling write requests.
 type simpleHashring []string
 
@@ -89,6 +101,7 @@ func (s simpleHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (st
 // Which hashring to use for a tenant is determined
 // by the tenants field of the hashring configuration.
 type multiHashring struct {
+	cfg        []HashringConfig
 	cache      map[string]Hashring
 	hashrings  []Hashring
 	tenantSets []map[string]struct{}
@@ -136,12 +149,18 @@ func (m *multiHashring) GetN(tenant string, ts *prompb.TimeSeries, n uint64) (st
 	return "", errors.New("no matching hashring to handle tenant")
 }
 
+// Config returns the configuration the hashrings were built from.
+func (m *multiHashring) Config() []HashringConfig {
+	return m.cfg
+}
+
 // newMultiHashring creates a multi-tenant hashring for a given slice of
 // groups.
 // Which hashring to use for a tenant is determined
 // by the tenants field of the hashring configuration.
 func newMultiHashring(cfg []HashringConfig) Hashring {
 	m := &multiHashring{
+		cfg:   cfg,
 		cache: make(map[string]Hashring),
 	}
 
@@ -160,21 +179,31 @@ func newMultiHashring(cfg []HashringConfig) Hashring {
 }
 
 // HashringFromConfig creates multi-tenant hashrings from a
-// hashring configuration file watcher.
-// The configuration file is watched for updates.
-// Hashrings are returned on the updates channel.
+// hashring configuration source, e.g. a file watcher.
+// The source is watched for updates.
+// Hashrings are returned on the updates channel once the configuration
+// has not changed for the debounce period, so that a source settling
+// on a new configuration does not cause churn.
 // Which hashring to use for a tenant is determined
 // by the tenants field of the hashring configuration.
-func HashringFromConfig(ctx context.Context, updates chan<- Hashring, cw *ConfigWatcher) {
-	go cw.Run(ctx)
+func HashringFromConfig(ctx context.Context, updates chan<- Hashring, cs ConfigSource, debounce time.Duration) {
+	go cs.Run(ctx)
 
+	var (
+		pending []HashringConfig
+		ready   <-chan time.Time
+	)
 	for {
 		select {
-		case cfg, ok := <-cw.C():
+		case cfg, ok := <-cs.C():
 			if !ok {
 				return
 			}
-			updates <- newMultiHashring(cfg)
+			pending = cfg
+			ready = time.After(debounce)
+		case <-ready:
+			ready = nil
+			updates <- newMultiHashring(pending)
 		case <-ctx.Done():
 			return
 		}
@@ -0,0 +1,350 @@
+package receive
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+)
+
+// errForwardQueueFull is returned when a write request cannot be queued
+// because the queue of the peer reached its maximum size.
+var errForwardQueueFull = errors.New("forward queue is full")
+
+// ForwardQueue is an on-disk queue of write requests destined for peers
+// that could not be reached. Every peer has its own bounded queue, which
+// is replayed in order once the peer is reachable again.
+type ForwardQueue struct {
+	logger   log.Logger
+	dir      string
+	maxBytes int64
+
+	mtx   sync.Mutex
+	peers map[string]*peerQueue
+
+	depth        *prometheus.GaugeVec
+	size         *prometheus.GaugeVec
+	oldestAge    *prometheus.GaugeVec
+	enqueued     *prometheus.CounterVec
+	replayed     *prometheus.CounterVec
+	dropped      *prometheus.CounterVec
+	rejectedFull *prometheus.CounterVec
+}
+
+// peerQueue holds the queued write requests of a single peer.
+type peerQueue struct {
+	dir string
+
+	mtx     sync.Mutex
+	entries []queueEntry
+	size    int64
+	nextSeq uint64
+}
+
+// queueEntry is a single write request persisted on disk.
+type queueEntry struct {
+	seq     uint64
+	size    int64
+	created time.Time
+}
+
+func (e queueEntry) path(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d", e.seq))
+}
+
+// NewForwardQueue creates a new ForwardQueue in the given directory and loads
+// all write requests that were queued before. Every peer can hold at most maxBytes
+// of queued write requests.
+func NewForwardQueue(logger log.Logger, reg prometheus.Registerer, dir string, maxBytes int64) (*ForwardQueue, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	q := &ForwardQueue{
+		logger:   logger,
+		dir:      dir,
+		maxBytes: maxBytes,
+		peers:    map[string]*peerQueue{},
+		depth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "thanos_receive_forward_queue_depth",
+				Help: "The number of write requests queued for a peer.",
+			}, []string{"peer"},
+		),
+		size: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "thanos_receive_forward_queue_size_bytes",
+				Help: "The size in bytes of the write requests queued for a peer.",
+			}, []string{"peer"},
+		),
+		oldestAge: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "thanos_receive_forward_queue_oldest_entry_age_seconds",
+				Help: "The age of the oldest write request queued for a peer.",
+			}, []string{"peer"},
+		),
+		enqueued: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_forward_queue_enqueued_total",
+				Help: "The number of write requests queued for a peer because it was unreachable.",
+			}, []string{"peer"},
+		),
+		replayed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_forward_queue_replayed_total",
+				Help: "The number of queued write requests successfully delivered to a peer.",
+			}, []string{"peer"},
+		),
+		dropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_forward_queue_dropped_total",
+				Help: "The number of queued write requests dropped because they were corrupted or rejected by the peer.",
+			}, []string{"peer"},
+		),
+		rejectedFull: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "thanos_receive_forward_queue_full_total",
+				Help: "The number of write requests that could not be queued because the queue of the peer was full.",
+			}, []string{"peer"},
+		),
+	}
+
+	if reg != nil {
+		reg.MustRegister(
+			q.depth,
+			q.size,
+			q.oldestAge,
+			q.enqueued,
+			q.replayed,
+			q.dropped,
+			q.rejectedFull,
+		)
+	}
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create forward queue dir")
+	}
+	if err := q.load(); err != nil {
+		return nil, errors.Wrap(err, "load forward queue")
+	}
+	return q, nil
+}
+
+// load reads the queued write requests of all peers from disk.
+func (q *ForwardQueue) load() error {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		peer, err := url.QueryUnescape(f.Name())
+		if err != nil {
+			level.Warn(q.logger).Log("msg", "ignoring unexpected directory in forward queue", "dir", f.Name(), "err", err)
+			continue
+		}
+
+		pq := &peerQueue{dir: filepath.Join(q.dir, f.Name())}
+		entries, err := ioutil.ReadDir(pq.dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			seq, err := strconv.ParseUint(e.Name(), 10, 64)
+			if err != nil {
+				// Leftover temporary files from an interrupted write.
+				if err := os.Remove(filepath.Join(pq.dir, e.Name())); err != nil {
+					return err
+				}
+				continue
+			}
+			pq.entries = append(pq.entries, queueEntry{seq: seq, size: e.Size(), created: e.ModTime()})
+			pq.size += e.Size()
+		}
+		sort.Slice(pq.entries, func(i, j int) bool { return pq.entries[i].seq < pq.entries[j].seq })
+		if len(pq.entries) > 0 {
+			pq.nextSeq = pq.entries[len(pq.entries)-1].seq + 1
+			level.Info(q.logger).Log("msg", "loaded forward queue", "peer", peer, "requests", len(pq.entries), "bytes", pq.size)
+		}
+
+		q.peers[peer] = pq
+		q.updateMetrics(peer, pq)
+	}
+	return nil
+}
+
+// peer returns the queue of the given peer, creating it if necessary.
+func (q *ForwardQueue) peer(peer string) (*peerQueue, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if pq, ok := q.peers[peer]; ok {
+		return pq, nil
+	}
+	pq := &peerQueue{dir: filepath.Join(q.dir, url.QueryEscape(peer))}
+	if err := os.MkdirAll(pq.dir, 0777); err != nil {
+		return nil, err
+	}
+	q.peers[peer] = pq
+	return pq, nil
+}
+
+// Pending returns true if write requests are queued for the given peer.
+func (q *ForwardQueue) Pending(peer string) bool {
+	q.mtx.Lock()
+	pq, ok := q.peers[peer]
+	q.mtx.Unlock()
+	if !ok {
+		return false
+	}
+
+	pq.mtx.Lock()
+	defer pq.mtx.Unlock()
+	return len(pq.entries) > 0
+}
+
+// Enqueue persists the write request for the given peer. The request will be
+// delivered on a subsequent Replay once the peer is reachable.
+func (q *ForwardQueue) Enqueue(peer string, wreq *storepb.WriteRequest) error {
+	pq, err := q.peer(peer)
+	if err != nil {
+		return errors.Wrapf(err, "create forward queue for peer %s", peer)
+	}
+
+	b, err := wreq.Marshal()
+	if err != nil {
+		return errors.Wrap(err, "marshal write request")
+	}
+
+	pq.mtx.Lock()
+	defer pq.mtx.Unlock()
+
+	if pq.size+int64(len(b)) > q.maxBytes {
+		q.rejectedFull.WithLabelValues(peer).Inc()
+		return errForwardQueueFull
+	}
+
+	e := queueEntry{seq: pq.nextSeq, size: int64(len(b)), created: time.Now()}
+	tmp := e.path(pq.dir) + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return errors.Wrap(err, "write queued request")
+	}
+	if err := os.Rename(tmp, e.path(pq.dir)); err != nil {
+		return errors.Wrap(err, "rename queued request")
+	}
+
+	pq.nextSeq++
+	pq.entries = append(pq.entries, e)
+	pq.size += e.size
+	q.enqueued.WithLabelValues(peer).Inc()
+	q.updateMetrics(peer, pq)
+	return nil
+}
+
+// Replay tries to deliver the queued write requests of every peer in order.
+// Delivery to a peer stops as soon as it is unreachable and is retried on the next Replay.
+// Write requests rejected by a reachable peer can never be delivered and are dropped.
+func (q *ForwardQueue) Replay(ctx context.Context, send func(context.Context, string, *storepb.WriteRequest) error) {
+	q.mtx.Lock()
+	peers := make(map[string]*peerQueue, len(q.peers))
+	for p, pq := range q.peers {
+		peers[p] = pq
+	}
+	q.mtx.Unlock()
+
+	for peer, pq := range peers {
+		n, err := q.replayPeer(ctx, peer, pq, send)
+		if n > 0 {
+			level.Info(q.logger).Log("msg", "replayed queued write requests", "peer", peer, "requests", n)
+		}
+		if err != nil {
+			level.Debug(q.logger).Log("msg", "peer still unreachable; keeping write requests queued", "peer", peer, "err", err)
+		}
+
+		pq.mtx.Lock()
+		q.updateMetrics(peer, pq)
+		pq.mtx.Unlock()
+	}
+}
+
+// replayPeer delivers the queued write requests of a single peer and returns
+// the number of delivered requests.
+func (q *ForwardQueue) replayPeer(ctx context.Context, peer string, pq *peerQueue, send func(context.Context, string, *storepb.WriteRequest) error) (int, error) {
+	var n int
+	for {
+		select {
+		case <-ctx.Done():
+			return n, ctx.Err()
+		default:
+		}
+
+		pq.mtx.Lock()
+		if len(pq.entries) == 0 {
+			pq.mtx.Unlock()
+			return n, nil
+		}
+		// Only the replay removes entries, so the head is stable while we send it.
+		e := pq.entries[0]
+		pq.mtx.Unlock()
+
+		b, err := ioutil.ReadFile(e.path(pq.dir))
+		if err != nil {
+			return n, errors.Wrap(err, "read queued request")
+		}
+		delivered := true
+		var wreq storepb.WriteRequest
+		if err := wreq.Unmarshal(b); err != nil {
+			// A corrupted entry can never be delivered, so drop it rather than blocking the queue forever.
+			level.Error(q.logger).Log("msg", "dropping corrupted queued write request", "peer", peer, "file", e.path(pq.dir), "err", err)
+			delivered = false
+		} else if err := send(ctx, peer, &wreq); err != nil {
+			if isUnreachable(err) {
+				return n, err
+			}
+			// The peer is reachable but rejected the request, so retrying it would block the queue forever.
+			level.Error(q.logger).Log("msg", "dropping queued write request rejected by peer", "peer", peer, "err", err)
+			delivered = false
+		}
+
+		if err := os.Remove(e.path(pq.dir)); err != nil {
+			return n, errors.Wrap(err, "remove queued request")
+		}
+
+		pq.mtx.Lock()
+		pq.entries = pq.entries[1:]
+		pq.size -= e.size
+		pq.mtx.Unlock()
+
+		if !delivered {
+			q.dropped.WithLabelValues(peer).Inc()
+			continue
+		}
+		q.replayed.WithLabelValues(peer).Inc()
+		n++
+	}
+}
+
+// updateMetrics updates the metrics of the given peer queue. The lock of pq must be held.
+func (q *ForwardQueue) updateMetrics(peer string, pq *peerQueue) {
+	q.depth.WithLabelValues(peer).Set(float64(len(pq.entries)))
+	q.size.WithLabelValues(peer).Set(float64(pq.size))
+	if len(pq.entries) == 0 {
+		q.oldestAge.WithLabelValues(peer).Set(0)
+		return
+	}
+	q.oldestAge.WithLabelValues(peer).Set(time.Since(pq.entries[0].created).Seconds())
+}
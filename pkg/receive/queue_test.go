@@ -0,0 +1,158 @@
+package receive
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/store/prompb"
+	"github.com/thanos-io/thanos/pkg/store/storepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func writeRequest(tenant string, ts int64) *storepb.WriteRequest {
+	return &storepb.WriteRequest{
+		Tenant: tenant,
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "foo", Value: "bar"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: ts}},
+			},
+		},
+	}
+}
+
+func TestForwardQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward-queue")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewForwardQueue(nil, nil, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := int64(0); i < 3; i++ {
+		if err := q.Enqueue("node-1:10901", writeRequest("tenant", i)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := q.Enqueue("node-2:10901", writeRequest("other", 10)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A peer that stays unreachable keeps all of its requests queued.
+	unreachable := status.Error(codes.Unavailable, "unreachable")
+	var sent []int64
+	q.Replay(context.Background(), func(_ context.Context, peer string, wreq *storepb.WriteRequest) error {
+		if peer == "node-1:10901" {
+			return unreachable
+		}
+		sent = append(sent, wreq.Timeseries[0].Samples[0].Timestamp)
+		return nil
+	})
+	if len(sent) != 1 || sent[0] != 10 {
+		t.Errorf("expected only the request for node-2 to be replayed, got %v", sent)
+	}
+	if !q.Pending("node-1:10901") {
+		t.Errorf("expected requests to be pending for node-1")
+	}
+	if q.Pending("node-2:10901") {
+		t.Errorf("expected no requests to be pending for node-2")
+	}
+
+	// Reopening the queue must restore the pending requests from disk.
+	q, err = NewForwardQueue(nil, nil, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sent = nil
+	q.Replay(context.Background(), func(_ context.Context, peer string, wreq *storepb.WriteRequest) error {
+		if peer != "node-1:10901" {
+			t.Errorf("unexpected peer %q", peer)
+		}
+		if wreq.Tenant != "tenant" {
+			t.Errorf("expected tenant %q, got %q", "tenant", wreq.Tenant)
+		}
+		sent = append(sent, wreq.Timeseries[0].Samples[0].Timestamp)
+		return nil
+	})
+	if len(sent) != 3 {
+		t.Fatalf("expected 3 replayed requests, got %d", len(sent))
+	}
+	for i, ts := range sent {
+		if ts != int64(i) {
+			t.Errorf("expected requests to be replayed in order, got %v", sent)
+			break
+		}
+	}
+
+	// Everything was delivered, so nothing is left to replay.
+	q.Replay(context.Background(), func(context.Context, string, *storepb.WriteRequest) error {
+		t.Errorf("unexpected replay of delivered request")
+		return nil
+	})
+}
+
+func TestForwardQueueFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward-queue")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wreq := writeRequest("tenant", 0)
+	q, err := NewForwardQueue(nil, nil, dir, int64(wreq.Size()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := q.Enqueue("node-1:10901", wreq); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := q.Enqueue("node-1:10901", wreq); err != errForwardQueueFull {
+		t.Errorf("expected %v, got %v", errForwardQueueFull, err)
+	}
+	// Queues are bounded per peer.
+	if err := q.Enqueue("node-2:10901", wreq); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestForwardQueueRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward-queue")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewForwardQueue(nil, nil, dir, 1<<20)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := int64(0); i < 3; i++ {
+		if err := q.Enqueue("node-1:10901", writeRequest("tenant", i)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// A request rejected by a reachable peer is dropped instead of blocking the requests behind it.
+	var sent []int64
+	q.Replay(context.Background(), func(_ context.Context, _ string, wreq *storepb.WriteRequest) error {
+		ts := wreq.Timeseries[0].Samples[0].Timestamp
+		if ts == 1 {
+			return errors.New("rejected")
+		}
+		sent = append(sent, ts)
+		return nil
+	})
+	if len(sent) != 2 || sent[0] != 0 || sent[1] != 2 {
+		t.Errorf("expected requests 0 and 2 to be replayed, got %v", sent)
+	}
+	if q.Pending("node-1:10901") {
+		t.Errorf("expected no requests to be pending")
+	}
+}
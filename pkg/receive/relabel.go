@@ -0,0 +1,111 @@
+package receive
+
+import (
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/thanos-io/thanos/pkg/store/prompb"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TenantRelabelConfig represents the relabel configuration applied
+// to the write requests of a set of tenants.
+type TenantRelabelConfig struct {
+	// Tenants the relabel configuration applies to. If empty, the relabel
+	// configuration applies to all tenants without their own configuration.
+	Tenants        []string          `yaml:"tenants"`
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs"`
+}
+
+// ParseRelabelConfig parses and validates the YAML relabel configuration of tenants.
+func ParseRelabelConfig(content []byte) ([]TenantRelabelConfig, error) {
+	var cfg []TenantRelabelConfig
+	if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+		return nil, errors.Wrap(err, "parsing YAML content")
+	}
+
+	var hasDefault bool
+	tenants := map[string]struct{}{}
+	for _, c := range cfg {
+		if len(c.Tenants) == 0 {
+			if hasDefault {
+				return nil, errors.New("more than one relabel configuration without tenants")
+			}
+			hasDefault = true
+		}
+		for _, t := range c.Tenants {
+			if _, ok := tenants[t]; ok {
+				return nil, errors.Errorf("tenant %s has more than one relabel configuration", t)
+			}
+			tenants[t] = struct{}{}
+		}
+	}
+	return cfg, nil
+}
+
+// relabeler applies the relabel configuration of tenants to their write requests.
+type relabeler struct {
+	tenants map[string][]*relabel.Config
+	// def is the relabel configuration of tenants without their own.
+	def []*relabel.Config
+	// tenantLabel, if not empty, is set to the tenant of the write request
+	// on all time series, overriding any value sent by the client.
+	tenantLabel string
+}
+
+func newRelabeler(cfg []TenantRelabelConfig, tenantLabel string) *relabeler {
+	r := &relabeler{
+		tenants:     map[string][]*relabel.Config{},
+		tenantLabel: tenantLabel,
+	}
+	for _, c := range cfg {
+		if len(c.Tenants) == 0 {
+			r.def = c.RelabelConfigs
+		}
+		for _, t := range c.Tenants {
+			r.tenants[t] = c.RelabelConfigs
+		}
+	}
+	return r
+}
+
+// relabel applies the relabel configuration of the tenant to all time series
+// of the write request in place. Time series dropped by the relabeling are removed
+// from the write request and their number is returned.
+func (r *relabeler) relabel(tenant string, wreq *prompb.WriteRequest) int {
+	cfgs, ok := r.tenants[tenant]
+	if !ok {
+		cfgs = r.def
+	}
+	if len(cfgs) == 0 && r.tenantLabel == "" {
+		return 0
+	}
+
+	var (
+		dropped int
+		kept    = wreq.Timeseries[:0]
+	)
+	for _, ts := range wreq.Timeseries {
+		lset := make(labels.Labels, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+		}
+
+		lset = relabel.Process(lset, cfgs...)
+		if lset == nil {
+			dropped++
+			continue
+		}
+		if r.tenantLabel != "" {
+			lset = labels.NewBuilder(lset).Set(r.tenantLabel, tenant).Labels()
+		}
+
+		ts.Labels = ts.Labels[:0]
+		for _, l := range lset {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		kept = append(kept, ts)
+	}
+	wreq.Timeseries = kept
+	return dropped
+}
@@ -0,0 +1,141 @@
+package receive
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/store/prompb"
+)
+
+func TestParseRelabelConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{
+			name:  "empty",
+			valid: true,
+		},
+		{
+			name: "tenants and default",
+			content: `
+- tenants: [a, b]
+  relabel_configs:
+  - source_labels: [__name__]
+    regex: noisy_.*
+    action: drop
+- relabel_configs:
+  - regex: pod
+    action: labeldrop
+`,
+			valid: true,
+		},
+		{
+			name: "two defaults",
+			content: `
+- relabel_configs: []
+- relabel_configs: []
+`,
+		},
+		{
+			name: "tenant twice",
+			content: `
+- tenants: [a]
+- tenants: [a]
+`,
+		},
+		{
+			name: "unknown field",
+			content: `
+- tenant: [a]
+`,
+		},
+		{
+			name: "invalid action",
+			content: `
+- relabel_configs:
+  - action: unknown
+`,
+		},
+	} {
+		_, err := ParseRelabelConfig([]byte(tc.content))
+		if tc.valid && err != nil {
+			t.Errorf("case %q: unexpected error: %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("case %q: expected error", tc.name)
+		}
+	}
+}
+
+func TestRelabel(t *testing.T) {
+	cfg, err := ParseRelabelConfig([]byte(`
+- tenants: [a]
+  relabel_configs:
+  - source_labels: [__name__]
+    regex: noisy_.*
+    action: drop
+  - regex: pod
+    action: labeldrop
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	series := func(lset ...string) prompb.TimeSeries {
+		ts := prompb.TimeSeries{Samples: []prompb.Sample{{Value: 1, Timestamp: 1}}}
+		for i := 0; i < len(lset); i += 2 {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: lset[i], Value: lset[i+1]})
+		}
+		return ts
+	}
+	newWriteRequest := func() *prompb.WriteRequest {
+		return &prompb.WriteRequest{
+			Timeseries: []prompb.TimeSeries{
+				series("__name__", "noisy_metric", "job", "foo"),
+				series("__name__", "up", "job", "foo", "pod", "foo-1", "tenant", "b"),
+			},
+		}
+	}
+
+	for _, tc := range []struct {
+		name        string
+		tenant      string
+		tenantLabel string
+		exp         []prompb.TimeSeries
+		dropped     int
+	}{
+		{
+			name:   "relabeled tenant",
+			tenant: "a",
+			exp: []prompb.TimeSeries{
+				series("__name__", "up", "job", "foo", "tenant", "b"),
+			},
+			dropped: 1,
+		},
+		{
+			name:   "tenant without relabel config",
+			tenant: "b",
+			exp:    newWriteRequest().Timeseries,
+		},
+		{
+			name:        "enforced tenant label",
+			tenant:      "a",
+			tenantLabel: "tenant",
+			exp: []prompb.TimeSeries{
+				series("__name__", "up", "job", "foo", "tenant", "a"),
+			},
+			dropped: 1,
+		},
+	} {
+		wreq := newWriteRequest()
+		dropped := newRelabeler(cfg, tc.tenantLabel).relabel(tc.tenant, wreq)
+		if dropped != tc.dropped {
+			t.Errorf("case %q: expected %d dropped series, got %d", tc.name, tc.dropped, dropped)
+		}
+		if !reflect.DeepEqual(wreq.Timeseries, tc.exp) {
+			t.Errorf("case %q: expected %v, got %v", tc.name, tc.exp, wreq.Timeseries)
+		}
+	}
+}
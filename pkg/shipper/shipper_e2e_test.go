@@ -3,6 +3,8 @@ package shipper
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
 	"math/rand"
@@ -118,6 +120,12 @@ func TestShipper_SyncBlocks_e2e(t *testing.T) {
 
 			// The external labels must be attached to the meta file on upload.
 			meta.Thanos.Labels = extLset.Map()
+			// The sizes and hashes of the index and chunk files are recorded on upload.
+			meta.Thanos.Files = []metadata.File{
+				{RelPath: "chunks/0001", SizeBytes: 14, Hash: sha256Hash("chunkcontents1")},
+				{RelPath: "chunks/0002", SizeBytes: 14, Hash: sha256Hash("chunkcontents2")},
+				{RelPath: "index", SizeBytes: 13, Hash: sha256Hash("indexcontents")},
+			}
 
 			var buf bytes.Buffer
 			enc := json.NewEncoder(&buf)
@@ -270,6 +278,12 @@ func TestShipper_SyncBlocksWithMigrating_e2e(t *testing.T) {
 
 			// The external labels must be attached to the meta file on upload.
 			meta.Thanos.Labels = extLset.Map()
+			// The sizes and hashes of the index and chunk files are recorded on upload.
+			meta.Thanos.Files = []metadata.File{
+				{RelPath: "chunks/0001", SizeBytes: 14, Hash: sha256Hash("chunkcontents1")},
+				{RelPath: "chunks/0002", SizeBytes: 14, Hash: sha256Hash("chunkcontents2")},
+				{RelPath: "index", SizeBytes: 13, Hash: sha256Hash("indexcontents")},
+			}
 
 			var buf bytes.Buffer
 			enc := json.NewEncoder(&buf)
@@ -319,3 +333,8 @@ func TestShipper_SyncBlocksWithMigrating_e2e(t *testing.T) {
 		testutil.Assert(t, ok == false, "fifth block was reuploaded")
 	})
 }
+
+func sha256Hash(content string) *metadata.ObjectHash {
+	h := sha256.Sum256([]byte(content))
+	return &metadata.ObjectHash{Func: metadata.SHA256Func, Value: hex.EncodeToString(h[:])}
+}
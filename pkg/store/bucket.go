@@ -28,6 +28,7 @@ import (
 	"github.com/prometheus/tsdb/index"
 	"github.com/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/indexheader"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
 	"github.com/thanos-io/thanos/pkg/component"
@@ -37,6 +38,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/runutil"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/strutil"
+	"github.com/thanos-io/thanos/pkg/tenancy"
 	"github.com/thanos-io/thanos/pkg/tracing"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc/codes"
@@ -57,6 +59,9 @@ type bucketStoreMetrics struct {
 	blockLoadFailures     prometheus.Counter
 	blockDrops            prometheus.Counter
 	blockDropFailures     prometheus.Counter
+	blocksFiltered        prometheus.Gauge
+	blocksTooFresh        prometheus.Gauge
+	blocksDuplicated      prometheus.Gauge
 	seriesDataTouched     *prometheus.SummaryVec
 	seriesDataFetched     *prometheus.SummaryVec
 	seriesDataSizeTouched *prometheus.SummaryVec
@@ -66,8 +71,14 @@ type bucketStoreMetrics struct {
 	seriesMergeDuration   prometheus.Histogram
 	resultSeriesCount     prometheus.Summary
 	chunkSizeBytes        prometheus.Histogram
-	queriesDropped        prometheus.Counter
+	queriesDropped        *prometheus.CounterVec
 	queriesLimit          prometheus.Gauge
+
+	cachedPostingsCompressions           *prometheus.CounterVec
+	cachedPostingsCompressionErrors      *prometheus.CounterVec
+	cachedPostingsCompressionTimeSeconds *prometheus.CounterVec
+	cachedPostingsOriginalSizeBytes      prometheus.Counter
+	cachedPostingsCompressedSizeBytes    prometheus.Counter
 }
 
 func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
@@ -93,6 +104,18 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		Name: "thanos_bucket_store_blocks_loaded",
 		Help: "Number of currently loaded blocks.",
 	})
+	m.blocksFiltered = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_blocks_filtered",
+		Help: "Number of blocks in the bucket that are not loaded because of the block filter.",
+	})
+	m.blocksTooFresh = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_blocks_too_fresh",
+		Help: "Number of blocks in the bucket that are not loaded yet because they were created within the consistency delay.",
+	})
+	m.blocksDuplicated = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "thanos_bucket_store_blocks_duplicated",
+		Help: "Number of blocks in the bucket that are not loaded because their sources are covered by another loaded block.",
+	})
 
 	m.seriesDataTouched = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Name: "thanos_bucket_store_series_data_touched",
@@ -143,15 +166,36 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 		},
 	})
 
-	m.queriesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	m.queriesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "thanos_bucket_store_queries_dropped_total",
-		Help: "Number of queries that were dropped due to the sample limit.",
-	})
+		Help: "Number of queries that were dropped due to a limit.",
+	}, []string{"reason"})
 	m.queriesLimit = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "thanos_bucket_store_queries_concurrent_max",
 		Help: "Number of maximum concurrent queries.",
 	})
 
+	m.cachedPostingsCompressions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_cached_postings_compressions_total",
+		Help: "Number of postings compressions and decompressions before storing to and after reading from the index cache.",
+	}, []string{"op"})
+	m.cachedPostingsCompressionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_cached_postings_compression_errors_total",
+		Help: "Number of postings compression and decompression errors.",
+	}, []string{"op"})
+	m.cachedPostingsCompressionTimeSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_cached_postings_compression_time_seconds",
+		Help: "Time spent compressing and decompressing postings of the index cache.",
+	}, []string{"op"})
+	m.cachedPostingsOriginalSizeBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_cached_postings_original_size_bytes_total",
+		Help: "Original size of postings stored into the index cache.",
+	})
+	m.cachedPostingsCompressedSizeBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "thanos_bucket_store_cached_postings_compressed_size_bytes_total",
+		Help: "Compressed size of postings stored into the index cache.",
+	})
+
 	if reg != nil {
 		reg.MustRegister(
 			m.blockLoads,
@@ -159,6 +203,9 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 			m.blockDrops,
 			m.blockDropFailures,
 			m.blocksLoaded,
+			m.blocksFiltered,
+			m.blocksTooFresh,
+			m.blocksDuplicated,
 			m.seriesDataTouched,
 			m.seriesDataFetched,
 			m.seriesDataSizeTouched,
@@ -170,6 +217,11 @@ func newBucketStoreMetrics(reg prometheus.Registerer) *bucketStoreMetrics {
 			m.chunkSizeBytes,
 			m.queriesDropped,
 			m.queriesLimit,
+			m.cachedPostingsCompressions,
+			m.cachedPostingsCompressionErrors,
+			m.cachedPostingsCompressionTimeSeconds,
+			m.cachedPostingsOriginalSizeBytes,
+			m.cachedPostingsCompressedSizeBytes,
 		)
 	}
 	return &m
@@ -182,32 +234,122 @@ type indexCache interface {
 	Series(b ulid.ULID, id uint64) ([]byte, bool)
 }
 
+// chunksCache caches the bytes of chunk segment files in subranges aligned to chunkSubrangeSize.
+type chunksCache interface {
+	SetChunksRange(b ulid.ULID, seq int, start uint64, v []byte)
+	ChunksRange(b ulid.ULID, seq int, start uint64) ([]byte, bool)
+}
+
+// noopChunksCache is used if no chunk cache is configured.
+type noopChunksCache struct{}
+
+func (noopChunksCache) SetChunksRange(ulid.ULID, int, uint64, []byte)     {}
+func (noopChunksCache) ChunksRange(ulid.ULID, int, uint64) ([]byte, bool) { return nil, false }
+
 // BucketStore implements the store API backed by a bucket. It loads all index
 // files to local disk.
 type BucketStore struct {
-	logger     log.Logger
-	metrics    *bucketStoreMetrics
-	bucket     objstore.BucketReader
-	dir        string
-	indexCache indexCache
-	chunkPool  *pool.BytesPool
+	logger      log.Logger
+	metrics     *bucketStoreMetrics
+	bucket      objstore.BucketReader
+	dir         string
+	indexCache  indexCache
+	chunksCache chunksCache
+	chunkPool   *pool.BytesPool
 
 	// Sets of blocks that have the same labels. They are indexed by a hash over their label set.
 	mtx       sync.RWMutex
 	blocks    map[ulid.ULID]*bucketBlock
 	blockSets map[uint64]*bucketBlockSet
+	// IDs of blocks that are not loaded because of the block filter, so that their meta is not downloaded again.
+	filteredBlocks map[ulid.ULID]struct{}
+	// Metas of blocks that are not loaded yet because they are too fresh or covered by another block, so that their
+	// meta is not downloaded again while they are skipped. Only accessed by SyncBlocks.
+	skippedBlocks map[ulid.ULID]*metadata.Meta
+
+	// filter selects the blocks served by the store. All blocks are served if nil.
+	filter BlockFilter
+	// consistencyDelay is the minimum age of blocks not uploaded by sidecars or receivers before they are loaded.
+	consistencyDelay time.Duration
 
 	// Verbose enabled additional logging.
 	debugLogging bool
 	// Number of goroutines to use when syncing blocks from object storage.
 	blockSyncConcurrency int
+	// verifyIndex enables verification of block indexes against their size and hash from meta.json on load.
+	verifyIndex bool
+	// indexHeaderPool creates the index-header readers of blocks, lazy loaded ones if enabled.
+	indexHeaderPool *indexheader.ReaderPool
 
 	// Query gate which limits the maximum amount of concurrent queries.
 	queryGate *Gate
 
 	// samplesLimiter limits the number of samples per each Series() call.
 	samplesLimiter *Limiter
-	partitioner    partitioner
+	// seriesLimiter limits the number of series touched per each Series() call.
+	seriesLimiter *Limiter
+	// chunkBytesLimiter limits the number of chunk bytes fetched per each Series() call.
+	chunkBytesLimiter *Limiter
+	// seriesBatchSize is the number of series of a block loaded at once while streaming a Series() call.
+	seriesBatchSize int
+	partitioner     partitioner
+}
+
+// BlockFilter returns true if the block with the given meta should be served by the store.
+type BlockFilter func(meta *metadata.Meta) bool
+
+// NewResolutionLevelFilter returns a BlockFilter selecting blocks of one of the given downsampling resolutions in
+// milliseconds, or of any resolution if none are given, and of at least the given compaction level.
+func NewResolutionLevelFilter(resolutions []int64, minCompactionLevel int) BlockFilter {
+	return func(meta *metadata.Meta) bool {
+		if meta.Compaction.Level < minCompactionLevel {
+			return false
+		}
+		if len(resolutions) == 0 {
+			return true
+		}
+		for _, r := range resolutions {
+			if meta.Thanos.Downsample.Resolution == r {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// BucketStoreOptions configures a BucketStore.
+type BucketStoreOptions struct {
+	// Dir is the local directory in which the index headers and metas of blocks are stored.
+	Dir        string
+	IndexCache indexCache
+	// ChunksCache caches chunk segment ranges. No chunks are cached if nil.
+	ChunksCache chunksCache
+	// MaxChunkPoolBytes is the maximum size in bytes of the pool of chunk bytes. 0 means no limit.
+	MaxChunkPoolBytes uint64
+	// MaxSampleCount, MaxSeriesCount and MaxChunkBytes limit the samples, series and chunk bytes touched
+	// by a single Series() call. 0 means no limit.
+	MaxSampleCount uint64
+	MaxSeriesCount uint64
+	MaxChunkBytes  uint64
+	// MaxConcurrent is the maximum number of concurrent Series() calls and must be positive. At most
+	// MaxConcurrentPerTenant of them may be of the same tenant, 0 means no limit other than MaxConcurrent.
+	MaxConcurrent          int
+	MaxConcurrentPerTenant int
+	// SeriesBatchSize is the number of series of a block loaded at once while streaming a Series() call.
+	SeriesBatchSize int
+	DebugLogging    bool
+	// BlockSyncConcurrency is the number of goroutines to use when syncing blocks from object storage.
+	BlockSyncConcurrency int
+	// VerifyIndex enables verification of block indexes against their size and hash from meta.json on load.
+	VerifyIndex bool
+	// LazyIndexHeader enables loading index headers on first use only and unloading them after
+	// IndexHeaderIdleTimeout without use.
+	LazyIndexHeader        bool
+	IndexHeaderIdleTimeout time.Duration
+	// Filter selects the blocks served by the store. All blocks are served if nil.
+	Filter BlockFilter
+	// ConsistencyDelay is the minimum age of blocks not uploaded by sidecars or receivers before they are loaded.
+	ConsistencyDelay time.Duration
 }
 
 // NewBucketStore creates a new bucket backed store that implements the store API against
@@ -216,54 +358,70 @@ func NewBucketStore(
 	logger log.Logger,
 	reg prometheus.Registerer,
 	bucket objstore.BucketReader,
-	dir string,
-	indexCache indexCache,
-	maxChunkPoolBytes uint64,
-	maxSampleCount uint64,
-	maxConcurrent int,
-	debugLogging bool,
-	blockSyncConcurrency int,
+	o *BucketStoreOptions,
 ) (*BucketStore, error) {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
 
-	if maxConcurrent < 0 {
-		return nil, errors.Errorf("max concurrency value cannot be lower than 0 (got %v)", maxConcurrent)
+	if o.MaxConcurrent <= 0 {
+		return nil, errors.Errorf("max concurrency value must be positive (got %v)", o.MaxConcurrent)
+	}
+	if o.MaxConcurrentPerTenant < 0 {
+		return nil, errors.Errorf("max concurrency per tenant value cannot be lower than 0 (got %v)", o.MaxConcurrentPerTenant)
+	}
+	if o.SeriesBatchSize <= 0 {
+		return nil, errors.Errorf("series batch size must be positive (got %v)", o.SeriesBatchSize)
 	}
 
-	chunkPool, err := pool.NewBytesPool(2e5, 50e6, 2, maxChunkPoolBytes)
+	chunkPool, err := pool.NewBytesPool(2e5, 50e6, 2, o.MaxChunkPoolBytes)
 	if err != nil {
 		return nil, errors.Wrap(err, "create chunk pool")
 	}
 
 	const maxGapSize = 512 * 1024
 
+	chunksCache := o.ChunksCache
+	if chunksCache == nil {
+		chunksCache = noopChunksCache{}
+	}
+
 	metrics := newBucketStoreMetrics(reg)
 	s := &BucketStore{
 		logger:               logger,
 		bucket:               bucket,
-		dir:                  dir,
-		indexCache:           indexCache,
+		dir:                  o.Dir,
+		indexCache:           o.IndexCache,
+		chunksCache:          chunksCache,
 		chunkPool:            chunkPool,
 		blocks:               map[ulid.ULID]*bucketBlock{},
 		blockSets:            map[uint64]*bucketBlockSet{},
-		debugLogging:         debugLogging,
-		blockSyncConcurrency: blockSyncConcurrency,
+		filteredBlocks:       map[ulid.ULID]struct{}{},
+		skippedBlocks:        map[ulid.ULID]*metadata.Meta{},
+		filter:               o.Filter,
+		consistencyDelay:     o.ConsistencyDelay,
+		debugLogging:         o.DebugLogging,
+		blockSyncConcurrency: o.BlockSyncConcurrency,
+		verifyIndex:          o.VerifyIndex,
+		indexHeaderPool:      indexheader.NewReaderPool(logger, reg, o.LazyIndexHeader, o.IndexHeaderIdleTimeout),
 		queryGate: NewGate(
-			maxConcurrent,
+			o.MaxConcurrent,
+			o.MaxConcurrentPerTenant,
 			extprom.WrapRegistererWithPrefix("thanos_bucket_store_series_", reg),
 		),
-		samplesLimiter: NewLimiter(maxSampleCount, metrics.queriesDropped),
-		partitioner:    gapBasedPartitioner{maxGapSize: maxGapSize},
+		samplesLimiter:    NewLimiter(o.MaxSampleCount, metrics.queriesDropped.WithLabelValues("samples")),
+		seriesLimiter:     NewLimiter(o.MaxSeriesCount, metrics.queriesDropped.WithLabelValues("series")),
+		chunkBytesLimiter: NewLimiter(o.MaxChunkBytes, metrics.queriesDropped.WithLabelValues("chunk_bytes")),
+		seriesBatchSize:   o.SeriesBatchSize,
+		partitioner:       gapBasedPartitioner{maxGapSize: maxGapSize},
 	}
 	s.metrics = metrics
 
-	if err := os.MkdirAll(dir, 0777); err != nil {
+	if err := os.MkdirAll(o.Dir, 0777); err != nil {
 		return nil, errors.Wrap(err, "create dir")
 	}
 
-	s.metrics.queriesLimit.Set(float64(maxConcurrent))
+	s.metrics.queriesLimit.Set(float64(o.MaxConcurrent))
 
 	return s, nil
 }
@@ -273,6 +431,8 @@ func (s *BucketStore) Close() (err error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
+	s.indexHeaderPool.Close()
+
 	for _, b := range s.blocks {
 		if e := b.Close(); e != nil {
 			level.Warn(s.logger).Log("msg", "closing Bucket block failed", "err", err)
@@ -285,24 +445,105 @@ func (s *BucketStore) Close() (err error) {
 // SyncBlocks synchronizes the stores state with the Bucket bucket.
 // It will reuse disk space as persistent cache based on s.dir param.
 func (s *BucketStore) SyncBlocks(ctx context.Context) error {
-	var wg sync.WaitGroup
-	blockc := make(chan ulid.ULID)
+	allIDs, pending, err := s.fetchNewMetas(ctx)
+	if err != nil {
+		return errors.Wrap(err, "iter")
+	}
+
+	// Blocks covered by another block are not loaded, so that the samples of a compacted block are not returned
+	// twice while the compactor has not deleted its source blocks yet. A covering block that fails to load or is no
+	// longer present in the bucket no longer covers anything, so we load in rounds until only blocks covered by loaded
+	// blocks are left.
+	for {
+		duplicates := duplicateBlocks(append(presentMetas(s.loadedMetas(), allIDs), metasOf(pending)...))
+
+		var toLoad []*metadata.Meta
+		for id, meta := range pending {
+			if _, ok := duplicates[id]; ok {
+				continue
+			}
+			toLoad = append(toLoad, meta)
+			delete(pending, id)
+			delete(s.skippedBlocks, id)
+		}
+		if len(toLoad) == 0 {
+			break
+		}
+		s.addBlocks(ctx, toLoad)
+	}
+	for id, meta := range pending {
+		level.Debug(s.logger).Log("msg", "skipping block covered by another block", "block", id)
+		s.skippedBlocks[id] = meta
+		if err := os.RemoveAll(filepath.Join(s.dir, id.String())); err != nil {
+			level.Warn(s.logger).Log("msg", "failed to remove meta of skipped block", "block", id, "err", err)
+		}
+	}
+
+	duplicates := duplicateBlocks(presentMetas(s.loadedMetas(), allIDs))
+	s.metrics.blocksDuplicated.Set(float64(len(pending) + len(duplicates)))
+
+	// Drop all blocks that are no longer present in the bucket or are covered by another loaded block.
+	for id := range s.blocks {
+		_, ok := allIDs[id]
+		if _, dup := duplicates[id]; ok && !dup {
+			continue
+		}
+		if err := s.removeBlock(id); err != nil {
+			level.Warn(s.logger).Log("msg", "drop outdated block", "block", id, "err", err)
+			s.metrics.blockDropFailures.Inc()
+		}
+		s.metrics.blockDrops.Inc()
+	}
+	// Forget skipped and filtered blocks that are no longer present in the bucket.
+	for id := range s.skippedBlocks {
+		if _, ok := allIDs[id]; !ok {
+			delete(s.skippedBlocks, id)
+		}
+	}
+	s.mtx.Lock()
+	for id := range s.filteredBlocks {
+		if _, ok := allIDs[id]; !ok {
+			delete(s.filteredBlocks, id)
+		}
+	}
+	s.metrics.blocksFiltered.Set(float64(len(s.filteredBlocks)))
+	s.mtx.Unlock()
+
+	return nil
+}
 
+// fetchNewMetas returns the IDs of all blocks in the bucket and the metas of the blocks that are not loaded yet and
+// should be served by the store. Metas of skipped blocks are not downloaded again. Blocks that are too fresh are
+// added to the skipped blocks.
+func (s *BucketStore) fetchNewMetas(ctx context.Context) (map[ulid.ULID]struct{}, map[ulid.ULID]*metadata.Meta, error) {
+	var (
+		wg     sync.WaitGroup
+		mtx    sync.Mutex
+		idc    = make(chan ulid.ULID)
+		metas  = map[ulid.ULID]*metadata.Meta{}
+		allIDs = map[ulid.ULID]struct{}{}
+	)
 	for i := 0; i < s.blockSyncConcurrency; i++ {
 		wg.Add(1)
 		go func() {
-			for id := range blockc {
-				if err := s.addBlock(ctx, id); err != nil {
-					level.Warn(s.logger).Log("msg", "loading block failed", "id", id, "err", err)
+			for id := range idc {
+				meta, err := s.fetchMeta(ctx, id)
+				if err != nil {
+					level.Warn(s.logger).Log("msg", "loading block meta failed", "id", id, "err", err)
+					continue
+				}
+				if meta == nil {
 					continue
 				}
+
+				mtx.Lock()
+				metas[id] = meta
+				mtx.Unlock()
 			}
 			wg.Done()
 		}()
 	}
 
-	allIDs := map[ulid.ULID]struct{}{}
-
 	err := s.bucket.Iter(ctx, "", func(name string) error {
 		// Strip trailing slash indicating a directory.
 		id, err := ulid.Parse(name[:len(name)-1])
@@ -311,35 +552,192 @@ func (s *BucketStore) SyncBlocks(ctx context.Context) error {
 		}
 		allIDs[id] = struct{}{}
 
-		if b := s.getBlock(id); b != nil {
+		if b := s.getBlock(id); b != nil || s.isFiltered(id) {
+			return nil
+		}
+		if _, ok := s.skippedBlocks[id]; ok {
 			return nil
 		}
 		select {
 		case <-ctx.Done():
-		case blockc <- id:
+		case idc <- id:
 		}
 		return nil
 	})
 
-	close(blockc)
+	close(idc)
 	wg.Wait()
 
+	for id, meta := range s.skippedBlocks {
+		if _, ok := allIDs[id]; ok {
+			metas[id] = meta
+		}
+	}
+	var fresh int
+	for id, meta := range metas {
+		if !s.tooFresh(meta) {
+			continue
+		}
+		level.Debug(s.logger).Log("msg", "block is too fresh for now", "block", id)
+		s.skippedBlocks[id] = meta
+		if err := os.RemoveAll(filepath.Join(s.dir, id.String())); err != nil {
+			level.Warn(s.logger).Log("msg", "failed to remove meta of skipped block", "block", id, "err", err)
+		}
+		delete(metas, id)
+		fresh++
+	}
+	s.metrics.blocksTooFresh.Set(float64(fresh))
+
+	return allIDs, metas, err
+}
+
+// fetchMeta returns the meta of the block, or nil if the block is excluded by the block filter.
+func (s *BucketStore) fetchMeta(ctx context.Context, id ulid.ULID) (meta *metadata.Meta, err error) {
+	dir := filepath.Join(s.dir, id.String())
+	logger := log.With(s.logger, "block", id)
+
+	meta, err = loadMeta(ctx, logger, s.bucket, dir, id)
 	if err != nil {
-		return errors.Wrap(err, "iter")
+		s.metrics.blockLoads.Inc()
+		s.metrics.blockLoadFailures.Inc()
+		if err2 := os.RemoveAll(dir); err2 != nil {
+			level.Warn(s.logger).Log("msg", "failed to remove block we cannot load", "err", err2)
+		}
+		return nil, errors.Wrap(err, "load meta")
 	}
-	// Drop all blocks that are no longer present in the bucket.
-	for id := range s.blocks {
-		if _, ok := allIDs[id]; ok {
+	if s.filter != nil && !s.filter(meta) {
+		level.Debug(logger).Log("msg", "skipping block excluded by the block filter")
+
+		s.mtx.Lock()
+		s.filteredBlocks[id] = struct{}{}
+		s.mtx.Unlock()
+		return nil, os.RemoveAll(dir)
+	}
+	return meta, nil
+}
+
+// tooFresh returns true if the block was created within the consistency delay. Blocks of sidecars and receivers are
+// uploaded only once, so they are served right away. Other blocks, e.g. compacted ones, overlap with blocks that are
+// served already and are only served after the delay, so that all store gateways switch over to them at about the same time.
+func (s *BucketStore) tooFresh(meta *metadata.Meta) bool {
+	if meta.Thanos.Source == metadata.SidecarSource || meta.Thanos.Source == metadata.ReceiveSource {
+		return false
+	}
+	return ulid.Now()-meta.ULID.Time() < uint64(s.consistencyDelay/time.Millisecond)
+}
+
+// addBlocks loads the blocks of the given metas concurrently.
+func (s *BucketStore) addBlocks(ctx context.Context, metas []*metadata.Meta) {
+	var wg sync.WaitGroup
+	metac := make(chan *metadata.Meta)
+
+	for i := 0; i < s.blockSyncConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			for meta := range metac {
+				if err := s.addBlock(ctx, meta); err != nil {
+					level.Warn(s.logger).Log("msg", "loading block failed", "id", meta.ULID, "err", err)
+					continue
+				}
+			}
+			wg.Done()
+		}()
+	}
+	for _, meta := range metas {
+		select {
+		case <-ctx.Done():
+		case metac <- meta:
+		}
+	}
+	close(metac)
+	wg.Wait()
+}
+
+func (s *BucketStore) loadedMetas() []*metadata.Meta {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	metas := make([]*metadata.Meta, 0, len(s.blocks))
+	for _, b := range s.blocks {
+		metas = append(metas, b.meta)
+	}
+	return metas
+}
+
+func metasOf(m map[ulid.ULID]*metadata.Meta) []*metadata.Meta {
+	metas := make([]*metadata.Meta, 0, len(m))
+	for _, meta := range m {
+		metas = append(metas, meta)
+	}
+	return metas
+}
+
+// presentMetas returns the metas of blocks with one of the given IDs.
+func presentMetas(metas []*metadata.Meta, ids map[ulid.ULID]struct{}) []*metadata.Meta {
+	var present []*metadata.Meta
+	for _, meta := range metas {
+		if _, ok := ids[meta.ULID]; ok {
+			present = append(present, meta)
+		}
+	}
+	return present
+}
+
+// duplicateBlocks returns the IDs of the blocks whose compaction sources are all covered by another block with the same
+// external labels and resolution. Of blocks with the same sources, the one with the highest compaction level is kept,
+// or the newest one on ties.
+func duplicateBlocks(metas []*metadata.Meta) map[ulid.ULID]struct{} {
+	type groupKey struct {
+		labels     uint64
+		resolution int64
+	}
+	// Blocks by group and by each of their sources.
+	bySource := map[groupKey]map[ulid.ULID][]*metadata.Meta{}
+	for _, m := range metas {
+		k := groupKey{labels: labels.FromMap(m.Thanos.Labels).Hash(), resolution: m.Thanos.Downsample.Resolution}
+		if bySource[k] == nil {
+			bySource[k] = map[ulid.ULID][]*metadata.Meta{}
+		}
+		for _, src := range m.Compaction.Sources {
+			bySource[k][src] = append(bySource[k][src], m)
+		}
+	}
+
+	duplicates := map[ulid.ULID]struct{}{}
+	for _, m := range metas {
+		if len(m.Compaction.Sources) == 0 {
 			continue
 		}
-		if err := s.removeBlock(id); err != nil {
-			level.Warn(s.logger).Log("msg", "drop outdated block", "block", id, "err", err)
-			s.metrics.blockDropFailures.Inc()
+		k := groupKey{labels: labels.FromMap(m.Thanos.Labels).Hash(), resolution: m.Thanos.Downsample.Resolution}
+		// Only blocks having the first source of the block can cover it.
+		for _, other := range bySource[k][m.Compaction.Sources[0]] {
+			if other.ULID != m.ULID && covers(other, m) {
+				duplicates[m.ULID] = struct{}{}
+				break
+			}
 		}
-		s.metrics.blockDrops.Inc()
 	}
+	return duplicates
+}
 
-	return nil
+// covers returns true if block a covers all sources of block b and is preferred over it.
+func covers(a, b *metadata.Meta) bool {
+	srcs := make(map[ulid.ULID]struct{}, len(a.Compaction.Sources))
+	for _, src := range a.Compaction.Sources {
+		srcs[src] = struct{}{}
+	}
+	for _, src := range b.Compaction.Sources {
+		if _, ok := srcs[src]; !ok {
+			return false
+		}
+	}
+	if len(srcs) != len(b.Compaction.Sources) {
+		return true
+	}
+	if a.Compaction.Level != b.Compaction.Level {
+		return a.Compaction.Level > b.Compaction.Level
+	}
+	return a.ULID.Compare(b.ULID) > 0
 }
 
 // InitialSync perform blocking sync with extra step at the end to delete locally saved blocks that are no longer
@@ -383,8 +781,15 @@ func (s *BucketStore) getBlock(id ulid.ULID) *bucketBlock {
 	return s.blocks[id]
 }
 
-func (s *BucketStore) addBlock(ctx context.Context, id ulid.ULID) (err error) {
-	dir := filepath.Join(s.dir, id.String())
+func (s *BucketStore) isFiltered(id ulid.ULID) bool {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	_, ok := s.filteredBlocks[id]
+	return ok
+}
+
+func (s *BucketStore) addBlock(ctx context.Context, meta *metadata.Meta) (err error) {
+	dir := filepath.Join(s.dir, meta.ULID.String())
 
 	defer func() {
 		if err != nil {
@@ -396,15 +801,22 @@ func (s *BucketStore) addBlock(ctx context.Context, id ulid.ULID) (err error) {
 	}()
 	s.metrics.blockLoads.Inc()
 
+	// The meta of skipped blocks is kept in memory only, so their dir may not exist.
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return errors.Wrap(err, "create dir")
+	}
 	b, err := newBucketBlock(
 		ctx,
-		log.With(s.logger, "block", id),
+		log.With(s.logger, "block", meta.ULID),
 		s.bucket,
-		id,
+		meta,
 		dir,
 		s.indexCache,
+		s.chunksCache,
 		s.chunkPool,
 		s.partitioner,
+		s.verifyIndex,
+		s.indexHeaderPool,
 	)
 	if err != nil {
 		return errors.Wrap(err, "new bucket block")
@@ -476,85 +888,155 @@ func (s *BucketStore) Info(context.Context, *storepb.InfoRequest) (*storepb.Info
 	mint, maxt := s.TimeRange()
 	// Store nodes hold global data and thus have no labels.
 	return &storepb.InfoResponse{
-		StoreType: component.Store.ToProto(),
-		MinTime:   mint,
-		MaxTime:   maxt,
+		StoreType:   component.Store.ToProto(),
+		MinTime:     mint,
+		MaxTime:     maxt,
+		Resolutions: s.resolutions(),
 	}, nil
 }
 
+// resolutions returns the sorted distinct downsampling resolutions of the loaded blocks.
+func (s *BucketStore) resolutions() []int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	seen := map[int64]struct{}{}
+	var res []int64
+	for _, b := range s.blocks {
+		r := b.meta.Thanos.Downsample.Resolution
+		if _, ok := seen[r]; ok {
+			continue
+		}
+		seen[r] = struct{}{}
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
 type seriesEntry struct {
 	lset []storepb.Label
 	refs []uint64
 	chks []storepb.AggrChunk
 }
 
-type bucketSeriesSet struct {
-	set []seriesEntry
-	i   int
-	err error
+// blockSeriesSet is a storepb.SeriesSet of the series of a single block matching a Series request. Series and their
+// chunks are loaded in batches of the matching postings while iterating, so that only about one batch of series of
+// each block is held in memory at once.
+type blockSeriesSet struct {
+	extLset   map[string]string
+	indexr    *bucketIndexReader
+	chunkr    *bucketChunkReader
+	req       *storepb.SeriesRequest
+	batchSize int
+
+	samplesLimiter *Limiter
+	// chunkBytesLimit accumulates the chunk bytes fetched for all blocks of the Series call.
+	chunkBytesLimit *limitCounter
+
+	// postings are the matching series which are not loaded yet.
+	postings []uint64
+	batch    []seriesEntry
+	i        int
+	err      error
 }
 
-func newBucketSeriesSet(set []seriesEntry) *bucketSeriesSet {
-	return &bucketSeriesSet{
-		set: set,
-		i:   -1,
+// newBlockSeriesSet expands the postings of the matchers in the block and loads the first batch of series, so that
+// it is loaded concurrently for all blocks before merging them.
+func newBlockSeriesSet(
+	extLset map[string]string,
+	indexr *bucketIndexReader,
+	chunkr *bucketChunkReader,
+	matchers []labels.Matcher,
+	req *storepb.SeriesRequest,
+	samplesLimiter *Limiter,
+	seriesLimit *limitCounter,
+	chunkBytesLimit *limitCounter,
+	batchSize int,
+) (*blockSeriesSet, error) {
+	ps, err := indexr.ExpandedPostings(matchers)
+	if err != nil {
+		return nil, errors.Wrap(err, "expanded matching posting")
+	}
+
+	// Check the series limit with the cardinality of the postings, before any series or chunks are fetched.
+	if err := seriesLimit.Add(uint64(len(ps))); err != nil {
+		return nil, errors.Wrap(err, "exceeded series limit")
+	}
+
+	s := &blockSeriesSet{
+		extLset:         extLset,
+		indexr:          indexr,
+		chunkr:          chunkr,
+		req:             req,
+		samplesLimiter:  samplesLimiter,
+		chunkBytesLimit: chunkBytesLimit,
+		batchSize:       batchSize,
+		postings:        ps,
+		i:               -1,
 	}
+	if err := s.loadBatch(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func (s *bucketSeriesSet) Next() bool {
-	if s.i >= len(s.set)-1 {
-		return false
+func (s *blockSeriesSet) Next() bool {
+	for {
+		if s.i < len(s.batch)-1 {
+			s.i++
+			return true
+		}
+		if s.err != nil || len(s.postings) == 0 {
+			return false
+		}
+		if err := s.loadBatch(); err != nil {
+			s.err = errors.Wrapf(err, "fetch series for block %s", s.indexr.block.meta.ULID)
+			return false
+		}
 	}
-	s.i++
-	return true
 }
 
-func (s *bucketSeriesSet) At() ([]storepb.Label, []storepb.AggrChunk) {
-	return s.set[s.i].lset, s.set[s.i].chks
+func (s *blockSeriesSet) At() ([]storepb.Label, []storepb.AggrChunk) {
+	return s.batch[s.i].lset, s.batch[s.i].chks
 }
 
-func (s *bucketSeriesSet) Err() error {
+func (s *blockSeriesSet) Err() error {
 	return s.err
 }
 
-func blockSeries(
-	ctx context.Context,
-	ulid ulid.ULID,
-	extLset map[string]string,
-	indexr *bucketIndexReader,
-	chunkr *bucketChunkReader,
-	matchers []labels.Matcher,
-	req *storepb.SeriesRequest,
-	samplesLimiter *Limiter,
-) (storepb.SeriesSet, *queryStats, error) {
-	ps, err := indexr.ExpandedPostings(matchers)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "expanded matching posting")
+// loadBatch loads the series and chunks of the next batch of postings, releasing the ones of the previous batch.
+func (s *blockSeriesSet) loadBatch() error {
+	ps := s.postings
+	if len(ps) > s.batchSize {
+		ps = ps[:s.batchSize]
 	}
+	s.postings = s.postings[len(ps):]
+
+	s.batch, s.i = s.batch[:0], -1
+	s.indexr.reset()
+	s.chunkr.reset()
 
 	if len(ps) == 0 {
-		return storepb.EmptySeriesSet(), indexr.stats, nil
+		return nil
 	}
 
-	// Preload all series index data.
-	// TODO(bwplotka): Consider not keeping all series in memory all the time.
-	// TODO(bwplotka): Do lazy loading in one step as `ExpandingPostings` method.
-	if err := indexr.PreloadSeries(ps); err != nil {
-		return nil, nil, errors.Wrap(err, "preload series")
+	// Preload all series index data of the batch.
+	if err := s.indexr.PreloadSeries(ps); err != nil {
+		return errors.Wrap(err, "preload series")
 	}
 
 	// Transform all series into the response types and mark their relevant chunks
 	// for preloading.
 	var (
-		res  []seriesEntry
 		lset labels.Labels
 		chks []chunks.Meta
 	)
 	for _, id := range ps {
-		if err := indexr.LoadedSeries(id, &lset, &chks); err != nil {
-			return nil, nil, errors.Wrap(err, "read series")
+		if err := s.indexr.LoadedSeries(id, &lset, &chks); err != nil {
+			return errors.Wrap(err, "read series")
 		}
-		s := seriesEntry{
+		e := seriesEntry{
 			lset: make([]storepb.Label, 0, len(lset)),
 			refs: make([]uint64, 0, len(chks)),
 			chks: make([]storepb.AggrChunk, 0, len(chks)),
@@ -562,70 +1044,84 @@ func blockSeries(
 		for _, l := range lset {
 			// Skip if the external labels of the block overrule the series' label.
 			// NOTE(fabxc): maybe move it to a prefixed version to still ensure uniqueness of series?
-			if extLset[l.Name] != "" {
+			if s.extLset[l.Name] != "" {
 				continue
 			}
-			s.lset = append(s.lset, storepb.Label{
+			e.lset = append(e.lset, storepb.Label{
 				Name:  l.Name,
 				Value: l.Value,
 			})
 		}
-		for ln, lv := range extLset {
-			s.lset = append(s.lset, storepb.Label{
+		for ln, lv := range s.extLset {
+			e.lset = append(e.lset, storepb.Label{
 				Name:  ln,
 				Value: lv,
 			})
 		}
-		sort.Slice(s.lset, func(i, j int) bool {
-			return s.lset[i].Name < s.lset[j].Name
+		sort.Slice(e.lset, func(i, j int) bool {
+			return e.lset[i].Name < e.lset[j].Name
 		})
 
 		for _, meta := range chks {
-			if meta.MaxTime < req.MinTime {
+			if meta.MaxTime < s.req.MinTime {
 				continue
 			}
-			if meta.MinTime > req.MaxTime {
+			if meta.MinTime > s.req.MaxTime {
 				break
 			}
 
-			if err := chunkr.addPreload(meta.Ref); err != nil {
-				return nil, nil, errors.Wrap(err, "add chunk preload")
+			if err := s.chunkr.addPreload(meta.Ref); err != nil {
+				return errors.Wrap(err, "add chunk preload")
 			}
-			s.chks = append(s.chks, storepb.AggrChunk{
+			e.chks = append(e.chks, storepb.AggrChunk{
 				MinTime: meta.MinTime,
 				MaxTime: meta.MaxTime,
 			})
-			s.refs = append(s.refs, meta.Ref)
+			e.refs = append(e.refs, meta.Ref)
 		}
-		if len(s.chks) > 0 {
-			res = append(res, s)
+		if len(e.chks) > 0 {
+			s.batch = append(s.batch, e)
 		}
 	}
 
 	// Preload all chunks that were marked in the previous stage.
-	if err := chunkr.preload(samplesLimiter); err != nil {
-		return nil, nil, errors.Wrap(err, "preload chunks")
+	if err := s.chunkr.preload(s.samplesLimiter, s.chunkBytesLimit); err != nil {
+		return errors.Wrap(err, "preload chunks")
+	}
+
+	// Transform all chunks into the response format. The chunk bytes are copied out of the pooled buffers of the
+	// chunk reader, which are reused for the next batches while the series of this one may still be merged and sent.
+	var slab []byte
+	save := func(b []byte) []byte {
+		if len(slab)+len(b) > cap(slab) {
+			size := chunkBytesSlabSize
+			if len(b) > size {
+				size = len(b)
+			}
+			slab = make([]byte, 0, size)
+		}
+		slab = append(slab, b...)
+		return slab[len(slab)-len(b) : len(slab) : len(slab)]
 	}
-
-	// Transform all chunks into the response format.
-	for _, s := range res {
-		for i, ref := range s.refs {
-			chk, err := chunkr.Chunk(ref)
+	for _, e := range s.batch {
+		for i, ref := range e.refs {
+			chk, err := s.chunkr.Chunk(ref)
 			if err != nil {
-				return nil, nil, errors.Wrap(err, "get chunk")
+				return errors.Wrap(err, "get chunk")
 			}
-			if err := populateChunk(&s.chks[i], chk, req.Aggregates); err != nil {
-				return nil, nil, errors.Wrap(err, "populate chunk")
+			if err := populateChunk(&e.chks[i], chk, s.req.Aggregates, save); err != nil {
+				return errors.Wrap(err, "populate chunk")
 			}
 		}
 	}
-
-	return newBucketSeriesSet(res), indexr.stats.merge(chunkr.stats), nil
+	return nil
 }
 
-func populateChunk(out *storepb.AggrChunk, in chunkenc.Chunk, aggrs []storepb.Aggr) error {
+// populateChunk sets the requested aggregates of the chunk in out. The chunk bytes are passed through save,
+// which must return a copy that stays valid after in is released.
+func populateChunk(out *storepb.AggrChunk, in chunkenc.Chunk, aggrs []storepb.Aggr, save func([]byte) []byte) error {
 	if in.Encoding() == chunkenc.EncXOR {
-		out.Raw = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: in.Bytes()}
+		out.Raw = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: save(in.Bytes())}
 		return nil
 	}
 	if in.Encoding() != downsample.ChunkEncAggr {
@@ -641,31 +1137,41 @@ func populateChunk(out *storepb.AggrChunk, in chunkenc.Chunk, aggrs []storepb.Ag
 			if err != nil {
 				return errors.Errorf("aggregate %s does not exist", downsample.AggrCount)
 			}
-			out.Count = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: x.Bytes()}
+			out.Count = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: save(x.Bytes())}
 		case storepb.Aggr_SUM:
 			x, err := ac.Get(downsample.AggrSum)
 			if err != nil {
 				return errors.Errorf("aggregate %s does not exist", downsample.AggrSum)
 			}
-			out.Sum = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: x.Bytes()}
+			out.Sum = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: save(x.Bytes())}
 		case storepb.Aggr_MIN:
 			x, err := ac.Get(downsample.AggrMin)
 			if err != nil {
 				return errors.Errorf("aggregate %s does not exist", downsample.AggrMin)
 			}
-			out.Min = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: x.Bytes()}
+			out.Min = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: save(x.Bytes())}
 		case storepb.Aggr_MAX:
 			x, err := ac.Get(downsample.AggrMax)
 			if err != nil {
 				return errors.Errorf("aggregate %s does not exist", downsample.AggrMax)
 			}
-			out.Max = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: x.Bytes()}
+			out.Max = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: save(x.Bytes())}
 		case storepb.Aggr_COUNTER:
 			x, err := ac.Get(downsample.AggrCounter)
 			if err != nil {
 				return errors.Errorf("aggregate %s does not exist", downsample.AggrCounter)
 			}
-			out.Counter = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: x.Bytes()}
+			out.Counter = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: save(x.Bytes())}
+		case storepb.Aggr_LAST:
+			// The last aggregate is optional, so blocks downsampled without it just omit it.
+			x, err := ac.Get(downsample.AggrLast)
+			if err == downsample.ErrAggrNotExist {
+				continue
+			}
+			if err != nil {
+				return errors.Errorf("aggregate %s does not exist", downsample.AggrLast)
+			}
+			out.Last = &storepb.Chunk{Type: storepb.Chunk_XOR, Data: save(x.Bytes())}
 		}
 	}
 	return nil
@@ -708,26 +1214,36 @@ func debugFoundBlockSetOverview(logger log.Logger, mint, maxt, maxResolutionMill
 
 // Series implements the storepb.StoreServer interface.
 func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_SeriesServer) (err error) {
+	tenant := tenancy.FromContext(srv.Context())
 	{
 		span, _ := tracing.StartSpan(srv.Context(), "store_query_gate_ismyturn")
-		err := s.queryGate.IsMyTurn(srv.Context())
+		err := s.queryGate.IsMyTurn(srv.Context(), tenant)
 		span.Finish()
 		if err != nil {
 			return errors.Wrapf(err, "failed to wait for turn")
 		}
 	}
-	defer s.queryGate.Done()
+	defer s.queryGate.Done(tenant)
 
 	matchers, err := translateMatchers(req.Matchers)
 	if err != nil {
 		return status.Error(codes.InvalidArgument, err.Error())
 	}
 	var (
-		stats = &queryStats{}
-		g     run.Group
-		res   []storepb.SeriesSet
-		mtx   sync.Mutex
+		stats        = &queryStats{}
+		g            errgroup.Group
+		res          []storepb.SeriesSet
+		mtx          sync.Mutex
+		indexReaders []*bucketIndexReader
+		chunkReaders []*bucketChunkReader
+
+		seriesLimit     = newLimitCounter(s.seriesLimiter)
+		chunkBytesLimit = newLimitCounter(s.chunkBytesLimiter)
 	)
+	// The readers of all blocks use the same context, so that a failure in one block aborts the others.
+	ctx, cancel := context.WithCancel(srv.Context())
+	defer cancel()
+
 	s.mtx.RLock()
 
 	for _, bs := range s.blockSets {
@@ -745,7 +1261,6 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 			stats.blocksQueried++
 
 			b := b
-			ctx, cancel := context.WithCancel(srv.Context())
 
 			// We must keep the readers open until all their data has been sent.
 			indexr := b.indexReader(ctx)
@@ -754,31 +1269,31 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 			// Defer all closes to the end of Series method.
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "series block")
 			defer runutil.CloseWithLogOnErr(s.logger, chunkr, "series block")
+			indexReaders = append(indexReaders, indexr)
+			chunkReaders = append(chunkReaders, chunkr)
 
-			g.Add(func() error {
-				part, pstats, err := blockSeries(ctx,
-					b.meta.ULID,
+			g.Go(func() error {
+				part, err := newBlockSeriesSet(
 					b.meta.Thanos.Labels,
 					indexr,
 					chunkr,
 					blockMatchers,
 					req,
 					s.samplesLimiter,
+					seriesLimit,
+					chunkBytesLimit,
+					s.seriesBatchSize,
 				)
 				if err != nil {
+					cancel()
 					return errors.Wrapf(err, "fetch series for block %s", b.meta.ULID)
 				}
 
 				mtx.Lock()
 				res = append(res, part)
-				stats = stats.merge(pstats)
 				mtx.Unlock()
 
 				return nil
-			}, func(err error) {
-				if err != nil {
-					cancel()
-				}
 			})
 		}
 	}
@@ -786,6 +1301,11 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 	s.mtx.RUnlock()
 
 	defer func() {
+		// Readers keep collecting stats while the series are streamed, so they are only merged at the end.
+		for i := range indexReaders {
+			stats = stats.merge(indexReaders[i].stats).merge(chunkReaders[i].stats)
+		}
+
 		s.metrics.seriesDataTouched.WithLabelValues("postings").Observe(float64(stats.postingsTouched))
 		s.metrics.seriesDataFetched.WithLabelValues("postings").Observe(float64(stats.postingsFetched))
 		s.metrics.seriesDataSizeTouched.WithLabelValues("postings").Observe(float64(stats.postingsTouchedSizeSum))
@@ -799,20 +1319,28 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		s.metrics.seriesDataSizeTouched.WithLabelValues("chunks").Observe(float64(stats.chunksTouchedSizeSum))
 		s.metrics.seriesDataSizeFetched.WithLabelValues("chunks").Observe(float64(stats.chunksFetchedSizeSum))
 		s.metrics.resultSeriesCount.Observe(float64(stats.mergedSeriesCount))
+		s.metrics.cachedPostingsCompressions.WithLabelValues("encode").Add(float64(stats.cachedPostingsCompressions))
+		s.metrics.cachedPostingsCompressions.WithLabelValues("decode").Add(float64(stats.cachedPostingsDecompressions))
+		s.metrics.cachedPostingsCompressionErrors.WithLabelValues("encode").Add(float64(stats.cachedPostingsCompressionErrors))
+		s.metrics.cachedPostingsCompressionErrors.WithLabelValues("decode").Add(float64(stats.cachedPostingsDecompressionErrors))
+		s.metrics.cachedPostingsCompressionTimeSeconds.WithLabelValues("encode").Add(stats.cachedPostingsCompressionTimeSum.Seconds())
+		s.metrics.cachedPostingsCompressionTimeSeconds.WithLabelValues("decode").Add(stats.cachedPostingsDecompressionTimeSum.Seconds())
+		s.metrics.cachedPostingsOriginalSizeBytes.Add(float64(stats.cachedPostingsOriginalSizeSum))
+		s.metrics.cachedPostingsCompressedSizeBytes.Add(float64(stats.cachedPostingsCompressedSizeSum))
 
 		level.Debug(s.logger).Log("msg", "stats query processed",
 			"stats", fmt.Sprintf("%+v", stats), "err", err)
 	}()
 
-	// Concurrently get data from all blocks.
+	// Concurrently expand postings and load the first batch of series of all blocks.
 	{
 		span, _ := tracing.StartSpan(srv.Context(), "bucket_store_preload_all")
 		begin := time.Now()
-		err := g.Run()
+		err := g.Wait()
 		span.Finish()
 
 		if err != nil {
-			return status.Error(codes.Aborted, err.Error())
+			return status.Error(seriesErrorCode(err, codes.Aborted), err.Error())
 		}
 		stats.getAllDuration = time.Since(begin)
 		s.metrics.seriesGetAllDuration.Observe(stats.getAllDuration.Seconds())
@@ -828,6 +1356,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 		// Merge series set into an union of all block sets. This exposes all blocks are single seriesSet.
 		// Chunks of returned series might be out of order w.r.t to their time range.
 		// This must be accounted for later by clients.
+		// Further batches of series are loaded from the blocks while merging, as the previous ones were sent.
 		set := storepb.MergeSeriesSets(res...)
 		for set.Next() {
 			var series storepb.Series
@@ -843,7 +1372,7 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 			}
 		}
 		if set.Err() != nil {
-			return status.Error(codes.Unknown, errors.Wrap(set.Err(), "expand series set").Error())
+			return status.Error(seriesErrorCode(set.Err(), codes.Unknown), errors.Wrap(set.Err(), "expand series set").Error())
 		}
 		stats.mergeDuration = time.Since(begin)
 		s.metrics.seriesMergeDuration.Observe(stats.mergeDuration.Seconds())
@@ -851,6 +1380,15 @@ func (s *BucketStore) Series(req *storepb.SeriesRequest, srv storepb.Store_Serie
 	return nil
 }
 
+// seriesErrorCode returns the gRPC code of an error of fetching series. Violated limits are returned as
+// ResourceExhausted, so that queriers do not turn them into partial responses. Other errors get the given code.
+func seriesErrorCode(err error, code codes.Code) codes.Code {
+	if isResourceExhausted(err) {
+		return codes.ResourceExhausted
+	}
+	return code
+}
+
 func chunksSize(chks []storepb.AggrChunk) (size int) {
 	for _, chk := range chks {
 		size += chk.Size() // This gets the encoded proto size.
@@ -872,8 +1410,10 @@ func (s *BucketStore) LabelNames(ctx context.Context, _ *storepb.LabelNamesReque
 		g.Go(func() error {
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "label names")
 
-			res := indexr.LabelNames()
-			sort.Strings(res)
+			res, err := indexr.LabelNames()
+			if err != nil {
+				return errors.Wrapf(err, "block %s", indexr.block.meta.ULID)
+			}
 
 			mtx.Lock()
 			sets = append(sets, res)
@@ -909,7 +1449,10 @@ func (s *BucketStore) LabelValues(ctx context.Context, req *storepb.LabelValuesR
 		g.Go(func() error {
 			defer runutil.CloseWithLogOnErr(s.logger, indexr, "label values")
 
-			res := indexr.LabelValues(req.Label)
+			res, err := indexr.LabelValues(req.Label)
+			if err != nil {
+				return errors.Wrapf(err, "block %s", indexr.block.meta.ULID)
+			}
 
 			mtx.Lock()
 			sets = append(sets, res)
@@ -938,8 +1481,8 @@ type bucketBlockSet struct {
 	blocks      [][]*bucketBlock // ordered buckets for the existing resolutions
 }
 
-// newBucketBlockSet initializes a new set with the known downsampling windows hard-configured.
-// The set currently does not support arbitrary ranges.
+// newBucketBlockSet initializes a new set with the standard downsampling resolutions. Resolutions of
+// custom downsampling levels are added along with their first block.
 func newBucketBlockSet(lset labels.Labels) *bucketBlockSet {
 	return &bucketBlockSet{
 		labels:      lset,
@@ -955,9 +1498,22 @@ func (s *bucketBlockSet) add(b *bucketBlock) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	i := int64index(s.resolutions, b.meta.Thanos.Downsample.Resolution)
+	res := b.meta.Thanos.Downsample.Resolution
+	if res < 0 {
+		return errors.Errorf("unsupported downsampling resolution %d", res)
+	}
+	i := int64index(s.resolutions, res)
 	if i < 0 {
-		return errors.Errorf("unsupported downsampling resolution %d", b.meta.Thanos.Downsample.Resolution)
+		// Keep resolutions ordered from high to low.
+		i = sort.Search(len(s.resolutions), func(j int) bool { return s.resolutions[j] < res })
+
+		s.resolutions = append(s.resolutions, 0)
+		copy(s.resolutions[i+1:], s.resolutions[i:])
+		s.resolutions[i] = res
+
+		s.blocks = append(s.blocks, nil)
+		copy(s.blocks[i+1:], s.blocks[i:])
+		s.blocks[i] = nil
 	}
 	bs := append(s.blocks[i], b)
 	s.blocks[i] = bs
@@ -1006,6 +1562,9 @@ func (s *bucketBlockSet) getFor(mint, maxt, maxResolutionMillis int64) (bs []*bu
 	i := 0
 	for ; i < len(s.resolutions) && s.resolutions[i] > maxResolutionMillis; i++ {
 	}
+	if i == len(s.resolutions) {
+		return nil
+	}
 
 	// Fill the given interval with the blocks for the current resolution.
 	// Our current resolution might not cover all data, so recursively fill the gaps with higher resolution blocks if there is any.
@@ -1052,17 +1611,15 @@ func (s *bucketBlockSet) labelMatchers(matchers ...labels.Matcher) ([]labels.Mat
 // bucketBlock represents a block that is located in a bucket. It holds intermediate
 // state for the block on local disk.
 type bucketBlock struct {
-	logger     log.Logger
-	bucket     objstore.BucketReader
-	meta       *metadata.Meta
-	dir        string
-	indexCache indexCache
-	chunkPool  *pool.BytesPool
-
-	indexVersion int
-	symbols      map[uint32]string
-	lvals        map[string][]string
-	postings     map[labels.Label]index.Range
+	logger      log.Logger
+	bucket      objstore.BucketReader
+	meta        *metadata.Meta
+	dir         string
+	indexCache  indexCache
+	chunksCache chunksCache
+	chunkPool   *pool.BytesPool
+
+	indexHeaderReader indexheader.Reader
 
 	id        ulid.ULID
 	chunkObjs []string
@@ -1076,29 +1633,41 @@ func newBucketBlock(
 	ctx context.Context,
 	logger log.Logger,
 	bkt objstore.BucketReader,
-	id ulid.ULID,
+	meta *metadata.Meta,
 	dir string,
 	indexCache indexCache,
+	chunksCache chunksCache,
 	chunkPool *pool.BytesPool,
 	p partitioner,
+	verifyIndex bool,
+	indexHeaderPool *indexheader.ReaderPool,
 ) (b *bucketBlock, err error) {
 	b = &bucketBlock{
 		logger:      logger,
 		bucket:      bkt,
-		id:          id,
+		id:          meta.ULID,
+		meta:        meta,
 		indexCache:  indexCache,
+		chunksCache: chunksCache,
 		chunkPool:   chunkPool,
 		dir:         dir,
 		partitioner: p,
 	}
-	if err = b.loadMeta(ctx, id); err != nil {
-		return nil, errors.Wrap(err, "load meta")
+	if verifyIndex {
+		if err = b.verifyIndex(ctx); err != nil {
+			return nil, errors.Wrap(err, "verify index")
+		}
 	}
-	if err = b.loadIndexCacheFile(ctx); err != nil {
-		return nil, errors.Wrap(err, "load index cache")
+	if err = b.loadIndexHeader(ctx, indexHeaderPool); err != nil {
+		return nil, errors.Wrap(err, "load index header")
 	}
+	defer func() {
+		if err != nil {
+			runutil.CloseWithLogOnErr(b.logger, b.indexHeaderReader, "index header")
+		}
+	}()
 	// Get object handles for all chunk files.
-	err = bkt.Iter(ctx, path.Join(id.String(), block.ChunksDirname), func(n string) error {
+	err = bkt.Iter(ctx, path.Join(b.id.String(), block.ChunksDirname), func(n string) error {
 		b.chunkObjs = append(b.chunkObjs, n)
 		return nil
 	})
@@ -1108,79 +1677,71 @@ func newBucketBlock(
 	return b, nil
 }
 
-func (b *bucketBlock) indexFilename() string {
-	return path.Join(b.id.String(), block.IndexFilename)
+// chunkObjSize returns the size of the chunk segment file recorded in the meta, or 0 if it is unknown.
+func (b *bucketBlock) chunkObjSize(seq int) uint64 {
+	relPath := strings.TrimPrefix(b.chunkObjs[seq], b.id.String()+"/")
+	for _, f := range b.meta.Thanos.Files {
+		if f.RelPath == relPath {
+			return uint64(f.SizeBytes)
+		}
+	}
+	return 0
 }
 
-func (b *bucketBlock) indexCacheFilename() string {
-	return path.Join(b.id.String(), block.IndexCacheFilename)
+func (b *bucketBlock) indexFilename() string {
+	return path.Join(b.id.String(), block.IndexFilename)
 }
 
-func (b *bucketBlock) loadMeta(ctx context.Context, id ulid.ULID) error {
-	// If we haven't seen the block before download the meta.json file.
-	if _, err := os.Stat(b.dir); os.IsNotExist(err) {
-		if err := os.MkdirAll(b.dir, 0777); err != nil {
-			return errors.Wrap(err, "create dir")
+// loadMeta returns the meta of the block, downloading it into dir if we haven't seen the block before.
+func loadMeta(ctx context.Context, logger log.Logger, bkt objstore.BucketReader, dir string, id ulid.ULID) (*metadata.Meta, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, errors.Wrap(err, "create dir")
 		}
 		src := path.Join(id.String(), block.MetaFilename)
 
-		if err := objstore.DownloadFile(ctx, b.logger, b.bucket, src, b.dir); err != nil {
-			return errors.Wrap(err, "download meta.json")
+		if err := objstore.DownloadFile(ctx, logger, bkt, src, dir); err != nil {
+			return nil, errors.Wrap(err, "download meta.json")
 		}
 	} else if err != nil {
-		return err
+		return nil, err
 	}
-	meta, err := metadata.Read(b.dir)
+	meta, err := metadata.Read(dir)
 	if err != nil {
-		return errors.Wrap(err, "read meta.json")
+		return nil, errors.Wrap(err, "read meta.json")
 	}
-	b.meta = meta
-	return nil
+	return meta, nil
 }
 
-func (b *bucketBlock) loadIndexCacheFile(ctx context.Context) (err error) {
-	cachefn := filepath.Join(b.dir, block.IndexCacheFilename)
-	if err = b.loadIndexCacheFileFromFile(ctx, cachefn); err == nil {
-		return nil
-	}
-	if !os.IsNotExist(errors.Cause(err)) {
-		return errors.Wrap(err, "read index cache")
-	}
-
-	// Try to download index cache file from object store.
-	if err = objstore.DownloadFile(ctx, b.logger, b.bucket, b.indexCacheFilename(), cachefn); err == nil {
-		return b.loadIndexCacheFileFromFile(ctx, cachefn)
-	}
-
-	if !b.bucket.IsObjNotFoundErr(errors.Cause(err)) {
-		return errors.Wrap(err, "download index cache file")
-	}
-
-	// No cache exists on disk yet, build it from the downloaded index and retry.
-	fn := filepath.Join(b.dir, block.IndexFilename)
-
-	if err := objstore.DownloadFile(ctx, b.logger, b.bucket, b.indexFilename(), fn); err != nil {
-		return errors.Wrap(err, "download index file")
-	}
-
-	defer func() {
-		if rerr := os.Remove(fn); rerr != nil {
-			level.Error(b.logger).Log("msg", "failed to remove temp index file", "path", fn, "err", rerr)
+// verifyIndex checks the index in the bucket against the size and hash recorded in meta.json, if any.
+func (b *bucketBlock) verifyIndex(ctx context.Context) error {
+	for _, f := range b.meta.Thanos.Files {
+		if f.RelPath == block.IndexFilename {
+			return block.VerifyObject(ctx, b.logger, b.bucket, b.id, f)
 		}
-	}()
-
-	if err := block.WriteIndexCache(b.logger, fn, cachefn); err != nil {
-		return errors.Wrap(err, "write index cache")
 	}
-
-	return errors.Wrap(b.loadIndexCacheFileFromFile(ctx, cachefn), "read index cache")
+	level.Debug(b.logger).Log("msg", "no index file recorded in meta.json; skipping index verification")
+	return nil
 }
 
-func (b *bucketBlock) loadIndexCacheFileFromFile(ctx context.Context, cache string) (err error) {
-	b.indexVersion, b.symbols, b.lvals, b.postings, err = block.ReadIndexCache(b.logger, cache)
+// loadIndexHeader creates the index-header reader of the block, which is loaded on first use if lazy loading is enabled.
+func (b *bucketBlock) loadIndexHeader(ctx context.Context, pool *indexheader.ReaderPool) (err error) {
+	b.indexHeaderReader, err = pool.NewReader(ctx, b.logger, b.newIndexHeaderReader)
 	return err
 }
 
+// newIndexHeaderReader opens the binary index-header of the block, building it from the index in the bucket if needed.
+// Blocks for which it cannot be built fall back to the JSON index cache.
+func (b *bucketBlock) newIndexHeaderReader(ctx context.Context) (indexheader.Reader, error) {
+	br, err := indexheader.NewBinaryReader(ctx, b.logger, b.bucket, b.dir, b.id, b.meta.IndexSize())
+	if err == nil {
+		return br, nil
+	}
+	level.Warn(b.logger).Log("msg", "failed to load binary index-header; falling back to JSON index cache", "err", err)
+
+	return indexheader.NewJSONReader(ctx, b.logger, b.bucket, b.dir, b.id)
+}
+
 func (b *bucketBlock) readIndexRange(ctx context.Context, off, length int64) ([]byte, error) {
 	r, err := b.bucket.GetRange(ctx, b.indexFilename(), off, length)
 	if err != nil {
@@ -1228,7 +1789,7 @@ func (b *bucketBlock) chunkReader(ctx context.Context) *bucketChunkReader {
 // Close waits for all pending readers to finish and then closes all underlying resources.
 func (b *bucketBlock) Close() error {
 	b.pendingReaders.Wait()
-	return nil
+	return b.indexHeaderReader.Close()
 }
 
 // bucketIndexReader is a custom index reader (not conforming index.Reader interface) that gets postings
@@ -1260,11 +1821,7 @@ func newBucketIndexReader(ctx context.Context, logger log.Logger, block *bucketB
 }
 
 func (r *bucketIndexReader) lookupSymbol(o uint32) (string, error) {
-	s, ok := r.block.symbols[o]
-	if !ok {
-		return "", errors.Errorf("bucketIndexReader: unknown symbol offset %d", o)
-	}
-	return s, nil
+	return r.block.indexHeaderReader.LookupSymbol(o)
 }
 
 // ExpandedPostings returns postings in expanded list instead of index.Postings.
@@ -1277,35 +1834,62 @@ func (r *bucketIndexReader) lookupSymbol(o uint32) (string, error) {
 // chunk where the series contains the matching label-value pair for a given block of data. Postings can be fetched by
 // single label name=value.
 func (r *bucketIndexReader) ExpandedPostings(ms []labels.Matcher) ([]uint64, error) {
-	var postingGroups []*postingGroup
+	var (
+		postingGroups []*postingGroup
+		hasAdd        bool
+	)
 
 	// NOTE: Derived from tsdb.PostingsForMatchers.
 	for _, m := range ms {
 		// Each group is separate to tell later what postings are intersecting with what.
-		postingGroups = append(postingGroups, toPostingGroup(r.LabelValues, m))
+		pg, err := toPostingGroup(r.LabelValues, m)
+		if err != nil {
+			return nil, errors.Wrap(err, "toPostingGroup")
+		}
+		if !pg.addAll && len(pg.keys) == 0 {
+			// No series match, so the intersection is empty and nothing needs to be fetched.
+			return nil, nil
+		}
+		postingGroups = append(postingGroups, pg)
+		hasAdd = hasAdd || !pg.addAll
 	}
 
 	if len(postingGroups) == 0 {
 		return nil, nil
 	}
 
+	// Groups of matchers selecting the empty value are subtracted from the intersection of the other groups. Only if
+	// there are no such other groups, the postings of all series are needed to subtract them from.
+	if !hasAdd {
+		allName, allValue := index.AllPostingsKey()
+		postingGroups = append(postingGroups, newPostingGroup(false, labels.Labels{{Name: allName, Value: allValue}}))
+	}
+
 	if err := r.fetchPostings(postingGroups); err != nil {
 		return nil, errors.Wrap(err, "get postings")
 	}
 
-	var postings []index.Postings
+	var postings, removals []index.Postings
 	for _, g := range postingGroups {
+		if g.addAll {
+			removals = append(removals, g.Postings())
+			continue
+		}
 		postings = append(postings, g.Postings())
 	}
 
-	ps, err := index.ExpandPostings(index.Intersect(postings...))
+	ps, err := index.ExpandPostings(index.Without(index.Intersect(postings...), index.Merge(removals...)))
 	if err != nil {
 		return nil, errors.Wrap(err, "expand")
 	}
 
 	// As of version two all series entries are 16 byte padded. All references
 	// we get have to account for that to get the correct offset.
-	if r.block.indexVersion >= 2 {
+	version, err := r.block.indexHeaderReader.IndexVersion()
+	if err != nil {
+		return nil, errors.Wrap(err, "get index version")
+	}
+	if version >= 2 {
 		for i, id := range ps {
 			ps[i] = id * 16
 		}
@@ -1314,18 +1898,19 @@ func (r *bucketIndexReader) ExpandedPostings(ms []labels.Matcher) ([]uint64, err
 	return ps, nil
 }
 
+// postingGroup holds the postings of the series selected by a single matcher. If addAll is set, it selects all series
+// but the ones with the keys, whose postings are then subtracted from the other groups.
 type postingGroup struct {
+	addAll   bool
 	keys     labels.Labels
 	postings []index.Postings
-
-	aggregate func(postings []index.Postings) index.Postings
 }
 
-func newPostingGroup(keys labels.Labels, aggr func(postings []index.Postings) index.Postings) *postingGroup {
+func newPostingGroup(addAll bool, keys labels.Labels) *postingGroup {
 	return &postingGroup{
-		keys:      keys,
-		postings:  make([]index.Postings, len(keys)),
-		aggregate: aggr,
+		addAll:   addAll,
+		keys:     keys,
+		postings: make([]index.Postings, len(keys)),
 	}
 }
 
@@ -1333,6 +1918,7 @@ func (p *postingGroup) Fill(i int, posting index.Postings) {
 	p.postings[i] = posting
 }
 
+// Postings returns the merged postings of all keys.
 func (p *postingGroup) Postings() index.Postings {
 	if len(p.keys) == 0 {
 		return index.EmptyPostings()
@@ -1345,56 +1931,72 @@ func (p *postingGroup) Postings() index.Postings {
 		}
 	}
 
-	return p.aggregate(p.postings)
-}
-
-func merge(p []index.Postings) index.Postings {
-	return index.Merge(p...)
-}
-
-func allWithout(p []index.Postings) index.Postings {
-	return index.Without(p[0], index.Merge(p[1:]...))
+	return index.Merge(p.postings...)
 }
 
 // NOTE: Derived from tsdb.postingsForMatcher. index.Merge is equivalent to map duplication.
-func toPostingGroup(lvalsFn func(name string) []string, m labels.Matcher) *postingGroup {
-	var matchingLabels labels.Labels
-
+func toPostingGroup(lvalsFn func(name string) ([]string, error), m labels.Matcher) (*postingGroup, error) {
 	// If the matcher selects an empty value, it selects all the series which don't
 	// have the label name set too. See: https://github.com/prometheus/prometheus/issues/3575
 	// and https://github.com/prometheus/prometheus/pull/3578#issuecomment-351653555
+	// Such a matcher selects all series but the ones with a not matching value, so the group holds those to subtract.
 	if m.Matches("") {
-		allName, allValue := index.AllPostingsKey()
-
-		matchingLabels = append(matchingLabels, labels.Label{Name: allName, Value: allValue})
-		for _, val := range lvalsFn(m.Name()) {
-			if !m.Matches(val) {
-				matchingLabels = append(matchingLabels, labels.Label{Name: m.Name(), Value: val})
+		// Fast-path for negated literals, like != "a" or !~ "a|b", which are subtracted directly.
+		if nm, ok := m.(*labels.NotMatcher); ok {
+			if vals := literalMatches(nm.Matcher); vals != nil {
+				return newPostingGroup(true, valuesToLabels(m.Name(), vals)), nil
 			}
 		}
 
-		if len(matchingLabels) == 1 {
-			// This is known hack to return all series.
-			// Ask for x != <not existing value>. Allow for that as Prometheus does,
-			// even though it is expensive.
-			return newPostingGroup(matchingLabels, merge)
+		vals, err := lvalsFn(m.Name())
+		if err != nil {
+			return nil, err
 		}
-
-		return newPostingGroup(matchingLabels, allWithout)
+		var toRemove []string
+		for _, val := range vals {
+			if !m.Matches(val) {
+				toRemove = append(toRemove, val)
+			}
+		}
+		return newPostingGroup(true, valuesToLabels(m.Name(), toRemove)), nil
 	}
 
-	// Fast-path for equal matching.
-	if em, ok := m.(*labels.EqualMatcher); ok {
-		return newPostingGroup(labels.Labels{{Name: em.Name(), Value: em.Value()}}, merge)
+	// Fast-path for literals, like = "a" or =~ "a|b", which are looked up directly.
+	if vals := literalMatches(m); vals != nil {
+		return newPostingGroup(false, valuesToLabels(m.Name(), vals)), nil
 	}
 
-	for _, val := range lvalsFn(m.Name()) {
+	vals, err := lvalsFn(m.Name())
+	if err != nil {
+		return nil, err
+	}
+	var matching []string
+	for _, val := range vals {
 		if m.Matches(val) {
-			matchingLabels = append(matchingLabels, labels.Label{Name: m.Name(), Value: val})
+			matching = append(matching, val)
 		}
 	}
+	return newPostingGroup(false, valuesToLabels(m.Name(), matching)), nil
+}
+
+// literalMatches returns the values matched by an equal matcher or a regex matcher of literals, or nil for any
+// other matcher.
+func literalMatches(m labels.Matcher) []string {
+	switch m := m.(type) {
+	case *labels.EqualMatcher:
+		return []string{m.Value()}
+	case *regexMatcher:
+		return m.setMatches
+	}
+	return nil
+}
 
-	return newPostingGroup(matchingLabels, merge)
+func valuesToLabels(name string, vals []string) labels.Labels {
+	res := make(labels.Labels, 0, len(vals))
+	for _, v := range vals {
+		res = append(res, labels.Label{Name: name, Value: v})
+	}
+	return res
 }
 
 type postingPtr struct {
@@ -1417,7 +2019,7 @@ func (r *bucketIndexReader) fetchPostings(groups []*postingGroup) error {
 				r.stats.postingsTouched++
 				r.stats.postingsTouchedSizeSum += len(b)
 
-				_, l, err := r.dec.Postings(b)
+				l, err := r.decodeCachedPostings(b)
 				if err != nil {
 					return errors.Wrap(err, "decode postings")
 				}
@@ -1426,12 +2028,15 @@ func (r *bucketIndexReader) fetchPostings(groups []*postingGroup) error {
 			}
 
 			// Cache miss; save pointer for actual posting in index stored in object store.
-			ptr, ok := r.block.postings[key]
-			if !ok {
+			ptr, err := r.block.indexHeaderReader.PostingsOffset(key.Name, key.Value)
+			if err == indexheader.NotFoundRangeErr {
 				// This block does not have any posting for given key.
 				g.Fill(j, index.EmptyPostings())
 				continue
 			}
+			if err != nil {
+				return errors.Wrap(err, "index header PostingsOffset")
+			}
 
 			r.stats.postingsToFetch++
 			ptrs = append(ptrs, postingPtr{ptr: ptr, groupID: i, keyID: j})
@@ -1483,9 +2088,23 @@ func (r *bucketIndexReader) fetchPostings(groups []*postingGroup) error {
 					return errors.Wrap(err, "read postings list")
 				}
 
-				// Return postings and fill LRU cache.
+				// Return postings and fill LRU cache with the compressed postings. If compression fails, which
+				// only happens for corrupted postings, the raw ones are cached instead.
 				groups[p.groupID].Fill(p.keyID, fetchedPostings)
-				r.cache.SetPostings(r.block.meta.ULID, groups[p.groupID].keys[p.keyID], c)
+
+				dataToCache := c
+				compressStart := time.Now()
+				if data, err := diffVarintSnappyEncode(c); err == nil {
+					dataToCache = data
+				} else {
+					r.stats.cachedPostingsCompressionErrors++
+				}
+				r.stats.cachedPostingsCompressions++
+				r.stats.cachedPostingsCompressionTimeSum += time.Since(compressStart)
+				r.stats.cachedPostingsOriginalSizeSum += len(c)
+				r.stats.cachedPostingsCompressedSizeSum += len(dataToCache)
+
+				r.cache.SetPostings(r.block.meta.ULID, groups[p.groupID].keys[p.keyID], dataToCache)
 
 				// If we just fetched it we still have to update the stats for touched postings.
 				r.stats.postingsTouched++
@@ -1502,6 +2121,29 @@ func (r *bucketIndexReader) fetchPostings(groups []*postingGroup) error {
 	return g.Run()
 }
 
+// decodeCachedPostings decodes postings read from the index cache, which are either compressed or raw ones stored
+// when their compression failed.
+func (r *bucketIndexReader) decodeCachedPostings(b []byte) (index.Postings, error) {
+	if !isDiffVarintSnappyEncodedPostings(b) {
+		_, l, err := r.dec.Postings(b)
+		return l, err
+	}
+
+	begin := time.Now()
+	l, err := diffVarintSnappyDecode(b)
+	r.stats.cachedPostingsDecompressions++
+	r.stats.cachedPostingsDecompressionTimeSum += time.Since(begin)
+	if err != nil {
+		r.stats.cachedPostingsDecompressionErrors++
+	}
+	return l, err
+}
+
+// reset releases the series loaded so far.
+func (r *bucketIndexReader) reset() {
+	r.loadedSeries = map[uint64][]byte{}
+}
+
 func (r *bucketIndexReader) PreloadSeries(ids []uint64) error {
 	const maxSeriesSize = 64 * 1024
 
@@ -1636,18 +2278,13 @@ func (r *bucketIndexReader) LoadedSeries(ref uint64, lset *labels.Labels, chks *
 }
 
 // LabelValues returns label values for single name.
-func (r *bucketIndexReader) LabelValues(name string) []string {
-	res := make([]string, 0, len(r.block.lvals[name]))
-	return append(res, r.block.lvals[name]...)
+func (r *bucketIndexReader) LabelValues(name string) ([]string, error) {
+	return r.block.indexHeaderReader.LabelValues(name)
 }
 
 // LabelNames returns a list of label names.
-func (r *bucketIndexReader) LabelNames() []string {
-	res := make([]string, 0, len(r.block.lvals))
-	for ln := range r.block.lvals {
-		res = append(res, ln)
-	}
-	return res
+func (r *bucketIndexReader) LabelNames() ([]string, error) {
+	return r.block.indexHeaderReader.LabelNames()
 }
 
 // Close released the underlying resources of the reader.
@@ -1656,6 +2293,22 @@ func (r *bucketIndexReader) Close() error {
 	return nil
 }
 
+const (
+	// maxChunkSize is the upper bound of the size of a chunk, including its length and checksum, in a segment file.
+	maxChunkSize = 16000
+	// chunkSubrangeSize is the size of the aligned byte ranges in which chunk segment files are fetched and cached.
+	// Aligning them allows to reuse cached ranges across queries touching overlapping chunks.
+	chunkSubrangeSize = 16000
+	// chunkBytesSlabSize is the size of the slabs the chunk bytes of a batch of series are copied into.
+	chunkBytesSlabSize = 16000
+)
+
+// chunkSubrange holds the bytes of a segment file subrange. Subranges at the end of a file may be shorter.
+type chunkSubrange struct {
+	b      []byte
+	cached bool
+}
+
 type bucketChunkReader struct {
 	ctx   context.Context
 	block *bucketBlock
@@ -1663,7 +2316,11 @@ type bucketChunkReader struct {
 
 	preloads [][]uint32
 	mtx      sync.Mutex
-	chunks   map[uint64]chunkenc.Chunk
+	// subranges holds the fetched or cached subranges of each segment file by their index.
+	subranges []map[uint64]chunkSubrange
+	chunks    map[uint64]chunkenc.Chunk
+	// numChunks is the number of chunks preloaded since the reader was created.
+	numChunks uint64
 
 	// Byte slice to return to the chunk pool on close.
 	chunkBytes []*[]byte
@@ -1671,14 +2328,30 @@ type bucketChunkReader struct {
 
 func newBucketChunkReader(ctx context.Context, block *bucketBlock) *bucketChunkReader {
 	return &bucketChunkReader{
-		ctx:      ctx,
-		block:    block,
-		stats:    &queryStats{},
-		preloads: make([][]uint32, len(block.chunkObjs)),
-		chunks:   map[uint64]chunkenc.Chunk{},
+		ctx:       ctx,
+		block:     block,
+		stats:     &queryStats{},
+		preloads:  make([][]uint32, len(block.chunkObjs)),
+		subranges: make([]map[uint64]chunkSubrange, len(block.chunkObjs)),
+		chunks:    map[uint64]chunkenc.Chunk{},
 	}
 }
 
+// reset releases the chunks loaded by the last preload and returns their bytes to the chunk pool, so that the reader
+// can preload the next ones. Chunks must not be used after the reset.
+func (r *bucketChunkReader) reset() {
+	for _, b := range r.chunkBytes {
+		r.block.chunkPool.Put(b)
+	}
+	r.chunkBytes = nil
+
+	for seq := range r.preloads {
+		r.preloads[seq] = r.preloads[seq][:0]
+		r.subranges[seq] = nil
+	}
+	r.chunks = map[uint64]chunkenc.Chunk{}
+}
+
 // addPreload adds the chunk with id to the data set that will be fetched on calling preload.
 func (r *bucketChunkReader) addPreload(id uint64) error {
 	var (
@@ -1693,39 +2366,143 @@ func (r *bucketChunkReader) addPreload(id uint64) error {
 }
 
 // preload all added chunk IDs. Must be called before the first call to Chunk is made.
-func (r *bucketChunkReader) preload(samplesLimiter *Limiter) error {
-	const maxChunkSize = 16000
-
-	var g run.Group
-
-	numChunks := uint64(0)
+// Chunks are read from aligned subranges of the segment files, which are taken from the chunks cache if possible.
+// Only the missing subranges are fetched from the bucket.
+// The chunk bytes limit is checked with the size of the ranges to fetch, before fetching them.
+func (r *bucketChunkReader) preload(samplesLimiter *Limiter, chunkBytesLimit *limitCounter) error {
 	for _, offsets := range r.preloads {
-		for range offsets {
-			numChunks++
-		}
+		r.numChunks += uint64(len(offsets))
 	}
-	if err := samplesLimiter.Check(numChunks * maxSamplesPerChunk); err != nil {
+	if err := samplesLimiter.Check(r.numChunks * maxSamplesPerChunk); err != nil {
 		return errors.Wrap(err, "exceeded samples limit")
 	}
 
+	// Fetch the subranges in which chunks start. A chunk may span into the next subrange, which is fetched along
+	// if missing. It is never fetched on its own here, as it might be beyond the end of the segment file.
+	toFetch := make([][]subrangeSpan, len(r.preloads))
 	for seq, offsets := range r.preloads {
+		if len(offsets) == 0 {
+			continue
+		}
 		sort.Slice(offsets, func(i, j int) bool {
 			return offsets[i] < offsets[j]
 		})
-		parts := r.block.partitioner.Partition(len(offsets), func(i int) (start, end uint64) {
-			return uint64(offsets[i]), uint64(offsets[i]) + maxChunkSize
+		r.subranges[seq] = map[uint64]chunkSubrange{}
+
+		for _, o := range offsets {
+			i := uint64(o) / chunkSubrangeSize
+			if _, ok := r.subranges[seq][i]; ok {
+				continue
+			}
+			if n := len(toFetch[seq]); n > 0 && toFetch[seq][n-1].last >= i {
+				continue
+			}
+			if b, ok := r.block.chunksCache.ChunksRange(r.block.meta.ULID, seq, i*chunkSubrangeSize); ok {
+				r.subranges[seq][i] = chunkSubrange{b: b, cached: true}
+				continue
+			}
+
+			span := subrangeSpan{first: i, last: i}
+			if uint64(o)%chunkSubrangeSize != 0 {
+				if b, ok := r.block.chunksCache.ChunksRange(r.block.meta.ULID, seq, (i+1)*chunkSubrangeSize); ok {
+					r.subranges[seq][i+1] = chunkSubrange{b: b, cached: true}
+				} else {
+					span.last = i + 1
+				}
+			}
+			toFetch[seq] = append(toFetch[seq], span)
+		}
+	}
+	if err := r.fetchSubranges(toFetch, chunkBytesLimit); err != nil {
+		return err
+	}
+
+	// Fetch the remaining subranges which chunks actually span into.
+	toFetch = make([][]subrangeSpan, len(r.preloads))
+	for seq, offsets := range r.preloads {
+		for _, o := range offsets {
+			err := r.loadChunk(seq, o)
+			if err == nil {
+				continue
+			}
+			missing, ok := errors.Cause(err).(errSubrangeNotLoaded)
+			if !ok {
+				return errors.Wrapf(err, "load chunk %d of segment %d", o, seq)
+			}
+			if n := len(toFetch[seq]); n > 0 && toFetch[seq][n-1].last >= uint64(missing) {
+				continue
+			}
+			if b, ok := r.block.chunksCache.ChunksRange(r.block.meta.ULID, seq, uint64(missing)*chunkSubrangeSize); ok {
+				r.subranges[seq][uint64(missing)] = chunkSubrange{b: b, cached: true}
+				continue
+			}
+			toFetch[seq] = append(toFetch[seq], subrangeSpan{first: uint64(missing), last: uint64(missing)})
+		}
+	}
+	if err := r.fetchSubranges(toFetch, chunkBytesLimit); err != nil {
+		return err
+	}
+	for seq, offsets := range r.preloads {
+		for _, o := range offsets {
+			if _, ok := r.chunks[uint64(seq<<32)|uint64(o)]; ok {
+				continue
+			}
+			if err := r.loadChunk(seq, o); err != nil {
+				return errors.Wrapf(err, "load chunk %d of segment %d", o, seq)
+			}
+		}
+	}
+	return nil
+}
+
+// subrangeSpan is an inclusive span of consecutive subrange indexes of a segment file.
+type subrangeSpan struct {
+	first, last uint64
+}
+
+// errSubrangeNotLoaded is the index of a subrange of a segment file which was needed, but not loaded.
+type errSubrangeNotLoaded uint64
+
+func (e errSubrangeNotLoaded) Error() string {
+	return fmt.Sprintf("subrange %d not loaded", uint64(e))
+}
+
+// fetchSubranges fetches the given sorted subrange spans of each segment file from the bucket, combining them
+// with the partitioner.
+func (r *bucketChunkReader) fetchSubranges(spans [][]subrangeSpan, chunkBytesLimit *limitCounter) error {
+	var (
+		g     run.Group
+		parts = make([][]part, len(spans))
+		size  uint64
+	)
+	for seq, ss := range spans {
+		parts[seq] = r.block.partitioner.Partition(len(ss), func(i int) (start, end uint64) {
+			return ss[i].first * chunkSubrangeSize, (ss[i].last + 1) * chunkSubrangeSize
 		})
+		// Ranges may end beyond the end of the segment file, which is not fetched.
+		objSize := r.block.chunkObjSize(seq)
+		for _, p := range parts[seq] {
+			end := p.end
+			if objSize > 0 && end > objSize {
+				end = objSize
+			}
+			if end > p.start {
+				size += end - p.start
+			}
+		}
+	}
+	if err := chunkBytesLimit.Add(size); err != nil {
+		return errors.Wrap(err, "exceeded chunk bytes limit")
+	}
 
+	for seq := range spans {
 		seq := seq
-		offsets := offsets
-
-		for _, p := range parts {
+		for _, p := range parts[seq] {
 			ctx, cancel := context.WithCancel(r.ctx)
-			s, e := uint32(p.start), uint32(p.end)
-			m, n := p.elemRng[0], p.elemRng[1]
+			s, e := p.start, p.end
 
 			g.Add(func() error {
-				return r.loadChunks(ctx, offsets[m:n], seq, s, e)
+				return r.loadSubranges(ctx, seq, s, e)
 			}, func(err error) {
 				if err != nil {
 					cancel()
@@ -1736,7 +2513,8 @@ func (r *bucketChunkReader) preload(samplesLimiter *Limiter) error {
 	return g.Run()
 }
 
-func (r *bucketChunkReader) loadChunks(ctx context.Context, offs []uint32, seq int, start, end uint32) error {
+// loadSubranges fetches the given aligned range of the segment file and caches all its subranges.
+func (r *bucketChunkReader) loadSubranges(ctx context.Context, seq int, start, end uint64) error {
 	begin := time.Now()
 
 	b, err := r.block.readChunkRange(ctx, seq, int64(start), int64(end-start))
@@ -1749,24 +2527,78 @@ func (r *bucketChunkReader) loadChunks(ctx context.Context, offs []uint32, seq i
 
 	r.chunkBytes = append(r.chunkBytes, b)
 	r.stats.chunksFetchCount++
-	r.stats.chunksFetched += len(offs)
 	r.stats.chunksFetchDurationSum += time.Since(begin)
-	r.stats.chunksFetchedSizeSum += int(end - start)
+	r.stats.chunksFetchedSizeSum += len(*b)
 
-	for _, o := range offs {
-		cb := (*b)[o-start:]
+	// The range may be shorter than requested at the end of the segment file.
+	for off := uint64(0); off < uint64(len(*b)); off += chunkSubrangeSize {
+		sub := (*b)[off:]
+		if uint64(len(sub)) > chunkSubrangeSize {
+			sub = sub[:chunkSubrangeSize]
+		}
+		r.block.chunksCache.SetChunksRange(r.block.meta.ULID, seq, start+off, sub)
+		r.subranges[seq][(start+off)/chunkSubrangeSize] = chunkSubrange{b: sub}
+	}
+	return nil
+}
 
-		l, n := binary.Uvarint(cb)
-		if n < 1 {
-			return errors.Errorf("reading chunk length failed")
+// loadChunk slices the chunk at the given offset out of the loaded subranges of the segment file.
+func (r *bucketChunkReader) loadChunk(seq int, off uint32) error {
+	// Chunks are prefixed with their data length, which is at most 4 bytes long given the maximum chunk size.
+	head, _, err := r.readSubranges(seq, uint64(off), binary.MaxVarintLen32)
+	if err != nil {
+		return err
+	}
+	l, n := binary.Uvarint(head)
+	if n < 1 {
+		return errors.Errorf("reading chunk length failed")
+	}
+	// The chunk encoding byte precedes the data.
+	cb, fetched, err := r.readSubranges(seq, uint64(off)+uint64(n), l+1)
+	if err != nil {
+		return errors.Wrapf(err, "preloaded chunk too small, expecting %d", n+int(l)+1)
+	}
+	if fetched {
+		r.stats.chunksFetched++
+	}
+	r.chunks[uint64(seq<<32)|uint64(off)] = rawChunk(cb)
+	return nil
+}
+
+// readSubranges returns length bytes at the given offset of the segment file. They are copied if they span multiple
+// subranges. It also returns whether any of the subranges was fetched from the bucket.
+func (r *bucketChunkReader) readSubranges(seq int, off, length uint64) ([]byte, bool, error) {
+	var (
+		i       = off / chunkSubrangeSize
+		start   = off - i*chunkSubrangeSize
+		res     []byte
+		fetched bool
+	)
+	for uint64(len(res)) < length {
+		sub, ok := r.subranges[seq][i]
+		if !ok {
+			return nil, false, errSubrangeNotLoaded(i)
+		}
+		if uint64(len(sub.b)) <= start {
+			return nil, false, errors.Errorf("range %d+%d of segment %d beyond its end", off, length, seq)
 		}
-		if len(cb) < n+int(l)+1 {
-			return errors.Errorf("preloaded chunk too small, expecting %d", n+int(l)+1)
+		fetched = fetched || !sub.cached
+
+		b := sub.b[start:]
+		if need := length - uint64(len(res)); uint64(len(b)) > need {
+			b = b[:need]
+		}
+		if res == nil && uint64(len(b)) == length {
+			// Fast path for bytes within a single subrange.
+			return b, fetched, nil
+		}
+		if res == nil {
+			res = make([]byte, 0, length)
 		}
-		cid := uint64(seq<<32) | uint64(o)
-		r.chunks[cid] = rawChunk(cb[n : n+int(l)+1])
+		res = append(res, b...)
+		i, start = i+1, 0
 	}
-	return nil
+	return res, fetched, nil
 }
 
 func (r *bucketChunkReader) Chunk(id uint64) (chunkenc.Chunk, error) {
@@ -1826,6 +2658,15 @@ type queryStats struct {
 	postingsFetchCount       int
 	postingsFetchDurationSum time.Duration
 
+	cachedPostingsCompressions         int
+	cachedPostingsCompressionErrors    int
+	cachedPostingsOriginalSizeSum      int
+	cachedPostingsCompressedSizeSum    int
+	cachedPostingsCompressionTimeSum   time.Duration
+	cachedPostingsDecompressions       int
+	cachedPostingsDecompressionErrors  int
+	cachedPostingsDecompressionTimeSum time.Duration
+
 	seriesTouched          int
 	seriesTouchedSizeSum   int
 	seriesFetched          int
@@ -1856,6 +2697,15 @@ func (s queryStats) merge(o *queryStats) *queryStats {
 	s.postingsFetchCount += o.postingsFetchCount
 	s.postingsFetchDurationSum += o.postingsFetchDurationSum
 
+	s.cachedPostingsCompressions += o.cachedPostingsCompressions
+	s.cachedPostingsCompressionErrors += o.cachedPostingsCompressionErrors
+	s.cachedPostingsOriginalSizeSum += o.cachedPostingsOriginalSizeSum
+	s.cachedPostingsCompressedSizeSum += o.cachedPostingsCompressedSizeSum
+	s.cachedPostingsCompressionTimeSum += o.cachedPostingsCompressionTimeSum
+	s.cachedPostingsDecompressions += o.cachedPostingsDecompressions
+	s.cachedPostingsDecompressionErrors += o.cachedPostingsDecompressionErrors
+	s.cachedPostingsDecompressionTimeSum += o.cachedPostingsDecompressionTimeSum
+
 	s.seriesTouched += o.seriesTouched
 	s.seriesTouchedSizeSum += o.seriesTouchedSizeSum
 	s.seriesFetched += o.seriesFetched
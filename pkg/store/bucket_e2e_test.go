@@ -2,9 +2,13 @@ package store
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -13,24 +17,34 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/timestamp"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/block/indexheader"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
 	"github.com/thanos-io/thanos/pkg/objstore/objtesting"
 	"github.com/thanos-io/thanos/pkg/runutil"
 	storecache "github.com/thanos-io/thanos/pkg/store/cache"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type noopCache struct{}
 
-func (noopCache) SetPostings(b ulid.ULID, l labels.Label, v []byte)   {}
-func (noopCache) Postings(b ulid.ULID, l labels.Label) ([]byte, bool) { return nil, false }
-func (noopCache) SetSeries(b ulid.ULID, id uint64, v []byte)          {}
-func (noopCache) Series(b ulid.ULID, id uint64) ([]byte, bool)        { return nil, false }
+func (noopCache) SetPostings(b ulid.ULID, l labels.Label, v []byte)             {}
+func (noopCache) Postings(b ulid.ULID, l labels.Label) ([]byte, bool)           { return nil, false }
+func (noopCache) SetSeries(b ulid.ULID, id uint64, v []byte)                    {}
+func (noopCache) Series(b ulid.ULID, id uint64) ([]byte, bool)                  { return nil, false }
+func (noopCache) SetChunksRange(b ulid.ULID, seq int, start uint64, v []byte)   {}
+func (noopCache) ChunksRange(b ulid.ULID, seq int, start uint64) ([]byte, bool) { return nil, false }
 
 type swappableCache struct {
 	ptr indexCache
@@ -56,6 +70,22 @@ func (c *swappableCache) Series(b ulid.ULID, id uint64) ([]byte, bool) {
 	return c.ptr.Series(b, id)
 }
 
+type swappableChunksCache struct {
+	ptr chunksCache
+}
+
+func (c *swappableChunksCache) SwapWith(ptr2 chunksCache) {
+	c.ptr = ptr2
+}
+
+func (c *swappableChunksCache) SetChunksRange(b ulid.ULID, seq int, start uint64, v []byte) {
+	c.ptr.SetChunksRange(b, seq, start, v)
+}
+
+func (c *swappableChunksCache) ChunksRange(b ulid.ULID, seq int, start uint64) ([]byte, bool) {
+	return c.ptr.ChunksRange(b, seq, start)
+}
+
 type storeSuite struct {
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
@@ -63,6 +93,7 @@ type storeSuite struct {
 	store            *BucketStore
 	minTime, maxTime int64
 	cache            *swappableCache
+	chunksCache      *swappableChunksCache
 
 	logger log.Logger
 }
@@ -70,9 +101,10 @@ type storeSuite struct {
 func (s *storeSuite) Close() {
 	s.cancel()
 	s.wg.Wait()
+	runutil.CloseWithLogOnErr(s.logger, s.store, "bucket store")
 }
 
-func prepareStoreWithTestBlocks(t testing.TB, dir string, bkt objstore.Bucket, manyParts bool, maxSampleCount uint64) *storeSuite {
+func prepareStoreWithTestBlocks(t testing.TB, dir string, bkt objstore.Bucket, manyParts bool, maxSampleCount uint64, lazyIndexHeader bool) *storeSuite {
 	series := []labels.Labels{
 		labels.FromStrings("a", "1", "b", "1"),
 		labels.FromStrings("a", "1", "b", "2"),
@@ -90,9 +122,10 @@ func prepareStoreWithTestBlocks(t testing.TB, dir string, bkt objstore.Bucket, m
 
 	ctx, cancel := context.WithCancel(context.Background())
 	s := &storeSuite{
-		cancel: cancel,
-		logger: log.NewLogfmtLogger(os.Stderr),
-		cache:  &swappableCache{},
+		cancel:      cancel,
+		logger:      log.NewLogfmtLogger(os.Stderr),
+		cache:       &swappableCache{},
+		chunksCache: &swappableChunksCache{ptr: noopCache{}},
 	}
 	blocks := 0
 	for i := 0; i < 3; i++ {
@@ -128,7 +161,17 @@ func prepareStoreWithTestBlocks(t testing.TB, dir string, bkt objstore.Bucket, m
 		testutil.Ok(t, os.RemoveAll(dir2))
 	}
 
-	store, err := NewBucketStore(s.logger, nil, bkt, dir, s.cache, 0, maxSampleCount, 20, false, 20)
+	store, err := NewBucketStore(s.logger, nil, bkt, &BucketStoreOptions{
+		Dir:                    dir,
+		IndexCache:             s.cache,
+		ChunksCache:            s.chunksCache,
+		MaxSampleCount:         maxSampleCount,
+		MaxConcurrent:          20,
+		SeriesBatchSize:        10000,
+		BlockSyncConcurrency:   20,
+		LazyIndexHeader:        lazyIndexHeader,
+		IndexHeaderIdleTimeout: time.Minute,
+	})
 	testutil.Ok(t, err)
 
 	s.store = store
@@ -335,6 +378,56 @@ func testBucketStore_e2e(t testing.TB, ctx context.Context, s *storeSuite) {
 				{{Name: "a", Value: "2"}, {Name: "c", Value: "2"}, {Name: "ext2", Value: "value2"}},
 			},
 		},
+		{
+			// Matchers selecting the empty value are subtracted from the other matchers.
+			req: &storepb.SeriesRequest{
+				Matchers: []storepb.LabelMatcher{
+					{Type: storepb.LabelMatcher_RE, Name: "a", Value: "1|2"},
+					{Type: storepb.LabelMatcher_NRE, Name: "b", Value: "2|3"},
+				},
+				MinTime: mint,
+				MaxTime: maxt,
+			},
+			expected: [][]storepb.Label{
+				{{Name: "a", Value: "1"}, {Name: "b", Value: "1"}, {Name: "ext1", Value: "value1"}},
+				{{Name: "a", Value: "1"}, {Name: "c", Value: "1"}, {Name: "ext2", Value: "value2"}},
+				{{Name: "a", Value: "1"}, {Name: "c", Value: "2"}, {Name: "ext2", Value: "value2"}},
+				{{Name: "a", Value: "2"}, {Name: "b", Value: "1"}, {Name: "ext1", Value: "value1"}},
+				{{Name: "a", Value: "2"}, {Name: "c", Value: "1"}, {Name: "ext2", Value: "value2"}},
+				{{Name: "a", Value: "2"}, {Name: "c", Value: "2"}, {Name: "ext2", Value: "value2"}},
+			},
+		},
+		{
+			req: &storepb.SeriesRequest{
+				Matchers: []storepb.LabelMatcher{
+					{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".*"},
+					{Type: storepb.LabelMatcher_RE, Name: "c", Value: ".+"},
+				},
+				MinTime: mint,
+				MaxTime: maxt,
+			},
+			expected: [][]storepb.Label{
+				{{Name: "a", Value: "1"}, {Name: "c", Value: "1"}, {Name: "ext2", Value: "value2"}},
+				{{Name: "a", Value: "1"}, {Name: "c", Value: "2"}, {Name: "ext2", Value: "value2"}},
+				{{Name: "a", Value: "2"}, {Name: "c", Value: "1"}, {Name: "ext2", Value: "value2"}},
+				{{Name: "a", Value: "2"}, {Name: "c", Value: "2"}, {Name: "ext2", Value: "value2"}},
+			},
+		},
+		{
+			req: &storepb.SeriesRequest{
+				Matchers: []storepb.LabelMatcher{
+					{Type: storepb.LabelMatcher_NRE, Name: "a", Value: "1.*"},
+					{Type: storepb.LabelMatcher_NEQ, Name: "c", Value: "1"},
+				},
+				MinTime: mint,
+				MaxTime: maxt,
+			},
+			expected: [][]storepb.Label{
+				{{Name: "a", Value: "2"}, {Name: "b", Value: "1"}, {Name: "ext1", Value: "value1"}},
+				{{Name: "a", Value: "2"}, {Name: "b", Value: "2"}, {Name: "ext1", Value: "value1"}},
+				{{Name: "a", Value: "2"}, {Name: "c", Value: "2"}, {Name: "ext2", Value: "value2"}},
+			},
+		},
 		// Regression https://github.com/thanos-io/thanos/issues/833.
 		// Problem: Matcher that was selecting NO series, was ignored instead of passed as emptyPosting to Intersect.
 		{
@@ -371,7 +464,7 @@ func TestBucketStore_e2e(t *testing.T) {
 		testutil.Ok(t, err)
 		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
 
-		s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0)
+		s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, false)
 		defer s.Close()
 
 		t.Log("Test with no index cache")
@@ -395,9 +488,43 @@ func TestBucketStore_e2e(t *testing.T) {
 		testutil.Ok(t, err)
 		s.cache.SwapWith(indexCache2)
 		testBucketStore_e2e(t, ctx, s)
+
+		t.Log("Test with chunks cache")
+		chunksCache, err := storecache.NewChunksCache(s.logger, nil, storecache.Opts{
+			MaxItemSizeBytes: 1e5,
+			MaxSizeBytes:     1e7,
+		})
+		testutil.Ok(t, err)
+		s.chunksCache.SwapWith(chunksCache)
+		testBucketStore_e2e(t, ctx, s)
+
+		// Now all chunks are served from the cache.
+		s.chunksCache.SwapWith(&failingChunksCache{chunksCache: chunksCache, t: t})
+		testBucketStore_e2e(t, ctx, s)
+
+		t.Log("Test with series batches smaller than the blocks")
+		s.chunksCache.SwapWith(noopCache{})
+		for _, batchSize := range []int{1, 3} {
+			s.store.seriesBatchSize = batchSize
+			testBucketStore_e2e(t, ctx, s)
+		}
 	})
 }
 
+// failingChunksCache fails the test if any chunk subrange is missing in the wrapped cache.
+type failingChunksCache struct {
+	chunksCache
+	t testing.TB
+}
+
+func (c *failingChunksCache) ChunksRange(b ulid.ULID, seq int, start uint64) ([]byte, bool) {
+	v, ok := c.chunksCache.ChunksRange(b, seq, start)
+	if !ok {
+		c.t.Errorf("chunks range %d of segment %d of block %s not cached", start, seq, b)
+	}
+	return v, ok
+}
+
 type naivePartitioner struct{}
 
 func (g naivePartitioner) Partition(length int, rng func(int) (uint64, uint64)) (parts []part) {
@@ -420,7 +547,7 @@ func TestBucketStore_ManyParts_e2e(t *testing.T) {
 		testutil.Ok(t, err)
 		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
 
-		s := prepareStoreWithTestBlocks(t, dir, bkt, true, 0)
+		s := prepareStoreWithTestBlocks(t, dir, bkt, true, 0, false)
 		defer s.Close()
 
 		indexCache, err := storecache.NewIndexCache(s.logger, nil, storecache.Opts{
@@ -433,3 +560,476 @@ func TestBucketStore_ManyParts_e2e(t *testing.T) {
 		testBucketStore_e2e(t, ctx, s)
 	})
 }
+
+func TestBucketStore_LazyIndexHeader_e2e(t *testing.T) {
+	objtesting.ForeachStore(t, func(t testing.TB, bkt objstore.Bucket) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		dir, err := ioutil.TempDir("", "test_bucketstore_e2e")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+		s := prepareStoreWithTestBlocks(t, dir, bkt, false, 0, true)
+		defer s.Close()
+
+		// No index-header is built before the first query.
+		headers, err := filepath.Glob(filepath.Join(dir, "*", indexheader.BinaryFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(headers))
+
+		s.cache.SwapWith(noopCache{})
+		testBucketStore_e2e(t, ctx, s)
+
+		headers, err = filepath.Glob(filepath.Join(dir, "*", indexheader.BinaryFilename))
+		testutil.Ok(t, err)
+		testutil.Equals(t, s.store.numBlocks(), len(headers))
+	})
+}
+
+func TestBucketStore_Limits_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucketstore_limits_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(t, dir, inmem.NewBucket(), false, 0, false)
+	defer s.Close()
+	s.cache.SwapWith(noopCache{})
+
+	mint, maxt := s.store.TimeRange()
+	req := &storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{
+			{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"},
+		},
+		MinTime: mint,
+		MaxTime: maxt,
+	}
+	// The request touches 2 series in each of the 6 blocks, whose small chunk files are fetched whole.
+	const touchedSeries = 12
+	var fetchedChunkBytes uint64
+	for _, b := range s.store.blocks {
+		fetchedChunkBytes += b.chunkObjSize(0)
+	}
+
+	for _, tcase := range []struct {
+		name            string
+		seriesLimit     uint64
+		chunkBytesLimit uint64
+		expectedErr     bool
+	}{
+		{name: "no limits"},
+		{name: "limits not exceeded", seriesLimit: touchedSeries, chunkBytesLimit: fetchedChunkBytes},
+		{name: "series limit exceeded", seriesLimit: touchedSeries - 1, expectedErr: true},
+		{name: "chunk bytes limit exceeded", chunkBytesLimit: fetchedChunkBytes - 1, expectedErr: true},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			dropped := prometheus.NewCounter(prometheus.CounterOpts{})
+			s.store.seriesLimiter = NewLimiter(tcase.seriesLimit, dropped)
+			s.store.chunkBytesLimiter = NewLimiter(tcase.chunkBytesLimit, dropped)
+
+			srv := newStoreSeriesServer(ctx)
+			err := s.store.Series(req, srv)
+			if !tcase.expectedErr {
+				testutil.Ok(t, err)
+				testutil.Equals(t, 4, len(srv.SeriesSet))
+				testutil.Equals(t, float64(0), promtest.ToFloat64(dropped))
+				return
+			}
+			testutil.NotOk(t, err)
+			testutil.Equals(t, codes.ResourceExhausted, status.Code(err))
+			testutil.Equals(t, 0, len(srv.SeriesSet))
+			testutil.Assert(t, promtest.ToFloat64(dropped) > 0, "expected dropped query to be counted")
+		})
+	}
+}
+
+func TestBucketStore_BlockFilter_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucketstore_block_filter_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := inmem.NewBucket()
+	s := prepareStoreWithTestBlocks(t, filepath.Join(dir, "all"), bkt, false, 0, false)
+	defer s.Close()
+
+	// All test blocks are raw level 1 blocks.
+	for _, tcase := range []struct {
+		name                string
+		filter              BlockFilter
+		expectedBlocks      int
+		expectedResolutions []int64
+	}{
+		{name: "raw", filter: NewResolutionLevelFilter([]int64{0}, 1), expectedBlocks: 6, expectedResolutions: []int64{0}},
+		{name: "any resolution", filter: NewResolutionLevelFilter(nil, 1), expectedBlocks: 6, expectedResolutions: []int64{0}},
+		{name: "downsampled", filter: NewResolutionLevelFilter([]int64{5 * 60 * 1000, 60 * 60 * 1000}, 1)},
+		{name: "compacted", filter: NewResolutionLevelFilter(nil, 2)},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			store, err := NewBucketStore(nil, nil, bkt, &BucketStoreOptions{
+				Dir:                  filepath.Join(dir, tcase.name),
+				IndexCache:           noopCache{},
+				ChunksCache:          noopCache{},
+				MaxConcurrent:        20,
+				SeriesBatchSize:      10000,
+				BlockSyncConcurrency: 20,
+				Filter:               tcase.filter,
+			})
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, store.Close()) }()
+
+			testutil.Ok(t, store.InitialSync(ctx))
+			testutil.Equals(t, tcase.expectedBlocks, store.numBlocks())
+			testutil.Equals(t, float64(6-tcase.expectedBlocks), promtest.ToFloat64(store.metrics.blocksFiltered))
+
+			resp, err := store.Info(ctx, &storepb.InfoRequest{})
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.expectedResolutions, resp.Resolutions)
+
+			// Filtered blocks are remembered and not loaded again.
+			testutil.Ok(t, store.SyncBlocks(ctx))
+			testutil.Equals(t, float64(tcase.expectedBlocks), promtest.ToFloat64(store.metrics.blockLoads))
+			testutil.Equals(t, tcase.expectedBlocks, store.numBlocks())
+		})
+	}
+}
+
+// metaCountingBucket counts the downloads of block metas.
+type metaCountingBucket struct {
+	objstore.BucketReader
+
+	mtx      sync.Mutex
+	metaGets int
+}
+
+func (b *metaCountingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if path.Base(name) == block.MetaFilename {
+		b.mtx.Lock()
+		b.metaGets++
+		b.mtx.Unlock()
+	}
+	return b.BucketReader.Get(ctx, name)
+}
+
+func (b *metaCountingBucket) MetaGets() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.metaGets
+}
+
+func TestBucketStore_ConsistencyDelay_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucketstore_consistency_delay_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := inmem.NewBucket()
+	s := prepareStoreWithTestBlocks(t, filepath.Join(dir, "all"), bkt, false, 0, false)
+	defer s.Close()
+
+	// Mark one of the test blocks as uploaded by a sidecar.
+	sidecarID := s.store.loadedMetas()[0].ULID
+	meta, err := block.DownloadMeta(ctx, s.logger, bkt, sidecarID)
+	testutil.Ok(t, err)
+	meta.Thanos.Source = metadata.SidecarSource
+	metaDir := filepath.Join(dir, "meta")
+	testutil.Ok(t, os.MkdirAll(metaDir, 0777))
+	testutil.Ok(t, metadata.Write(s.logger, metaDir, &meta))
+	testutil.Ok(t, objstore.UploadFile(ctx, s.logger, bkt, filepath.Join(metaDir, block.MetaFilename), path.Join(sidecarID.String(), block.MetaFilename)))
+
+	cbkt := &metaCountingBucket{BucketReader: bkt}
+	store, err := NewBucketStore(nil, nil, cbkt, &BucketStoreOptions{
+		Dir:                  filepath.Join(dir, "delayed"),
+		IndexCache:           noopCache{},
+		ChunksCache:          noopCache{},
+		MaxConcurrent:        20,
+		SeriesBatchSize:      10000,
+		BlockSyncConcurrency: 20,
+		ConsistencyDelay:     time.Hour,
+	})
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, store.Close()) }()
+
+	// All other test blocks were just created by a test source, while blocks uploaded by a sidecar are loaded right away.
+	testutil.Ok(t, store.InitialSync(ctx))
+	testutil.Equals(t, 1, store.numBlocks())
+	testutil.Assert(t, store.getBlock(sidecarID) != nil, "expected block of sidecar to be loaded")
+	testutil.Equals(t, float64(5), promtest.ToFloat64(store.metrics.blocksTooFresh))
+	testutil.Equals(t, 6, cbkt.MetaGets())
+
+	// The metas of blocks that are too fresh are not downloaded again.
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 1, store.numBlocks())
+	testutil.Equals(t, float64(5), promtest.ToFloat64(store.metrics.blocksTooFresh))
+	testutil.Equals(t, 6, cbkt.MetaGets())
+
+	// Blocks are loaded once they are old enough.
+	store.consistencyDelay = 0
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 6, store.numBlocks())
+	testutil.Equals(t, float64(0), promtest.ToFloat64(store.metrics.blocksTooFresh))
+	testutil.Equals(t, 6, cbkt.MetaGets())
+}
+
+func TestBucketStore_CoveredBlocks_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucketstore_covered_blocks_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := inmem.NewBucket()
+	s := prepareStoreWithTestBlocks(t, filepath.Join(dir, "all"), bkt, false, 0, false)
+	defer s.Close()
+
+	// Upload a compacted block that covers one of the test blocks.
+	covered := s.store.loadedMetas()[0]
+	coveringID, err := testutil.CreateBlock(ctx, dir, []labels.Labels{labels.FromStrings("a", "1")}, 10, covered.MinTime, covered.MaxTime, labels.FromMap(covered.Thanos.Labels), 0)
+	testutil.Ok(t, err)
+	coveringDir := filepath.Join(dir, coveringID.String())
+	meta, err := metadata.Read(coveringDir)
+	testutil.Ok(t, err)
+	meta.Compaction.Level = 2
+	meta.Compaction.Sources = append(meta.Compaction.Sources, covered.Compaction.Sources...)
+	testutil.Ok(t, metadata.Write(s.logger, coveringDir, meta))
+	testutil.Ok(t, block.Upload(ctx, s.logger, bkt, coveringDir))
+
+	cbkt := &metaCountingBucket{BucketReader: bkt}
+	store, err := NewBucketStore(nil, nil, cbkt, &BucketStoreOptions{
+		Dir:                  filepath.Join(dir, "store"),
+		IndexCache:           noopCache{},
+		ChunksCache:          noopCache{},
+		MaxConcurrent:        20,
+		SeriesBatchSize:      10000,
+		BlockSyncConcurrency: 20,
+	})
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, store.Close()) }()
+
+	testutil.Ok(t, store.InitialSync(ctx))
+	testutil.Equals(t, 6, store.numBlocks())
+	testutil.Assert(t, store.getBlock(covered.ULID) == nil, "expected covered block not to be loaded")
+	testutil.Equals(t, float64(1), promtest.ToFloat64(store.metrics.blocksDuplicated))
+	testutil.Equals(t, 7, cbkt.MetaGets())
+
+	// The meta of the covered block is not downloaded again.
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 6, store.numBlocks())
+	testutil.Equals(t, float64(1), promtest.ToFloat64(store.metrics.blocksDuplicated))
+	testutil.Equals(t, 7, cbkt.MetaGets())
+
+	// The covered block is loaded once the covering block is gone.
+	testutil.Ok(t, block.Delete(ctx, bkt, coveringID))
+	testutil.Ok(t, store.SyncBlocks(ctx))
+	testutil.Equals(t, 6, store.numBlocks())
+	testutil.Assert(t, store.getBlock(covered.ULID) != nil, "expected covered block to be loaded")
+	testutil.Assert(t, store.getBlock(coveringID) == nil, "expected deleted block to be dropped")
+	testutil.Equals(t, float64(0), promtest.ToFloat64(store.metrics.blocksDuplicated))
+	testutil.Equals(t, 7, cbkt.MetaGets())
+}
+
+// createSparseBlock creates a block with the given series, which have samples with the values of valueFn at 1000-1009
+// if inRange returns true for them and at 0-9 otherwise.
+func createSparseBlock(t *testing.T, dir string, series []labels.Labels, inRange func(i int) bool, valueFn func(i int) float64) ulid.ULID {
+	h, err := tsdb.NewHead(nil, nil, nil, 10000)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, h.Close()) }()
+
+	app := h.Appender()
+	for i, lset := range series {
+		start := int64(0)
+		if inRange(i) {
+			start = 1000
+		}
+		for ts := start; ts < start+10; ts++ {
+			_, err := app.Add(lset, ts, valueFn(i))
+			testutil.Ok(t, err)
+		}
+	}
+	testutil.Ok(t, app.Commit())
+
+	c, err := tsdb.NewLeveledCompactor(context.Background(), nil, log.NewNopLogger(), []int64{2000}, nil)
+	testutil.Ok(t, err)
+	id, err := c.Write(dir, h, 0, 2000, nil)
+	testutil.Ok(t, err)
+
+	_, err = metadata.InjectThanos(log.NewNopLogger(), filepath.Join(dir, id.String()), metadata.Thanos{
+		Labels: map[string]string{"ext1": "value1"},
+		Source: metadata.TestSource,
+	}, nil)
+	testutil.Ok(t, err)
+	return id
+}
+
+func TestBucketStore_SparseBatches_e2e(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test_bucketstore_sparse_batches_e2e")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var series []labels.Labels
+	for i := 0; i < 40; i++ {
+		series = append(series, labels.FromStrings("i", fmt.Sprintf("%02d", i)))
+	}
+
+	// Every block has samples within the queried time range for a few series only, so that most batches of
+	// a single series are empty. Some series have samples in all blocks and their chunks get concatenated.
+	const numBlocks = 4
+	bkt := inmem.NewBucket()
+	for k := 0; k < numBlocks; k++ {
+		k := k
+		id := createSparseBlock(t, dir, series,
+			func(i int) bool { return i%numBlocks == k || i%5 == 0 },
+			func(i int) float64 { return float64(i*10 + k) },
+		)
+		testutil.Ok(t, block.Upload(ctx, log.NewNopLogger(), bkt, filepath.Join(dir, id.String())))
+		testutil.Ok(t, os.RemoveAll(filepath.Join(dir, id.String())))
+	}
+
+	store, err := NewBucketStore(nil, nil, bkt, &BucketStoreOptions{
+		Dir:                  dir,
+		IndexCache:           noopCache{},
+		ChunksCache:          noopCache{},
+		MaxConcurrent:        20,
+		SeriesBatchSize:      1,
+		BlockSyncConcurrency: 20,
+	})
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, store.Close()) }()
+	testutil.Ok(t, store.InitialSync(ctx))
+	testutil.Equals(t, numBlocks, store.numBlocks())
+
+	srv := newStoreSeriesServer(ctx)
+	testutil.Ok(t, store.Series(&storepb.SeriesRequest{
+		Matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "i", Value: ".+"}},
+		MinTime:  1000,
+		MaxTime:  1999,
+	}, srv))
+
+	var expectedSeries int
+	for i := range series {
+		if i%5 == 0 {
+			expectedSeries++
+			continue
+		}
+		for k := 0; k < numBlocks; k++ {
+			if i%numBlocks == k {
+				expectedSeries++
+				break
+			}
+		}
+	}
+	testutil.Equals(t, expectedSeries, len(srv.SeriesSet))
+
+	// The chunks of every series must still hold the samples of its blocks after all series were sent.
+	for _, s := range srv.SeriesSet {
+		var i int
+		for _, l := range s.Labels {
+			if l.Name == "i" {
+				_, err := fmt.Sscanf(l.Value, "%d", &i)
+				testutil.Ok(t, err)
+			}
+		}
+
+		var expected, got []float64
+		for k := 0; k < numBlocks; k++ {
+			if i%numBlocks == k || i%5 == 0 {
+				for ts := 0; ts < 10; ts++ {
+					expected = append(expected, float64(i*10+k))
+				}
+			}
+		}
+		for _, c := range s.Chunks {
+			chk, err := chunkenc.FromData(chunkenc.EncXOR, c.Raw.Data)
+			testutil.Ok(t, err)
+			it := chk.Iterator()
+			for it.Next() {
+				_, v := it.At()
+				got = append(got, v)
+			}
+			testutil.Ok(t, it.Err())
+		}
+		sort.Float64s(got)
+		testutil.Equals(t, expected, got)
+	}
+}
+
+func BenchmarkBucketStore_Series_Matchers(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "bench_bucketstore_matchers")
+	testutil.Ok(b, err)
+	defer func() { testutil.Ok(b, os.RemoveAll(dir)) }()
+
+	s := prepareStoreWithTestBlocks(b, dir, inmem.NewBucket(), false, 0, false)
+	defer s.Close()
+
+	s.cache.SwapWith(noopCache{})
+	s.store.logger = log.NewNopLogger()
+	mint, maxt := s.store.TimeRange()
+
+	for _, bcase := range []struct {
+		name     string
+		matchers []storepb.LabelMatcher
+	}{
+		{
+			name:     "equal",
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"}},
+		},
+		{
+			name:     "literal alternation",
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: "1|2|3"}},
+		},
+		{
+			name:     "prefix",
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: "1.*"}},
+		},
+		{
+			name:     "regex",
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: "[0-9]+"}},
+		},
+		{
+			name:     "match all",
+			matchers: []storepb.LabelMatcher{{Type: storepb.LabelMatcher_RE, Name: "a", Value: ".*"}},
+		},
+		{
+			name: "equal and not literal alternation",
+			matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"},
+				{Type: storepb.LabelMatcher_NRE, Name: "b", Value: "2|3"},
+			},
+		},
+		{
+			name: "equal and not regex",
+			matchers: []storepb.LabelMatcher{
+				{Type: storepb.LabelMatcher_EQ, Name: "a", Value: "1"},
+				{Type: storepb.LabelMatcher_NRE, Name: "b", Value: "[2-9]+"},
+			},
+		},
+	} {
+		req := &storepb.SeriesRequest{
+			Matchers: bcase.matchers,
+			MinTime:  mint,
+			MaxTime:  maxt,
+		}
+		b.Run(bcase.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				testutil.Ok(b, s.store.Series(req, newStoreSeriesServer(ctx)))
+			}
+		})
+	}
+}
@@ -1,20 +1,31 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"io/ioutil"
 	"math"
+	"path"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/go-kit/kit/log"
 	"github.com/leanovate/gopter"
 	"github.com/leanovate/gopter/gen"
 	"github.com/leanovate/gopter/prop"
 	"github.com/oklog/ulid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/tsdb"
+	"github.com/prometheus/tsdb/chunkenc"
 	"github.com/prometheus/tsdb/labels"
+	"github.com/thanos-io/thanos/pkg/block"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/compact/downsample"
+	"github.com/thanos-io/thanos/pkg/objstore/inmem"
+	"github.com/thanos-io/thanos/pkg/pool"
+	storecache "github.com/thanos-io/thanos/pkg/store/cache"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
@@ -248,6 +259,53 @@ func TestBucketBlockSet_addGet(t *testing.T) {
 	}
 }
 
+func TestBucketBlockSet_customResolutions(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	set := newBucketBlockSet(labels.Labels{})
+
+	const (
+		res1m  = int64(60 * 1000)
+		res15m = int64(15 * 60 * 1000)
+	)
+	type resBlock struct {
+		mint, maxt int64
+		window     int64
+	}
+	input := []resBlock{
+		{window: downsample.ResLevel0, mint: 0, maxt: 100},
+		{window: downsample.ResLevel0, mint: 100, maxt: 200},
+		{window: downsample.ResLevel0, mint: 200, maxt: 300},
+		{window: res15m, mint: 0, maxt: 100},
+		{window: res1m, mint: 0, maxt: 100},
+		{window: res1m, mint: 100, maxt: 200},
+	}
+	for _, in := range input {
+		var m metadata.Meta
+		m.Thanos.Downsample.Resolution = in.window
+		m.MinTime = in.mint
+		m.MaxTime = in.maxt
+
+		testutil.Ok(t, set.add(&bucketBlock{meta: &m}))
+	}
+	testutil.Equals(t, []int64{downsample.ResLevel2, res15m, downsample.ResLevel1, res1m, downsample.ResLevel0}, set.resolutions)
+
+	var exp []*bucketBlock
+	for _, b := range []resBlock{
+		{window: res15m, mint: 0, maxt: 100},
+		{window: res1m, mint: 100, maxt: 200},
+		{window: downsample.ResLevel0, mint: 200, maxt: 300},
+	} {
+		var m metadata.Meta
+		m.Thanos.Downsample.Resolution = b.window
+		m.MinTime = b.mint
+		m.MaxTime = b.maxt
+		exp = append(exp, &bucketBlock{meta: &m})
+	}
+	testutil.Equals(t, exp, set.getFor(0, 300, downsample.ResLevel2))
+	testutil.Equals(t, exp[1:], set.getFor(100, 300, res1m))
+}
+
 func TestBucketBlockSet_remove(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -407,6 +465,65 @@ func TestGapBasedPartitioner_Partition(t *testing.T) {
 	}
 }
 
+func TestDuplicateBlocks(t *testing.T) {
+	id := func(i uint64) ulid.ULID { return ulid.MustNew(i, nil) }
+	meta := func(i uint64, level int, resolution int64, lset map[string]string, sources ...uint64) *metadata.Meta {
+		var m metadata.Meta
+		m.ULID = id(i)
+		m.Compaction.Level = level
+		for _, src := range sources {
+			m.Compaction.Sources = append(m.Compaction.Sources, id(src))
+		}
+		m.Thanos.Downsample.Resolution = resolution
+		m.Thanos.Labels = lset
+		return &m
+	}
+	ext1 := map[string]string{"ext": "1"}
+	ext2 := map[string]string{"ext": "2"}
+
+	for _, tcase := range []struct {
+		name     string
+		metas    []*metadata.Meta
+		expected []ulid.ULID
+	}{
+		{
+			name:  "no overlapping sources",
+			metas: []*metadata.Meta{meta(1, 1, 0, ext1, 1), meta(2, 1, 0, ext1, 2), meta(3, 2, 0, ext1, 3, 4)},
+		},
+		{
+			name:     "sources of compacted block",
+			metas:    []*metadata.Meta{meta(1, 1, 0, ext1, 1), meta(2, 1, 0, ext1, 2), meta(3, 1, 0, ext1, 3), meta(4, 2, 0, ext1, 1, 2)},
+			expected: []ulid.ULID{id(1), id(2)},
+		},
+		{
+			name:     "compacted block covered by a block of a higher level",
+			metas:    []*metadata.Meta{meta(4, 2, 0, ext1, 1, 2), meta(5, 2, 0, ext1, 3), meta(6, 3, 0, ext1, 1, 2, 3)},
+			expected: []ulid.ULID{id(4), id(5)},
+		},
+		{
+			name:     "same sources keep the highest level, then the newest block",
+			metas:    []*metadata.Meta{meta(4, 2, 0, ext1, 1, 2), meta(5, 3, 0, ext1, 1, 2), meta(6, 3, 0, ext1, 1, 2)},
+			expected: []ulid.ULID{id(4), id(5)},
+		},
+		{
+			name:  "partially overlapping sources",
+			metas: []*metadata.Meta{meta(4, 2, 0, ext1, 1, 2), meta(5, 2, 0, ext1, 2, 3)},
+		},
+		{
+			name:  "different resolutions or labels",
+			metas: []*metadata.Meta{meta(1, 1, 0, ext1, 1), meta(2, 2, downsample.ResLevel1, ext1, 1, 2), meta(3, 2, 0, ext2, 1, 2)},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			expected := map[ulid.ULID]struct{}{}
+			for _, id := range tcase.expected {
+				expected[id] = struct{}{}
+			}
+			testutil.Equals(t, expected, duplicateBlocks(tcase.metas))
+		})
+	}
+}
+
 func TestBucketStore_Info(t *testing.T) {
 	defer leaktest.CheckTimeout(t, 10*time.Second)()
 
@@ -416,7 +533,15 @@ func TestBucketStore_Info(t *testing.T) {
 	dir, err := ioutil.TempDir("", "prometheus-test")
 	testutil.Ok(t, err)
 
-	bucketStore, err := NewBucketStore(nil, nil, nil, dir, noopCache{}, 2e5, 0, 0, false, 20)
+	bucketStore, err := NewBucketStore(nil, nil, nil, &BucketStoreOptions{
+		Dir:                  dir,
+		IndexCache:           noopCache{},
+		ChunksCache:          noopCache{},
+		MaxChunkPoolBytes:    2e5,
+		MaxConcurrent:        20,
+		SeriesBatchSize:      10000,
+		BlockSyncConcurrency: 20,
+	})
 	testutil.Ok(t, err)
 
 	resp, err := bucketStore.Info(ctx, &storepb.InfoRequest{})
@@ -426,3 +551,78 @@ func TestBucketStore_Info(t *testing.T) {
 	testutil.Equals(t, int64(math.MaxInt64), resp.MinTime)
 	testutil.Equals(t, int64(math.MinInt64), resp.MaxTime)
 }
+
+func TestBucketChunkReader_SubrangesCache(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	ctx := context.Background()
+	bkt := inmem.NewBucket()
+	id := ulid.MustNew(1, nil)
+
+	// Write a segment file with chunks spanning subrange boundaries, up to the maximum chunk size.
+	var (
+		segment []byte
+		offsets []uint32
+		datas   [][]byte
+	)
+	for i, size := range []int{100, 15000, 3000, 9000, 40, 15900, 700, 12000, 5} {
+		offsets = append(offsets, uint32(len(segment)))
+
+		data := bytes.Repeat([]byte{byte(i)}, size)
+		datas = append(datas, data)
+
+		var l [binary.MaxVarintLen32]byte
+		segment = append(segment, l[:binary.PutUvarint(l[:], uint64(size))]...)
+		segment = append(segment, byte(chunkenc.EncXOR))
+		segment = append(segment, data...)
+		segment = append(segment, 0, 0, 0, 0)
+	}
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), block.ChunksDirname, "000001"), bytes.NewReader(segment)))
+
+	chunkPool, err := pool.NewBytesPool(2e5, 50e6, 2, 1e9)
+	testutil.Ok(t, err)
+
+	for _, p := range []partitioner{gapBasedPartitioner{maxGapSize: 512 * 1024}, naivePartitioner{}} {
+		cache, err := storecache.NewChunksCache(log.NewNopLogger(), nil, storecache.Opts{
+			MaxItemSizeBytes: 1e5,
+			MaxSizeBytes:     1e7,
+		})
+		testutil.Ok(t, err)
+
+		b := &bucketBlock{
+			logger:      log.NewNopLogger(),
+			bucket:      bkt,
+			meta:        &metadata.Meta{BlockMeta: tsdb.BlockMeta{ULID: id}},
+			chunksCache: cache,
+			chunkPool:   chunkPool,
+			chunkObjs:   []string{path.Join(id.String(), block.ChunksDirname, "000001")},
+			partitioner: p,
+		}
+
+		readChunks := func(idxs ...int) {
+			r := b.chunkReader(ctx)
+			defer func() { testutil.Ok(t, r.Close()) }()
+
+			for _, i := range idxs {
+				testutil.Ok(t, r.addPreload(uint64(offsets[i])))
+			}
+			noLimit := NewLimiter(0, prometheus.NewCounter(prometheus.CounterOpts{}))
+			testutil.Ok(t, r.preload(noLimit, newLimitCounter(noLimit)))
+
+			for _, i := range idxs {
+				c, err := r.Chunk(uint64(offsets[i]))
+				testutil.Ok(t, err)
+				testutil.Equals(t, chunkenc.EncXOR, c.Encoding())
+				testutil.Equals(t, datas[i], c.Bytes())
+			}
+		}
+
+		readChunks(1, 2, 5, 8)
+		readChunks(0, 1, 2, 3, 4, 5, 6, 7, 8)
+
+		// All subranges are cached now.
+		b.chunksCache = &failingChunksCache{chunksCache: cache, t: t}
+		readChunks(0, 1, 2, 3, 4, 5, 6, 7, 8)
+		readChunks(3, 7)
+	}
+}
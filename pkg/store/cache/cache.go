@@ -16,6 +16,7 @@ import (
 const (
 	cacheTypePostings string = "Postings"
 	cacheTypeSeries   string = "Series"
+	cacheTypeChunks   string = "Chunks"
 
 	sliceHeaderSize = 16
 )
@@ -31,6 +32,8 @@ func (c cacheKey) keyType() string {
 		return cacheTypePostings
 	case cacheKeySeries:
 		return cacheTypeSeries
+	case cacheKeyChunks:
+		return cacheTypeChunks
 	}
 	return "<unknown>"
 }
@@ -42,14 +45,22 @@ func (c cacheKey) size() uint64 {
 		return 16 + 2*sliceHeaderSize + uint64(len(k.Value)+len(k.Name))
 	case cacheKeySeries:
 		return 16 + 8 // ULID + uint64
+	case cacheKeyChunks:
+		return 16 + 8 + 8 // ULID + int + uint64
 	}
 	return 0
 }
 
 type cacheKeyPostings labels.Label
 type cacheKeySeries uint64
+type cacheKeyChunks struct {
+	seq   int
+	start uint64
+}
 
-type IndexCache struct {
+// lruCache is a thread-safe LRU cache of byte slices which ensures the total cache size approximately does not exceed
+// the configured maximum. Metrics are partitioned by the item types of the cache.
+type lruCache struct {
 	mtx sync.Mutex
 
 	logger           log.Logger
@@ -79,82 +90,85 @@ type Opts struct {
 // NewIndexCache creates a new thread-safe LRU cache for index entries and ensures the total cache
 // size approximately does not exceed maxBytes.
 func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*IndexCache, error) {
+	c, err := newLRUCache(logger, reg, opts, "index", cacheTypePostings, cacheTypeSeries)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexCache{lruCache: c}, nil
+}
+
+func newLRUCache(logger log.Logger, reg prometheus.Registerer, opts Opts, name string, itemTypes ...string) (*lruCache, error) {
 	if opts.MaxItemSizeBytes > opts.MaxSizeBytes {
 		return nil, errors.Errorf("max item size (%v) cannot be bigger than overall cache size (%v)", opts.MaxItemSizeBytes, opts.MaxSizeBytes)
 	}
 
-	c := &IndexCache{
+	c := &lruCache{
 		logger:           logger,
 		maxSizeBytes:     opts.MaxSizeBytes,
 		maxItemSizeBytes: opts.MaxItemSizeBytes,
 	}
 
 	c.evicted = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "thanos_store_index_cache_items_evicted_total",
-		Help: "Total number of items that were evicted from the index cache.",
+		Name: "thanos_store_" + name + "_cache_items_evicted_total",
+		Help: "Total number of items that were evicted from the " + name + " cache.",
 	}, []string{"item_type"})
-	c.evicted.WithLabelValues(cacheTypePostings)
-	c.evicted.WithLabelValues(cacheTypeSeries)
 
 	c.added = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "thanos_store_index_cache_items_added_total",
-		Help: "Total number of items that were added to the index cache.",
+		Name: "thanos_store_" + name + "_cache_items_added_total",
+		Help: "Total number of items that were added to the " + name + " cache.",
 	}, []string{"item_type"})
-	c.added.WithLabelValues(cacheTypePostings)
-	c.added.WithLabelValues(cacheTypeSeries)
 
 	c.requests = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "thanos_store_index_cache_requests_total",
+		Name: "thanos_store_" + name + "_cache_requests_total",
 		Help: "Total number of requests to the cache.",
 	}, []string{"item_type"})
-	c.requests.WithLabelValues(cacheTypePostings)
-	c.requests.WithLabelValues(cacheTypeSeries)
 
 	c.overflow = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "thanos_store_index_cache_items_overflowed_total",
+		Name: "thanos_store_" + name + "_cache_items_overflowed_total",
 		Help: "Total number of items that could not be added to the cache due to being too big.",
 	}, []string{"item_type"})
-	c.overflow.WithLabelValues(cacheTypePostings)
-	c.overflow.WithLabelValues(cacheTypeSeries)
 
 	c.hits = prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "thanos_store_index_cache_hits_total",
+		Name: "thanos_store_" + name + "_cache_hits_total",
 		Help: "Total number of requests to the cache that were a hit.",
 	}, []string{"item_type"})
-	c.hits.WithLabelValues(cacheTypePostings)
-	c.hits.WithLabelValues(cacheTypeSeries)
 
 	c.current = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "thanos_store_index_cache_items",
-		Help: "Current number of items in the index cache.",
+		Name: "thanos_store_" + name + "_cache_items",
+		Help: "Current number of items in the " + name + " cache.",
 	}, []string{"item_type"})
-	c.current.WithLabelValues(cacheTypePostings)
-	c.current.WithLabelValues(cacheTypeSeries)
 
 	c.currentSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "thanos_store_index_cache_items_size_bytes",
-		Help: "Current byte size of items in the index cache.",
+		Name: "thanos_store_" + name + "_cache_items_size_bytes",
+		Help: "Current byte size of items in the " + name + " cache.",
 	}, []string{"item_type"})
-	c.currentSize.WithLabelValues(cacheTypePostings)
-	c.currentSize.WithLabelValues(cacheTypeSeries)
 
 	c.totalCurrentSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: "thanos_store_index_cache_total_size_bytes",
-		Help: "Current byte size of items (both value and key) in the index cache.",
+		Name: "thanos_store_" + name + "_cache_total_size_bytes",
+		Help: "Current byte size of items (both value and key) in the " + name + " cache.",
 	}, []string{"item_type"})
-	c.totalCurrentSize.WithLabelValues(cacheTypePostings)
-	c.totalCurrentSize.WithLabelValues(cacheTypeSeries)
+
+	for _, typ := range itemTypes {
+		c.evicted.WithLabelValues(typ)
+		c.added.WithLabelValues(typ)
+		c.requests.WithLabelValues(typ)
+		c.overflow.WithLabelValues(typ)
+		c.hits.WithLabelValues(typ)
+		c.current.WithLabelValues(typ)
+		c.currentSize.WithLabelValues(typ)
+		c.totalCurrentSize.WithLabelValues(typ)
+	}
 
 	if reg != nil {
 		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-			Name: "thanos_store_index_cache_max_size_bytes",
-			Help: "Maximum number of bytes to be held in the index cache.",
+			Name: "thanos_store_" + name + "_cache_max_size_bytes",
+			Help: "Maximum number of bytes to be held in the " + name + " cache.",
 		}, func() float64 {
 			return float64(c.maxSizeBytes)
 		}))
 		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-			Name: "thanos_store_index_cache_max_item_size_bytes",
-			Help: "Maximum number of bytes for single entry to be held in the index cache.",
+			Name: "thanos_store_" + name + "_cache_max_item_size_bytes",
+			Help: "Maximum number of bytes for single entry to be held in the " + name + " cache.",
 		}, func() float64 {
 			return float64(c.maxItemSizeBytes)
 		}))
@@ -170,7 +184,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	c.lru = l
 
 	level.Info(logger).Log(
-		"msg", "created index cache",
+		"msg", "created "+name+" cache",
 		"maxItemSizeBytes", c.maxItemSizeBytes,
 		"maxSizeBytes", c.maxSizeBytes,
 		"maxItems", "math.MaxInt64",
@@ -178,7 +192,7 @@ func NewIndexCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*In
 	return c, nil
 }
 
-func (c *IndexCache) onEvict(key, val interface{}) {
+func (c *lruCache) onEvict(key, val interface{}) {
 	k := key.(cacheKey).keyType()
 	entrySize := sliceHeaderSize + uint64(len(val.([]byte)))
 
@@ -190,7 +204,7 @@ func (c *IndexCache) onEvict(key, val interface{}) {
 	c.curSize -= entrySize
 }
 
-func (c *IndexCache) get(typ string, key cacheKey) ([]byte, bool) {
+func (c *lruCache) get(typ string, key cacheKey) ([]byte, bool) {
 	c.requests.WithLabelValues(typ).Inc()
 
 	c.mtx.Lock()
@@ -204,7 +218,7 @@ func (c *IndexCache) get(typ string, key cacheKey) ([]byte, bool) {
 	return v.([]byte), true
 }
 
-func (c *IndexCache) set(typ string, key cacheKey, val []byte) {
+func (c *lruCache) set(typ string, key cacheKey, val []byte) {
 	var size = sliceHeaderSize + uint64(len(val))
 
 	c.mtx.Lock()
@@ -234,7 +248,7 @@ func (c *IndexCache) set(typ string, key cacheKey, val []byte) {
 
 // ensureFits tries to make sure that the passed slice will fit into the LRU cache.
 // Returns true if it will fit.
-func (c *IndexCache) ensureFits(size uint64, typ string) bool {
+func (c *lruCache) ensureFits(size uint64, typ string) bool {
 	if size > c.maxItemSizeBytes {
 		level.Debug(c.logger).Log(
 			"msg", "item bigger than maxItemSizeBytes. Ignoring..",
@@ -263,7 +277,7 @@ func (c *IndexCache) ensureFits(size uint64, typ string) bool {
 	return true
 }
 
-func (c *IndexCache) reset() {
+func (c *lruCache) reset() {
 	c.lru.Purge()
 	c.current.Reset()
 	c.currentSize.Reset()
@@ -271,6 +285,11 @@ func (c *IndexCache) reset() {
 	c.curSize = 0
 }
 
+// IndexCache is a LRU cache for postings and series of block indexes.
+type IndexCache struct {
+	*lruCache
+}
+
 // SetPostings sets the postings identfied by the ulid and label to the value v,
 // if the postings already exists in the cache it is not mutated.
 func (c *IndexCache) SetPostings(b ulid.ULID, l labels.Label, v []byte) {
@@ -290,3 +309,28 @@ func (c *IndexCache) SetSeries(b ulid.ULID, id uint64, v []byte) {
 func (c *IndexCache) Series(b ulid.ULID, id uint64) ([]byte, bool) {
 	return c.get(cacheTypeSeries, cacheKey{b, cacheKeySeries(id)})
 }
+
+// ChunksCache is a LRU cache for byte ranges of chunk segment files of blocks.
+type ChunksCache struct {
+	*lruCache
+}
+
+// NewChunksCache creates a new thread-safe LRU cache for chunk segment byte ranges and ensures the total cache
+// size approximately does not exceed maxBytes.
+func NewChunksCache(logger log.Logger, reg prometheus.Registerer, opts Opts) (*ChunksCache, error) {
+	c, err := newLRUCache(logger, reg, opts, "chunks", cacheTypeChunks)
+	if err != nil {
+		return nil, err
+	}
+	return &ChunksCache{lruCache: c}, nil
+}
+
+// SetChunksRange sets the bytes of the chunk segment file seq of the block starting at the given offset to v,
+// if the range already exists in the cache it is not mutated.
+func (c *ChunksCache) SetChunksRange(b ulid.ULID, seq int, start uint64, v []byte) {
+	c.set(cacheTypeChunks, cacheKey{b, cacheKeyChunks{seq: seq, start: start}}, v)
+}
+
+func (c *ChunksCache) ChunksRange(b ulid.ULID, seq int, start uint64) ([]byte, bool) {
+	return c.get(cacheTypeChunks, cacheKey{b, cacheKeyChunks{seq: seq, start: start}})
+}
@@ -365,3 +365,41 @@ func TestIndexCache_Eviction_WithMetrics(t *testing.T) {
 	testutil.Equals(t, float64(5), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypePostings)))
 	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypeSeries)))
 }
+
+func TestChunksCache(t *testing.T) {
+	defer leaktest.CheckTimeout(t, 10*time.Second)()
+
+	// Both caches register their own metrics.
+	metrics := prometheus.NewRegistry()
+	_, err := NewIndexCache(log.NewNopLogger(), metrics, Opts{MaxItemSizeBytes: 100, MaxSizeBytes: 100})
+	testutil.Ok(t, err)
+	cache, err := NewChunksCache(log.NewNopLogger(), metrics, Opts{
+		MaxItemSizeBytes: sliceHeaderSize + 5,
+		MaxSizeBytes:     2 * (sliceHeaderSize + 5),
+	})
+	testutil.Ok(t, err)
+
+	id := ulid.MustNew(0, nil)
+	cache.SetChunksRange(id, 0, 0, []byte{1, 2, 3})
+	cache.SetChunksRange(id, 1, 0, []byte{4, 5})
+
+	v, ok := cache.ChunksRange(id, 0, 0)
+	testutil.Assert(t, ok, "range not cached")
+	testutil.Equals(t, []byte{1, 2, 3}, v)
+
+	v, ok = cache.ChunksRange(id, 1, 0)
+	testutil.Assert(t, ok, "range not cached")
+	testutil.Equals(t, []byte{4, 5}, v)
+
+	_, ok = cache.ChunksRange(id, 0, 16000)
+	testutil.Assert(t, !ok, "unexpected cached range")
+
+	// Too big ranges are not cached.
+	cache.SetChunksRange(id, 0, 16000, []byte{1, 2, 3, 4, 5, 6})
+	_, ok = cache.ChunksRange(id, 0, 16000)
+	testutil.Assert(t, !ok, "unexpected cached range")
+
+	testutil.Equals(t, float64(2), promtest.ToFloat64(cache.current.WithLabelValues(cacheTypeChunks)))
+	testutil.Equals(t, float64(1), promtest.ToFloat64(cache.overflow.WithLabelValues(cacheTypeChunks)))
+	testutil.Equals(t, float64(2), promtest.ToFloat64(cache.hits.WithLabelValues(cacheTypeChunks)))
+}
@@ -2,27 +2,71 @@ package store
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/prometheus/pkg/gate"
 )
 
-// Gate wraps the Prometheus gate with extra metrics.
+// maxGateTenantLabels is the number of distinct tenants whose queue time is observed with their own tenant label.
+// The queue time of other tenants is observed with the otherTenantsLabel, so that the number of series is bounded.
+const (
+	maxGateTenantLabels = 32
+	otherTenantsLabel   = "other"
+)
+
+// Gate limits the number of concurrent queries, overall and per tenant. Queries waiting for their turn are queued per
+// tenant and tenants are served in round-robin order, so that a tenant sending many queries cannot starve the others.
 type Gate struct {
-	g               *gate.Gate
-	inflightQueries prometheus.Gauge
-	gateTiming      prometheus.Histogram
+	maxConcurrent          int
+	maxConcurrentPerTenant int
+
+	mtx      sync.Mutex
+	inflight int
+	tenants  map[string]*gateTenant
+	// waiting holds the tenants with queued queries in the order they are served.
+	waiting []*gateTenant
+
+	// tenantLabels holds the tenants observed with their own label in tenantGateTiming.
+	tenantLabels    map[string]struct{}
+	maxTenantLabels int
+
+	inflightQueries  prometheus.Gauge
+	queuedQueries    prometheus.Gauge
+	gateTiming       prometheus.Histogram
+	tenantGateTiming *prometheus.HistogramVec
+}
+
+type gateTenant struct {
+	name     string
+	inflight int
+	queue    []*gateWaiter
+}
+
+type gateWaiter struct {
+	ready   chan struct{}
+	granted bool
 }
 
-// NewGate returns a new query gate.
-func NewGate(maxConcurrent int, reg prometheus.Registerer) *Gate {
+// NewGate returns a new query gate. A maxConcurrentPerTenant of 0 or less only limits the overall concurrency.
+func NewGate(maxConcurrent, maxConcurrentPerTenant int, reg prometheus.Registerer) *Gate {
+	if maxConcurrentPerTenant <= 0 || maxConcurrentPerTenant > maxConcurrent {
+		maxConcurrentPerTenant = maxConcurrent
+	}
 	g := &Gate{
-		g: gate.New(maxConcurrent),
+		maxConcurrent:          maxConcurrent,
+		maxConcurrentPerTenant: maxConcurrentPerTenant,
+		tenants:                map[string]*gateTenant{},
+		tenantLabels:           map[string]struct{}{},
+		maxTenantLabels:        maxGateTenantLabels,
 		inflightQueries: prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "gate_queries_in_flight",
 			Help: "Number of queries that are currently in flight.",
 		}),
+		queuedQueries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gate_queries_queued",
+			Help: "Number of queries that are currently waiting at the gate.",
+		}),
 		gateTiming: prometheus.NewHistogram(prometheus.HistogramOpts{
 			Name: "gate_duration_seconds",
 			Help: "How many seconds it took for queries to wait at the gate.",
@@ -30,32 +74,167 @@ func NewGate(maxConcurrent int, reg prometheus.Registerer) *Gate {
 				0.01, 0.05, 0.1, 0.25, 0.6, 1, 2, 3.5, 5, 10,
 			},
 		}),
+		tenantGateTiming: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "gate_tenant_duration_seconds",
+			Help: "How many seconds it took for queries of each tenant to wait at the gate.",
+			Buckets: []float64{
+				0.01, 0.05, 0.1, 0.25, 0.6, 1, 2, 3.5, 5, 10,
+			},
+		}, []string{"tenant"}),
 	}
 
 	if reg != nil {
-		reg.MustRegister(g.inflightQueries, g.gateTiming)
+		reg.MustRegister(g.inflightQueries, g.queuedQueries, g.gateTiming, g.tenantGateTiming)
 	}
 
 	return g
 }
 
-// IsMyTurn iniates a new query and waits until it's our turn to fulfill a query request.
-func (g *Gate) IsMyTurn(ctx context.Context) error {
+// IsMyTurn iniates a new query of the tenant and waits until it's our turn to fulfill a query request.
+// Every successful call must be followed by a call to Done with the same tenant.
+func (g *Gate) IsMyTurn(ctx context.Context, tenant string) error {
 	start := time.Now()
 	defer func() {
-		g.gateTiming.Observe(float64(time.Since(start)))
+		d := time.Since(start).Seconds()
+		g.gateTiming.Observe(d)
+		g.tenantGateTiming.WithLabelValues(g.tenantLabel(tenant)).Observe(d)
 	}()
 
-	if err := g.g.Start(ctx); err != nil {
-		return err
+	g.mtx.Lock()
+	t, ok := g.tenants[tenant]
+	if !ok {
+		t = &gateTenant{name: tenant}
+		g.tenants[tenant] = t
+	}
+	// Queries of other tenants are only waiting if they cannot be started, so we do not skip them by starting
+	// right away.
+	if len(t.queue) == 0 && g.canStart(t) {
+		g.start(t)
+		g.mtx.Unlock()
+		return nil
+	}
+
+	w := &gateWaiter{ready: make(chan struct{})}
+	if len(t.queue) == 0 {
+		g.waiting = append(g.waiting, t)
+	}
+	t.queue = append(t.queue, w)
+	g.queuedQueries.Inc()
+	g.mtx.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if w.granted {
+		// We got our turn concurrently with the cancellation, hand it over to the next query.
+		g.done(t)
+		return ctx.Err()
+	}
+	for i, qw := range t.queue {
+		if qw == w {
+			t.queue = append(t.queue[:i], t.queue[i+1:]...)
+			break
+		}
+	}
+	g.queuedQueries.Dec()
+	if len(t.queue) == 0 {
+		g.removeWaiting(t)
+	}
+	g.cleanup(t)
+	return ctx.Err()
+}
+
+// Done finishes a query of the tenant.
+func (g *Gate) Done(tenant string) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.done(g.tenants[tenant])
+}
+
+// tenantLabel returns the label of the tenant in tenantGateTiming. The first maxTenantLabels tenants get their own
+// label, all others share the otherTenantsLabel.
+func (g *Gate) tenantLabel(tenant string) string {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	if _, ok := g.tenantLabels[tenant]; ok {
+		return tenant
+	}
+	if len(g.tenantLabels) >= g.maxTenantLabels {
+		return otherTenantsLabel
 	}
+	g.tenantLabels[tenant] = struct{}{}
+	return tenant
+}
 
+func (g *Gate) canStart(t *gateTenant) bool {
+	return g.inflight < g.maxConcurrent && t.inflight < g.maxConcurrentPerTenant
+}
+
+func (g *Gate) start(t *gateTenant) {
+	g.inflight++
+	t.inflight++
 	g.inflightQueries.Inc()
-	return nil
 }
 
-// Done finishes a query.
-func (g *Gate) Done() {
+func (g *Gate) done(t *gateTenant) {
+	g.inflight--
+	t.inflight--
 	g.inflightQueries.Dec()
-	g.g.Done()
+
+	g.dispatch()
+	g.cleanup(t)
+}
+
+// dispatch starts queued queries while there is capacity, taking one query of each tenant in turn.
+func (g *Gate) dispatch() {
+	for g.inflight < g.maxConcurrent {
+		i := 0
+		for ; i < len(g.waiting); i++ {
+			if g.canStart(g.waiting[i]) {
+				break
+			}
+		}
+		if i == len(g.waiting) {
+			return
+		}
+
+		t := g.waiting[i]
+		w := t.queue[0]
+		t.queue = t.queue[1:]
+		g.queuedQueries.Dec()
+
+		// Move the tenant to the back of the line.
+		g.waiting = append(g.waiting[:i], g.waiting[i+1:]...)
+		if len(t.queue) > 0 {
+			g.waiting = append(g.waiting, t)
+		}
+
+		g.start(t)
+		w.granted = true
+		close(w.ready)
+	}
+}
+
+func (g *Gate) removeWaiting(t *gateTenant) {
+	for i, wt := range g.waiting {
+		if wt == t {
+			g.waiting = append(g.waiting[:i], g.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// cleanup forgets tenants without queries, so that their state does not accumulate.
+func (g *Gate) cleanup(t *gateTenant) {
+	if t.inflight == 0 && len(t.queue) == 0 {
+		delete(g.tenants, t.name)
+	}
 }
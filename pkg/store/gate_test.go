@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestGate_PerTenantLimit(t *testing.T) {
+	ctx := context.Background()
+	g := NewGate(3, 2, nil)
+
+	testutil.Ok(t, g.IsMyTurn(ctx, "a"))
+	testutil.Ok(t, g.IsMyTurn(ctx, "a"))
+
+	// Tenant a is at its limit, while others can still start.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	testutil.NotOk(t, g.IsMyTurn(timeoutCtx, "a"))
+	testutil.Equals(t, float64(0), promtest.ToFloat64(g.queuedQueries))
+
+	testutil.Ok(t, g.IsMyTurn(ctx, "b"))
+	testutil.Equals(t, float64(3), promtest.ToFloat64(g.inflightQueries))
+
+	g.Done("a")
+	g.Done("a")
+	g.Done("b")
+	testutil.Equals(t, float64(0), promtest.ToFloat64(g.inflightQueries))
+	testutil.Equals(t, 0, len(g.tenants))
+}
+
+func TestGate_FairQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	g := NewGate(1, 0, nil)
+	testutil.Ok(t, g.IsMyTurn(ctx, "a"))
+
+	// Tenant a queues many queries before tenant b queues one.
+	started := make(chan string)
+	queue := func(tenant string) {
+		want := queued(g) + 1
+		go func() {
+			if err := g.IsMyTurn(ctx, tenant); err != nil {
+				return
+			}
+			started <- tenant
+		}()
+		// Wait for the query to be queued, to have a deterministic order.
+		for queued(g) != want {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		queue("a")
+	}
+	queue("b")
+	testutil.Equals(t, float64(4), promtest.ToFloat64(g.queuedQueries))
+
+	var order []string
+	tenant := "a"
+	for i := 0; i < 4; i++ {
+		g.Done(tenant)
+		tenant = <-started
+		order = append(order, tenant)
+	}
+	g.Done(tenant)
+
+	testutil.Equals(t, []string{"a", "b", "a", "a"}, order)
+	testutil.Equals(t, float64(0), promtest.ToFloat64(g.inflightQueries))
+	testutil.Equals(t, float64(0), promtest.ToFloat64(g.queuedQueries))
+	testutil.Equals(t, 0, len(g.tenants))
+}
+
+func TestGate_TenantTiming(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	g := NewGate(1, 0, nil)
+	g.maxTenantLabels = 2
+
+	testutil.Ok(t, g.IsMyTurn(ctx, "a"))
+
+	// Tenant b waits at the gate until tenant a is done.
+	started := make(chan error)
+	go func() { started <- g.IsMyTurn(ctx, "b") }()
+	for queued(g) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	g.Done("a")
+	testutil.Ok(t, <-started)
+	g.Done("b")
+
+	// Tenants beyond the limit share a label.
+	for _, tenant := range []string{"c", "d"} {
+		testutil.Ok(t, g.IsMyTurn(ctx, tenant))
+		g.Done(tenant)
+	}
+
+	count, sum := tenantTiming(t, g, "a")
+	testutil.Equals(t, uint64(1), count)
+	testutil.Assert(t, sum < 0.1, "expected tenant a not to wait, waited %vs", sum)
+
+	count, sum = tenantTiming(t, g, "b")
+	testutil.Equals(t, uint64(1), count)
+	testutil.Assert(t, sum >= 0.1, "expected tenant b to wait at least 0.1s, waited %vs", sum)
+
+	count, _ = tenantTiming(t, g, otherTenantsLabel)
+	testutil.Equals(t, uint64(2), count)
+	count, _ = tenantTiming(t, g, "c")
+	testutil.Equals(t, uint64(0), count)
+}
+
+// tenantTiming returns the sample count and sum of the queue time of the tenant label.
+func tenantTiming(t *testing.T, g *Gate, tenant string) (uint64, float64) {
+	m := &dto.Metric{}
+	testutil.Ok(t, g.tenantGateTiming.WithLabelValues(tenant).(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func queued(g *Gate) int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	n := 0
+	for _, t := range g.tenants {
+		n += len(t.queue)
+	}
+	return n
+}
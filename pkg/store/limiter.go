@@ -1,8 +1,12 @@
 package store
 
 import (
+	"sync/atomic"
+
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Limiter is a simple mechanism for checking if something has passed a certain threshold.
@@ -18,14 +22,36 @@ func NewLimiter(limit uint64, ctr prometheus.Counter) *Limiter {
 	return &Limiter{limit: limit, failedCounter: ctr}
 }
 
-// Check checks if the passed number exceeds the limits or not.
+// Check checks if the passed number exceeds the limits or not. Violations are returned as gRPC ResourceExhausted errors.
 func (l *Limiter) Check(num uint64) error {
 	if l.limit == 0 {
 		return nil
 	}
 	if num > l.limit {
 		l.failedCounter.Inc()
-		return errors.Errorf("limit %v violated (got %v)", l.limit, num)
+		return status.Error(codes.ResourceExhausted, errors.Errorf("limit %v violated (got %v)", l.limit, num).Error())
 	}
 	return nil
 }
+
+// limitCounter accumulates a quantity across all blocks queried by a single Series call and checks the total
+// against a Limiter.
+type limitCounter struct {
+	limiter *Limiter
+	n       uint64
+}
+
+func newLimitCounter(l *Limiter) *limitCounter {
+	return &limitCounter{limiter: l}
+}
+
+// Add adds n to the total and checks it against the limit.
+func (c *limitCounter) Add(n uint64) error {
+	return c.limiter.Check(atomic.AddUint64(&c.n, n))
+}
+
+// isResourceExhausted returns true if the error was caused by a violated limit.
+func isResourceExhausted(err error) bool {
+	st, ok := status.FromError(errors.Cause(err))
+	return ok && st.Code() == codes.ResourceExhausted
+}
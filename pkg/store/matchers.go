@@ -1,6 +1,11 @@
 package store
 
 import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
 	"github.com/pkg/errors"
 	"github.com/prometheus/tsdb/labels"
 	"github.com/thanos-io/thanos/pkg/store/storepb"
@@ -15,10 +20,10 @@ func translateMatcher(m storepb.LabelMatcher) (labels.Matcher, error) {
 		return labels.Not(labels.NewEqualMatcher(m.Name, m.Value)), nil
 
 	case storepb.LabelMatcher_RE:
-		return labels.NewRegexpMatcher(m.Name, "^(?:"+m.Value+")$")
+		return newRegexMatcher(m.Name, m.Value)
 
 	case storepb.LabelMatcher_NRE:
-		m, err := labels.NewRegexpMatcher(m.Name, "^(?:"+m.Value+")$")
+		m, err := newRegexMatcher(m.Name, m.Value)
 		if err != nil {
 			return nil, err
 		}
@@ -37,3 +42,169 @@ func translateMatchers(ms []storepb.LabelMatcher) (res []labels.Matcher, err err
 	}
 	return res, nil
 }
+
+// maxSetMatches is the maximum number of values a regex is expanded to, to look them up directly in the index.
+const maxSetMatches = 256
+
+// regexMatcher is a labels.Matcher of a fully anchored regex. It analyses the regex, so that values are matched
+// without running it where possible and alternations of literals, like "a|b|c", are looked up directly in the index
+// instead of matching all values of the label.
+type regexMatcher struct {
+	name string
+	re   *regexp.Regexp
+
+	// setMatches are all values matched by the regex, if it only matches a few literals.
+	setMatches []string
+
+	// prefix and suffix are literals all matched values start and end with.
+	prefix, suffix string
+	// anyInfix is true if the regex matches all values with the prefix and suffix, like "foo.*bar".
+	anyInfix bool
+	// infixNewline is true if the regex matches a newline between the prefix and suffix.
+	infixNewline bool
+}
+
+func newRegexMatcher(name, pattern string) (*regexMatcher, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+	m := &regexMatcher{name: name, re: re}
+
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	parsed = parsed.Simplify()
+
+	if vals, ok := findSetMatches(parsed); ok {
+		m.setMatches = vals
+		return m, nil
+	}
+	m.prefix, m.suffix, m.anyInfix, m.infixNewline = findPrefixSuffix(parsed)
+	return m, nil
+}
+
+func (m *regexMatcher) Name() string { return m.name }
+
+func (m *regexMatcher) Matches(v string) bool {
+	if m.setMatches != nil {
+		for _, s := range m.setMatches {
+			if s == v {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(v) < len(m.prefix)+len(m.suffix) || !strings.HasPrefix(v, m.prefix) || !strings.HasSuffix(v, m.suffix) {
+		return false
+	}
+	if m.anyInfix {
+		return m.infixNewline || !strings.Contains(v[len(m.prefix):len(v)-len(m.suffix)], "\n")
+	}
+	return m.re.MatchString(v)
+}
+
+func (m *regexMatcher) String() string { return fmt.Sprintf("%s=~%q", m.name, m.re.String()) }
+
+// findSetMatches returns all values matched by the regex, if it only matches up to maxSetMatches literals.
+func findSetMatches(re *syntax.Regexp) ([]string, bool) {
+	switch re.Op {
+	case syntax.OpEmptyMatch:
+		return []string{""}, true
+
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		return []string{string(re.Rune)}, true
+
+	case syntax.OpCharClass:
+		var vals []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(vals) == maxSetMatches {
+					return nil, false
+				}
+				vals = append(vals, string(r))
+			}
+		}
+		return vals, true
+
+	case syntax.OpCapture:
+		return findSetMatches(re.Sub[0])
+
+	case syntax.OpQuest:
+		vals, ok := findSetMatches(re.Sub[0])
+		if !ok || len(vals) == maxSetMatches {
+			return nil, false
+		}
+		return append(vals, ""), true
+
+	case syntax.OpAlternate:
+		var vals []string
+		for _, sub := range re.Sub {
+			subVals, ok := findSetMatches(sub)
+			if !ok || len(vals)+len(subVals) > maxSetMatches {
+				return nil, false
+			}
+			vals = append(vals, subVals...)
+		}
+		return vals, true
+
+	case syntax.OpConcat:
+		vals := []string{""}
+		for _, sub := range re.Sub {
+			subVals, ok := findSetMatches(sub)
+			if !ok || len(vals)*len(subVals) > maxSetMatches {
+				return nil, false
+			}
+			concat := make([]string, 0, len(vals)*len(subVals))
+			for _, v := range vals {
+				for _, s := range subVals {
+					concat = append(concat, v+s)
+				}
+			}
+			vals = concat
+		}
+		return vals, true
+	}
+	return nil, false
+}
+
+// findPrefixSuffix returns the literals all values matched by the regex start and end with, and whether it matches
+// any value in between, like "foo.*bar".
+func findPrefixSuffix(re *syntax.Regexp) (prefix, suffix string, anyInfix, infixNewline bool) {
+	for re.Op == syntax.OpCapture {
+		re = re.Sub[0]
+	}
+
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+
+	if len(subs) > 0 && isCaseSensitiveLiteral(subs[0]) {
+		prefix = string(subs[0].Rune)
+		subs = subs[1:]
+	}
+	if len(subs) > 0 && isCaseSensitiveLiteral(subs[len(subs)-1]) {
+		suffix = string(subs[len(subs)-1].Rune)
+		subs = subs[:len(subs)-1]
+	}
+
+	if len(subs) == 1 && subs[0].Op == syntax.OpStar {
+		switch subs[0].Sub[0].Op {
+		case syntax.OpAnyChar:
+			return prefix, suffix, true, true
+		case syntax.OpAnyCharNotNL:
+			return prefix, suffix, true, false
+		}
+	}
+	return prefix, suffix, false, false
+}
+
+func isCaseSensitiveLiteral(re *syntax.Regexp) bool {
+	return re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0
+}
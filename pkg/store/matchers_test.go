@@ -0,0 +1,70 @@
+package store
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestRegexMatcher(t *testing.T) {
+	values := []string{
+		"", "a", "b", "c", "ab", "abc", "abd", "foo", "foobar", "foo\\nbar", "foo\nbar", "barfoo", "FOO", "Foo",
+		"api_v1", "api_v2", "api_v10", "xyz", "ä", "äb",
+	}
+
+	for _, tcase := range []struct {
+		pattern    string
+		setMatches []string
+		prefix     string
+		suffix     string
+		anyInfix   bool
+	}{
+		{pattern: "", setMatches: []string{""}},
+		{pattern: "a", setMatches: []string{"a"}},
+		{pattern: "a|b|c", setMatches: []string{"a", "b", "c"}},
+		{pattern: "foo|foobar", setMatches: []string{"foo", "foobar"}},
+		{pattern: "ab[cd]", setMatches: []string{"abc", "abd"}},
+		{pattern: "api_v(1|2)", setMatches: []string{"api_v1", "api_v2"}},
+		{pattern: "ab?", setMatches: []string{"ab", "a"}},
+		{pattern: "ä|äb", setMatches: []string{"ä", "äb"}},
+		{pattern: "(?i)foo"},
+		{pattern: "[^a]"},
+		{pattern: ".*", anyInfix: true},
+		{pattern: "(?s).*", anyInfix: true},
+		{pattern: ".+"},
+		{pattern: "foo.*", prefix: "foo", anyInfix: true},
+		{pattern: ".*foo", suffix: "foo", anyInfix: true},
+		{pattern: "foo.*bar", prefix: "foo", suffix: "bar", anyInfix: true},
+		{pattern: "(?s)foo.*bar", prefix: "foo", suffix: "bar", anyInfix: true},
+		{pattern: "api_v.+", prefix: "api_v"},
+		{pattern: "api_v[0-9]+", prefix: "api_v"},
+		{pattern: "a.*|foo"},
+		{pattern: "^foo.*"},
+	} {
+		t.Run(tcase.pattern, func(t *testing.T) {
+			m, err := newRegexMatcher("n", tcase.pattern)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.setMatches, m.setMatches)
+			testutil.Equals(t, tcase.prefix, m.prefix)
+			testutil.Equals(t, tcase.suffix, m.suffix)
+			testutil.Equals(t, tcase.anyInfix, m.anyInfix)
+
+			re := regexp.MustCompile("^(?:" + tcase.pattern + ")$")
+			for _, v := range values {
+				testutil.Assert(t, re.MatchString(v) == m.Matches(v), "unexpected match result for %q", v)
+			}
+		})
+	}
+}
+
+func TestRegexMatcher_TooManySetMatches(t *testing.T) {
+	m, err := newRegexMatcher("n", "[a-z][a-z]")
+	testutil.Ok(t, err)
+	testutil.Assert(t, m.setMatches == nil, "expected no set matches for %d values", 26*26)
+	testutil.Assert(t, m.Matches("ab"), "expected match")
+	testutil.Assert(t, !m.Matches("abc"), "unexpected match")
+
+	_, err = newRegexMatcher("n", "a(")
+	testutil.NotOk(t, err)
+}
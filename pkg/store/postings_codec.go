@@ -0,0 +1,117 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/tsdb/encoding"
+	"github.com/prometheus/tsdb/index"
+)
+
+// This file implements encoding and decoding of postings stored in the index cache.
+//
+// Postings in the TSDB index are stored as a 4 byte length followed by big-endian uint32 series references, which
+// is wasteful for the sorted references of large postings lists. In the cache, they are stored as the deltas between
+// consecutive references encoded as uvarints and compressed with snappy, prefixed with a short header identifying
+// the encoding.
+
+// Header used to identify diff+varint+snappy encoded postings.
+const codecHeaderSnappy = "dvs"
+
+// isDiffVarintSnappyEncodedPostings returns true if the input looks like it has been encoded by diff+varint+snappy
+// codec. Raw postings from the index start with their big-endian 4 byte length, which would have to exceed 1.6 billion
+// entries to match the header.
+func isDiffVarintSnappyEncodedPostings(input []byte) bool {
+	return bytes.HasPrefix(input, []byte(codecHeaderSnappy))
+}
+
+// diffVarintSnappyEncode encodes the raw postings list, as stored in the index, with the diff+varint+snappy codec.
+func diffVarintSnappyEncode(raw []byte) ([]byte, error) {
+	if len(raw) < 4 {
+		return nil, errors.Errorf("postings too short: %d bytes", len(raw))
+	}
+	n := binary.BigEndian.Uint32(raw)
+	raw = raw[4:]
+	if uint64(len(raw)) < 4*uint64(n) {
+		return nil, errors.Errorf("postings of %d entries truncated to %d bytes", n, len(raw))
+	}
+
+	buf := encoding.Encbuf{B: make([]byte, 0, n)}
+	prev := uint32(0)
+	for i := uint32(0); i < n; i++ {
+		v := binary.BigEndian.Uint32(raw[4*i:])
+		if v < prev {
+			return nil, errors.Errorf("postings entries not in order: %d after %d", v, prev)
+		}
+		buf.PutUvarint32(v - prev)
+		prev = v
+	}
+
+	out := make([]byte, len(codecHeaderSnappy)+snappy.MaxEncodedLen(buf.Len()))
+	copy(out, codecHeaderSnappy)
+	compressed := snappy.Encode(out[len(codecHeaderSnappy):], buf.Get())
+
+	// Trim the output to the actually used space.
+	return out[:len(codecHeaderSnappy)+len(compressed)], nil
+}
+
+// diffVarintSnappyDecode decodes postings encoded with diffVarintSnappyEncode.
+func diffVarintSnappyDecode(input []byte) (index.Postings, error) {
+	if !isDiffVarintSnappyEncodedPostings(input) {
+		return nil, errors.New("header not found")
+	}
+
+	raw, err := snappy.Decode(nil, input[len(codecHeaderSnappy):])
+	if err != nil {
+		return nil, errors.Wrap(err, "snappy decode")
+	}
+	return newDiffVarintPostings(raw), nil
+}
+
+// diffVarintPostings is an index.Postings iterating over uvarint encoded deltas of series references.
+type diffVarintPostings struct {
+	buf *encoding.Decbuf
+	cur uint64
+}
+
+func newDiffVarintPostings(input []byte) *diffVarintPostings {
+	return &diffVarintPostings{buf: &encoding.Decbuf{B: input}}
+}
+
+func (it *diffVarintPostings) At() uint64 {
+	return it.cur
+}
+
+func (it *diffVarintPostings) Next() bool {
+	if it.buf.Err() != nil || it.buf.Len() == 0 {
+		return false
+	}
+
+	val := it.buf.Uvarint64()
+	if it.buf.Err() != nil {
+		return false
+	}
+
+	it.cur = it.cur + val
+	return true
+}
+
+func (it *diffVarintPostings) Seek(x uint64) bool {
+	if it.cur >= x {
+		return true
+	}
+
+	// We cannot do any search due to how values are stored, so we simply advance until we find the right value.
+	for it.Next() {
+		if it.At() >= x {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *diffVarintPostings) Err() error {
+	return it.buf.Err()
+}
@@ -0,0 +1,96 @@
+package store
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/prometheus/tsdb/index"
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func rawPostings(refs []uint64) []byte {
+	b := make([]byte, 4+4*len(refs))
+	binary.BigEndian.PutUint32(b, uint32(len(refs)))
+	for i, r := range refs {
+		binary.BigEndian.PutUint32(b[4+4*i:], uint32(r))
+	}
+	return b
+}
+
+func TestDiffVarintSnappyCodec(t *testing.T) {
+	var sparse []uint64
+	for r := uint64(0); len(sparse) < 1000; r += uint64(1 + rand.Intn(10000)) {
+		sparse = append(sparse, r)
+	}
+	var dense []uint64
+	for i := 0; i < 10000; i++ {
+		dense = append(dense, uint64(16*i))
+	}
+
+	for _, tcase := range []struct {
+		name string
+		refs []uint64
+	}{
+		{name: "empty"},
+		{name: "single", refs: []uint64{42}},
+		{name: "max ref", refs: []uint64{0, 1, math.MaxUint32}},
+		{name: "sparse", refs: sparse},
+		{name: "dense", refs: dense},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			raw := rawPostings(tcase.refs)
+			testutil.Assert(t, !isDiffVarintSnappyEncodedPostings(raw), "raw postings detected as encoded")
+
+			data, err := diffVarintSnappyEncode(raw)
+			testutil.Ok(t, err)
+			testutil.Assert(t, isDiffVarintSnappyEncodedPostings(data), "encoded postings not detected")
+			if len(tcase.refs) > 100 {
+				testutil.Assert(t, len(data) < len(raw)/2, "expected encoded postings of %d bytes to be less than half of %d raw bytes", len(data), len(raw))
+			}
+
+			p, err := diffVarintSnappyDecode(data)
+			testutil.Ok(t, err)
+			got, err := index.ExpandPostings(p)
+			testutil.Ok(t, err)
+			if len(tcase.refs) == 0 {
+				testutil.Equals(t, 0, len(got))
+				return
+			}
+			testutil.Equals(t, tcase.refs, got)
+
+			// Seek must behave as for the raw postings.
+			p, err = diffVarintSnappyDecode(data)
+			testutil.Ok(t, err)
+			mid := tcase.refs[len(tcase.refs)/2]
+			testutil.Assert(t, p.Seek(mid), "seek to existing value failed")
+			testutil.Equals(t, mid, p.At())
+			testutil.Assert(t, p.Seek(mid), "seek to current value failed")
+			testutil.Equals(t, mid, p.At())
+			testutil.Assert(t, !p.Seek(tcase.refs[len(tcase.refs)-1]+1), "seek past last value succeeded")
+			testutil.Ok(t, p.Err())
+		})
+	}
+}
+
+func TestDiffVarintSnappyCodec_Errors(t *testing.T) {
+	_, err := diffVarintSnappyEncode([]byte{0, 0})
+	testutil.NotOk(t, err)
+
+	// Length larger than the entries.
+	raw := rawPostings([]uint64{1, 2})
+	binary.BigEndian.PutUint32(raw, 3)
+	_, err = diffVarintSnappyEncode(raw)
+	testutil.NotOk(t, err)
+
+	// Unordered entries.
+	_, err = diffVarintSnappyEncode(rawPostings([]uint64{2, 1}))
+	testutil.NotOk(t, err)
+
+	_, err = diffVarintSnappyDecode(rawPostings([]uint64{1, 2}))
+	testutil.NotOk(t, err)
+
+	_, err = diffVarintSnappyDecode([]byte(codecHeaderSnappy + "not snappy"))
+	testutil.NotOk(t, err)
+}
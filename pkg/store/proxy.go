@@ -36,6 +36,10 @@ type Client interface {
 	// Minimum and maximum time range of data in the store.
 	TimeRange() (mint int64, maxt int64)
 
+	// Resolutions returns the downsampling resolutions in milliseconds of data in the store.
+	// Empty if the store may have data of any resolution.
+	Resolutions() []int64
+
 	String() string
 	// Addr returns address of a Client.
 	Addr() string
@@ -227,6 +231,7 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 			// NOTE: all matchers are validated in matchesExternalLabels method so we explicitly ignore error.
 			spanStoreMathes, gctx := tracing.StartSpan(gctx, "store_matches")
 			ok, _ := storeMatches(st, r.MinTime, r.MaxTime, r.Matchers...)
+			ok = ok && storeMatchesResolution(st, r.MaxResolutionWindow)
 			spanStoreMathes.Finish()
 			if !ok {
 				storeDebugMsgs = append(storeDebugMsgs, fmt.Sprintf("store %s filtered out", st))
@@ -248,7 +253,7 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 					storeID = "Store Gateway"
 				}
 				err = errors.Wrapf(err, "fetch series for %s %s", storeID, st)
-				if r.PartialResponseDisabled {
+				if r.PartialResponseDisabled || isResourceExhausted(err) {
 					level.Error(s.logger).Log("err", err, "msg", "partial response disabled; aborting request")
 					return err
 				}
@@ -288,6 +293,9 @@ func (s *ProxyStore) Series(r *storepb.SeriesRequest, srv storepb.Store_SeriesSe
 
 	if err := g.Wait(); err != nil {
 		level.Error(s.logger).Log("err", err)
+		if isResourceExhausted(err) {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
 		return err
 	}
 	return nil
@@ -356,7 +364,9 @@ func startStreamSeriesSet(
 
 			if err != nil {
 				wrapErr := errors.Wrapf(err, "receive series from %s", s.name)
-				if partialResponse {
+				// Violated limits of the store always fail the request, as a partial response would silently miss
+				// all data of the store.
+				if partialResponse && !isResourceExhausted(err) {
 					s.warnCh.send(storepb.NewWarnSeriesResponse(wrapErr))
 					return
 				}
@@ -441,6 +451,21 @@ func storeMatches(s Client, mint, maxt int64, matchers ...storepb.LabelMatcher)
 	return labelSetsMatch(s.LabelSets(), matchers)
 }
 
+// storeMatchesResolution returns false if all resolutions of the store are coarser than the maximum resolution window,
+// so that the store has no data usable for the request.
+func storeMatchesResolution(s Client, maxResolutionWindow int64) bool {
+	res := s.Resolutions()
+	if len(res) == 0 {
+		return true
+	}
+	for _, r := range res {
+		if r <= maxResolutionWindow {
+			return true
+		}
+	}
+	return false
+}
+
 // labelSetsMatch returns false if all label-set do not match the matchers.
 func labelSetsMatch(lss []storepb.LabelSet, matchers []storepb.LabelMatcher) (bool, error) {
 	if len(lss) == 0 {
@@ -27,9 +27,10 @@ type testClient struct {
 	// Just to pass interface check.
 	storepb.StoreClient
 
-	labelSets []storepb.LabelSet
-	minTime   int64
-	maxTime   int64
+	labelSets   []storepb.LabelSet
+	minTime     int64
+	maxTime     int64
+	resolutions []int64
 }
 
 func (c *testClient) LabelSets() []storepb.LabelSet {
@@ -40,6 +41,10 @@ func (c *testClient) TimeRange() (int64, int64) {
 	return c.minTime, c.maxTime
 }
 
+func (c *testClient) Resolutions() []int64 {
+	return c.resolutions
+}
+
 func (c *testClient) String() string {
 	return "test"
 }
@@ -202,6 +207,57 @@ func TestProxyStore_Series(t *testing.T) {
 				Matchers: []storepb.LabelMatcher{{Name: "ext", Value: "1", Type: storepb.LabelMatcher_EQ}},
 			},
 		},
+		{
+			title: "storeAPIs available for time range; only stores with a resolution within max resolution window are queried",
+			storeAPIs: []Client{
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storeSeriesResponse(t, labels.FromStrings("a", "raw"), []sample{{0, 0}, {2, 1}, {3, 2}}),
+						},
+					},
+					minTime:     1,
+					maxTime:     300,
+					resolutions: []int64{0},
+				},
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storeSeriesResponse(t, labels.FromStrings("a", "5m"), []sample{{0, 0}, {2, 1}, {3, 2}}),
+						},
+					},
+					minTime:     1,
+					maxTime:     300,
+					resolutions: []int64{5 * 60 * 1000, 60 * 60 * 1000},
+				},
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storeSeriesResponse(t, labels.FromStrings("a", "1h"), []sample{{0, 0}, {2, 1}, {3, 2}}),
+						},
+					},
+					minTime:     1,
+					maxTime:     300,
+					resolutions: []int64{60 * 60 * 1000},
+				},
+			},
+			req: &storepb.SeriesRequest{
+				MinTime:             1,
+				MaxTime:             300,
+				Matchers:            []storepb.LabelMatcher{{Name: "a", Value: ".*", Type: storepb.LabelMatcher_RE}},
+				MaxResolutionWindow: 10 * 60 * 1000,
+			},
+			expectedSeries: []rawSeries{
+				{
+					lset:    []storepb.Label{{Name: "a", Value: "5m"}},
+					samples: []sample{{0, 0}, {2, 1}, {3, 2}},
+				},
+				{
+					lset:    []storepb.Label{{Name: "a", Value: "raw"}},
+					samples: []sample{{0, 0}, {2, 1}, {3, 2}},
+				},
+			},
+		},
 		{
 			title: "no validation if storeAPI follow matching contract",
 			storeAPIs: []Client{
@@ -404,6 +460,35 @@ func TestProxyStore_Series(t *testing.T) {
 			},
 			expectedErr: errors.New("fetch series for [name:\"ext\" value:\"1\" ] test: error!"),
 		},
+		{
+			title: "partial response enabled, but store limit exceeded",
+			storeAPIs: []Client{
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespSeries: []*storepb.SeriesResponse{
+							storeSeriesResponse(t, labels.FromStrings("a", "b"), []sample{{1, 1}, {2, 2}, {3, 3}}),
+						},
+					},
+					labelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "1"}}}},
+					minTime:   1,
+					maxTime:   300,
+				},
+				&testClient{
+					StoreClient: &mockedStoreAPI{
+						RespError: status.Error(codes.ResourceExhausted, "exceeded series limit"),
+					},
+					labelSets: []storepb.LabelSet{{Labels: []storepb.Label{{Name: "ext", Value: "1"}}}},
+					minTime:   1,
+					maxTime:   300,
+				},
+			},
+			req: &storepb.SeriesRequest{
+				MinTime:  1,
+				MaxTime:  300,
+				Matchers: []storepb.LabelMatcher{{Name: "ext", Value: "1", Type: storepb.LabelMatcher_EQ}},
+			},
+			expectedErr: status.Error(codes.ResourceExhausted, "fetch series for [name:\"ext\" value:\"1\" ] test: rpc error: code = ResourceExhausted desc = exceeded series limit"),
+		},
 	} {
 
 		if ok := t.Run(tc.title, func(t *testing.T) {
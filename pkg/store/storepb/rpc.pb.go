@@ -11,6 +11,7 @@ import (
 
 	_ "github.com/gogo/protobuf/gogoproto"
 	proto "github.com/gogo/protobuf/proto"
+	prompb "github.com/thanos-io/thanos/pkg/store/prompb"
 	grpc "google.golang.org/grpc"
 )
 
@@ -105,6 +106,7 @@ const (
 	Aggr_MIN     Aggr = 3
 	Aggr_MAX     Aggr = 4
 	Aggr_COUNTER Aggr = 5
+	Aggr_LAST    Aggr = 6
 )
 
 var Aggr_name = map[int32]string{
@@ -114,6 +116,7 @@ var Aggr_name = map[int32]string{
 	3: "MIN",
 	4: "MAX",
 	5: "COUNTER",
+	6: "LAST",
 }
 
 var Aggr_value = map[string]int32{
@@ -123,6 +126,7 @@ var Aggr_value = map[string]int32{
 	"MIN":     3,
 	"MAX":     4,
 	"COUNTER": 5,
+	"LAST":    6,
 }
 
 func (x Aggr) String() string {
@@ -179,10 +183,13 @@ type InfoResponse struct {
 	MaxTime   int64     `protobuf:"varint,3,opt,name=max_time,json=maxTime,proto3" json:"max_time,omitempty"`
 	StoreType StoreType `protobuf:"varint,4,opt,name=storeType,proto3,enum=thanos.StoreType" json:"storeType,omitempty"`
 	// label_sets is an unsorted list of `LabelSet`s.
-	LabelSets            []LabelSet `protobuf:"bytes,5,rep,name=label_sets,json=labelSets,proto3" json:"label_sets"`
-	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
-	XXX_unrecognized     []byte     `json:"-"`
-	XXX_sizecache        int32      `json:"-"`
+	LabelSets []LabelSet `protobuf:"bytes,5,rep,name=label_sets,json=labelSets,proto3" json:"label_sets"`
+	// resolutions are the downsampling resolutions in milliseconds of the data served by the store.
+	// Empty if the store may serve data of any resolution.
+	Resolutions          []int64  `protobuf:"varint,6,rep,packed,name=resolutions,proto3" json:"resolutions,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
 }
 
 func (m *InfoResponse) Reset()         { *m = InfoResponse{} }
@@ -623,6 +630,87 @@ func (m *LabelValuesResponse) XXX_DiscardUnknown() {
 
 var xxx_messageInfo_LabelValuesResponse proto.InternalMessageInfo
 
+type WriteResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WriteResponse) Reset()         { *m = WriteResponse{} }
+func (m *WriteResponse) String() string { return proto.CompactTextString(m) }
+func (*WriteResponse) ProtoMessage()    {}
+func (*WriteResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{9}
+}
+func (m *WriteResponse) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *WriteResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_WriteResponse.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *WriteResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WriteResponse.Merge(m, src)
+}
+func (m *WriteResponse) XXX_Size() int {
+	return m.Size()
+}
+func (m *WriteResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_WriteResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WriteResponse proto.InternalMessageInfo
+
+type WriteRequest struct {
+	Timeseries           []prompb.TimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3" json:"timeseries"`
+	Tenant               string              `protobuf:"bytes,2,opt,name=tenant,proto3" json:"tenant,omitempty"`
+	Replica              int64               `protobuf:"varint,3,opt,name=replica,proto3" json:"replica,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}            `json:"-"`
+	XXX_unrecognized     []byte              `json:"-"`
+	XXX_sizecache        int32               `json:"-"`
+}
+
+func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
+func (m *WriteRequest) String() string { return proto.CompactTextString(m) }
+func (*WriteRequest) ProtoMessage()    {}
+func (*WriteRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_77a6da22d6a3feb1, []int{10}
+}
+func (m *WriteRequest) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *WriteRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_WriteRequest.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalTo(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *WriteRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WriteRequest.Merge(m, src)
+}
+func (m *WriteRequest) XXX_Size() int {
+	return m.Size()
+}
+func (m *WriteRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WriteRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WriteRequest proto.InternalMessageInfo
+
 func init() {
 	proto.RegisterEnum("thanos.StoreType", StoreType_name, StoreType_value)
 	proto.RegisterEnum("thanos.PartialResponseStrategy", PartialResponseStrategy_name, PartialResponseStrategy_value)
@@ -636,61 +724,70 @@ func init() {
 	proto.RegisterType((*LabelNamesResponse)(nil), "thanos.LabelNamesResponse")
 	proto.RegisterType((*LabelValuesRequest)(nil), "thanos.LabelValuesRequest")
 	proto.RegisterType((*LabelValuesResponse)(nil), "thanos.LabelValuesResponse")
+	proto.RegisterType((*WriteResponse)(nil), "thanos.WriteResponse")
+	proto.RegisterType((*WriteRequest)(nil), "thanos.WriteRequest")
 }
 
 func init() { proto.RegisterFile("rpc.proto", fileDescriptor_77a6da22d6a3feb1) }
 
 var fileDescriptor_77a6da22d6a3feb1 = []byte{
-	// 772 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x55, 0x4f, 0x6f, 0xfa, 0x46,
-	0x10, 0x65, 0x6d, 0x30, 0x78, 0x48, 0x90, 0xb3, 0x21, 0x89, 0x71, 0x25, 0x82, 0x38, 0xa1, 0xb4,
-	0x22, 0x2d, 0x55, 0x5b, 0xb5, 0x37, 0x20, 0x8e, 0x82, 0x9a, 0x40, 0xbb, 0x40, 0xe8, 0x9f, 0x03,
-	0x35, 0xc9, 0xd6, 0xb1, 0x64, 0x6c, 0xea, 0x35, 0x4d, 0x72, 0xed, 0xe7, 0xe9, 0xb7, 0xe8, 0x25,
-	0xc7, 0x5e, 0x7b, 0xa9, 0xda, 0x7c, 0x8a, 0x1e, 0x2b, 0xaf, 0xd7, 0x80, 0xdb, 0x24, 0xd2, 0x4f,
-	0xdc, 0x76, 0xde, 0x1b, 0xcf, 0xec, 0x7b, 0x3b, 0xbb, 0x06, 0x35, 0x58, 0xdc, 0x34, 0x17, 0x81,
-	0x1f, 0xfa, 0x58, 0x09, 0xef, 0x2c, 0xcf, 0x67, 0x46, 0x31, 0x7c, 0x5c, 0x50, 0x16, 0x83, 0x46,
-	0xd9, 0xf6, 0x6d, 0x9f, 0x2f, 0x4f, 0xa3, 0x55, 0x8c, 0xd6, 0x77, 0xa1, 0xd8, 0xf3, 0x7e, 0xf4,
-	0x09, 0xfd, 0x69, 0x49, 0x59, 0x58, 0xff, 0x03, 0xc1, 0x4e, 0x1c, 0xb3, 0x85, 0xef, 0x31, 0x8a,
-	0xdf, 0x07, 0xc5, 0xb5, 0x66, 0xd4, 0x65, 0x3a, 0xaa, 0xc9, 0x8d, 0x62, 0x6b, 0xb7, 0x19, 0xd7,
-	0x6e, 0x5e, 0x46, 0x68, 0x27, 0xfb, 0xf4, 0xe7, 0x71, 0x86, 0x88, 0x14, 0x5c, 0x81, 0xc2, 0xdc,
-	0xf1, 0xa6, 0xa1, 0x33, 0xa7, 0xba, 0x54, 0x43, 0x0d, 0x99, 0xe4, 0xe7, 0x8e, 0x37, 0x72, 0xe6,
-	0x94, 0x53, 0xd6, 0x43, 0x4c, 0xc9, 0x82, 0xb2, 0x1e, 0x38, 0x75, 0x0a, 0x2a, 0x0b, 0xfd, 0x80,
-	0x8e, 0x1e, 0x17, 0x54, 0xcf, 0xd6, 0x50, 0xa3, 0xd4, 0xda, 0x4b, 0xba, 0x0c, 0x13, 0x82, 0xac,
-	0x73, 0xf0, 0x27, 0x00, 0xbc, 0xe1, 0x94, 0xd1, 0x90, 0xe9, 0x39, 0xbe, 0x2f, 0x2d, 0xb5, 0xaf,
-	0x21, 0x0d, 0xc5, 0xd6, 0x54, 0x57, 0xc4, 0xac, 0xfe, 0x19, 0x14, 0x12, 0xf2, 0x9d, 0x64, 0xd5,
-	0xff, 0x91, 0x60, 0x77, 0x48, 0x03, 0x87, 0x32, 0x61, 0x53, 0x4a, 0x28, 0x7a, 0x5d, 0xa8, 0x94,
-	0x16, 0xfa, 0x69, 0x44, 0x85, 0x37, 0x77, 0x34, 0x60, 0xba, 0xcc, 0xdb, 0x96, 0x53, 0x6d, 0xaf,
-	0x62, 0x52, 0x74, 0x5f, 0xe5, 0xe2, 0x16, 0x1c, 0x44, 0x25, 0x03, 0xca, 0x7c, 0x77, 0x19, 0x3a,
-	0xbe, 0x37, 0xbd, 0x77, 0xbc, 0x5b, 0xff, 0x9e, 0x9b, 0x25, 0x93, 0xfd, 0xb9, 0xf5, 0x40, 0x56,
-	0xdc, 0x84, 0x53, 0xf8, 0x03, 0x00, 0xcb, 0xb6, 0x03, 0x6a, 0x5b, 0x21, 0x8d, 0x3d, 0x2a, 0xb5,
-	0x76, 0x92, 0x6e, 0x6d, 0xdb, 0x0e, 0xc8, 0x06, 0x8f, 0xbf, 0x80, 0xca, 0xc2, 0x0a, 0x42, 0xc7,
-	0x72, 0xa3, 0x2e, 0xfc, 0xe4, 0xa7, 0xb7, 0x0e, 0xb3, 0x66, 0x2e, 0xbd, 0xd5, 0x95, 0x1a, 0x6a,
-	0x14, 0xc8, 0x91, 0x48, 0x48, 0x26, 0xe3, 0x4c, 0xd0, 0xf8, 0xfb, 0x17, 0xbe, 0x65, 0x61, 0x60,
-	0x85, 0xd4, 0x7e, 0xd4, 0xf3, 0xfc, 0x38, 0x8f, 0x93, 0xc6, 0x5f, 0xa5, 0x6b, 0x0c, 0x45, 0xda,
-	0xff, 0x8a, 0x27, 0x44, 0xfd, 0x07, 0x28, 0x25, 0xce, 0x8b, 0x81, 0x6c, 0x80, 0xc2, 0x38, 0xc2,
-	0x8d, 0x2f, 0xb6, 0x4a, 0xab, 0x51, 0xe1, 0xe8, 0x45, 0x86, 0x08, 0x1e, 0x1b, 0x90, 0xbf, 0xb7,
-	0x02, 0xcf, 0xf1, 0x6c, 0x7e, 0x10, 0xea, 0x45, 0x86, 0x24, 0x40, 0xa7, 0x00, 0x4a, 0x40, 0xd9,
-	0xd2, 0x0d, 0xeb, 0xbf, 0x22, 0xd8, 0xe3, 0xee, 0xf7, 0xad, 0xf9, 0xfa, 0x80, 0xdf, 0x34, 0x04,
-	0x6d, 0x61, 0x88, 0xb4, 0xa5, 0x21, 0xe7, 0x80, 0x37, 0x77, 0x2b, 0x4c, 0x29, 0x43, 0xce, 0x8b,
-	0x00, 0x3e, 0xcd, 0x2a, 0x89, 0x03, 0x6c, 0x40, 0x41, 0xe8, 0x65, 0xba, 0xc4, 0x89, 0x55, 0x5c,
-	0xff, 0x0d, 0x89, 0x42, 0xd7, 0x96, 0xbb, 0x5c, 0xeb, 0x2e, 0x43, 0x8e, 0x0f, 0x3d, 0xd7, 0xa8,
-	0x92, 0x38, 0x78, 0xdb, 0x0d, 0x69, 0x0b, 0x37, 0xe4, 0x2d, 0xdd, 0xe8, 0xc1, 0x7e, 0x4a, 0x84,
-	0xb0, 0xe3, 0x10, 0x94, 0x9f, 0x39, 0x22, 0xfc, 0x10, 0xd1, 0x5b, 0x86, 0x9c, 0x10, 0x50, 0x57,
-	0x8f, 0x0d, 0x2e, 0x42, 0x7e, 0xdc, 0xff, 0xb2, 0x3f, 0x98, 0xf4, 0xb5, 0x0c, 0x56, 0x21, 0xf7,
-	0xf5, 0xd8, 0x24, 0xdf, 0x6a, 0x08, 0x17, 0x20, 0x4b, 0xc6, 0x97, 0xa6, 0x26, 0x45, 0x19, 0xc3,
-	0xde, 0x99, 0xd9, 0x6d, 0x13, 0x4d, 0x8e, 0x32, 0x86, 0xa3, 0x01, 0x31, 0xb5, 0x6c, 0x84, 0x13,
-	0xb3, 0x6b, 0xf6, 0xae, 0x4d, 0x2d, 0x77, 0xd2, 0x84, 0xa3, 0x57, 0x24, 0x45, 0x95, 0x26, 0x6d,
-	0x22, 0xca, 0xb7, 0x3b, 0x03, 0x32, 0xd2, 0xd0, 0x49, 0x07, 0xb2, 0xd1, 0xd5, 0xc4, 0x79, 0x90,
-	0x49, 0x7b, 0x12, 0x73, 0xdd, 0xc1, 0xb8, 0x3f, 0xd2, 0x50, 0x84, 0x0d, 0xc7, 0x57, 0x9a, 0x14,
-	0x2d, 0xae, 0x7a, 0x7d, 0x4d, 0xe6, 0x8b, 0xf6, 0x37, 0x71, 0x4f, 0x9e, 0x65, 0x12, 0x2d, 0xd7,
-	0xfa, 0x45, 0x82, 0x1c, 0x17, 0x82, 0x3f, 0x82, 0x6c, 0xf4, 0x94, 0xe3, 0xfd, 0xc4, 0xde, 0x8d,
-	0x87, 0xde, 0x28, 0xa7, 0x41, 0x61, 0xdc, 0xe7, 0xa0, 0xc4, 0xd7, 0x08, 0x1f, 0xa4, 0xaf, 0x55,
-	0xf2, 0xd9, 0xe1, 0x7f, 0xe1, 0xf8, 0xc3, 0x0f, 0x11, 0xee, 0x02, 0xac, 0x07, 0x13, 0x57, 0x52,
-	0x0f, 0xdb, 0xe6, 0xd5, 0x32, 0x8c, 0x97, 0x28, 0xd1, 0xff, 0x1c, 0x8a, 0x1b, 0xe7, 0x89, 0xd3,
-	0xa9, 0xa9, 0x49, 0x35, 0xde, 0x7b, 0x91, 0x8b, 0xeb, 0x74, 0x2a, 0x4f, 0x7f, 0x57, 0x33, 0x4f,
-	0xcf, 0x55, 0xf4, 0xfb, 0x73, 0x15, 0xfd, 0xf5, 0x5c, 0x45, 0xdf, 0xe5, 0xf9, 0xef, 0x63, 0x31,
-	0x9b, 0x29, 0xfc, 0xbf, 0xf7, 0xf1, 0xbf, 0x01, 0x00, 0x00, 0xff, 0xff, 0xe8, 0xcb, 0x18, 0x01,
-	0x2f, 0x07, 0x00, 0x00,
+	// 894 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x56, 0x4f, 0x6f, 0xe3, 0x44,
+	0x14, 0x8f, 0xed, 0xc4, 0x49, 0x5e, 0xda, 0xe0, 0x9d, 0xa6, 0x5d, 0xd7, 0x48, 0xdd, 0x28, 0xa7,
+	0xa8, 0xa0, 0x2c, 0x04, 0x01, 0x62, 0xc5, 0x25, 0xed, 0x66, 0xb5, 0x11, 0x69, 0x0a, 0x93, 0x64,
+	0xc3, 0x9f, 0x43, 0x70, 0xdb, 0xc1, 0xb5, 0xe4, 0xd8, 0x61, 0x66, 0x42, 0xdb, 0x0b, 0x07, 0x3e,
+	0x0f, 0xdf, 0x82, 0x4b, 0x8f, 0x7c, 0x02, 0x04, 0xfd, 0x14, 0x48, 0x5c, 0xd0, 0xfc, 0x71, 0x12,
+	0x2f, 0x6d, 0x25, 0x94, 0x9b, 0xdf, 0xef, 0xf7, 0xe6, 0xbd, 0x79, 0xbf, 0x79, 0x6f, 0xc6, 0x50,
+	0xa6, 0xf3, 0xf3, 0xd6, 0x9c, 0x26, 0x3c, 0x41, 0x36, 0xbf, 0xf4, 0xe3, 0x84, 0x79, 0x15, 0x7e,
+	0x33, 0x27, 0x4c, 0x81, 0x5e, 0x2d, 0x48, 0x82, 0x44, 0x7e, 0x3e, 0x17, 0x5f, 0x1a, 0xdd, 0xa2,
+	0x64, 0x96, 0x70, 0xa2, 0xac, 0xc6, 0x36, 0x54, 0x7a, 0xf1, 0x0f, 0x09, 0x26, 0x3f, 0x2e, 0x08,
+	0xe3, 0x8d, 0x7f, 0x0c, 0xd8, 0x52, 0x36, 0x9b, 0x27, 0x31, 0x23, 0xe8, 0x3d, 0xb0, 0x23, 0xff,
+	0x8c, 0x44, 0xcc, 0x35, 0xea, 0x56, 0xb3, 0xd2, 0xde, 0x6e, 0xa9, 0x4c, 0xad, 0xbe, 0x40, 0x8f,
+	0xf2, 0xb7, 0x7f, 0x3c, 0xcb, 0x61, 0xed, 0x82, 0xf6, 0xa1, 0x34, 0x0b, 0xe3, 0x29, 0x0f, 0x67,
+	0xc4, 0x35, 0xeb, 0x46, 0xd3, 0xc2, 0xc5, 0x59, 0x18, 0x8f, 0xc2, 0x19, 0x91, 0x94, 0x7f, 0xad,
+	0x28, 0x4b, 0x53, 0xfe, 0xb5, 0xa4, 0x9e, 0x43, 0x99, 0xf1, 0x84, 0x92, 0xd1, 0xcd, 0x9c, 0xb8,
+	0xf9, 0xba, 0xd1, 0xac, 0xb6, 0x9f, 0xa4, 0x59, 0x86, 0x29, 0x81, 0x57, 0x3e, 0xe8, 0x63, 0x00,
+	0x99, 0x70, 0xca, 0x08, 0x67, 0x6e, 0x41, 0xee, 0xcb, 0xc9, 0xec, 0x6b, 0x48, 0xb8, 0xde, 0x5a,
+	0x39, 0xd2, 0x36, 0x43, 0x75, 0xa8, 0x50, 0xc2, 0x92, 0x68, 0xc1, 0xc3, 0x24, 0x66, 0xae, 0x5d,
+	0xb7, 0x9a, 0x16, 0x5e, 0x87, 0x1a, 0x9f, 0x42, 0x29, 0x5d, 0xfe, 0xbf, 0x0a, 0x6f, 0xfc, 0x6d,
+	0xc2, 0xf6, 0x90, 0xd0, 0x90, 0x30, 0x2d, 0x64, 0x46, 0x0a, 0xe3, 0x61, 0x29, 0xcc, 0xac, 0x14,
+	0x9f, 0x08, 0x8a, 0x9f, 0x5f, 0x12, 0xca, 0x5c, 0x4b, 0xa6, 0xad, 0x65, 0xd2, 0x9e, 0x28, 0x52,
+	0x67, 0x5f, 0xfa, 0xa2, 0x36, 0xec, 0x8a, 0x90, 0xab, 0x5a, 0xa6, 0x57, 0x61, 0x7c, 0x91, 0x5c,
+	0x49, 0x39, 0x2d, 0xbc, 0x33, 0xf3, 0xaf, 0xf1, 0x92, 0x9b, 0x48, 0x0a, 0xbd, 0x0f, 0xe0, 0x07,
+	0x01, 0x25, 0x81, 0xcf, 0x89, 0x52, 0xb1, 0xda, 0xde, 0x4a, 0xb3, 0x75, 0x82, 0x80, 0xe2, 0x35,
+	0x1e, 0xbd, 0x80, 0xfd, 0xb9, 0x4f, 0x79, 0xe8, 0x47, 0x53, 0xaa, 0x7b, 0x63, 0x7a, 0x11, 0x32,
+	0xff, 0x2c, 0x22, 0x17, 0xae, 0x5d, 0x37, 0x9a, 0x25, 0xfc, 0x54, 0x3b, 0xa4, 0xbd, 0xf3, 0x52,
+	0xd3, 0xe8, 0xbb, 0x7b, 0xd6, 0x32, 0x4e, 0x7d, 0x4e, 0x82, 0x1b, 0xb7, 0x28, 0x0f, 0xfc, 0x59,
+	0x9a, 0xf8, 0xcb, 0x6c, 0x8c, 0xa1, 0x76, 0xfb, 0x4f, 0xf0, 0x94, 0x68, 0x7c, 0x0f, 0xd5, 0x54,
+	0x79, 0xc5, 0xa0, 0x26, 0xd8, 0x4c, 0x22, 0x52, 0xf8, 0x4a, 0xbb, 0xba, 0x6c, 0x26, 0x89, 0xbe,
+	0xce, 0x61, 0xcd, 0x23, 0x0f, 0x8a, 0x57, 0x3e, 0x8d, 0xc3, 0x38, 0x90, 0x07, 0x51, 0x7e, 0x9d,
+	0xc3, 0x29, 0x70, 0x54, 0x02, 0x9b, 0x12, 0xb6, 0x88, 0x78, 0xe3, 0x57, 0x03, 0x9e, 0x48, 0xf5,
+	0x07, 0xfe, 0x6c, 0x75, 0xc0, 0x8f, 0x0a, 0x62, 0x6c, 0x20, 0x88, 0xb9, 0xa1, 0x20, 0xaf, 0x00,
+	0xad, 0xef, 0x56, 0x8b, 0x52, 0x83, 0x42, 0x2c, 0x00, 0xd9, 0xcd, 0x65, 0xac, 0x0c, 0xe4, 0x41,
+	0x49, 0xd7, 0xcb, 0x5c, 0x53, 0x12, 0x4b, 0xbb, 0xf1, 0x9b, 0xa1, 0x03, 0xbd, 0xf1, 0xa3, 0xc5,
+	0xaa, 0xee, 0x1a, 0x14, 0x64, 0xd3, 0xcb, 0x1a, 0xcb, 0x58, 0x19, 0x8f, 0xab, 0x61, 0x6e, 0xa0,
+	0x86, 0xb5, 0xa1, 0x1a, 0x3d, 0xd8, 0xc9, 0x14, 0xa1, 0xe5, 0xd8, 0x03, 0xfb, 0x27, 0x89, 0x68,
+	0x3d, 0xb4, 0xf5, 0xa8, 0x20, 0xef, 0xc0, 0xf6, 0x84, 0x86, 0x9c, 0xa4, 0x41, 0x1a, 0x3f, 0xc3,
+	0x96, 0x06, 0x94, 0x34, 0x9f, 0x03, 0x88, 0xa1, 0x5e, 0x36, 0x9f, 0x98, 0xdf, 0x3d, 0x71, 0xcf,
+	0xce, 0x08, 0xbf, 0x24, 0x0b, 0xd6, 0x12, 0x33, 0xae, 0x9a, 0x50, 0x4f, 0xf0, 0x9a, 0xbf, 0xd8,
+	0x12, 0x27, 0xb1, 0x1f, 0x73, 0xd5, 0x8b, 0x58, 0x5b, 0xc8, 0x85, 0x22, 0x25, 0xf3, 0x28, 0x3c,
+	0xf7, 0xd3, 0x8b, 0x53, 0x9b, 0x87, 0x18, 0xca, 0xcb, 0xfb, 0x11, 0x55, 0xa0, 0x38, 0x1e, 0x7c,
+	0x31, 0x38, 0x9d, 0x0c, 0x9c, 0x1c, 0x2a, 0x43, 0xe1, 0xab, 0x71, 0x17, 0x7f, 0xe3, 0x18, 0xa8,
+	0x04, 0x79, 0x3c, 0xee, 0x77, 0x1d, 0x53, 0x78, 0x0c, 0x7b, 0x2f, 0xbb, 0xc7, 0x1d, 0xec, 0x58,
+	0xc2, 0x63, 0x38, 0x3a, 0xc5, 0x5d, 0x27, 0x2f, 0x70, 0xdc, 0x3d, 0xee, 0xf6, 0xde, 0x74, 0x9d,
+	0xc2, 0x61, 0x0b, 0x9e, 0x3e, 0xa0, 0xb1, 0x88, 0x34, 0xe9, 0x60, 0x1d, 0xbe, 0x73, 0x74, 0x8a,
+	0x47, 0x8e, 0x71, 0xd8, 0x87, 0xbc, 0xb8, 0x2b, 0x50, 0x11, 0x2c, 0xdc, 0x99, 0x28, 0xee, 0xf8,
+	0x74, 0x3c, 0x18, 0x39, 0x86, 0xc0, 0x86, 0xe3, 0x13, 0xc7, 0x14, 0x1f, 0x27, 0xbd, 0x81, 0x63,
+	0xc9, 0x8f, 0xce, 0xd7, 0x2a, 0xa7, 0xf4, 0xea, 0x62, 0xa7, 0x20, 0x02, 0xf7, 0x3b, 0xc3, 0x91,
+	0x63, 0xb7, 0x7f, 0x31, 0xa1, 0x20, 0x4b, 0x42, 0x1f, 0x42, 0x5e, 0xbc, 0x43, 0x68, 0x27, 0x3d,
+	0xf9, 0xb5, 0x57, 0xca, 0xab, 0x65, 0x41, 0x7d, 0xa6, 0x9f, 0x81, 0xad, 0xc4, 0x45, 0xbb, 0xd9,
+	0x89, 0x4f, 0x97, 0xed, 0xbd, 0x0d, 0xab, 0x85, 0x1f, 0x18, 0xe8, 0x18, 0x60, 0x35, 0x33, 0x68,
+	0x3f, 0x73, 0xe7, 0xae, 0x4f, 0xbd, 0xe7, 0xdd, 0x47, 0xe9, 0xfc, 0xaf, 0xa0, 0xb2, 0xd6, 0x6a,
+	0x28, 0xeb, 0x9a, 0x19, 0x22, 0xef, 0xdd, 0x7b, 0x39, 0x15, 0xa7, 0xdd, 0x87, 0xaa, 0x6c, 0x2b,
+	0x31, 0x1d, 0x4a, 0x8c, 0x17, 0x50, 0xc1, 0xf2, 0xd1, 0x96, 0x38, 0x5a, 0x96, 0xbf, 0xde, 0x7d,
+	0xde, 0xee, 0x5b, 0xa8, 0x8a, 0x76, 0xb4, 0x7f, 0xfb, 0xd7, 0x41, 0xee, 0xf6, 0xee, 0xc0, 0xf8,
+	0xfd, 0xee, 0xc0, 0xf8, 0xf3, 0xee, 0xc0, 0xf8, 0xb6, 0x28, 0x5f, 0xd2, 0xf9, 0xd9, 0x99, 0x2d,
+	0x7f, 0x01, 0x3e, 0xfa, 0x77, 0x00, 0x2d, 0x76, 0xff, 0xa2, 0x48, 0x08, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -904,6 +1001,72 @@ var _Store_serviceDesc = grpc.ServiceDesc{
 	Metadata: "rpc.proto",
 }
 
+// WriteableStoreClient is the client API for WriteableStore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type WriteableStoreClient interface {
+	/// RemoteWrite writes the given time series for the given tenant.
+	RemoteWrite(ctx context.Context, in *WriteRequest, opts ...grpc.CallOption) (*WriteResponse, error)
+}
+
+type writeableStoreClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewWriteableStoreClient(cc *grpc.ClientConn) WriteableStoreClient {
+	return &writeableStoreClient{cc}
+}
+
+func (c *writeableStoreClient) RemoteWrite(ctx context.Context, in *WriteRequest, opts ...grpc.CallOption) (*WriteResponse, error) {
+	out := new(WriteResponse)
+	err := c.cc.Invoke(ctx, "/thanos.WriteableStore/RemoteWrite", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WriteableStoreServer is the server API for WriteableStore service.
+type WriteableStoreServer interface {
+	/// RemoteWrite writes the given time series for the given tenant.
+	RemoteWrite(context.Context, *WriteRequest) (*WriteResponse, error)
+}
+
+func RegisterWriteableStoreServer(s *grpc.Server, srv WriteableStoreServer) {
+	s.RegisterService(&_WriteableStore_serviceDesc, srv)
+}
+
+func _WriteableStore_RemoteWrite_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WriteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WriteableStoreServer).RemoteWrite(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/thanos.WriteableStore/RemoteWrite",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WriteableStoreServer).RemoteWrite(ctx, req.(*WriteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _WriteableStore_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "thanos.WriteableStore",
+	HandlerType: (*WriteableStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RemoteWrite",
+			Handler:    _WriteableStore_RemoteWrite_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "rpc.proto",
+}
+
 func (m *InfoRequest) Marshal() (dAtA []byte, err error) {
 	size := m.Size()
 	dAtA = make([]byte, size)
@@ -979,6 +1142,24 @@ func (m *InfoResponse) MarshalTo(dAtA []byte) (int, error) {
 			i += n
 		}
 	}
+	if len(m.Resolutions) > 0 {
+		dAtA2 := make([]byte, len(m.Resolutions)*10)
+		var j1 int
+		for _, num1 := range m.Resolutions {
+			num := uint64(num1)
+			for num >= 1<<7 {
+				dAtA2[j1] = uint8(uint64(num)&0x7f | 0x80)
+				num >>= 7
+				j1++
+			}
+			dAtA2[j1] = uint8(num)
+			j1++
+		}
+		dAtA[i] = 0x32
+		i++
+		i = encodeVarintRpc(dAtA, i, uint64(j1))
+		i += copy(dAtA[i:], dAtA2[:j1])
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(dAtA[i:], m.XXX_unrecognized)
 	}
@@ -1061,21 +1242,21 @@ func (m *SeriesRequest) MarshalTo(dAtA []byte) (int, error) {
 		i = encodeVarintRpc(dAtA, i, uint64(m.MaxResolutionWindow))
 	}
 	if len(m.Aggregates) > 0 {
-		dAtA2 := make([]byte, len(m.Aggregates)*10)
-		var j1 int
+		dAtA4 := make([]byte, len(m.Aggregates)*10)
+		var j3 int
 		for _, num := range m.Aggregates {
 			for num >= 1<<7 {
-				dAtA2[j1] = uint8(uint64(num)&0x7f | 0x80)
+				dAtA4[j3] = uint8(uint64(num)&0x7f | 0x80)
 				num >>= 7
-				j1++
+				j3++
 			}
-			dAtA2[j1] = uint8(num)
-			j1++
+			dAtA4[j3] = uint8(num)
+			j3++
 		}
 		dAtA[i] = 0x2a
 		i++
-		i = encodeVarintRpc(dAtA, i, uint64(j1))
-		i += copy(dAtA[i:], dAtA2[:j1])
+		i = encodeVarintRpc(dAtA, i, uint64(j3))
+		i += copy(dAtA[i:], dAtA4[:j3])
 	}
 	if m.PartialResponseDisabled {
 		dAtA[i] = 0x30
@@ -1328,6 +1509,71 @@ func (m *LabelValuesResponse) MarshalTo(dAtA []byte) (int, error) {
 	return i, nil
 }
 
+func (m *WriteResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *WriteResponse) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		i += copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
+func (m *WriteRequest) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalTo(dAtA)
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *WriteRequest) MarshalTo(dAtA []byte) (int, error) {
+	var i int
+	_ = i
+	var l int
+	_ = l
+	if len(m.Timeseries) > 0 {
+		for _, msg := range m.Timeseries {
+			dAtA[i] = 0xa
+			i++
+			i = encodeVarintRpc(dAtA, i, uint64(msg.Size()))
+			n, err := msg.MarshalTo(dAtA[i:])
+			if err != nil {
+				return 0, err
+			}
+			i += n
+		}
+	}
+	if len(m.Tenant) > 0 {
+		dAtA[i] = 0x12
+		i++
+		i = encodeVarintRpc(dAtA, i, uint64(len(m.Tenant)))
+		i += copy(dAtA[i:], m.Tenant)
+	}
+	if m.Replica != 0 {
+		dAtA[i] = 0x18
+		i++
+		i = encodeVarintRpc(dAtA, i, uint64(m.Replica))
+	}
+	if m.XXX_unrecognized != nil {
+		i += copy(dAtA[i:], m.XXX_unrecognized)
+	}
+	return i, nil
+}
+
 func encodeVarintRpc(dAtA []byte, offset int, v uint64) int {
 	for v >= 1<<7 {
 		dAtA[offset] = uint8(v&0x7f | 0x80)
@@ -1376,6 +1622,13 @@ func (m *InfoResponse) Size() (n int) {
 			n += 1 + l + sovRpc(uint64(l))
 		}
 	}
+	if len(m.Resolutions) > 0 {
+		l = 0
+		for _, e := range m.Resolutions {
+			l += sovRpc(uint64(e))
+		}
+		n += 1 + sovRpc(uint64(l)) + l
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1565,6 +1818,43 @@ func (m *LabelValuesResponse) Size() (n int) {
 	return n
 }
 
+func (m *WriteResponse) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
+func (m *WriteRequest) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if len(m.Timeseries) > 0 {
+		for _, e := range m.Timeseries {
+			l = e.Size()
+			n += 1 + l + sovRpc(uint64(l))
+		}
+	}
+	l = len(m.Tenant)
+	if l > 0 {
+		n += 1 + l + sovRpc(uint64(l))
+	}
+	if m.Replica != 0 {
+		n += 1 + sovRpc(uint64(m.Replica))
+	}
+	if m.XXX_unrecognized != nil {
+		n += len(m.XXX_unrecognized)
+	}
+	return n
+}
+
 func sovRpc(x uint64) (n int) {
 	for {
 		n++
@@ -1786,6 +2076,82 @@ func (m *InfoResponse) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 6:
+			if wireType == 0 {
+				var v int64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowRpc
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					v |= int64(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				m.Resolutions = append(m.Resolutions, v)
+			} else if wireType == 2 {
+				var packedLen int
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowRpc
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					packedLen |= int(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				if packedLen < 0 {
+					return ErrInvalidLengthRpc
+				}
+				postIndex := iNdEx + packedLen
+				if postIndex < 0 {
+					return ErrInvalidLengthRpc
+				}
+				if postIndex > l {
+					return io.ErrUnexpectedEOF
+				}
+				var elementCount int
+				var count int
+				for _, integer := range dAtA[iNdEx:postIndex] {
+					if integer < 128 {
+						count++
+					}
+				}
+				elementCount = count
+				if elementCount != 0 && len(m.Resolutions) == 0 {
+					m.Resolutions = make([]int64, 0, elementCount)
+				}
+				for iNdEx < postIndex {
+					var v int64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowRpc
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						v |= int64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					m.Resolutions = append(m.Resolutions, v)
+				}
+			} else {
+				return fmt.Errorf("proto: wrong wireType = %d for field Resolutions", wireType)
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRpc(dAtA[iNdEx:])
@@ -2727,6 +3093,199 @@ func (m *LabelValuesResponse) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *WriteResponse) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRpc
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: WriteResponse: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: WriteResponse: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRpc(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *WriteRequest) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRpc
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: WriteRequest: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: WriteRequest: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Timeseries", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Timeseries = append(m.Timeseries, prompb.TimeSeries{})
+			if err := m.Timeseries[len(m.Timeseries)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Tenant", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthRpc
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Tenant = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Replica", wireType)
+			}
+			m.Replica = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRpc
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Replica |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRpc(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthRpc
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.XXX_unrecognized = append(m.XXX_unrecognized, dAtA[iNdEx:iNdEx+skippy]...)
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipRpc(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
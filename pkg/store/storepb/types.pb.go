@@ -208,6 +208,7 @@ type AggrChunk struct {
 	Min                  *Chunk   `protobuf:"bytes,6,opt,name=min,proto3" json:"min,omitempty"`
 	Max                  *Chunk   `protobuf:"bytes,7,opt,name=max,proto3" json:"max,omitempty"`
 	Counter              *Chunk   `protobuf:"bytes,8,opt,name=counter,proto3" json:"counter,omitempty"`
+	Last                 *Chunk   `protobuf:"bytes,9,opt,name=last,proto3" json:"last,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -302,34 +303,35 @@ func init() {
 func init() { proto.RegisterFile("types.proto", fileDescriptor_d938547f84707355) }
 
 var fileDescriptor_d938547f84707355 = []byte{
-	// 432 bytes of a gzipped FileDescriptorProto
+	// 442 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x6c, 0x92, 0xdd, 0x6e, 0xd3, 0x30,
-	0x14, 0xc7, 0xeb, 0x7c, 0x76, 0x67, 0x03, 0x05, 0x33, 0x21, 0x97, 0x8b, 0xae, 0x0a, 0x17, 0x54,
-	0x20, 0x32, 0x31, 0x9e, 0x80, 0xa1, 0xdc, 0xf1, 0xa1, 0x99, 0x5d, 0x20, 0x84, 0x84, 0xdc, 0xce,
-	0xa4, 0x11, 0x8d, 0x5d, 0xc5, 0x0e, 0x74, 0x8f, 0x81, 0x78, 0xa9, 0x5e, 0xf2, 0x04, 0x08, 0xfa,
-	0x24, 0xc8, 0x27, 0x0d, 0x5b, 0xa5, 0xdc, 0x1d, 0x9f, 0xff, 0xef, 0x7c, 0xc8, 0xe7, 0x0f, 0x87,
-	0xf6, 0x7a, 0x25, 0x4d, 0xb6, 0xaa, 0xb5, 0xd5, 0x34, 0xb2, 0x0b, 0xa1, 0xb4, 0x79, 0x78, 0x5c,
-	0xe8, 0x42, 0x63, 0xea, 0xd4, 0x45, 0xad, 0x9a, 0x3e, 0x87, 0xf0, 0xb5, 0x98, 0xc9, 0x25, 0xa5,
-	0x10, 0x28, 0x51, 0x49, 0x46, 0x26, 0x64, 0x7a, 0xc0, 0x31, 0xa6, 0xc7, 0x10, 0x7e, 0x13, 0xcb,
-	0x46, 0x32, 0x0f, 0x93, 0xed, 0x23, 0xfd, 0x04, 0xe1, 0xab, 0x45, 0xa3, 0xbe, 0xd2, 0x27, 0x10,
-	0xb8, 0x41, 0x58, 0x72, 0xf7, 0xec, 0x41, 0xd6, 0x0e, 0xca, 0x50, 0xcc, 0x72, 0x35, 0xd7, 0x57,
-	0xa5, 0x2a, 0x38, 0x32, 0xae, 0xfd, 0x95, 0xb0, 0x02, 0x3b, 0x1d, 0x71, 0x8c, 0xd3, 0xfb, 0x30,
-	0xec, 0x28, 0x1a, 0x83, 0xff, 0xe1, 0x1d, 0x4f, 0x06, 0xe9, 0x17, 0x88, 0xde, 0xcb, 0xba, 0x94,
-	0x86, 0x3e, 0x85, 0x68, 0xe9, 0x56, 0x33, 0x8c, 0x4c, 0xfc, 0xe9, 0xe1, 0xd9, 0x9d, 0x6e, 0x00,
-	0x2e, 0x7c, 0x1e, 0x6c, 0x7e, 0x9f, 0x0c, 0xf8, 0x0e, 0xa1, 0xa7, 0x10, 0xcd, 0xdd, 0x5c, 0xc3,
-	0x3c, 0x84, 0xef, 0x75, 0xf0, 0xcb, 0xa2, 0xa8, 0x71, 0xa3, 0xae, 0xa0, 0xc5, 0xd2, 0x9f, 0x1e,
-	0x1c, 0xfc, 0xd7, 0xe8, 0x08, 0x86, 0x55, 0xa9, 0x3e, 0xdb, 0x72, 0xf7, 0x03, 0x3e, 0x8f, 0xab,
-	0x52, 0x5d, 0x96, 0x95, 0x44, 0x49, 0xac, 0x5b, 0xc9, 0xdb, 0x49, 0x62, 0x8d, 0xd2, 0x09, 0xf8,
-	0xb5, 0xf8, 0xce, 0xfc, 0x09, 0xb9, 0xbd, 0x1e, 0x76, 0xe4, 0x4e, 0xa1, 0x8f, 0x20, 0x9c, 0xeb,
-	0x46, 0x59, 0x16, 0xf4, 0x21, 0xad, 0xe6, 0xba, 0x98, 0xa6, 0x62, 0x61, 0x6f, 0x17, 0xd3, 0x54,
-	0x0e, 0xa8, 0x4a, 0xc5, 0xa2, 0x5e, 0xa0, 0x2a, 0x15, 0x02, 0x62, 0xcd, 0xe2, 0x7e, 0x40, 0xac,
-	0xe9, 0x63, 0x88, 0x71, 0x96, 0xac, 0xd9, 0xb0, 0x0f, 0xea, 0xd4, 0xf4, 0x07, 0x81, 0x23, 0xfc,
-	0xde, 0x37, 0xc2, 0xce, 0x17, 0xb2, 0xa6, 0xcf, 0xf6, 0x6e, 0x3c, 0xda, 0x3b, 0xc1, 0x8e, 0xc9,
-	0x2e, 0xaf, 0x57, 0xf2, 0xe6, 0xcc, 0xe8, 0x22, 0xaf, 0xcf, 0x45, 0xfe, 0x6d, 0x17, 0x4d, 0x21,
-	0x70, 0x75, 0x34, 0x02, 0x2f, 0xbf, 0x48, 0x06, 0xce, 0x00, 0x6f, 0xf3, 0x8b, 0x84, 0xb8, 0x04,
-	0xcf, 0x13, 0x0f, 0x13, 0x3c, 0x4f, 0xfc, 0xf3, 0xd1, 0xe6, 0xef, 0x78, 0xb0, 0xd9, 0x8e, 0xc9,
-	0xaf, 0xed, 0x98, 0xfc, 0xd9, 0x8e, 0xc9, 0xc7, 0xd8, 0x58, 0x5d, 0xcb, 0xd5, 0x6c, 0x16, 0xa1,
-	0x89, 0x5f, 0xfc, 0x0b, 0x00, 0x00, 0xff, 0xff, 0x46, 0x5a, 0xe2, 0x68, 0xf1, 0x02, 0x00, 0x00,
+	0x14, 0xc7, 0xeb, 0x7c, 0xb6, 0x67, 0x03, 0x05, 0x33, 0x21, 0x97, 0x8b, 0xae, 0x84, 0x0b, 0x2a,
+	0x10, 0x99, 0x18, 0x4f, 0xc0, 0x50, 0xee, 0xf8, 0xd0, 0xcc, 0x2e, 0x10, 0x42, 0x42, 0x6e, 0x67,
+	0xd2, 0x88, 0xc6, 0xa9, 0x62, 0x07, 0xba, 0xc7, 0xe0, 0x65, 0x78, 0x86, 0x5e, 0xf2, 0x04, 0x08,
+	0xfa, 0x24, 0xc8, 0x27, 0x09, 0xac, 0x5a, 0xee, 0x9c, 0xf3, 0xfb, 0xf9, 0x9c, 0xa3, 0xf8, 0x0f,
+	0x07, 0xe6, 0x6a, 0x2d, 0x75, 0xb2, 0xae, 0x4a, 0x53, 0xd2, 0xc0, 0x2c, 0x85, 0x2a, 0xf5, 0xfd,
+	0xa3, 0xac, 0xcc, 0x4a, 0x2c, 0x9d, 0xd8, 0x53, 0x43, 0xe3, 0x67, 0xe0, 0xbf, 0x12, 0x73, 0xb9,
+	0xa2, 0x14, 0x3c, 0x25, 0x0a, 0xc9, 0xc8, 0x94, 0xcc, 0x46, 0x1c, 0xcf, 0xf4, 0x08, 0xfc, 0xaf,
+	0x62, 0x55, 0x4b, 0xe6, 0x60, 0xb1, 0xf9, 0x88, 0x3f, 0x82, 0xff, 0x72, 0x59, 0xab, 0x2f, 0xf4,
+	0x31, 0x78, 0x76, 0x10, 0x5e, 0xb9, 0x7d, 0x7a, 0x2f, 0x69, 0x06, 0x25, 0x08, 0x93, 0x54, 0x2d,
+	0xca, 0xcb, 0x5c, 0x65, 0x1c, 0x1d, 0xdb, 0xfe, 0x52, 0x18, 0x81, 0x9d, 0x0e, 0x39, 0x9e, 0xe3,
+	0xbb, 0x30, 0xec, 0x2c, 0x1a, 0x82, 0xfb, 0xfe, 0x2d, 0x8f, 0x06, 0xf1, 0x67, 0x08, 0xde, 0xc9,
+	0x2a, 0x97, 0x9a, 0x3e, 0x81, 0x60, 0x65, 0x57, 0xd3, 0x8c, 0x4c, 0xdd, 0xd9, 0xc1, 0xe9, 0xad,
+	0x6e, 0x00, 0x2e, 0x7c, 0xe6, 0x6d, 0x7f, 0x1d, 0x0f, 0x78, 0xab, 0xd0, 0x13, 0x08, 0x16, 0x76,
+	0xae, 0x66, 0x0e, 0xca, 0x77, 0x3a, 0xf9, 0x45, 0x96, 0x55, 0xb8, 0x51, 0x77, 0xa1, 0xd1, 0xe2,
+	0x1f, 0x0e, 0x8c, 0xfe, 0x31, 0x3a, 0x86, 0x61, 0x91, 0xab, 0x4f, 0x26, 0x6f, 0xff, 0x80, 0xcb,
+	0xc3, 0x22, 0x57, 0x17, 0x79, 0x21, 0x11, 0x89, 0x4d, 0x83, 0x9c, 0x16, 0x89, 0x0d, 0xa2, 0x63,
+	0x70, 0x2b, 0xf1, 0x8d, 0xb9, 0x53, 0x72, 0x7d, 0x3d, 0xec, 0xc8, 0x2d, 0xa1, 0x0f, 0xc1, 0x5f,
+	0x94, 0xb5, 0x32, 0xcc, 0xeb, 0x53, 0x1a, 0x66, 0xbb, 0xe8, 0xba, 0x60, 0x7e, 0x6f, 0x17, 0x5d,
+	0x17, 0x56, 0x28, 0x72, 0xc5, 0x82, 0x5e, 0xa1, 0xc8, 0x15, 0x0a, 0x62, 0xc3, 0xc2, 0x7e, 0x41,
+	0x6c, 0xe8, 0x23, 0x08, 0x71, 0x96, 0xac, 0xd8, 0xb0, 0x4f, 0xea, 0x28, 0x7d, 0x00, 0xde, 0x4a,
+	0x68, 0xc3, 0x46, 0x7d, 0x16, 0xa2, 0xf8, 0x3b, 0x81, 0x43, 0x7c, 0x81, 0xd7, 0xc2, 0x2c, 0x96,
+	0xb2, 0xa2, 0x4f, 0xf7, 0x62, 0x30, 0xde, 0x7b, 0xa5, 0xd6, 0x49, 0x2e, 0xae, 0xd6, 0xf2, 0x7f,
+	0x12, 0x94, 0x68, 0xff, 0xe5, 0x8d, 0xa0, 0xb9, 0xd7, 0x83, 0x36, 0x03, 0xcf, 0xde, 0xa3, 0x01,
+	0x38, 0xe9, 0x79, 0x34, 0xb0, 0x19, 0x79, 0x93, 0x9e, 0x47, 0xc4, 0x16, 0x78, 0x1a, 0x39, 0x58,
+	0xe0, 0x69, 0xe4, 0x9e, 0x8d, 0xb7, 0x7f, 0x26, 0x83, 0xed, 0x6e, 0x42, 0x7e, 0xee, 0x26, 0xe4,
+	0xf7, 0x6e, 0x42, 0x3e, 0x84, 0xda, 0x94, 0x95, 0x5c, 0xcf, 0xe7, 0x01, 0xe6, 0xfc, 0xf9, 0xdf,
+	0x01, 0x00, 0xaf, 0x0d, 0x17, 0x4c, 0x14, 0x03, 0x00, 0x00,
 }
 
 func (m *Label) Marshal() (dAtA []byte, err error) {
@@ -527,6 +529,16 @@ func (m *AggrChunk) MarshalTo(dAtA []byte) (int, error) {
 		}
 		i += n6
 	}
+	if m.Last != nil {
+		dAtA[i] = 0x4a
+		i++
+		i = encodeVarintTypes(dAtA, i, uint64(m.Last.Size()))
+		n7, err := m.Last.MarshalTo(dAtA[i:])
+		if err != nil {
+			return 0, err
+		}
+		i += n7
+	}
 	if m.XXX_unrecognized != nil {
 		i += copy(dAtA[i:], m.XXX_unrecognized)
 	}
@@ -679,6 +691,10 @@ func (m *AggrChunk) Size() (n int) {
 		l = m.Counter.Size()
 		n += 1 + l + sovTypes(uint64(l))
 	}
+	if m.Last != nil {
+		l = m.Last.Size()
+		n += 1 + l + sovTypes(uint64(l))
+	}
 	if m.XXX_unrecognized != nil {
 		n += len(m.XXX_unrecognized)
 	}
@@ -1351,6 +1367,42 @@ func (m *AggrChunk) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 9:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Last", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowTypes
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthTypes
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthTypes
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Last == nil {
+				m.Last = &Chunk{}
+			}
+			if err := m.Last.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipTypes(dAtA[iNdEx:])
@@ -0,0 +1,74 @@
+// Package tenancy propagates the tenant of a request from the HTTP API of the querier to the StoreAPIs it queries.
+package tenancy
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// DefaultTenantHeader is the default HTTP header carrying the tenant of a request.
+	DefaultTenantHeader = "THANOS-TENANT"
+	// DefaultTenant is the tenant of requests without a tenant.
+	DefaultTenant = "default-tenant"
+
+	// MetadataKey is the gRPC metadata key carrying the tenant of a request.
+	MetadataKey = "thanos-tenant"
+)
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a new context carrying the given tenant.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// FromContext returns the tenant carried by the context, or by the incoming gRPC metadata of the context if none was
+// set explicitly, so that a querier queried over gRPC forwards the tenant of its own caller.
+// It returns DefaultTenant if the request has no tenant.
+func FromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok && tenant != "" {
+		return tenant
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get(MetadataKey); len(vals) > 0 && vals[0] != "" {
+			return vals[0]
+		}
+	}
+	return DefaultTenant
+}
+
+// HTTPMiddleware returns an HTTP handler attaching the tenant from the given header to the context of the request.
+func HTTPMiddleware(header string, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tenant := r.Header.Get(header); header != "" && tenant != "" {
+			r = r.WithContext(ContextWithTenant(r.Context(), tenant))
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func outgoingContext(ctx context.Context) context.Context {
+	tenant := FromContext(ctx)
+	if tenant == DefaultTenant {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, MetadataKey, tenant)
+}
+
+// UnaryClientInterceptor returns a new unary client interceptor sending the tenant of the context as gRPC metadata.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingContext(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor returns a new streaming client interceptor sending the tenant of the context as gRPC metadata.
+func StreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingContext(ctx), desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,45 @@
+package tenancy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestFromContext(t *testing.T) {
+	ctx := context.Background()
+	testutil.Equals(t, DefaultTenant, FromContext(ctx))
+
+	incoming := metadata.NewIncomingContext(ctx, metadata.Pairs(MetadataKey, "a"))
+	testutil.Equals(t, "a", FromContext(incoming))
+
+	// An explicitly set tenant takes precedence over the one of the caller.
+	testutil.Equals(t, "b", FromContext(ContextWithTenant(incoming, "b")))
+
+	// The tenant is sent to the next StoreAPI.
+	md, ok := metadata.FromOutgoingContext(outgoingContext(incoming))
+	testutil.Assert(t, ok, "expected outgoing metadata")
+	testutil.Equals(t, []string{"a"}, md.Get(MetadataKey))
+
+	_, ok = metadata.FromOutgoingContext(outgoingContext(ctx))
+	testutil.Assert(t, !ok, "unexpected outgoing metadata for default tenant")
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	var tenant string
+	h := HTTPMiddleware(DefaultTenantHeader, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = FromContext(r.Context())
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	testutil.Equals(t, DefaultTenant, tenant)
+
+	r.Header.Set(DefaultTenantHeader, "a")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	testutil.Equals(t, "a", tenant)
+}
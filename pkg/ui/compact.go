@@ -0,0 +1,38 @@
+package ui
+
+import (
+	"net/http"
+
+	"github.com/go-kit/kit/log"
+	"github.com/prometheus/common/route"
+	"github.com/thanos-io/thanos/pkg/compact"
+	extpromhttp "github.com/thanos-io/thanos/pkg/extprom/http"
+)
+
+// Compact is a web UI showing the compaction groups and the work the compactor still has to do.
+type Compact struct {
+	*BaseUI
+	progress *compact.ProgressCalculator
+}
+
+func NewCompactUI(logger log.Logger, progress *compact.ProgressCalculator) *Compact {
+	return &Compact{
+		BaseUI:   NewBaseUI(logger, "compact_menu.html", queryTmplFuncs()),
+		progress: progress,
+	}
+}
+
+// Register registers http routes for compact UI.
+func (c *Compact) Register(r *route.Router, ins extpromhttp.InstrumentationMiddleware) {
+	instrf := func(name string, next func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+		return ins.NewHandler(name, http.HandlerFunc(next))
+	}
+
+	r.Get("/", instrf("root", c.root))
+	r.Get("/static/*filepath", instrf("static", c.serveStaticAsset))
+}
+
+// Handle / of compact UI.
+func (c *Compact) root(w http.ResponseWriter, r *http.Request) {
+	c.executeTemplate(w, "compact.html", "", c.progress.Progress())
+}
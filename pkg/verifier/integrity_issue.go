@@ -0,0 +1,66 @@
+package verifier
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/thanos-io/thanos/pkg/block"
+	"github.com/thanos-io/thanos/pkg/objstore"
+)
+
+const FileIntegrityIssueID = "file_integrity"
+
+// FileIntegrityIssue checks the files of all blocks against their sizes and hashes recorded in meta.json.
+// Files are streamed from the bucket, so blocks are not downloaded to disk. Blocks without recorded files are skipped.
+// No repair is available for this issue.
+func FileIntegrityIssue(ctx context.Context, logger log.Logger, bkt objstore.Bucket, _ objstore.Bucket, repair bool, idMatcher func(ulid.ULID) bool) error {
+	level.Info(logger).Log("msg", "started verifying issue", "with-repair", repair, "issue", FileIntegrityIssueID)
+
+	var broken int
+	err := bkt.Iter(ctx, "", func(name string) error {
+		id, ok := block.IsBlockDir(name)
+		if !ok {
+			return nil
+		}
+
+		if idMatcher != nil && !idMatcher(id) {
+			return nil
+		}
+
+		meta, err := block.DownloadMeta(ctx, logger, bkt, id)
+		if err != nil {
+			return errors.Wrapf(err, "download meta file %s", id)
+		}
+
+		if len(meta.Thanos.Files) == 0 {
+			level.Debug(logger).Log("msg", "no files recorded in meta.json; skipping", "id", id, "issue", FileIntegrityIssueID)
+			return nil
+		}
+
+		for _, f := range meta.Thanos.Files {
+			err := block.VerifyObject(ctx, logger, bkt, id, f)
+			if block.IsIntegrityErr(err) || (err != nil && bkt.IsObjNotFoundErr(errors.Cause(err))) {
+				level.Warn(logger).Log("msg", "detected issue", "id", id, "file", f.RelPath, "err", err, "issue", FileIntegrityIssueID)
+				broken++
+				return nil
+			}
+			if err != nil {
+				return errors.Wrapf(err, "verify block %s", id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "verify iter, issue %s", FileIntegrityIssueID)
+	}
+
+	if broken > 0 && repair {
+		level.Warn(logger).Log("msg", "repair is not implemented for this issue", "issue", FileIntegrityIssueID)
+	}
+
+	level.Info(logger).Log("msg", "verified issue", "with-repair", repair, "issue", FileIntegrityIssueID, "broken_blocks", broken)
+	return nil
+}
@@ -128,7 +128,7 @@ func scraper(i int, config string) cmdScheduleFunc {
 
 func receiver(i int, config string, replicationFactor int, receiveAddresses ...string) cmdScheduleFunc {
 	if len(receiveAddresses) == 0 {
-		receiveAddresses = []string{remoteWriteEndpoint(1)}
+		receiveAddresses = []string{remoteWriteReceiveGRPC(1)}
 	}
 	return func(workDir string) ([]Exec, error) {
 		promDir := fmt.Sprintf("%s/data/remote-write-prom%d", workDir, i)
@@ -167,7 +167,7 @@ func receiver(i int, config string, replicationFactor int, receiveAddresses ...s
 			"--tsdb.path", promDir,
 			"--log.level", "debug",
 			"--receive.replication-factor", strconv.Itoa(replicationFactor),
-			"--receive.local-endpoint", remoteWriteEndpoint(i),
+			"--receive.local-endpoint", remoteWriteReceiveGRPC(i),
 			"--receive.hashrings-file", path.Join(hashringsFileDir, "hashrings.json"),
 			"--receive.hashrings-file-refresh-interval", "5s"))), nil
 	}